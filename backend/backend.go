@@ -0,0 +1,174 @@
+// Package backend is how the UI reads and changes an account's mail,
+// whatever stores it. Each kind of account implements Backend; IMAP
+// accounts are served by the fetcher package, Maildir accounts from disk,
+// JMAP accounts by the jmap package and POP3 accounts from a Maildir of
+// downloaded mail.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+// Backend is an account's mail store. Mailboxes are named as the store
+// names them, with "INBOX" always being the inbox. UIDs identify emails
+// within a mailbox for as long as its UIDVALIDITY stays the same.
+type Backend interface {
+	// Folders lists the account's folders.
+	Folders() ([]fetcher.Folder, error)
+	// FetchPage returns up to limit emails of mailbox older than beforeUID,
+	// or the newest ones if beforeUID is 0. A nonzero uidValidity that no
+	// longer matches the mailbox's fails with fetcher.ErrUIDValidityChanged.
+	FetchPage(mailbox string, limit, beforeUID, uidValidity uint32) (fetcher.Page, error)
+	// FetchBody returns the text of an email and lists its attachments.
+	FetchBody(mailbox string, uid uint32) (string, []fetcher.Attachment, error)
+	// FetchAttachment returns the decoded content of an attachment.
+	FetchAttachment(mailbox string, uid uint32, partID, encoding string) ([]byte, error)
+	// Move moves emails to the dest mailbox.
+	Move(mailbox string, uids []uint32, dest string) error
+	// Delete moves emails to the trash, or deletes them for good if they
+	// are in the trash already.
+	Delete(mailbox string, uids []uint32) error
+	// Restore moves the email with messageID from one mailbox back to
+	// another, undoing a delete or archive.
+	Restore(messageID, from, to string) error
+	// SetFlag adds or removes a flag, such as fetcher.FlagSeen, on emails.
+	SetFlag(mailbox string, uids []uint32, flag string, enable bool) error
+	// Search returns up to limit emails of mailbox matching query, newest
+	// first. A limit of 0 returns all matches.
+	Search(mailbox string, query fetcher.Query, limit int) ([]fetcher.Email, error)
+	// Flagged returns all flagged emails of mailbox, newest first.
+	Flagged(mailbox string) ([]fetcher.Email, error)
+	// SpecialMailbox returns the name of the mailbox with the given role.
+	SpecialMailbox(use fetcher.SpecialUse) string
+	// Close releases what is held open for the account, such as
+	// connections.
+	Close()
+}
+
+// Syncer is implemented by backends that can tell what changed in a
+// mailbox since a previous state, instead of the mailbox being fetched
+// again.
+type Syncer interface {
+	// SyncState returns the current state of mailbox.
+	SyncState(mailbox string) (fetcher.SyncState, error)
+	// Sync returns the changes since state to the emails with the known
+	// UIDs. It fails with fetcher.ErrUIDValidityChanged if the UIDs are no
+	// longer valid.
+	Sync(mailbox string, state fetcher.SyncState, known []uint32) (fetcher.Changes, error)
+}
+
+// Threader is implemented by backends that know which emails belong to the
+// same conversation.
+type Threader interface {
+	// Thread sets the ThreadID of emails of mailbox.
+	Thread(mailbox string, emails []fetcher.Email) error
+	// Conversation returns the other emails of the conversation an email
+	// belongs to, from any mailbox. Bodies of loaded emails are reused
+	// instead of being fetched again.
+	Conversation(email fetcher.Email, loaded fetcher.LoadedBodies) ([]fetcher.Email, error)
+}
+
+// Submitter is implemented by backends that send mail themselves, instead
+// of it being sent over SMTP.
+type Submitter interface {
+	// Submit sends a message to the given addresses and keeps a copy of
+	// it in the Sent mailbox.
+	Submit(raw []byte, to []string) error
+}
+
+// Exporter is implemented by backends that can read whole messages as they
+// were received, e.g. to back them up.
+type Exporter interface {
+	// Messages lists every message of mailbox in UID order, whoever it was
+	// sent to, and returns the mailbox's UIDVALIDITY.
+	Messages(mailbox string) ([]fetcher.MessageInfo, uint32, error)
+	// FetchRaw writes the full message of an email to w.
+	FetchRaw(mailbox string, uid uint32, w io.Writer) error
+}
+
+// HeaderFetcher is implemented by backends that can read the header of a
+// message without the rest of it.
+type HeaderFetcher interface {
+	// FetchHeader writes the header of an email, as it was received, to w.
+	FetchHeader(mailbox string, uid uint32, w io.Writer) error
+}
+
+// Importer is implemented by backends that can store messages from
+// elsewhere.
+type Importer interface {
+	// Append stores a message in mailbox with the given flags and the
+	// date it arrived, which may be zero if unknown.
+	Append(mailbox string, flags []string, date time.Time, raw []byte) error
+}
+
+// AttachmentSaver is implemented by backends that can write an attachment
+// out as it is downloaded, instead of holding all of it in memory.
+type AttachmentSaver interface {
+	// SaveAttachment writes the decoded content of an attachment to w,
+	// calling progress with how many bytes of it, counted as in the
+	// Attachment's Size, have been downloaded. It stops with ctx's error
+	// once ctx is done.
+	SaveAttachment(ctx context.Context, mailbox string, uid uint32, partID, encoding string, w io.Writer, progress func(fetched int64)) error
+}
+
+// Open returns the backend of an account.
+func Open(account *config.Account) (Backend, error) {
+	switch account.GetBackend() {
+	case config.BackendIMAP:
+		return &imapBackend{account: account}, nil
+	case config.BackendMaildir:
+		b, err := newMaildirBackend(account)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case config.BackendJMAP:
+		b, err := newJMAPBackend(account)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case config.BackendPOP3:
+		b, err := newPOP3Backend(account)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q for %s", account.Backend, account.Email)
+	}
+}
+
+// Archive moves emails to the backend's archive mailbox.
+func Archive(b Backend, mailbox string, uids []uint32) error {
+	return b.Move(mailbox, uids, b.SpecialMailbox(fetcher.SpecialArchive))
+}
+
+// SaveAttachment writes the decoded content of an attachment to w, as it
+// is downloaded if the backend is an AttachmentSaver.
+func SaveAttachment(ctx context.Context, b Backend, mailbox string, uid uint32, partID, encoding string, w io.Writer, progress func(fetched int64)) error {
+	if saver, ok := b.(AttachmentSaver); ok {
+		return saver.SaveAttachment(ctx, mailbox, uid, partID, encoding, w, progress)
+	}
+	data, err := b.FetchAttachment(mailbox, uid, partID, encoding)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// CloseAll releases what is held open for all accounts, before exiting.
+func CloseAll() {
+	fetcher.CloseSessions()
+	closeJMAPSessions()
+}
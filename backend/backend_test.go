@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+func TestOpen(t *testing.T) {
+	b, err := Open(&config.Account{Email: "me@example.com", ServiceProvider: "gmail"})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if _, ok := b.(*imapBackend); !ok {
+		t.Errorf("expected accounts to default to IMAP, got %T", b)
+	}
+	// IMAP can sync and thread on the server.
+	if _, ok := b.(Syncer); !ok {
+		t.Error("expected the IMAP backend to be a Syncer")
+	}
+	if _, ok := b.(Threader); !ok {
+		t.Error("expected the IMAP backend to be a Threader")
+	}
+
+	if _, err := Open(&config.Account{Email: "me@example.com", Backend: "carrier-pigeon"}); err == nil {
+		t.Error("expected an unknown backend to fail")
+	}
+}
+
+// moveRecorder is a Backend that records moves.
+type moveRecorder struct {
+	Backend
+	dest string
+	uids []uint32
+}
+
+func (b *moveRecorder) Move(mailbox string, uids []uint32, dest string) error {
+	b.uids, b.dest = uids, dest
+	return nil
+}
+
+func (b *moveRecorder) SpecialMailbox(use fetcher.SpecialUse) string {
+	return map[fetcher.SpecialUse]string{fetcher.SpecialArchive: "Old Mail"}[use]
+}
+
+func TestArchive(t *testing.T) {
+	b := &moveRecorder{}
+	if err := Archive(b, "INBOX", []uint32{4, 2}); err != nil {
+		t.Fatalf("Archive() failed: %v", err)
+	}
+	if b.dest != "Old Mail" || len(b.uids) != 2 {
+		t.Errorf("expected 2 emails moved to the archive, got %v to %q", b.uids, b.dest)
+	}
+}
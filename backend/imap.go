@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+// imapBackend serves an account from its IMAP server, through the sessions
+// of the fetcher package.
+type imapBackend struct {
+	account *config.Account
+}
+
+func (b *imapBackend) Folders() ([]fetcher.Folder, error) {
+	return fetcher.FetchFolders(b.account)
+}
+
+func (b *imapBackend) FetchPage(mailbox string, limit, beforeUID, uidValidity uint32) (fetcher.Page, error) {
+	return fetcher.FetchMailboxPage(b.account, mailbox, limit, beforeUID, uidValidity)
+}
+
+func (b *imapBackend) FetchBody(mailbox string, uid uint32) (string, []fetcher.Attachment, error) {
+	return fetcher.FetchEmailBodyFromMailbox(b.account, mailbox, uid)
+}
+
+func (b *imapBackend) FetchAttachment(mailbox string, uid uint32, partID, encoding string) ([]byte, error) {
+	return fetcher.FetchAttachmentFromMailbox(b.account, mailbox, uid, partID, encoding)
+}
+
+func (b *imapBackend) Move(mailbox string, uids []uint32, dest string) error {
+	return fetcher.MoveEmails(b.account, mailbox, uids, dest)
+}
+
+func (b *imapBackend) Delete(mailbox string, uids []uint32) error {
+	return fetcher.DeleteEmailsFromMailbox(b.account, mailbox, uids)
+}
+
+func (b *imapBackend) Restore(messageID, from, to string) error {
+	return fetcher.RestoreEmail(b.account, messageID, from, to)
+}
+
+func (b *imapBackend) SetFlag(mailbox string, uids []uint32, flag string, enable bool) error {
+	return fetcher.SetFlagInMailbox(b.account, mailbox, uids, flag, enable)
+}
+
+func (b *imapBackend) Search(mailbox string, query fetcher.Query, limit int) ([]fetcher.Email, error) {
+	return fetcher.SearchMailboxEmails(b.account, mailbox, query.Criteria(), limit)
+}
+
+func (b *imapBackend) Flagged(mailbox string) ([]fetcher.Email, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.FlaggedFlag}
+	return fetcher.SearchMailboxEmails(b.account, mailbox, criteria, 0)
+}
+
+func (b *imapBackend) SpecialMailbox(use fetcher.SpecialUse) string {
+	return fetcher.SpecialMailbox(b.account, use)
+}
+
+func (b *imapBackend) Close() {
+	fetcher.CloseSession(b.account.ID)
+}
+
+func (b *imapBackend) SyncState(mailbox string) (fetcher.SyncState, error) {
+	return fetcher.FetchSyncState(b.account, mailbox)
+}
+
+func (b *imapBackend) Sync(mailbox string, state fetcher.SyncState, known []uint32) (fetcher.Changes, error) {
+	return fetcher.SyncMailbox(b.account, mailbox, state, known)
+}
+
+func (b *imapBackend) Thread(mailbox string, emails []fetcher.Email) error {
+	return fetcher.ThreadEmails(b.account, mailbox, emails)
+}
+
+func (b *imapBackend) Conversation(email fetcher.Email, loaded fetcher.LoadedBodies) ([]fetcher.Email, error) {
+	return fetcher.FetchConversation(b.account, email, loaded)
+}
+
+func (b *imapBackend) SaveAttachment(ctx context.Context, mailbox string, uid uint32, partID, encoding string, w io.Writer, progress func(fetched int64)) error {
+	return fetcher.SaveAttachmentFromMailbox(ctx, b.account, mailbox, uid, partID, encoding, w, progress)
+}
+
+func (b *imapBackend) Messages(mailbox string) ([]fetcher.MessageInfo, uint32, error) {
+	return fetcher.ListMessages(b.account, mailbox)
+}
+
+func (b *imapBackend) FetchRaw(mailbox string, uid uint32, w io.Writer) error {
+	return fetcher.FetchRawMessage(b.account, mailbox, uid, w)
+}
+
+func (b *imapBackend) FetchHeader(mailbox string, uid uint32, w io.Writer) error {
+	return fetcher.FetchRawHeader(b.account, mailbox, uid, w)
+}
+
+func (b *imapBackend) Append(mailbox string, flags []string, date time.Time, raw []byte) error {
+	return fetcher.AppendMessage(b.account, mailbox, flags, date, raw)
+}
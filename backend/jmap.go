@@ -0,0 +1,881 @@
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/jmap"
+	"github.com/floatpane/matcha/oauth"
+)
+
+// jmapBackend serves an account from a JMAP server. Mailboxes are named by
+// their path, with "/" between a mailbox and its children.
+//
+// JMAP emails have string IDs rather than UIDs, so they are given UIDs the
+// first time they are seen: counting up from the middle of the UID range
+// for newer emails and down for older ones, so that UIDs follow arrival
+// order like IMAP's. The UIDs are kept in matcha's data directory.
+type jmapBackend struct {
+	account *config.Account
+}
+
+// jmapUIDs is the UIDs given to an account's emails.
+type jmapUIDs struct {
+	UIDValidity uint32            `json:"uid_validity"`
+	High        uint32            `json:"high"` // The next UID for a newer email
+	Low         uint32            `json:"low"`  // The UID last given to an older email
+	IDs         map[string]uint32 `json:"ids"`  // By email ID
+
+	emails map[uint32]string // Email IDs by UID
+}
+
+// jmapFirstUID is where UIDs start, leaving room both ways.
+const jmapFirstUID = 1 << 31
+
+// jmapSession is an account's client and its mailboxes as last listed.
+type jmapSession struct {
+	client    *jmap.Client
+	mailboxes []jmap.Mailbox
+}
+
+// jmapAccounts holds the sessions and UIDs of JMAP accounts, made when first
+// needed.
+var jmapAccounts = struct {
+	sync.Mutex
+	sessions map[string]*jmapSession
+	uids     map[string]*jmapUIDs
+}{
+	sessions: make(map[string]*jmapSession),
+	uids:     make(map[string]*jmapUIDs),
+}
+
+// jmapListProperties are the properties of emails shown in a list.
+var jmapListProperties = []string{"id", "threadId", "mailboxIds", "keywords", "receivedAt", "headers", "preview"}
+
+// jmapRoles maps the roles of mailboxes to the special-use attributes of
+// folders.
+var jmapRoles = map[string]string{
+	"sent":    imap.SentAttr,
+	"archive": imap.ArchiveAttr,
+	"trash":   imap.TrashAttr,
+	"drafts":  imap.DraftsAttr,
+	"junk":    imap.JunkAttr,
+	"all":     imap.AllAttr,
+}
+
+// jmapKeywords maps the keywords of emails to IMAP flags.
+var jmapKeywords = map[string]string{
+	jmap.KeywordSeen:      imap.SeenFlag,
+	jmap.KeywordFlagged:   imap.FlaggedFlag,
+	jmap.KeywordAnswered:  imap.AnsweredFlag,
+	jmap.KeywordDraft:     imap.DraftFlag,
+	jmap.KeywordForwarded: "$Forwarded",
+}
+
+func newJMAPBackend(account *config.Account) (*jmapBackend, error) {
+	if account.JMAPURL == "" {
+		return nil, fmt.Errorf("no jmap_url set for %s", account.Email)
+	}
+	return &jmapBackend{account: account}, nil
+}
+
+// session returns the account's session, discovering it the first time.
+func (b *jmapBackend) session() (*jmapSession, error) {
+	jmapAccounts.Lock()
+	defer jmapAccounts.Unlock()
+	if s, ok := jmapAccounts.sessions[b.account.ID]; ok {
+		return s, nil
+	}
+
+	u, err := url.Parse(b.account.JMAPURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if b.account.CAFile != "" || len(b.account.CertFingerprints) > 0 {
+		var tlsConfig *tls.Config
+		tlsConfig, err = b.account.TLSConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	httpClient := &http.Client{Transport: transport, Timeout: time.Minute}
+
+	auth := jmap.BasicAuth(b.account.Email, b.account.Password)
+	switch {
+	case b.account.UsesOAuth2():
+		auth = jmap.BearerAuth(func() (string, error) { return oauth.AccessToken(b.account) })
+	case b.account.AuthMethod == config.AuthToken:
+		token := b.account.Password
+		auth = jmap.BearerAuth(func() (string, error) { return token, nil })
+	}
+	c, err := jmap.Dial(httpClient, b.account.JMAPURL, auth)
+	if err != nil {
+		return nil, config.ExplainTLSError(host, err)
+	}
+	s := &jmapSession{client: c}
+	jmapAccounts.sessions[b.account.ID] = s
+	return s, nil
+}
+
+func (b *jmapBackend) client() (*jmap.Client, error) {
+	s, err := b.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.client, nil
+}
+
+// mailboxes returns the account's mailboxes, listing them again if fresh
+// is set or they haven't been listed yet.
+func (b *jmapBackend) mailboxes(fresh bool) ([]jmap.Mailbox, error) {
+	s, err := b.session()
+	if err != nil {
+		return nil, err
+	}
+	jmapAccounts.Lock()
+	mailboxes := s.mailboxes
+	jmapAccounts.Unlock()
+	if mailboxes != nil && !fresh {
+		return mailboxes, nil
+	}
+
+	mailboxes, err = s.client.Mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	jmapAccounts.Lock()
+	s.mailboxes = mailboxes
+	jmapAccounts.Unlock()
+	return mailboxes, nil
+}
+
+// mailboxNames returns the names of mailboxes by ID.
+func mailboxNames(mailboxes []jmap.Mailbox) map[string]string {
+	byID := make(map[string]jmap.Mailbox, len(mailboxes))
+	for _, mb := range mailboxes {
+		byID[mb.ID] = mb
+	}
+	names := make(map[string]string, len(mailboxes))
+	for _, mb := range mailboxes {
+		if mb.Role == "inbox" {
+			names[mb.ID] = "INBOX"
+			continue
+		}
+		name := mb.Name
+		for parent, depth := byID[mb.ParentID], 0; parent.ID != "" && depth < len(mailboxes); parent, depth = byID[parent.ParentID], depth+1 {
+			name = parent.Name + "/" + name
+		}
+		names[mb.ID] = name
+	}
+	return names
+}
+
+// mailboxID returns the ID of the mailbox with the given name.
+func (b *jmapBackend) mailboxID(name string) (string, error) {
+	for _, fresh := range []bool{false, true} {
+		mailboxes, err := b.mailboxes(fresh)
+		if err != nil {
+			return "", err
+		}
+		for id, n := range mailboxNames(mailboxes) {
+			if n == name || (name == "INBOX" && strings.EqualFold(n, name)) {
+				return id, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no mailbox %q", name)
+}
+
+func (b *jmapBackend) Folders() ([]fetcher.Folder, error) {
+	mailboxes, err := b.mailboxes(true)
+	if err != nil {
+		return nil, err
+	}
+	names := mailboxNames(mailboxes)
+	folders := make([]fetcher.Folder, 0, len(mailboxes))
+	for _, mb := range mailboxes {
+		f := fetcher.Folder{Name: names[mb.ID], Delimiter: "/", Messages: mb.TotalEmails, Unseen: mb.UnreadEmails}
+		if attr, ok := jmapRoles[mb.Role]; ok {
+			f.Attributes = []string{attr}
+		}
+		folders = append(folders, f)
+	}
+	fetcher.SortFolders(folders)
+	return folders, nil
+}
+
+// uids returns the account's UIDs, reading them from disk the first time.
+// jmapAccounts must be locked.
+func (b *jmapBackend) uids() (*jmapUIDs, error) {
+	if u, ok := jmapAccounts.uids[b.account.ID]; ok {
+		return u, nil
+	}
+	path, err := b.uidsFile()
+	if err != nil {
+		return nil, err
+	}
+	u := &jmapUIDs{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, u); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if u.IDs == nil {
+		u.UIDValidity = uint32(time.Now().Unix())
+		u.High, u.Low = jmapFirstUID, jmapFirstUID
+		u.IDs = make(map[string]uint32)
+	}
+	u.emails = make(map[uint32]string, len(u.IDs))
+	for id, uid := range u.IDs {
+		u.emails[uid] = id
+	}
+	jmapAccounts.uids[b.account.ID] = u
+	return u, nil
+}
+
+// uidsFile returns where the account's UIDs are kept.
+func (b *jmapBackend) uidsFile() (string, error) {
+	dir, err := config.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "jmap", b.account.ID+".json"), nil
+}
+
+// assignUIDs returns the UIDs of emails listed newest first, giving UIDs to
+// those without one. Older ones are those of a page older than any seen.
+func (b *jmapBackend) assignUIDs(ids []string, older bool) ([]uint32, uint32, error) {
+	jmapAccounts.Lock()
+	defer jmapAccounts.Unlock()
+	u, err := b.uids()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	changed := false
+	give := func(id string) {
+		if _, ok := u.IDs[id]; ok {
+			return
+		}
+		var uid uint32
+		if older {
+			u.Low--
+			uid = u.Low
+		} else {
+			uid = u.High
+			u.High++
+		}
+		u.IDs[id] = uid
+		u.emails[uid] = id
+		changed = true
+	}
+	if older {
+		for _, id := range ids {
+			give(id)
+		}
+	} else {
+		for i := len(ids) - 1; i >= 0; i-- {
+			give(ids[i])
+		}
+	}
+
+	if changed {
+		path, err := b.uidsFile()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, 0, err
+		}
+		data, err := json.Marshal(u)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	uids := make([]uint32, len(ids))
+	for i, id := range ids {
+		uids[i] = u.IDs[id]
+	}
+	return uids, u.UIDValidity, nil
+}
+
+// emailIDs returns the IDs of the emails with the given UIDs.
+func (b *jmapBackend) emailIDs(uids []uint32) ([]string, error) {
+	jmapAccounts.Lock()
+	defer jmapAccounts.Unlock()
+	u, err := b.uids()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		id, ok := u.emails[uid]
+		if !ok {
+			return nil, fmt.Errorf("no email with UID %d", uid)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// emails converts emails listed newest first to the client's, in the same
+// order.
+func (b *jmapBackend) emails(mailbox string, list []jmap.Email, older bool) ([]fetcher.Email, error) {
+	ids := make([]string, len(list))
+	for i, e := range list {
+		ids[i] = e.ID
+	}
+	uids, uidValidity, err := b.assignUIDs(ids, older)
+	if err != nil {
+		return nil, err
+	}
+
+	local := make([]fetcher.LocalMessage, len(list))
+	for i, e := range list {
+		var header textproto.Header
+		for _, h := range e.Headers {
+			// Values are as they appear in the message, folded.
+			value := strings.NewReplacer("\r\n", "", "\n", "").Replace(h.Value)
+			header.Add(h.Name, strings.TrimSpace(value))
+		}
+		var flags []string
+		for keyword, set := range e.Keywords {
+			if !set {
+				continue
+			}
+			if flag, ok := jmapKeywords[keyword]; ok {
+				flags = append(flags, flag)
+			} else {
+				flags = append(flags, keyword)
+			}
+		}
+		local[i] = fetcher.LocalMessage{UID: uids[i], Flags: flags, Header: header, Preview: e.Preview}
+	}
+	sent := mailbox == b.SpecialMailbox(fetcher.SpecialSent)
+	return fetcher.LocalEmails(b.account, mailbox, sent, uidValidity, local), nil
+}
+
+// newestFirst sorts emails by when they arrived, newest first.
+var newestFirst = []jmap.Comparator{{Property: "receivedAt", IsAscending: false}}
+
+func (b *jmapBackend) FetchPage(mailbox string, limit, beforeUID, uidValidity uint32) (fetcher.Page, error) {
+	c, err := b.client()
+	if err != nil {
+		return fetcher.Page{}, err
+	}
+	mailboxID, err := b.mailboxID(mailbox)
+	if err != nil {
+		return fetcher.Page{}, err
+	}
+
+	q := jmap.Query{Filter: map[string]interface{}{"inMailbox": mailboxID}, Sort: newestFirst, Limit: int(limit)}
+	if beforeUID != 0 {
+		ids, err := b.emailIDs([]uint32{beforeUID})
+		if err != nil {
+			return fetcher.Page{}, err
+		}
+		q.Anchor, q.AnchorOffset = ids[0], 1
+	}
+	list, err := c.QueryEmails(q, jmapListProperties)
+	if err != nil {
+		return fetcher.Page{}, err
+	}
+	emails, err := b.emails(mailbox, list, beforeUID != 0)
+	if err != nil {
+		return fetcher.Page{}, err
+	}
+
+	page := fetcher.Page{Emails: emails}
+	jmapAccounts.Lock()
+	u, err := b.uids()
+	if err == nil {
+		page.UIDValidity = u.UIDValidity
+		// A short page is the last one.
+		if len(list) > 0 && len(list) == int(limit) {
+			page.OldestUID = u.IDs[list[len(list)-1].ID]
+		}
+	}
+	jmapAccounts.Unlock()
+	if err != nil {
+		return fetcher.Page{}, err
+	}
+	if uidValidity != 0 && page.UIDValidity != uidValidity {
+		return fetcher.Page{}, fetcher.ErrUIDValidityChanged
+	}
+	return page, nil
+}
+
+func (b *jmapBackend) FetchBody(mailbox string, uid uint32) (string, []fetcher.Attachment, error) {
+	c, err := b.client()
+	if err != nil {
+		return "", nil, err
+	}
+	ids, err := b.emailIDs([]uint32{uid})
+	if err != nil {
+		return "", nil, err
+	}
+	list, err := c.GetEmails(ids, []string{"id", "textBody", "htmlBody", "attachments", "bodyValues"}, true)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(list) == 0 {
+		return "", nil, fmt.Errorf("no email with UID %d", uid)
+	}
+	e := list[0]
+
+	// Prefer HTML, like for IMAP accounts.
+	parts := e.TextBody
+	for _, p := range e.HTMLBody {
+		if p.Type == "text/html" {
+			parts = e.HTMLBody
+			break
+		}
+	}
+	var body strings.Builder
+	for _, p := range parts {
+		if v, ok := e.BodyValues[p.PartID]; ok {
+			body.WriteString(v.Value)
+		}
+	}
+
+	var attachments []fetcher.Attachment
+	for _, p := range e.Attachments {
+		att := fetcher.Attachment{
+			Filename:  p.Name,
+			PartID:    p.BlobID,
+			MIMEType:  strings.ToLower(p.Type),
+			ContentID: strings.Trim(p.CID, "<>"),
+			Inline:    p.Disposition == "inline" || p.CID != "",
+		}
+		if att.Inline && strings.HasPrefix(att.MIMEType, "image/") {
+			if att.Filename == "" {
+				att.Filename = "inline"
+			}
+			if data, err := c.Download(p.BlobID, att.Filename, p.Type); err == nil {
+				att.Data = data
+			}
+		}
+		attachments = append(attachments, att)
+	}
+	return body.String(), attachments, nil
+}
+
+// FetchAttachment downloads an attachment, whose part ID is its blob ID.
+// Blobs are decoded already.
+func (b *jmapBackend) FetchAttachment(mailbox string, uid uint32, partID, encoding string) ([]byte, error) {
+	c, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return c.Download(partID, "attachment", "")
+}
+
+// update applies the same patch to the emails with the given UIDs.
+func (b *jmapBackend) update(uids []uint32, patch map[string]interface{}) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	ids, err := b.emailIDs(uids)
+	if err != nil {
+		return err
+	}
+	patches := make(map[string]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		patches[id] = patch
+	}
+	return c.UpdateEmails(patches)
+}
+
+func (b *jmapBackend) Move(mailbox string, uids []uint32, dest string) error {
+	if dest == mailbox {
+		return nil
+	}
+	from, err := b.mailboxID(mailbox)
+	if err != nil {
+		return err
+	}
+	to, err := b.mailboxID(dest)
+	if err != nil {
+		return err
+	}
+	return b.update(uids, map[string]interface{}{"mailboxIds/" + from: nil, "mailboxIds/" + to: true})
+}
+
+func (b *jmapBackend) Delete(mailbox string, uids []uint32) error {
+	trash := b.SpecialMailbox(fetcher.SpecialTrash)
+	if mailbox != trash {
+		return b.Move(mailbox, uids, trash)
+	}
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	ids, err := b.emailIDs(uids)
+	if err != nil {
+		return err
+	}
+	return c.DestroyEmails(ids)
+}
+
+func (b *jmapBackend) Restore(messageID, from, to string) error {
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	fromID, err := b.mailboxID(from)
+	if err != nil {
+		return err
+	}
+	filter := map[string]interface{}{"inMailbox": fromID, "header": []string{"Message-ID", messageID}}
+	list, err := c.QueryEmails(jmap.Query{Filter: filter, Sort: newestFirst, Limit: 1}, jmapListProperties)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("%s not found in %s", messageID, from)
+	}
+	uids, _, err := b.assignUIDs([]string{list[0].ID}, false)
+	if err != nil {
+		return err
+	}
+	return b.Move(from, uids, to)
+}
+
+func (b *jmapBackend) SetFlag(mailbox string, uids []uint32, flag string, enable bool) error {
+	keyword := strings.ToLower(flag)
+	for k, f := range jmapKeywords {
+		if strings.EqualFold(f, flag) {
+			keyword = k
+		}
+	}
+	if strings.HasPrefix(keyword, "\\") {
+		return fmt.Errorf("the %s flag has no JMAP keyword", flag)
+	}
+	var value interface{}
+	if enable {
+		value = true
+	}
+	return b.update(uids, map[string]interface{}{"keywords/" + keyword: value})
+}
+
+// jmapFilter converts a query on a mailbox to an Email/query filter.
+func jmapFilter(mailboxID string, q fetcher.Query) map[string]interface{} {
+	conditions := []interface{}{map[string]interface{}{"inMailbox": mailboxID}}
+	add := func(key string, value interface{}) {
+		conditions = append(conditions, map[string]interface{}{key: value})
+	}
+	for key, values := range map[string][]string{"from": q.From, "to": q.To, "subject": q.Subject, "body": q.Body, "text": q.Text} {
+		for _, v := range values {
+			add(key, v)
+		}
+	}
+	if !q.Since.IsZero() {
+		add("after", q.Since.UTC().Format(time.RFC3339))
+	}
+	if !q.Before.IsZero() {
+		add("before", q.Before.UTC().Format(time.RFC3339))
+	}
+	if q.HasAttachment {
+		add("hasAttachment", true)
+	}
+	if q.Unread {
+		add("notKeyword", jmap.KeywordSeen)
+	}
+	return map[string]interface{}{"operator": "AND", "conditions": conditions}
+}
+
+func (b *jmapBackend) Search(mailbox string, query fetcher.Query, limit int) ([]fetcher.Email, error) {
+	return b.search(mailbox, func(mailboxID string) interface{} { return jmapFilter(mailboxID, query) }, limit)
+}
+
+func (b *jmapBackend) Flagged(mailbox string) ([]fetcher.Email, error) {
+	return b.search(mailbox, func(mailboxID string) interface{} {
+		return map[string]interface{}{"inMailbox": mailboxID, "hasKeyword": jmap.KeywordFlagged}
+	}, 0)
+}
+
+// search returns up to limit emails of mailbox matching the Email/query
+// filter made for the mailbox's ID, newest first.
+func (b *jmapBackend) search(mailbox string, filter func(mailboxID string) interface{}, limit int) ([]fetcher.Email, error) {
+	c, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	mailboxID, err := b.mailboxID(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.QueryEmails(jmap.Query{Filter: filter(mailboxID), Sort: newestFirst, Limit: limit}, jmapListProperties)
+	if err != nil {
+		return nil, err
+	}
+	return b.emails(mailbox, list, false)
+}
+
+func (b *jmapBackend) SpecialMailbox(use fetcher.SpecialUse) string {
+	mailboxes, _ := b.mailboxes(false)
+	names := mailboxNames(mailboxes)
+	folders := make([]fetcher.Folder, 0, len(mailboxes))
+	for _, mb := range mailboxes {
+		f := fetcher.Folder{Name: names[mb.ID], Delimiter: "/"}
+		if attr, ok := jmapRoles[mb.Role]; ok {
+			f.Attributes = []string{attr}
+		}
+		folders = append(folders, f)
+	}
+	return fetcher.SpecialFolder(b.account, use, folders)
+}
+
+// Close forgets the account's session, which holds no connection.
+func (b *jmapBackend) Close() {
+	jmapAccounts.Lock()
+	delete(jmapAccounts.sessions, b.account.ID)
+	jmapAccounts.Unlock()
+}
+
+// Thread leaves the emails to be threaded locally.
+func (b *jmapBackend) Thread(mailbox string, emails []fetcher.Email) error {
+	return nil
+}
+
+// Conversation returns the emails of the email's JMAP thread.
+func (b *jmapBackend) Conversation(email fetcher.Email, loaded fetcher.LoadedBodies) ([]fetcher.Email, error) {
+	c, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := b.emailIDs([]uint32{email.UID})
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.GetEmails(ids, []string{"id", "threadId"}, false)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	threads, err := c.Threads([]string{list[0].ThreadID})
+	if err != nil || len(threads) == 0 {
+		return nil, err
+	}
+	if len(threads[0].EmailIDs) == 1 {
+		return []fetcher.Email{email}, nil
+	}
+	members, err := c.GetEmails(threads[0].EmailIDs, jmapListProperties, false)
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxes, err := b.mailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+	names := mailboxNames(mailboxes)
+	loaded = loaded.With(email)
+	var conversation []fetcher.Email
+	for _, member := range members {
+		// An email can be in several mailboxes; the inbox is preferred.
+		var mailbox string
+		for id := range member.MailboxIDs {
+			if mailbox == "" || names[id] == "INBOX" {
+				mailbox = names[id]
+			}
+		}
+		emails, err := b.emails(mailbox, []jmap.Email{member}, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, found := range emails {
+			if !loaded.Fill(&found) {
+				found.Body, found.Attachments, err = b.FetchBody(mailbox, found.UID)
+				if err != nil {
+					return nil, err
+				}
+			}
+			conversation = append(conversation, found)
+		}
+	}
+
+	sort.SliceStable(conversation, func(i, j int) bool { return conversation[i].Date.Before(conversation[j].Date) })
+	return conversation, nil
+}
+
+// Submit sends a message with EmailSubmission. It is stored in the Sent
+// mailbox as a draft until the server has sent it.
+func (b *jmapBackend) Submit(raw []byte, to []string) error {
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	mailboxes, err := b.mailboxes(false)
+	if err != nil {
+		return err
+	}
+	var mailboxID string
+	for _, role := range []string{"sent", "drafts"} {
+		for _, mb := range mailboxes {
+			if mb.Role == role && mailboxID == "" {
+				mailboxID = mb.ID
+			}
+		}
+	}
+	if mailboxID == "" {
+		return fmt.Errorf("no Sent or Drafts mailbox to keep the sent email in")
+	}
+
+	identities, err := c.Identities()
+	if err != nil {
+		return err
+	}
+	var identity *jmap.Identity
+	for i := range identities {
+		if identity == nil || strings.EqualFold(identities[i].Email, b.account.Email) {
+			identity = &identities[i]
+		}
+	}
+	if identity == nil {
+		return fmt.Errorf("no JMAP identity to send from")
+	}
+
+	blobID, err := c.Upload(raw, "message/rfc822")
+	if err != nil {
+		return err
+	}
+	emailID, err := c.ImportEmail(blobID, map[string]bool{mailboxID: true}, map[string]bool{jmap.KeywordSeen: true, jmap.KeywordDraft: true})
+	if err != nil {
+		return err
+	}
+	envelope := &jmap.Envelope{MailFrom: jmap.Address{Email: identity.Email}}
+	for _, addr := range to {
+		envelope.RcptTo = append(envelope.RcptTo, jmap.Address{Email: addr})
+	}
+	return c.Submit(identity.ID, emailID, envelope, map[string]interface{}{"keywords/" + jmap.KeywordDraft: nil})
+}
+
+// Messages lists the emails of a mailbox, dated when they arrived.
+func (b *jmapBackend) Messages(mailbox string) ([]fetcher.MessageInfo, uint32, error) {
+	c, err := b.client()
+	if err != nil {
+		return nil, 0, err
+	}
+	mailboxID, err := b.mailboxID(mailbox)
+	if err != nil {
+		return nil, 0, err
+	}
+	q := jmap.Query{Filter: map[string]interface{}{"inMailbox": mailboxID}, Sort: newestFirst}
+	ids, err := c.QueryAllEmailIDs(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := c.GetEmails(ids, []string{"id", "keywords", "receivedAt"}, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	uids, uidValidity, err := b.assignUIDs(ids, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	uidOf := make(map[string]uint32, len(ids))
+	for i, id := range ids {
+		uidOf[id] = uids[i]
+	}
+
+	infos := make([]fetcher.MessageInfo, 0, len(list))
+	for _, e := range list {
+		info := fetcher.MessageInfo{UID: uidOf[e.ID], Date: e.ReceivedAt}
+		for keyword, set := range e.Keywords {
+			if flag, ok := jmapKeywords[keyword]; ok && set {
+				info.Flags = append(info.Flags, flag)
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].UID < infos[j].UID })
+	return infos, uidValidity, nil
+}
+
+// FetchRaw downloads the blob of an email's message.
+func (b *jmapBackend) FetchRaw(mailbox string, uid uint32, w io.Writer) error {
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	ids, err := b.emailIDs([]uint32{uid})
+	if err != nil {
+		return err
+	}
+	list, err := c.GetEmails(ids, []string{"id", "blobId"}, false)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("no email with UID %d", uid)
+	}
+	data, err := c.Download(list[0].BlobID, "message.eml", "message/rfc822")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// FetchHeader writes the header fields of an email, as they were received,
+// to w.
+func (b *jmapBackend) FetchHeader(mailbox string, uid uint32, w io.Writer) error {
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	ids, err := b.emailIDs([]uint32{uid})
+	if err != nil {
+		return err
+	}
+	list, err := c.GetEmails(ids, []string{"id", "headers"}, false)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("no email with UID %d", uid)
+	}
+	for _, h := range list[0].Headers {
+		// Values are raw, with the space after the colon.
+		if _, err := fmt.Fprintf(w, "%s:%s\r\n", h.Name, h.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeJMAPSessions forgets the sessions of all accounts.
+func closeJMAPSessions() {
+	jmapAccounts.Lock()
+	jmapAccounts.sessions = make(map[string]*jmapSession)
+	jmapAccounts.Unlock()
+}
@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/jmap"
+	"github.com/floatpane/matcha/jmap/jmaptest"
+)
+
+// newTestJMAP starts a JMAP server with an inbox holding a read and an
+// unread email, and Sent, Archive and Trash mailboxes.
+func newTestJMAP(t *testing.T) (*jmaptest.Server, *jmapBackend) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	jmapAccounts.uids = make(map[string]*jmapUIDs)
+	s := jmaptest.NewServer("me@example.com", "secret")
+	t.Cleanup(s.Close)
+	inbox := s.AddMailbox("Inbox", "inbox", "")
+	s.AddMailbox("Sent", "sent", "")
+	s.AddMailbox("Archive", "archive", "")
+	s.AddMailbox("Trash", "trash", "")
+	s.AddEmail(inbox, []byte(plainMessage), time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), jmap.KeywordSeen)
+	s.AddEmail(inbox, []byte(attachmentMessage), time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+
+	account := &config.Account{ID: "jmap", Email: "me@example.com", Password: "secret", Backend: config.BackendJMAP, JMAPURL: s.URL}
+	b, err := Open(account)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	t.Cleanup(b.Close)
+	return s, b.(*jmapBackend)
+}
+
+func TestJMAPFetch(t *testing.T) {
+	_, b := newTestJMAP(t)
+	folders, err := b.Folders()
+	if err != nil {
+		t.Fatalf("Folders() failed: %v", err)
+	}
+	if folders[0].Name != "INBOX" || folders[0].Messages != 2 || folders[0].Unseen != 1 {
+		t.Errorf("expected the inbox first with 1 of 2 emails unread, got %+v", folders[0])
+	}
+	if got := b.SpecialMailbox(fetcher.SpecialTrash); got != "Trash" {
+		t.Errorf("expected the mailbox with the trash role, got %q", got)
+	}
+
+	page, err := b.FetchPage("INBOX", 1, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(page.Emails) != 1 || page.Emails[0].Subject != "Report" || !page.Emails[0].IsUnread() {
+		t.Fatalf("expected the newest, unread email, got %+v", page.Emails)
+	}
+	report := page.Emails[0]
+
+	// UIDs are kept for the next run.
+	jmapAccounts.uids = make(map[string]*jmapUIDs)
+	older, err := b.FetchPage("INBOX", 1, page.OldestUID, page.UIDValidity)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(older.Emails) != 1 || older.Emails[0].Subject != "Lunch" || older.Emails[0].UID >= report.UID {
+		t.Fatalf("expected the older email with a lower UID, got %+v", older.Emails)
+	}
+
+	body, attachments, err := b.FetchBody("INBOX", report.UID)
+	if err != nil {
+		t.Fatalf("FetchBody() failed: %v", err)
+	}
+	if !strings.Contains(body, "See attached.") || len(attachments) != 1 || attachments[0].Filename != "report.csv" {
+		t.Fatalf("unexpected body %q and attachments %+v", body, attachments)
+	}
+	data, err := b.FetchAttachment("INBOX", report.UID, attachments[0].PartID, attachments[0].Encoding)
+	if err != nil {
+		t.Fatalf("FetchAttachment() failed: %v", err)
+	}
+	if string(data) != "a,b\n1,2\n" {
+		t.Errorf("expected the decoded attachment, got %q", data)
+	}
+
+	found, err := b.Search("INBOX", fetcher.Query{From: []string{"alice"}}, 0)
+	if err != nil {
+		t.Fatalf("Search() failed: %v", err)
+	}
+	if len(found) != 1 || found[0].UID != older.Emails[0].UID {
+		t.Errorf("expected the email from alice, got %+v", found)
+	}
+
+	if err := b.SetFlag("INBOX", []uint32{found[0].UID}, fetcher.FlagFlagged, true); err != nil {
+		t.Fatalf("SetFlag() failed: %v", err)
+	}
+	flagged, err := b.Flagged("INBOX")
+	if err != nil {
+		t.Fatalf("Flagged() failed: %v", err)
+	}
+	if len(flagged) != 1 || flagged[0].UID != found[0].UID {
+		t.Errorf("expected only the flagged email, got %+v", flagged)
+	}
+}
+
+func TestJMAPChanges(t *testing.T) {
+	s, b := newTestJMAP(t)
+	page, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	report, lunch := page.Emails[0], page.Emails[1]
+
+	if err := b.SetFlag("INBOX", []uint32{report.UID}, fetcher.FlagSeen, true); err != nil {
+		t.Fatalf("SetFlag() failed: %v", err)
+	}
+	if err := Archive(b, "INBOX", []uint32{lunch.UID}); err != nil {
+		t.Fatalf("Archive() failed: %v", err)
+	}
+	archive, err := b.FetchPage("Archive", 10, 0, 0)
+	if err != nil || len(archive.Emails) != 1 || archive.Emails[0].UID != lunch.UID {
+		t.Fatalf("expected the email to keep its UID in the archive, got %+v, %v", archive.Emails, err)
+	}
+
+	if err := b.Restore("<lunch@example.com>", "Archive", "INBOX"); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	if err := b.Delete("INBOX", []uint32{report.UID}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if err := b.Delete("Trash", []uint32{report.UID}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	inbox, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(inbox.Emails) != 1 || inbox.Emails[0].Subject != "Lunch" {
+		t.Errorf("expected only the restored email in the inbox, got %+v", inbox.Emails)
+	}
+	ids, _ := b.emailIDs([]uint32{report.UID})
+	if _, ok := s.Email(ids[0]); ok {
+		t.Error("expected the email deleted from the trash to be destroyed")
+	}
+}
+
+func TestJMAPMessagesPages(t *testing.T) {
+	s, b := newTestJMAP(t)
+	// Set before the session is discovered, on first use.
+	s.MaxQueryResults = 1
+	s.MaxObjectsInGet = 1
+
+	infos, _, err := b.Messages("INBOX")
+	if err != nil {
+		t.Fatalf("Messages() failed: %v", err)
+	}
+	if len(infos) != 2 || infos[0].UID == infos[1].UID || !infos[0].Date.Before(infos[1].Date) {
+		t.Fatalf("expected both emails, oldest first, got %+v", infos)
+	}
+	if len(infos[0].Flags) != 1 || infos[0].Flags[0] != "\\Seen" {
+		t.Errorf("expected the oldest email to be read, got %v", infos[0].Flags)
+	}
+
+	var header strings.Builder
+	if err := b.FetchHeader("INBOX", infos[0].UID, &header); err != nil {
+		t.Fatalf("FetchHeader() failed: %v", err)
+	}
+	if !strings.Contains(header.String(), "Subject: Lunch\r\n") || strings.Contains(header.String(), "Noon") {
+		t.Errorf("expected only the header of the email, got %q", header.String())
+	}
+}
+
+func TestJMAPSubmit(t *testing.T) {
+	s, b := newTestJMAP(t)
+	raw := "From: me@example.com\r\nTo: bob@example.com\r\nSubject: Hi\r\n\r\nHello\r\n"
+	if err := b.Submit([]byte(raw), []string{"bob@example.com"}); err != nil {
+		t.Fatalf("Submit() failed: %v", err)
+	}
+	subs := s.Submissions()
+	if len(subs) != 1 || subs[0].Envelope.RcptTo[0].Email != "bob@example.com" {
+		t.Fatalf("expected the email to be submitted to bob, got %+v", subs)
+	}
+
+	sent, err := b.FetchPage("Sent", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(sent.Emails) != 1 || sent.Emails[0].Subject != "Hi" {
+		t.Fatalf("expected the sent email in Sent, got %+v", sent.Emails)
+	}
+	for _, flag := range sent.Emails[0].Flags {
+		if flag == "\\Draft" {
+			t.Error("expected the sent email to no longer be a draft")
+		}
+	}
+}
@@ -0,0 +1,705 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+// maildirInfo separates a Maildir file's unique name from its flags.
+const maildirInfo = ":2,"
+
+// maildirFlags maps the flag letters of Maildir file names to IMAP flags.
+var maildirFlags = map[byte]string{
+	'D': imap.DraftFlag,
+	'F': imap.FlaggedFlag,
+	'P': "$Forwarded", // Passed
+	'R': imap.AnsweredFlag,
+	'S': imap.SeenFlag,
+	'T': imap.DeletedFlag,
+}
+
+// maildirBackend serves an account from a Maildir++ tree: the inbox is the
+// root, and other folders are its subdirectories named with a leading dot,
+// such as ".Sent" or ".Lists.go" for the folder "go" in "Lists".
+//
+// Maildir messages have no UIDs, so they are given some the first time
+// they are seen, and the UIDs are kept in matcha's data directory.
+type maildirBackend struct {
+	account *config.Account
+	root    string
+}
+
+// maildirMessage is a message file of a Maildir folder.
+type maildirMessage struct {
+	uid   uint32
+	path  string
+	flags []string
+}
+
+// maildirFolder is what is kept about a Maildir folder between runs.
+type maildirFolder struct {
+	UIDValidity uint32            `json:"uid_validity"`
+	UIDNext     uint32            `json:"uid_next"`
+	UIDs        map[string]uint32 `json:"uids"` // By unique name
+}
+
+// maildirUIDs holds the folders of each Maildir account, loaded when first
+// needed.
+var maildirUIDs = struct {
+	sync.Mutex
+	accounts map[string]map[string]*maildirFolder
+}{accounts: make(map[string]map[string]*maildirFolder)}
+
+func newMaildirBackend(account *config.Account) (*maildirBackend, error) {
+	root := account.GetMaildirPath()
+	if root == "" {
+		return nil, fmt.Errorf("no maildir_path set for %s", account.Email)
+	}
+	return &maildirBackend{account: account, root: root}, nil
+}
+
+// dir returns the directory of a folder.
+func (b *maildirBackend) dir(mailbox string) (string, error) {
+	if strings.EqualFold(mailbox, "INBOX") {
+		return b.root, nil
+	}
+	if mailbox == "" || strings.HasPrefix(mailbox, ".") || strings.ContainsAny(mailbox, `/\`) || strings.Contains(mailbox, "..") {
+		return "", fmt.Errorf("invalid folder name %q", mailbox)
+	}
+	return filepath.Join(b.root, "."+mailbox), nil
+}
+
+// listFolders lists the folders of the tree without counting their messages.
+func (b *maildirBackend) listFolders() ([]fetcher.Folder, error) {
+	if _, err := os.Stat(filepath.Join(b.root, "cur")); err != nil {
+		return nil, fmt.Errorf("%s is not a Maildir: %w", b.root, err)
+	}
+	entries, err := os.ReadDir(b.root)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := []fetcher.Folder{{Name: "INBOX", Delimiter: "."}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || len(name) < 2 || name[0] != '.' || name == ".." {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(b.root, name, "cur")); err != nil || !info.IsDir() {
+			continue
+		}
+		folders = append(folders, fetcher.Folder{Name: name[1:], Delimiter: "."})
+	}
+	return folders, nil
+}
+
+func (b *maildirBackend) Folders() ([]fetcher.Folder, error) {
+	folders, err := b.listFolders()
+	if err != nil {
+		return nil, err
+	}
+	for i := range folders {
+		msgs, _, err := b.scan(folders[i].Name)
+		if err != nil {
+			continue
+		}
+		folders[i].Messages = uint32(len(msgs))
+		for _, msg := range msgs {
+			if !hasFlag(msg.flags, imap.SeenFlag) {
+				folders[i].Unseen++
+			}
+		}
+	}
+	fetcher.SortFolders(folders)
+	return folders, nil
+}
+
+// scan lists the messages of a folder, oldest first, giving UIDs to the new
+// ones.
+func (b *maildirBackend) scan(mailbox string) ([]maildirMessage, maildirFolder, error) {
+	dir, err := b.dir(mailbox)
+	if err != nil {
+		return nil, maildirFolder{}, err
+	}
+
+	files := make(map[string]maildirMessage)
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, maildirFolder{}, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			unique, flags := parseMaildirName(name)
+			files[unique] = maildirMessage{path: filepath.Join(dir, sub, name), flags: flags}
+		}
+	}
+
+	maildirUIDs.Lock()
+	defer maildirUIDs.Unlock()
+	folders, err := b.loadFolders()
+	if err != nil {
+		return nil, maildirFolder{}, err
+	}
+	key := strings.ToUpper(mailbox)
+	if key != "INBOX" {
+		key = mailbox
+	}
+	folder := folders[key]
+	changed := false
+	if folder == nil {
+		folder = &maildirFolder{UIDValidity: uint32(time.Now().Unix()), UIDNext: 1, UIDs: make(map[string]uint32)}
+		folders[key] = folder
+		changed = true
+	}
+
+	var unknown []string
+	for unique := range files {
+		if _, ok := folder.UIDs[unique]; !ok {
+			unknown = append(unknown, unique)
+		}
+	}
+	// Unique names start with the delivery time, so they sort by arrival.
+	sort.Strings(unknown)
+	for _, unique := range unknown {
+		folder.UIDs[unique] = folder.UIDNext
+		folder.UIDNext++
+		changed = true
+	}
+	for unique := range folder.UIDs {
+		if _, ok := files[unique]; !ok {
+			delete(folder.UIDs, unique)
+			changed = true
+		}
+	}
+	if changed {
+		if err := b.saveFolders(folders); err != nil {
+			return nil, maildirFolder{}, err
+		}
+	}
+
+	msgs := make([]maildirMessage, 0, len(files))
+	for unique, msg := range files {
+		msg.uid = folder.UIDs[unique]
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].uid < msgs[j].uid })
+	return msgs, maildirFolder{UIDValidity: folder.UIDValidity, UIDNext: folder.UIDNext}, nil
+}
+
+// uidsFile returns where the account's UIDs are kept.
+func (b *maildirBackend) uidsFile() (string, error) {
+	dir, err := config.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "maildir", b.account.ID+".json"), nil
+}
+
+// loadFolders returns the account's folders, reading them from disk the
+// first time. maildirUIDs must be locked.
+func (b *maildirBackend) loadFolders() (map[string]*maildirFolder, error) {
+	if folders, ok := maildirUIDs.accounts[b.account.ID]; ok {
+		return folders, nil
+	}
+	folders := make(map[string]*maildirFolder)
+	path, err := b.uidsFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &folders); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	maildirUIDs.accounts[b.account.ID] = folders
+	return folders, nil
+}
+
+// saveFolders writes the account's folders to disk. maildirUIDs must be
+// locked.
+func (b *maildirBackend) saveFolders(folders map[string]*maildirFolder) error {
+	path, err := b.uidsFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(folders)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// parseMaildirName splits a Maildir file name into its unique name and
+// flags.
+func parseMaildirName(name string) (string, []string) {
+	unique, info, ok := strings.Cut(name, maildirInfo)
+	if !ok {
+		// Messages in new/ have no info yet.
+		unique, _, _ = strings.Cut(name, ":")
+		return unique, nil
+	}
+	var flags []string
+	for i := 0; i < len(info); i++ {
+		if flag, ok := maildirFlags[info[i]]; ok {
+			flags = append(flags, flag)
+		}
+	}
+	return unique, flags
+}
+
+// setMaildirFlag returns the file name of a message with flag added or
+// removed. Letters matcha doesn't know, such as keywords, are kept.
+func setMaildirFlag(name, flag string, enable bool) (string, error) {
+	var letter byte
+	for l, f := range maildirFlags {
+		if strings.EqualFold(f, flag) {
+			letter = l
+		}
+	}
+	if letter == 0 {
+		return "", fmt.Errorf("the %s flag can't be kept in a Maildir", flag)
+	}
+
+	unique, info, _ := strings.Cut(name, maildirInfo)
+	unique, _, _ = strings.Cut(unique, ":")
+	letters := []byte(strings.ReplaceAll(info, string(letter), ""))
+	if enable {
+		letters = append(letters, letter)
+	}
+	// Flags must be in ASCII order.
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return unique + maildirInfo + string(letters), nil
+}
+
+// maildirDeliveries counts the messages delivered by this process, to make
+// their file names unique.
+var maildirDeliveries struct {
+	sync.Mutex
+	n int
+}
+
+// deliverMaildir writes a message into the Maildir folder dir, to tmp/
+// first so that it never appears half written. A message with flags goes
+// to cur/, one without to new/. The file is dated date, unless it is zero.
+func deliverMaildir(dir string, date time.Time, flags []string, r io.Reader) error {
+	maildirDeliveries.Lock()
+	maildirDeliveries.n++
+	n := maildirDeliveries.n
+	maildirDeliveries.Unlock()
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	delivered := date
+	if delivered.IsZero() {
+		delivered = time.Now()
+	}
+	// Unique names start with the delivery time and count up, so that
+	// messages delivered in the same second keep their order.
+	name := fmt.Sprintf("%d.M%09dP%d.%s", delivered.Unix(), n, os.Getpid(), strings.ReplaceAll(host, "/", "_"))
+	sub := "new"
+	if len(flags) > 0 {
+		sub = "cur"
+		name += maildirInfo
+		for _, flag := range flags {
+			// Flags a Maildir can't keep, such as \Recent, are dropped.
+			if named, err := setMaildirFlag(name, flag, true); err == nil {
+				name = named
+			}
+		}
+	}
+
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !date.IsZero() {
+		err = os.Chtimes(tmp, date, date)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, sub, name))
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the messages of mailbox with the given UIDs.
+func (b *maildirBackend) find(mailbox string, uids []uint32) ([]maildirMessage, error) {
+	msgs, _, err := b.scan(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		want[uid] = true
+	}
+	var found []maildirMessage
+	for _, msg := range msgs {
+		if want[msg.uid] {
+			found = append(found, msg)
+		}
+	}
+	if len(found) == 0 && len(uids) > 0 {
+		return nil, fmt.Errorf("no message with UID %d in %s", uids[0], mailbox)
+	}
+	return found, nil
+}
+
+// emails reads the headers of msgs into emails, in the same order.
+func (b *maildirBackend) emails(mailbox string, uidValidity uint32, msgs []maildirMessage) []fetcher.Email {
+	local := make([]fetcher.LocalMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		header, err := readMaildirHeader(msg.path)
+		if err != nil {
+			// The message may have been moved away in the meantime.
+			continue
+		}
+		local = append(local, fetcher.LocalMessage{UID: msg.uid, Flags: msg.flags, Header: header})
+	}
+	sent := mailbox == b.SpecialMailbox(fetcher.SpecialSent)
+	return fetcher.LocalEmails(b.account, mailbox, sent, uidValidity, local)
+}
+
+func readMaildirHeader(path string) (textproto.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	defer f.Close()
+	return textproto.ReadHeader(bufio.NewReader(f))
+}
+
+func (b *maildirBackend) FetchPage(mailbox string, limit, beforeUID, uidValidity uint32) (fetcher.Page, error) {
+	msgs, folder, err := b.scan(mailbox)
+	if err != nil {
+		return fetcher.Page{}, err
+	}
+	page := fetcher.Page{UIDValidity: folder.UIDValidity}
+	if uidValidity != 0 && folder.UIDValidity != uidValidity {
+		return page, fetcher.ErrUIDValidityChanged
+	}
+
+	var picked []maildirMessage
+	i := len(msgs) - 1
+	for ; i >= 0 && uint32(len(picked)) < limit; i-- {
+		if beforeUID == 0 || msgs[i].uid < beforeUID {
+			picked = append(picked, msgs[i])
+		}
+	}
+	if len(picked) > 0 && i >= 0 {
+		page.OldestUID = picked[len(picked)-1].uid
+	}
+	page.Emails = b.emails(mailbox, folder.UIDValidity, picked)
+	return page, nil
+}
+
+func (b *maildirBackend) FetchBody(mailbox string, uid uint32) (string, []fetcher.Attachment, error) {
+	msgs, err := b.find(mailbox, []uint32{uid})
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.Open(msgs[0].path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	return fetcher.ParseMessage(f)
+}
+
+func (b *maildirBackend) FetchAttachment(mailbox string, uid uint32, partID, encoding string) ([]byte, error) {
+	msgs, err := b.find(mailbox, []uint32{uid})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(msgs[0].path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return fetcher.MessagePart(f, partID, encoding)
+}
+
+// Messages lists the messages of a folder, dated when their files were
+// last written.
+func (b *maildirBackend) Messages(mailbox string) ([]fetcher.MessageInfo, uint32, error) {
+	msgs, folder, err := b.scan(mailbox)
+	if err != nil {
+		return nil, 0, err
+	}
+	infos := make([]fetcher.MessageInfo, 0, len(msgs))
+	for _, msg := range msgs {
+		info := fetcher.MessageInfo{UID: msg.uid, Flags: msg.flags}
+		if fi, err := os.Stat(msg.path); err == nil {
+			info.Date = fi.ModTime()
+		}
+		infos = append(infos, info)
+	}
+	return infos, folder.UIDValidity, nil
+}
+
+// FetchRaw copies the file of a message to w.
+func (b *maildirBackend) FetchRaw(mailbox string, uid uint32, w io.Writer) error {
+	msgs, err := b.find(mailbox, []uint32{uid})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(msgs[0].path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Append delivers a message into a folder, with its file dated date.
+func (b *maildirBackend) Append(mailbox string, flags []string, date time.Time, raw []byte) error {
+	dir, err := b.dir(mailbox)
+	if err != nil {
+		return err
+	}
+	return deliverMaildir(dir, date, flags, bytes.NewReader(raw))
+}
+
+func (b *maildirBackend) Move(mailbox string, uids []uint32, dest string) error {
+	if len(uids) == 0 || dest == mailbox {
+		return nil
+	}
+	destDir, err := b.dir(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "cur")); err != nil {
+		return fmt.Errorf("no folder %q: %w", dest, err)
+	}
+	msgs, err := b.find(mailbox, uids)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		// A message stays new or current, and keeps its name and flags.
+		sub := filepath.Base(filepath.Dir(msg.path))
+		if err := os.Rename(msg.path, filepath.Join(destDir, sub, filepath.Base(msg.path))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *maildirBackend) Delete(mailbox string, uids []uint32) error {
+	trash := b.SpecialMailbox(fetcher.SpecialTrash)
+	if mailbox != trash {
+		return b.Move(mailbox, uids, trash)
+	}
+	msgs, err := b.find(mailbox, uids)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := os.Remove(msg.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *maildirBackend) Restore(messageID, from, to string) error {
+	msgs, _, err := b.scan(from)
+	if err != nil {
+		return err
+	}
+	// The message moved last is the newest copy.
+	for i := len(msgs) - 1; i >= 0; i-- {
+		header, err := readMaildirHeader(msgs[i].path)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(header.Get("Message-Id")) == messageID {
+			return b.Move(from, []uint32{msgs[i].uid}, to)
+		}
+	}
+	return fmt.Errorf("%s not found in %s", messageID, from)
+}
+
+func (b *maildirBackend) SetFlag(mailbox string, uids []uint32, flag string, enable bool) error {
+	msgs, err := b.find(mailbox, uids)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		name, err := setMaildirFlag(filepath.Base(msg.path), flag, enable)
+		if err != nil {
+			return err
+		}
+		// Messages the reader has dealt with belong in cur/.
+		dir := filepath.Dir(filepath.Dir(msg.path))
+		if err := os.Rename(msg.path, filepath.Join(dir, "cur", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *maildirBackend) Search(mailbox string, query fetcher.Query, limit int) ([]fetcher.Email, error) {
+	return b.search(mailbox, query.Criteria(), limit)
+}
+
+func (b *maildirBackend) Flagged(mailbox string) ([]fetcher.Email, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.FlaggedFlag}
+	return b.search(mailbox, criteria, 0)
+}
+
+// search is Search with IMAP SEARCH criteria, matched against each message.
+func (b *maildirBackend) search(mailbox string, criteria *imap.SearchCriteria, limit int) ([]fetcher.Email, error) {
+	msgs, folder, err := b.scan(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []maildirMessage
+	for i := len(msgs) - 1; i >= 0 && (limit == 0 || len(matched) < limit); i-- {
+		f, err := os.Open(msgs[i].path)
+		if err != nil {
+			continue
+		}
+		ok, err := fetcher.MatchMessage(f, msgs[i].uid, msgs[i].flags, criteria)
+		f.Close()
+		if err == nil && ok {
+			matched = append(matched, msgs[i])
+		}
+	}
+	return b.emails(mailbox, folder.UIDValidity, matched), nil
+}
+
+func (b *maildirBackend) SpecialMailbox(use fetcher.SpecialUse) string {
+	folders, _ := b.listFolders()
+	return fetcher.SpecialFolder(b.account, use, folders)
+}
+
+func (b *maildirBackend) Close() {}
+
+func (b *maildirBackend) SyncState(mailbox string) (fetcher.SyncState, error) {
+	msgs, folder, err := b.scan(mailbox)
+	if err != nil {
+		return fetcher.SyncState{}, err
+	}
+	return fetcher.SyncState{UIDValidity: folder.UIDValidity, UIDNext: folder.UIDNext, Messages: uint32(len(msgs))}, nil
+}
+
+func (b *maildirBackend) Sync(mailbox string, state fetcher.SyncState, known []uint32) (fetcher.Changes, error) {
+	msgs, folder, err := b.scan(mailbox)
+	if err != nil {
+		return fetcher.Changes{}, err
+	}
+	if folder.UIDValidity != state.UIDValidity {
+		return fetcher.Changes{}, fetcher.ErrUIDValidityChanged
+	}
+	changes := fetcher.Changes{
+		Flags: make(map[uint32][]string),
+		State: fetcher.SyncState{UIDValidity: folder.UIDValidity, UIDNext: folder.UIDNext, Messages: uint32(len(msgs))},
+	}
+
+	byUID := make(map[uint32]maildirMessage, len(msgs))
+	var arrived []maildirMessage
+	for i := len(msgs) - 1; i >= 0; i-- {
+		byUID[msgs[i].uid] = msgs[i]
+		if msgs[i].uid >= state.UIDNext {
+			arrived = append(arrived, msgs[i])
+		}
+	}
+	for _, uid := range known {
+		if msg, ok := byUID[uid]; ok {
+			changes.Flags[uid] = msg.flags
+		} else {
+			changes.Vanished = append(changes.Vanished, uid)
+		}
+	}
+	changes.New = b.emails(mailbox, folder.UIDValidity, arrived)
+	return changes, nil
+}
+
+// Thread leaves the emails to be threaded locally, as there is no server
+// to do it.
+func (b *maildirBackend) Thread(mailbox string, emails []fetcher.Email) error {
+	return nil
+}
+
+func (b *maildirBackend) Conversation(email fetcher.Email, loaded fetcher.LoadedBodies) ([]fetcher.Email, error) {
+	criteria := fetcher.ConversationCriteria(email)
+	if criteria == nil {
+		return []fetcher.Email{email}, nil
+	}
+
+	loaded = loaded.With(email)
+	var conversation []fetcher.Email
+	seen := make(map[string]bool)
+	for _, mailbox := range []string{"INBOX", b.SpecialMailbox(fetcher.SpecialSent)} {
+		emails, err := b.search(mailbox, criteria, 0)
+		if err != nil {
+			if mailbox == "INBOX" {
+				return nil, err
+			}
+			// Not every Maildir has a Sent folder.
+			continue
+		}
+		for _, found := range emails {
+			if found.MessageID != "" && seen[found.MessageID] {
+				continue
+			}
+			seen[found.MessageID] = true
+
+			if !loaded.Fill(&found) {
+				body, attachments, err := b.FetchBody(mailbox, found.UID)
+				if err != nil {
+					return nil, err
+				}
+				found.Body = body
+				found.Attachments = attachments
+			}
+			conversation = append(conversation, found)
+		}
+	}
+
+	sort.SliceStable(conversation, func(i, j int) bool { return conversation[i].Date.Before(conversation[j].Date) })
+	return conversation, nil
+}
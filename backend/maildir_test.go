@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+const plainMessage = "From: alice@example.com\r\n" +
+	"To: me@example.com\r\n" +
+	"Subject: Lunch\r\n" +
+	"Date: Mon, 01 Jan 2024 12:00:00 +0000\r\n" +
+	"Message-Id: <lunch@example.com>\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Noon at the usual place?\r\n"
+
+const attachmentMessage = "From: bob@example.com\r\n" +
+	"To: me@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"Date: Tue, 02 Jan 2024 12:00:00 +0000\r\n" +
+	"Message-Id: <report@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/csv; name=report.csv\r\n" +
+	"Content-Disposition: attachment; filename=report.csv\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"YSxiCjEsMgo=\r\n" +
+	"--b--\r\n"
+
+// newTestMaildir creates a Maildir++ tree with an inbox holding a read and
+// an unread message, and Sent, Archive and Trash folders.
+func newTestMaildir(t *testing.T) *maildirBackend {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	maildirUIDs.accounts = make(map[string]map[string]*maildirFolder)
+	root := t.TempDir()
+	for _, dir := range []string{"", ".Sent", ".Archive", ".Trash"} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(root, dir, sub), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("cur/1704110400.1.host:2,S", plainMessage)
+	write("new/1704196800.2.host", attachmentMessage)
+
+	account := &config.Account{ID: "local", Email: "me@example.com", Backend: config.BackendMaildir, MaildirPath: root}
+	b, err := Open(account)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	return b.(*maildirBackend)
+}
+
+func TestMaildirFolders(t *testing.T) {
+	b := newTestMaildir(t)
+	folders, err := b.Folders()
+	if err != nil {
+		t.Fatalf("Folders() failed: %v", err)
+	}
+	var names []string
+	for _, f := range folders {
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, ","); got != "INBOX,Archive,Sent,Trash" {
+		t.Errorf("expected INBOX and the subfolders, got %s", got)
+	}
+	if folders[0].Messages != 2 || folders[0].Unseen != 1 {
+		t.Errorf("expected 2 messages with 1 unread in the inbox, got %+v", folders[0])
+	}
+	if got := b.SpecialMailbox(fetcher.SpecialTrash); got != "Trash" {
+		t.Errorf("expected the Trash folder, got %q", got)
+	}
+}
+
+func TestMaildirFetch(t *testing.T) {
+	b := newTestMaildir(t)
+	page, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(page.Emails) != 2 || page.Emails[0].Subject != "Report" || page.Emails[1].Subject != "Lunch" {
+		t.Fatalf("expected both emails newest first, got %+v", page.Emails)
+	}
+	report, lunch := page.Emails[0], page.Emails[1]
+	if !report.IsUnread() || lunch.IsUnread() {
+		t.Errorf("expected the flags from the file names, got %v and %v", report.Flags, lunch.Flags)
+	}
+
+	// UIDs are kept for the next run.
+	maildirUIDs.accounts = make(map[string]map[string]*maildirFolder)
+	older, err := b.FetchPage("INBOX", 10, report.UID, page.UIDValidity)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(older.Emails) != 1 || older.Emails[0].UID != lunch.UID {
+		t.Errorf("expected the older email on the next page, got %+v", older.Emails)
+	}
+
+	body, attachments, err := b.FetchBody("INBOX", report.UID)
+	if err != nil {
+		t.Fatalf("FetchBody() failed: %v", err)
+	}
+	if !strings.Contains(body, "See attached.") || len(attachments) != 1 || attachments[0].Filename != "report.csv" {
+		t.Fatalf("unexpected body %q and attachments %+v", body, attachments)
+	}
+	data, err := b.FetchAttachment("INBOX", report.UID, attachments[0].PartID, attachments[0].Encoding)
+	if err != nil {
+		t.Fatalf("FetchAttachment() failed: %v", err)
+	}
+	if string(data) != "a,b\n1,2\n" {
+		t.Errorf("expected the decoded attachment, got %q", data)
+	}
+
+	found, err := b.Search("INBOX", fetcher.Query{From: []string{"alice"}}, 0)
+	if err != nil {
+		t.Fatalf("Search() failed: %v", err)
+	}
+	if len(found) != 1 || found[0].UID != lunch.UID {
+		t.Errorf("expected the email from alice, got %+v", found)
+	}
+
+	if err := b.SetFlag("INBOX", []uint32{lunch.UID}, fetcher.FlagFlagged, true); err != nil {
+		t.Fatalf("SetFlag() failed: %v", err)
+	}
+	flagged, err := b.Flagged("INBOX")
+	if err != nil {
+		t.Fatalf("Flagged() failed: %v", err)
+	}
+	if len(flagged) != 1 || flagged[0].UID != lunch.UID {
+		t.Errorf("expected only the flagged email, got %+v", flagged)
+	}
+}
+
+func TestMaildirChanges(t *testing.T) {
+	b := newTestMaildir(t)
+	state, err := b.SyncState("INBOX")
+	if err != nil {
+		t.Fatalf("SyncState() failed: %v", err)
+	}
+	page, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	report, lunch := page.Emails[0], page.Emails[1]
+
+	if err := b.SetFlag("INBOX", []uint32{report.UID}, fetcher.FlagSeen, true); err != nil {
+		t.Fatalf("SetFlag() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.root, "cur", "1704196800.2.host:2,S")); err != nil {
+		t.Errorf("expected the message to be marked seen in cur/: %v", err)
+	}
+
+	if err := Archive(b, "INBOX", []uint32{lunch.UID}); err != nil {
+		t.Fatalf("Archive() failed: %v", err)
+	}
+	changes, err := b.Sync("INBOX", state, []uint32{report.UID, lunch.UID})
+	if err != nil {
+		t.Fatalf("Sync() failed: %v", err)
+	}
+	if len(changes.Vanished) != 1 || changes.Vanished[0] != lunch.UID || len(changes.New) != 0 {
+		t.Errorf("expected the archived email to have vanished, got %+v", changes)
+	}
+	if flags := changes.Flags[report.UID]; len(flags) != 1 || flags[0] != fetcher.FlagSeen {
+		t.Errorf("expected the report to be seen, got %v", flags)
+	}
+
+	if err := b.Restore("<lunch@example.com>", "Archive", "INBOX"); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	if err := b.Delete("INBOX", []uint32{report.UID}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	trash, err := b.FetchPage("Trash", 10, 0, 0)
+	if err != nil || len(trash.Emails) != 1 {
+		t.Fatalf("expected the email in the trash, got %+v, %v", trash.Emails, err)
+	}
+	if err := b.Delete("Trash", []uint32{trash.Emails[0].UID}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	inbox, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(inbox.Emails) != 1 || inbox.Emails[0].Subject != "Lunch" {
+		t.Errorf("expected only the restored email in the inbox, got %+v", inbox.Emails)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(b.root, ".Trash", "cur")); len(entries) != 0 {
+		t.Errorf("expected the trash to be emptied, got %d files", len(entries))
+	}
+}
@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/oauth"
+	"github.com/floatpane/matcha/pop3"
+)
+
+// pop3Backend serves an account whose mail is downloaded from a POP3 server
+// into a Maildir++ tree in matcha's data directory, which is then read like
+// any other Maildir. Downloaded messages are remembered by their UIDL so
+// that those left on the server aren't downloaded again.
+type pop3Backend struct {
+	*maildirBackend
+}
+
+// pop3Folders are the folders made in the tree, besides the inbox.
+var pop3Folders = []string{"Sent", "Archive", "Trash"}
+
+// pop3Downloads serializes the downloads of each account.
+var pop3Downloads = struct {
+	sync.Mutex
+	accounts map[string]*sync.Mutex
+}{accounts: make(map[string]*sync.Mutex)}
+
+// pop3Seen is what is kept about a maildrop between runs.
+type pop3Seen struct {
+	// UIDs are the unique IDs of the messages already downloaded.
+	UIDs map[string]bool `json:"uids"`
+}
+
+func newPOP3Backend(account *config.Account) (*pop3Backend, error) {
+	if account.GetPOP3Server() == "" {
+		return nil, fmt.Errorf("no pop3_server set for %s", account.Email)
+	}
+	dir, err := config.DataDir()
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(dir, "pop3", account.ID)
+	for _, folder := range append([]string{""}, pop3Folders...) {
+		if folder != "" {
+			folder = "." + folder
+		}
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(root, folder, sub), 0700); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &pop3Backend{&maildirBackend{account: account, root: root}}, nil
+}
+
+// FetchPage downloads new mail before returning the newest page of the
+// inbox.
+func (b *pop3Backend) FetchPage(mailbox string, limit, beforeUID, uidValidity uint32) (fetcher.Page, error) {
+	if beforeUID == 0 && mailbox == "INBOX" {
+		if err := b.download(); err != nil {
+			return fetcher.Page{}, err
+		}
+	}
+	return b.maildirBackend.FetchPage(mailbox, limit, beforeUID, uidValidity)
+}
+
+// Sync downloads new mail before telling what changed in the inbox.
+func (b *pop3Backend) Sync(mailbox string, state fetcher.SyncState, known []uint32) (fetcher.Changes, error) {
+	if mailbox == "INBOX" {
+		if err := b.download(); err != nil {
+			return fetcher.Changes{}, err
+		}
+	}
+	return b.maildirBackend.Sync(mailbox, state, known)
+}
+
+// download stores the messages of the maildrop that haven't been downloaded
+// yet in the inbox, and deletes them from the server if the account says
+// so.
+func (b *pop3Backend) download() error {
+	pop3Downloads.Lock()
+	mu, ok := pop3Downloads.accounts[b.account.ID]
+	if !ok {
+		mu = &sync.Mutex{}
+		pop3Downloads.accounts[b.account.ID] = mu
+	}
+	pop3Downloads.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	seen, err := b.loadSeen()
+	if err != nil {
+		return err
+	}
+	c, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	msgs, err := c.UIDL()
+	if err != nil {
+		return err
+	}
+	onServer := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		onServer[msg.UID] = true
+		if !seen.UIDs[msg.UID] {
+			if err := b.retrieve(c, msg.Number); err != nil {
+				return err
+			}
+			// Saved after each message, so that an interrupted download
+			// carries on where it stopped.
+			seen.UIDs[msg.UID] = true
+			if err := b.saveSeen(seen); err != nil {
+				return err
+			}
+		}
+		if b.account.POP3Delete {
+			if err := c.Dele(msg.Number); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Forget messages that are gone from the server, as they won't be
+	// listed again.
+	for uid := range seen.UIDs {
+		if !onServer[uid] || b.account.POP3Delete {
+			delete(seen.UIDs, uid)
+		}
+	}
+	if b.account.POP3Delete {
+		// Deletions only happen if the session ends with QUIT, so the
+		// messages are remembered until then.
+		if err := c.Quit(); err != nil {
+			return err
+		}
+		return b.saveSeen(seen)
+	}
+	if err := b.saveSeen(seen); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// retrieve downloads a message into the inbox as a new message.
+func (b *pop3Backend) retrieve(c *pop3.Client, number int) error {
+	r, err := c.Retr(number)
+	if err != nil {
+		return err
+	}
+	if err := deliverMaildir(b.root, time.Time{}, nil, r); err != nil {
+		// The rest of the message must be read before the next command.
+		io.Copy(io.Discard, r)
+		return err
+	}
+	return nil
+}
+
+// connect signs in to the account's POP3 server.
+func (b *pop3Backend) connect() (*pop3.Client, error) {
+	server := b.account.GetPOP3Server()
+	tlsConfig, err := b.account.TLSConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	addr := fmt.Sprintf("%s:%d", server, b.account.GetPOP3Port())
+	c, err := dialPOP3(addr, server, b.account.GetPOP3Security(), tlsConfig)
+	if err != nil {
+		return nil, config.ExplainTLSError(server, err)
+	}
+
+	if b.account.UsesOAuth2() {
+		var token string
+		token, err = oauth.AccessToken(b.account)
+		if err == nil {
+			var caps map[string][]string
+			caps, err = c.Capabilities()
+			if err == nil {
+				supports := func(mech string) bool {
+					for _, m := range caps["SASL"] {
+						if m == mech {
+							return true
+						}
+					}
+					return false
+				}
+				err = c.Authenticate(oauth.NewSASLClient(b.account.Email, token, supports))
+			}
+		}
+	} else {
+		err = c.Login(b.account.Email, b.account.Password)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialPOP3 connects to addr with the given security, never settling for
+// less: STLS fails if the server doesn't offer it, and plaintext is only
+// allowed to localhost.
+func dialPOP3(addr, host, security string, tlsConfig *tls.Config) (*pop3.Client, error) {
+	switch security {
+	case config.SecurityTLS:
+		return pop3.DialTLS(addr, tlsConfig)
+	case config.SecuritySTARTTLS:
+		c, err := pop3.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		caps, err := c.Capabilities()
+		if err == nil {
+			if _, ok := caps["STLS"]; !ok {
+				err = fmt.Errorf("%s does not support STLS", host)
+			}
+		}
+		if err == nil {
+			err = c.StartTLS(tlsConfig)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	case config.SecurityNone:
+		if !config.IsLocalhost(host) {
+			return nil, fmt.Errorf("plaintext POP3 is only allowed to localhost, not %s", host)
+		}
+		return pop3.Dial(addr)
+	default:
+		return nil, fmt.Errorf("unknown POP3 security %q", security)
+	}
+}
+
+// seenFile returns where the UIDLs of downloaded messages are kept.
+func (b *pop3Backend) seenFile() (string, error) {
+	dir, err := config.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pop3", b.account.ID+".json"), nil
+}
+
+func (b *pop3Backend) loadSeen() (*pop3Seen, error) {
+	path, err := b.seenFile()
+	if err != nil {
+		return nil, err
+	}
+	seen := &pop3Seen{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, seen); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if seen.UIDs == nil {
+		seen.UIDs = make(map[string]bool)
+	}
+	return seen, nil
+}
+
+func (b *pop3Backend) saveSeen(seen *pop3Seen) error {
+	path, err := b.seenFile()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so that a crash never leaves it
+	// half written and the messages downloaded again.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
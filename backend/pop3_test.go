@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/pop3/pop3test"
+)
+
+// newTestPOP3 starts a POP3 server with two messages and opens an account
+// on it.
+func newTestPOP3(t *testing.T, deleteDownloaded bool) (*pop3test.Server, *pop3Backend) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	maildirUIDs.accounts = make(map[string]map[string]*maildirFolder)
+	s := pop3test.NewServer("me@example.com", "secret")
+	t.Cleanup(s.Close)
+	s.AddMessage("lunch", []byte(plainMessage))
+	s.AddMessage("report", []byte(attachmentMessage))
+
+	account := &config.Account{
+		ID: "pop", Email: "me@example.com", Password: "secret", Backend: config.BackendPOP3,
+		ServiceProvider: "custom", POP3Server: s.Host(), POP3Port: s.Port(), POP3Security: config.SecurityNone,
+		POP3Delete: deleteDownloaded,
+	}
+	b, err := Open(account)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	return s, b.(*pop3Backend)
+}
+
+func TestPOP3LeaveOnServer(t *testing.T) {
+	s, b := newTestPOP3(t, false)
+	page, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(page.Emails) != 2 || page.Emails[0].Subject != "Report" || !page.Emails[0].IsUnread() {
+		t.Fatalf("expected both messages downloaded, newest first and unread, got %+v", page.Emails)
+	}
+	if len(s.UIDs()) != 2 {
+		t.Errorf("expected the messages left on the server, got %v", s.UIDs())
+	}
+
+	// Only new messages are downloaded again.
+	state, err := b.SyncState("INBOX")
+	if err != nil {
+		t.Fatalf("SyncState() failed: %v", err)
+	}
+	s.AddMessage("later", []byte("To: me@example.com\r\nSubject: Later\r\nMessage-Id: <later@example.com>\r\n\r\nHi\r\n"))
+	changes, err := b.Sync("INBOX", state, []uint32{page.Emails[0].UID, page.Emails[1].UID})
+	if err != nil {
+		t.Fatalf("Sync() failed: %v", err)
+	}
+	if len(changes.New) != 1 || changes.New[0].Subject != "Later" {
+		t.Errorf("expected only the new message, got %+v", changes.New)
+	}
+
+	found, err := b.Search("INBOX", fetcher.Query{From: []string{"alice"}}, 0)
+	if err != nil || len(found) != 1 || found[0].Subject != "Lunch" {
+		t.Errorf("expected to find the email from alice, got %+v, %v", found, err)
+	}
+
+	// Deleting locally doesn't bring the message back with the next
+	// download.
+	if err := b.Delete("INBOX", []uint32{found[0].UID}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	inbox, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(inbox.Emails) != 2 {
+		t.Errorf("expected the deleted message to stay deleted, got %+v", inbox.Emails)
+	}
+}
+
+func TestPOP3DeleteFromServer(t *testing.T) {
+	s, b := newTestPOP3(t, true)
+	page, err := b.FetchPage("INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchPage() failed: %v", err)
+	}
+	if len(page.Emails) != 2 {
+		t.Fatalf("expected both messages downloaded, got %+v", page.Emails)
+	}
+	if uids := s.UIDs(); len(uids) != 0 {
+		t.Errorf("expected the messages deleted from the server, got %v", uids)
+	}
+
+	body, attachments, err := b.FetchBody("INBOX", page.Emails[0].UID)
+	if err != nil {
+		t.Fatalf("FetchBody() failed: %v", err)
+	}
+	if body == "" || len(attachments) != 1 {
+		t.Errorf("expected the downloaded message to be readable, got %q and %+v", body, attachments)
+	}
+}
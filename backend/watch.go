@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+// Watcher pushes the changes of a watched mailbox per account. IMAP
+// accounts are watched with IDLE, or polled where the server lacks it.
+type Watcher struct {
+	imap *fetcher.Watcher
+}
+
+// NewWatcher creates a watcher with no accounts.
+func NewWatcher() *Watcher {
+	return &Watcher{imap: fetcher.NewWatcher()}
+}
+
+// Updates returns the channel on which mailbox changes are delivered.
+func (w *Watcher) Updates() <-chan fetcher.MailboxUpdate {
+	return w.imap.Updates()
+}
+
+// Watch starts watching mailbox for the account, replacing any previous
+// watch for the same account. Accounts whose backend can't be watched are
+// left to manual refreshes.
+func (w *Watcher) Watch(account config.Account, mailbox string) {
+	switch account.GetBackend() {
+	case config.BackendIMAP:
+		w.imap.Watch(account, mailbox)
+	}
+}
+
+// Unwatch stops watching the account.
+func (w *Watcher) Unwatch(accountID string) {
+	w.imap.Unwatch(accountID)
+}
+
+// Close stops all watches.
+func (w *Watcher) Close() {
+	w.imap.Close()
+}
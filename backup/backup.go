@@ -0,0 +1,364 @@
+// Package backup copies whole mailboxes between an account and mbox files
+// or Maildir folders on disk, for backups and for moving mail between
+// providers. Messages keep their flags and the date they arrived.
+//
+// Copies can be interrupted and run again with the same arguments to carry
+// on where they stopped: how far they got is kept in matcha's data
+// directory until they finish.
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/floatpane/matcha/backend"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+// The formats mail can be kept in on disk.
+const (
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+)
+
+// Progress is told how many of the messages have been copied so far.
+type Progress func(done, total int)
+
+// exportState is how far an export got.
+type exportState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	// LastUID is the UID of the last message written.
+	LastUID uint32 `json:"last_uid"`
+	// Offset is the size of the mbox file after that message, anything
+	// after which was left by the interruption.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// importState is how far an import got.
+type importState struct {
+	// Done is how many messages of the source were stored.
+	Done int `json:"done"`
+}
+
+// Export writes every message of an account's mailbox to path, as an mbox
+// file or a Maildir folder, in the order they arrived. An mbox file that
+// already has mail in it is only written to by the export that left it
+// unfinished. A message being stored in a Maildir folder when the export
+// is interrupted may be stored twice.
+func Export(src backend.Exporter, account *config.Account, mailbox, format, path string, progress Progress) error {
+	if format != FormatMbox && format != FormatMaildir {
+		return fmt.Errorf("unknown format %q, expected %s or %s", format, FormatMbox, FormatMaildir)
+	}
+	infos, uidValidity, err := src.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	statePath, err := stateFile("export", account.ID, mailbox, format, path)
+	if err != nil {
+		return err
+	}
+	var state exportState
+	resumed, err := loadState(statePath, &state)
+	if err != nil {
+		return err
+	}
+	if !resumed && format == FormatMbox {
+		// An earlier backup mustn't be written over.
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			return fmt.Errorf("%s already exists; remove it or export to another file", path)
+		}
+	}
+	if resumed && state.UIDValidity != uidValidity {
+		return fmt.Errorf("%s has changed since the export was interrupted; remove %s and export it again", mailbox, path)
+	}
+	state.UIDValidity = uidValidity
+	if resumed && format == FormatMbox {
+		// Starts over if the file is gone or shorter than it was left.
+		if fi, err := os.Stat(path); err != nil || fi.Size() < state.Offset {
+			state = exportState{UIDValidity: uidValidity}
+		}
+	}
+
+	var write func(info fetcher.MessageInfo, raw []byte) error
+	switch format {
+	case FormatMbox:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Whatever was written after the last message that was saved as
+		// done is dropped, as it may be cut short.
+		if err := f.Truncate(state.Offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(state.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		write = func(info fetcher.MessageInfo, raw []byte) error {
+			if err := writeMbox(f, info.Date, info.Flags, raw); err != nil {
+				return err
+			}
+			state.Offset, err = f.Seek(0, io.SeekCurrent)
+			return err
+		}
+	case FormatMaildir:
+		dest, err := openMaildir(path, true)
+		if err != nil {
+			return err
+		}
+		write = func(info fetcher.MessageInfo, raw []byte) error {
+			return dest.Append("INBOX", info.Flags, info.Date, raw)
+		}
+	}
+
+	done := 0
+	for _, info := range infos {
+		if info.UID <= state.LastUID {
+			done++
+		}
+	}
+	report(progress, done, len(infos))
+	for _, info := range infos {
+		if info.UID <= state.LastUID {
+			continue
+		}
+		var raw bytes.Buffer
+		if err := src.FetchRaw(mailbox, info.UID, &raw); err != nil {
+			return err
+		}
+		if err := write(info, raw.Bytes()); err != nil {
+			return err
+		}
+		state.LastUID = info.UID
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+		done++
+		report(progress, done, len(infos))
+	}
+	return removeState(statePath)
+}
+
+// Import stores every message of an mbox file or Maildir folder at path in
+// an account's mailbox. A message being stored when the import is
+// interrupted may be stored twice.
+func Import(dest backend.Importer, account *config.Account, mailbox, path string, progress Progress) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	format := FormatMbox
+	if fi.IsDir() {
+		format = FormatMaildir
+	}
+
+	statePath, err := stateFile("import", account.ID, mailbox, format, path)
+	if err != nil {
+		return err
+	}
+	var state importState
+	if _, err := loadState(statePath, &state); err != nil {
+		return err
+	}
+
+	// store stores the i-th message of the source, unless it was already.
+	var total int
+	store := func(i int, msg *mboxMessage) error {
+		if i < state.Done {
+			return nil
+		}
+		if err := dest.Append(mailbox, msg.Flags, msg.Date, crlf(msg.Raw)); err != nil {
+			return err
+		}
+		state.Done = i + 1
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+		report(progress, state.Done, total)
+		return nil
+	}
+
+	switch format {
+	case FormatMbox:
+		total, err = countMbox(path)
+		if err != nil {
+			return err
+		}
+		report(progress, min(state.Done, total), total)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r := newMboxReader(f)
+		for i := 0; ; i++ {
+			msg, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := store(i, msg); err != nil {
+				return err
+			}
+		}
+	case FormatMaildir:
+		src, err := openMaildir(path, false)
+		if err != nil {
+			return err
+		}
+		infos, _, err := src.Messages("INBOX")
+		if err != nil {
+			return err
+		}
+		total = len(infos)
+		report(progress, min(state.Done, total), total)
+		for i, info := range infos {
+			if i < state.Done {
+				continue
+			}
+			var raw bytes.Buffer
+			if err := src.FetchRaw("INBOX", info.UID, &raw); err != nil {
+				return err
+			}
+			if err := store(i, &mboxMessage{Date: info.Date, Flags: info.Flags, Raw: raw.Bytes()}); err != nil {
+				return err
+			}
+		}
+	}
+	return removeState(statePath)
+}
+
+// maildir is what is used of a Maildir folder opened as an account.
+type maildir interface {
+	backend.Exporter
+	backend.Importer
+}
+
+// openMaildir opens the Maildir folder at path through the maildir backend,
+// making it first if create is set.
+func openMaildir(path string, create bool) (maildir, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(abs, sub), 0700); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// The folder gets UIDs of its own, apart from any account reading it.
+	account := &config.Account{
+		ID:          "backup-" + hash(abs),
+		Email:       abs,
+		Backend:     config.BackendMaildir,
+		MaildirPath: abs,
+	}
+	b, err := backend.Open(account)
+	if err != nil {
+		return nil, err
+	}
+	return b.(maildir), nil
+}
+
+// countMbox counts the messages of an mbox file.
+func countMbox(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := newMboxReader(f)
+	n := 0
+	for {
+		if _, err := r.Next(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
+
+// crlf converts a message to the CRLF line endings IMAP expects.
+func crlf(raw []byte) []byte {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
+
+func report(progress Progress, done, total int) {
+	if progress != nil {
+		progress(done, total)
+	}
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// stateFile returns where the progress of a copy is kept, named after what
+// is copied where.
+func stateFile(kind, accountID, mailbox, format, path string) (string, error) {
+	dir, err := config.DataDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.Join([]string{kind, accountID, mailbox, format, abs}, "\x00")
+	return filepath.Join(dir, "backup", hash(key)+".json"), nil
+}
+
+// loadState reads the progress of an interrupted copy into state, and
+// tells whether there was one.
+func loadState(path string, state interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, state)
+}
+
+func saveState(path string, state interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so that an interruption never
+	// leaves it half written.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func removeState(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+var (
+	firstDate  = time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	secondDate = time.Date(2022, 6, 7, 18, 30, 0, 0, time.UTC)
+)
+
+const firstMessage = "From: alice@example.com\r\nSubject: Lunch\r\n\r\nFrom now on, we eat at noon.\r\n>From the kitchen\r\n"
+const secondMessage = "From: bob@example.com\r\nSubject: Report\r\nStatus: O\r\n\r\nAttached.\r\n"
+
+// newSource makes a Maildir folder with two messages to copy.
+func newSource(t *testing.T) maildir {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	src, err := openMaildir(filepath.Join(t.TempDir(), "source"), true)
+	if err != nil {
+		t.Fatalf("openMaildir() failed: %v", err)
+	}
+	if err := src.Append("INBOX", []string{imap.SeenFlag, imap.FlaggedFlag}, firstDate, []byte(firstMessage)); err != nil {
+		t.Fatalf("Append() failed: %v", err)
+	}
+	if err := src.Append("INBOX", nil, secondDate, []byte(secondMessage)); err != nil {
+		t.Fatalf("Append() failed: %v", err)
+	}
+	return src
+}
+
+// checkCopy checks that dest has the messages of newSource.
+func checkCopy(t *testing.T, dest maildir) {
+	t.Helper()
+	infos, _, err := dest.Messages("INBOX")
+	if err != nil {
+		t.Fatalf("Messages() failed: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected both messages copied, got %+v", infos)
+	}
+	byDate := map[time.Time]fetcher.MessageInfo{}
+	for _, info := range infos {
+		byDate[info.Date.UTC()] = info
+	}
+	first, ok := byDate[firstDate]
+	if !ok || !hasFlag(first.Flags, imap.SeenFlag) || !hasFlag(first.Flags, imap.FlaggedFlag) {
+		t.Errorf("expected the first message to keep its date and flags, got %+v", infos)
+	}
+	second, ok := byDate[secondDate]
+	if !ok || len(second.Flags) != 0 {
+		t.Errorf("expected the second message to keep its date and no flags, got %+v", infos)
+	}
+
+	var raw bytes.Buffer
+	if err := dest.FetchRaw("INBOX", first.UID, &raw); err != nil {
+		t.Fatalf("FetchRaw() failed: %v", err)
+	}
+	if raw.String() != firstMessage {
+		t.Errorf("expected the message as it was, got %q", raw.String())
+	}
+}
+
+func TestMboxRoundTrip(t *testing.T) {
+	src := newSource(t)
+	account := &config.Account{ID: "source"}
+	path := filepath.Join(t.TempDir(), "backup.mbox")
+
+	var reported []int
+	progress := func(done, total int) {
+		if total != 2 {
+			t.Errorf("expected a total of 2, got %d", total)
+		}
+		reported = append(reported, done)
+	}
+	if err := Export(src, account, "INBOX", FormatMbox, path, progress); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	if len(reported) != 3 || reported[2] != 2 {
+		t.Errorf("expected progress for each message, got %v", reported)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox := string(data)
+	if strings.Count(mbox, "\nFrom ") != 1 || !strings.HasPrefix(mbox, "From MAILER-DAEMON Thu Mar  4 10:00:00 2021\n") {
+		t.Errorf("expected two messages with From_ lines, got %q", mbox)
+	}
+	if !strings.Contains(mbox, "\n>From now on") || !strings.Contains(mbox, "\n>>From the kitchen") {
+		t.Errorf("expected From lines in bodies to be quoted, got %q", mbox)
+	}
+	if !strings.Contains(mbox, "Status: RO\nX-Status: F\n") || strings.Count(mbox, "Status: O\n") != 1 {
+		t.Errorf("expected flags in Status headers, got %q", mbox)
+	}
+
+	dest, err := openMaildir(filepath.Join(t.TempDir(), "dest"), true)
+	if err != nil {
+		t.Fatalf("openMaildir() failed: %v", err)
+	}
+	if err := Import(dest, account, "INBOX", path, nil); err != nil {
+		t.Fatalf("Import() failed: %v", err)
+	}
+	checkCopy(t, dest)
+}
+
+func TestMaildirRoundTrip(t *testing.T) {
+	src := newSource(t)
+	account := &config.Account{ID: "source"}
+	path := filepath.Join(t.TempDir(), "backup")
+	if err := Export(src, account, "INBOX", FormatMaildir, path, nil); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+
+	dest, err := openMaildir(filepath.Join(t.TempDir(), "dest"), true)
+	if err != nil {
+		t.Fatalf("openMaildir() failed: %v", err)
+	}
+	if err := Import(dest, account, "INBOX", path, nil); err != nil {
+		t.Fatalf("Import() failed: %v", err)
+	}
+	checkCopy(t, dest)
+}
+
+// failingSource fails to fetch messages once it has fetched a number of
+// them, as if interrupted.
+type failingSource struct {
+	maildir
+	left int
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (s *failingSource) FetchRaw(mailbox string, uid uint32, w io.Writer) error {
+	if s.left == 0 {
+		// Half a message is written, as a cut connection would.
+		w.Write([]byte("From: cut"))
+		return errInterrupted
+	}
+	s.left--
+	return s.maildir.FetchRaw(mailbox, uid, w)
+}
+
+func TestExportResumes(t *testing.T) {
+	src := newSource(t)
+	account := &config.Account{ID: "source"}
+	path := filepath.Join(t.TempDir(), "backup.mbox")
+
+	if err := Export(&failingSource{src, 1}, account, "INBOX", FormatMbox, path, nil); !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected the export to be interrupted, got %v", err)
+	}
+	var reported []int
+	progress := func(done, total int) { reported = append(reported, done) }
+	if err := Export(src, account, "INBOX", FormatMbox, path, progress); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	if len(reported) != 2 || reported[0] != 1 {
+		t.Errorf("expected the export to carry on from the second message, got %v", reported)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := newMboxReader(f)
+	var subjects []string
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() failed: %v", err)
+		}
+		for _, line := range strings.Split(string(msg.Raw), "\n") {
+			if strings.HasPrefix(line, "Subject: ") {
+				subjects = append(subjects, strings.TrimPrefix(line, "Subject: "))
+			}
+		}
+	}
+	if strings.Join(subjects, ",") != "Lunch,Report" {
+		t.Errorf("expected each message once, got %v", subjects)
+	}
+}
+
+// failingDest fails to store messages once it has stored a number of them.
+type failingDest struct {
+	maildir
+	left int
+}
+
+func (d *failingDest) Append(mailbox string, flags []string, date time.Time, raw []byte) error {
+	if d.left == 0 {
+		return errInterrupted
+	}
+	d.left--
+	return d.maildir.Append(mailbox, flags, date, raw)
+}
+
+func TestImportResumes(t *testing.T) {
+	src := newSource(t)
+	account := &config.Account{ID: "dest"}
+	path := filepath.Join(t.TempDir(), "backup.mbox")
+	if err := Export(src, account, "INBOX", FormatMbox, path, nil); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+
+	dest, err := openMaildir(filepath.Join(t.TempDir(), "dest"), true)
+	if err != nil {
+		t.Fatalf("openMaildir() failed: %v", err)
+	}
+	if err := Import(&failingDest{dest, 1}, account, "INBOX", path, nil); !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected the import to be interrupted, got %v", err)
+	}
+	if err := Import(dest, account, "INBOX", path, nil); err != nil {
+		t.Fatalf("Import() failed: %v", err)
+	}
+	checkCopy(t, dest)
+}
+
+func TestExportKeepsExistingMbox(t *testing.T) {
+	src := newSource(t)
+	account := &config.Account{ID: "source"}
+	path := filepath.Join(t.TempDir(), "backup.mbox")
+	const earlier = "From MAILER-DAEMON Thu Mar  4 10:00:00 2021\nSubject: Old\n\nKeep me.\n"
+	if err := os.WriteFile(path, []byte(earlier), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Export(src, account, "INBOX", FormatMbox, path, nil); err == nil {
+		t.Fatal("expected the export to refuse to write over an existing mbox")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != earlier {
+		t.Errorf("expected the existing mbox left as it was, got %q", data)
+	}
+}
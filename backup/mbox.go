@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// The mbox files are mboxrd: each message starts with a From_ line, lines
+// of the message that start with From, after any number of '>', are quoted
+// with one more '>', and a blank line follows each message. Flags are kept
+// in the Status and X-Status headers, as mutt and Thunderbird read them.
+
+// mboxStatus maps the letters of the Status and X-Status headers to flags.
+var mboxStatus = map[byte]string{
+	'R': imap.SeenFlag,
+	'A': imap.AnsweredFlag,
+	'F': imap.FlaggedFlag,
+	'T': imap.DraftFlag,
+	'D': imap.DeletedFlag,
+}
+
+// mboxMessage is a message read from an mbox file.
+type mboxMessage struct {
+	Date  time.Time // Zero if the message has none
+	Flags []string
+	Raw   []byte // With LF line endings
+}
+
+// writeMbox appends a message to an mbox file, converting it to LF line
+// endings.
+func writeMbox(w io.Writer, date time.Time, flags []string, raw []byte) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var buf bytes.Buffer
+	buf.WriteString("From MAILER-DAEMON " + date.UTC().Format(time.ANSIC) + "\n")
+
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	header, body := raw, []byte(nil)
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		header, body = raw[:i+1], raw[i+2:]
+	} else if len(header) > 0 && header[len(header)-1] != '\n' {
+		header = append(header, '\n')
+	}
+	for _, line := range splitLines(header) {
+		if isStatusHeader(line) {
+			continue
+		}
+		buf.WriteString(escapeFrom(line))
+	}
+	status, xStatus := "O", ""
+	for _, flag := range flags {
+		for letter, f := range mboxStatus {
+			if strings.EqualFold(flag, f) {
+				if letter == 'R' {
+					status = "RO"
+				} else {
+					xStatus += string(letter)
+				}
+			}
+		}
+	}
+	buf.WriteString("Status: " + status + "\n")
+	if xStatus != "" {
+		buf.WriteString("X-Status: " + sortLetters(xStatus) + "\n")
+	}
+	buf.WriteString("\n")
+	for _, line := range splitLines(body) {
+		buf.WriteString(escapeFrom(line))
+	}
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// splitLines splits text after each LF, keeping them.
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func isStatusHeader(line string) bool {
+	name, _, ok := strings.Cut(line, ":")
+	return ok && (strings.EqualFold(name, "Status") || strings.EqualFold(name, "X-Status"))
+}
+
+// escapeFrom quotes a line that would be taken for a From_ line, or for a
+// quoted one.
+func escapeFrom(line string) string {
+	if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+		return ">" + line
+	}
+	return line
+}
+
+func sortLetters(s string) string {
+	var sorted []byte
+	for _, letter := range "ADFT" {
+		if strings.ContainsRune(s, letter) {
+			sorted = append(sorted, byte(letter))
+		}
+	}
+	return string(sorted)
+}
+
+// mboxReader reads the messages of an mbox file one at a time.
+type mboxReader struct {
+	r    *bufio.Reader
+	from string // The From_ line of the next message
+}
+
+func newMboxReader(r io.Reader) *mboxReader {
+	return &mboxReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next message, or io.EOF after the last one.
+func (m *mboxReader) Next() (*mboxMessage, error) {
+	for m.from == "" {
+		line, err := m.r.ReadString('\n')
+		if strings.HasPrefix(line, "From ") {
+			m.from = line
+		} else if err != nil {
+			// Anything before the first From_ line isn't a message.
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+	}
+
+	from := m.from
+	m.from = ""
+	var lines []string
+	for {
+		line, err := m.r.ReadString('\n')
+		if strings.HasPrefix(line, "From ") {
+			m.from = line
+			break
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The blank line before the next message is part of the separator.
+	if n := len(lines); n > 0 && strings.TrimRight(lines[n-1], "\r\n") == "" {
+		lines = lines[:n-1]
+	}
+
+	msg := &mboxMessage{}
+	var raw strings.Builder
+	var status, xStatus string
+	inHeader := true
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\n"
+		if inHeader {
+			if line == "\n" {
+				inHeader = false
+			} else if isStatusHeader(line) {
+				name, value, _ := strings.Cut(line, ":")
+				if strings.EqualFold(name, "Status") {
+					status = strings.TrimSpace(value)
+				} else {
+					xStatus = strings.TrimSpace(value)
+				}
+				continue
+			}
+		}
+		raw.WriteString(line)
+	}
+	msg.Raw = []byte(raw.String())
+
+	for _, letters := range []string{status, xStatus} {
+		for i := 0; i < len(letters); i++ {
+			if flag, ok := mboxStatus[letters[i]]; ok && !hasFlag(msg.Flags, flag) {
+				msg.Flags = append(msg.Flags, flag)
+			}
+		}
+	}
+
+	// The From_ line is "From sender date"; the date is when the message
+	// arrived, which the Date header only approximates.
+	if fields := strings.Fields(from); len(fields) >= 3 {
+		date := strings.Join(fields[2:], " ")
+		if t, err := time.Parse(time.ANSIC, date); err == nil {
+			msg.Date = t
+		}
+	}
+	if msg.Date.IsZero() {
+		if parsed, err := mail.ReadMessage(bytes.NewReader(msg.Raw)); err == nil {
+			if t, err := parsed.Header.Date(); err == nil {
+				msg.Date = t
+			}
+		}
+	}
+	return msg, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
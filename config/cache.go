@@ -11,19 +11,40 @@ import (
 
 // CachedEmail stores essential email data for caching.
 type CachedEmail struct {
-	UID       uint32    `json:"uid"`
-	From      string    `json:"from"`
-	To        []string  `json:"to"`
-	Subject   string    `json:"subject"`
-	Date      time.Time `json:"date"`
-	MessageID string    `json:"message_id"`
-	AccountID string    `json:"account_id"`
+	UID         uint32    `json:"uid"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Subject     string    `json:"subject"`
+	Date        time.Time `json:"date"`
+	MessageID   string    `json:"message_id"`
+	InReplyTo   string    `json:"in_reply_to,omitempty"`
+	References  []string  `json:"references,omitempty"`
+	ThreadID    string    `json:"thread_id,omitempty"`
+	Preview     string    `json:"preview,omitempty"`
+	AccountID   string    `json:"account_id"`
+	UIDValidity uint32    `json:"uid_validity,omitempty"`
+	Flags       []string  `json:"flags,omitempty"`
+}
+
+// MailboxState stores the sync state of a cached mailbox, so that a refresh
+// only asks the server for what changed since.
+type MailboxState struct {
+	UIDValidity   uint32 `json:"uid_validity"`
+	UIDNext       uint32 `json:"uid_next"`
+	Messages      uint32 `json:"messages"`
+	HighestModSeq uint64 `json:"highest_modseq,omitempty"`
 }
 
 // EmailCache stores cached emails for all accounts.
 type EmailCache struct {
-	Emails    []CachedEmail `json:"emails"`
-	UpdatedAt time.Time     `json:"updated_at"`
+	Emails    []CachedEmail           `json:"emails"`
+	Mailboxes map[string]MailboxState `json:"mailboxes,omitempty"` // Keyed by MailboxKey
+	UpdatedAt time.Time               `json:"updated_at"`
+}
+
+// MailboxKey identifies an account's mailbox in EmailCache.Mailboxes.
+func MailboxKey(accountID, mailbox string) string {
+	return accountID + "/" + mailbox
 }
 
 // cacheFile returns the full path to the email cache file.
@@ -2,8 +2,11 @@ package config
 
 import (
 	"encoding/json"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -15,8 +18,33 @@ type Account struct {
 	Email           string `json:"email"`
 	Password        string `json:"password"`
 	ServiceProvider string `json:"service_provider"` // "gmail", "icloud", or "custom"
-	// FetchEmail is the single email address for which messages should be fetched.
-	// If empty, it will default to `Email` when accounts are added.
+	// Backend is where the account's mail is read from: BackendIMAP, the
+	// default when empty, BackendMaildir, BackendJMAP or BackendPOP3.
+	Backend string `json:"backend,omitempty"`
+	// MaildirPath is the root of the account's Maildir++ tree, for
+	// BackendMaildir. A leading ~ stands for the home directory.
+	MaildirPath string `json:"maildir_path,omitempty"`
+	// JMAPURL is the JMAP session URL, or the server's address whose
+	// /.well-known/jmap is the session, for BackendJMAP.
+	JMAPURL string `json:"jmap_url,omitempty"`
+	// POP3Server, POP3Port and POP3Security are the POP3 server of
+	// BackendPOP3 when ServiceProvider is "custom", like the IMAP settings.
+	POP3Server   string `json:"pop3_server,omitempty"`
+	POP3Port     int    `json:"pop3_port,omitempty"`
+	POP3Security string `json:"pop3_security,omitempty"`
+	// POP3Delete deletes messages from the POP3 server once they are
+	// downloaded. Otherwise they are left there.
+	POP3Delete bool `json:"pop3_delete,omitempty"`
+	// Addresses are the addresses whose mail is shown: mail to one of
+	// them, or from one in the Sent folder. A "*" matches any text, e.g.
+	// "*@example.com" for a catch-all domain or "me+*@example.com" for
+	// sub-addresses. Empty means Email.
+	Addresses []string `json:"addresses,omitempty"`
+	// AllMail shows every message, whoever it was sent to, e.g. mailing
+	// list mail and mail received as a Bcc.
+	AllMail bool `json:"all_mail,omitempty"`
+	// FetchEmail is the single address of configs from before Addresses.
+	// LoadConfig moves it into Addresses.
 	FetchEmail string `json:"fetch_email,omitempty"`
 
 	// Custom server settings (used when ServiceProvider is "custom")
@@ -24,11 +52,130 @@ type Account struct {
 	IMAPPort   int    `json:"imap_port,omitempty"`
 	SMTPServer string `json:"smtp_server,omitempty"`
 	SMTPPort   int    `json:"smtp_port,omitempty"`
+	// Connection security for custom servers: SecurityTLS, SecuritySTARTTLS
+	// or SecurityNone. Empty means the usual one for the port.
+	IMAPSecurity string `json:"imap_security,omitempty"`
+	SMTPSecurity string `json:"smtp_security,omitempty"`
+	// CAFile is a PEM file of CAs to trust instead of the system's, e.g. for
+	// a self-hosted server with its own CA.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFingerprints are SHA-256 fingerprints of server certificates
+	// trusted whatever signed them, e.g. a local mail bridge's self-signed one.
+	CertFingerprints []string `json:"cert_fingerprints,omitempty"`
+
+	// AuthMethod is AuthPassword, AuthOAuth2 or, for JMAP, AuthToken.
+	// Empty means AuthPassword.
+	AuthMethod string `json:"auth_method,omitempty"`
+	// OAuth2 holds the client and the refresh token of accounts that sign
+	// in with AuthOAuth2.
+	OAuth2 *OAuth2 `json:"oauth2,omitempty"`
+
+	// PollInterval is the number of seconds between checks for new mail on
+	// servers that do not support IMAP IDLE. Zero means the default.
+	PollInterval int `json:"poll_interval,omitempty"`
+
+	// Special folders, overriding the ones discovered on the server.
+	SentFolder    string `json:"sent_folder,omitempty"`
+	ArchiveFolder string `json:"archive_folder,omitempty"`
+	TrashFolder   string `json:"trash_folder,omitempty"`
+	DraftsFolder  string `json:"drafts_folder,omitempty"`
+	JunkFolder    string `json:"junk_folder,omitempty"`
+}
+
+// Mail backends of Backend.
+const (
+	BackendIMAP    = "imap"    // Read from the IMAP server
+	BackendMaildir = "maildir" // Read from a local Maildir, e.g. kept in sync by mbsync
+	BackendJMAP    = "jmap"    // Read from and sent through a JMAP server
+	BackendPOP3    = "pop3"    // Downloaded from a POP3 server into the data directory
+)
+
+// GetBackend returns where the account's mail is read from.
+func (a *Account) GetBackend() string {
+	if a.Backend == "" {
+		return BackendIMAP
+	}
+	return a.Backend
+}
+
+// GetMaildirPath returns the root of the account's Maildir, with a leading ~
+// expanded.
+func (a *Account) GetMaildirPath() string {
+	path := a.MaildirPath
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// Authentication methods of AuthMethod.
+const (
+	AuthPassword = "password" // LOGIN and SMTP AUTH PLAIN with Password
+	AuthOAuth2   = "oauth2"   // XOAUTH2 or OAUTHBEARER with an OAuth2 access token
+	AuthToken    = "token"    // A JMAP API token in Password, sent as a bearer token
+)
+
+// OAuth2 configures how an account gets OAuth2 access tokens. The endpoints
+// default to the provider's, and only need to be set for custom providers.
+type OAuth2 struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// AuthURL is where the user approves access in a browser, which then
+	// redirects to a local port.
+	AuthURL string `json:"auth_url,omitempty"`
+	// DeviceAuthURL, if set, is used instead of AuthURL to sign in with a
+	// code entered on another device (RFC 8628).
+	DeviceAuthURL string   `json:"device_auth_url,omitempty"`
+	TokenURL      string   `json:"token_url,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+	// RefreshToken is stored after signing in and used to get access tokens.
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// UsesOAuth2 reports whether the account signs in with OAuth2.
+func (a *Account) UsesOAuth2() bool {
+	return a.AuthMethod == AuthOAuth2
 }
 
 // Config stores the user's email configuration with multiple accounts.
 type Config struct {
-	Accounts []Account `json:"accounts"`
+	Accounts     []Account `json:"accounts"`
+	CompactInbox bool      `json:"compact_inbox,omitempty"` // One-line rows, without previews
+}
+
+// FetchAddresses returns the addresses, or patterns of addresses, whose mail
+// the account shows, or nil if it shows all mail.
+func (a *Account) FetchAddresses() []string {
+	switch {
+	case a.AllMail:
+		return nil
+	case len(a.Addresses) > 0:
+		return a.Addresses
+	case a.Email != "":
+		return []string{a.Email}
+	}
+	return nil
+}
+
+// ParseAddresses splits a comma-separated list of addresses as typed in,
+// where "*" on its own stands for all mail.
+func ParseAddresses(s string) (addresses []string, allMail bool) {
+	for _, address := range strings.Split(s, ",") {
+		address = strings.TrimSpace(address)
+		switch address {
+		case "":
+		case "*":
+			allMail = true
+		default:
+			addresses = append(addresses, address)
+		}
+	}
+	if allMail {
+		return nil, true
+	}
+	return addresses, false
 }
 
 // GetIMAPServer returns the IMAP server address for the account.
@@ -54,12 +201,73 @@ func (a *Account) GetIMAPPort() int {
 		if a.IMAPPort != 0 {
 			return a.IMAPPort
 		}
+		if a.IMAPSecurity == SecuritySTARTTLS || a.IMAPSecurity == SecurityNone {
+			return 143
+		}
 		return 993 // Default IMAP SSL port
 	default:
 		return 993
 	}
 }
 
+// GetPOP3Server returns the POP3 server address for the account.
+func (a *Account) GetPOP3Server() string {
+	switch a.ServiceProvider {
+	case "gmail":
+		return "pop.gmail.com"
+	case "custom":
+		return a.POP3Server
+	default:
+		return ""
+	}
+}
+
+// GetPOP3Port returns the POP3 port for the account.
+func (a *Account) GetPOP3Port() int {
+	if a.ServiceProvider == "custom" {
+		if a.POP3Port != 0 {
+			return a.POP3Port
+		}
+		if a.POP3Security == SecuritySTARTTLS || a.POP3Security == SecurityNone {
+			return 110
+		}
+	}
+	return 995 // Default POP3 SSL port
+}
+
+// GetPOP3Security returns how the account's POP3 connection is secured.
+func (a *Account) GetPOP3Security() string {
+	if a.ServiceProvider == "custom" {
+		if a.POP3Security != "" {
+			return a.POP3Security
+		}
+		if a.POP3Port == 110 {
+			return SecuritySTARTTLS
+		}
+	}
+	return SecurityTLS
+}
+
+// Connection security modes of IMAPSecurity, SMTPSecurity and POP3Security.
+const (
+	SecurityTLS      = "tls"      // TLS from the start
+	SecuritySTARTTLS = "starttls" // Plaintext upgraded with STARTTLS, which the server must offer
+	SecurityNone     = "none"     // Plaintext, only allowed to localhost
+)
+
+// GetIMAPSecurity returns how the account's IMAP connection is secured.
+func (a *Account) GetIMAPSecurity() string {
+	if a.ServiceProvider == "custom" {
+		if a.IMAPSecurity != "" {
+			return a.IMAPSecurity
+		}
+		if a.IMAPPort == 143 {
+			return SecuritySTARTTLS
+		}
+	}
+	return SecurityTLS
+}
+
 // GetSMTPServer returns the SMTP server address for the account.
 func (a *Account) GetSMTPServer() string {
 	switch a.ServiceProvider {
@@ -83,12 +291,49 @@ func (a *Account) GetSMTPPort() int {
 		if a.SMTPPort != 0 {
 			return a.SMTPPort
 		}
+		if a.SMTPSecurity == SecurityTLS {
+			return 465
+		}
 		return 587 // Default SMTP TLS port
 	default:
 		return 587
 	}
 }
 
+// GetSMTPSecurity returns how the account's SMTP connection is secured.
+func (a *Account) GetSMTPSecurity() string {
+	if a.ServiceProvider == "custom" {
+		if a.SMTPSecurity != "" {
+			return a.SMTPSecurity
+		}
+		if a.SMTPPort == 465 {
+			return SecurityTLS
+		}
+	}
+	return SecuritySTARTTLS
+}
+
+// IsLocalhost reports whether host is this machine, the only host that
+// SecurityNone may be used with.
+func IsLocalhost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// DefaultPollInterval is used when an account does not set PollInterval.
+const DefaultPollInterval = 2 * time.Minute
+
+// GetPollInterval returns how often to poll for new mail when IDLE is unavailable.
+func (a *Account) GetPollInterval() time.Duration {
+	if a.PollInterval > 0 {
+		return time.Duration(a.PollInterval) * time.Second
+	}
+	return DefaultPollInterval
+}
+
 // configDir returns the path to the configuration directory.
 func configDir() (string, error) {
 	home, err := os.UserHomeDir()
@@ -98,6 +343,12 @@ func configDir() (string, error) {
 	return filepath.Join(home, ".config", "matcha"), nil
 }
 
+// DataDir returns the directory matcha keeps its own data in, such as the
+// email cache.
+func DataDir() (string, error) {
+	return configDir()
+}
+
 // configFile returns the full path to the configuration file.
 func configFile() (string, error) {
 	dir, err := configDir()
@@ -147,8 +398,6 @@ func LoadConfig() (*Config, error) {
 						Email:           legacyConfig.Email,
 						Password:        legacyConfig.Password,
 						ServiceProvider: legacyConfig.ServiceProvider,
-						// Default FetchEmail to the legacy Email value
-						FetchEmail: legacyConfig.Email,
 					},
 				},
 			}
@@ -160,9 +409,20 @@ func LoadConfig() (*Config, error) {
 		}
 		return nil, err
 	}
+	for i := range config.Accounts {
+		config.Accounts[i].migrateFetchEmail()
+	}
 	return &config, nil
 }
 
+// migrateFetchEmail moves the FetchEmail of an older config into Addresses.
+func (a *Account) migrateFetchEmail() {
+	if a.FetchEmail != "" && len(a.Addresses) == 0 {
+		a.Addresses = []string{a.FetchEmail}
+	}
+	a.FetchEmail = ""
+}
+
 // legacyConfigFormat represents the old single-account configuration format.
 type legacyConfigFormat struct {
 	ServiceProvider string `json:"service_provider"`
@@ -176,10 +436,6 @@ func (c *Config) AddAccount(account Account) {
 	if account.ID == "" {
 		account.ID = uuid.New().String()
 	}
-	// Ensure FetchEmail defaults to the login Email if not explicitly set.
-	if account.FetchEmail == "" && account.Email != "" {
-		account.FetchEmail = account.Email
-	}
 	c.Accounts = append(c.Accounts, account)
 }
 
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // TestSaveAndLoadConfig verifies that the config can be saved to and loaded from a file correctly.
@@ -238,3 +240,136 @@ func TestAccountGetPorts(t *testing.T) {
 		t.Errorf("Expected default SMTP port 587 for custom with no port, got %d", customDefaultAccount.GetSMTPPort())
 	}
 }
+
+// TestAccountGetPollInterval tests the poll interval default and override.
+func TestAccountGetPollInterval(t *testing.T) {
+	account := Account{}
+	if got := account.GetPollInterval(); got != DefaultPollInterval {
+		t.Errorf("Expected default poll interval %v, got %v", DefaultPollInterval, got)
+	}
+
+	account.PollInterval = 30
+	if got := account.GetPollInterval(); got != 30*time.Second {
+		t.Errorf("Expected poll interval 30s, got %v", got)
+	}
+}
+
+// TestAccountGetSecurity tests the connection security defaults and overrides.
+func TestAccountGetSecurity(t *testing.T) {
+	gmailAccount := Account{ServiceProvider: "gmail", IMAPSecurity: SecurityNone}
+	if got := gmailAccount.GetIMAPSecurity(); got != SecurityTLS {
+		t.Errorf("Expected Gmail IMAP security %q, got %q", SecurityTLS, got)
+	}
+	if got := gmailAccount.GetSMTPSecurity(); got != SecuritySTARTTLS {
+		t.Errorf("Expected Gmail SMTP security %q, got %q", SecuritySTARTTLS, got)
+	}
+
+	// Without a setting, the security follows the port.
+	customAccount := Account{ServiceProvider: "custom", IMAPPort: 143, SMTPPort: 465}
+	if got := customAccount.GetIMAPSecurity(); got != SecuritySTARTTLS {
+		t.Errorf("Expected IMAP security %q on port 143, got %q", SecuritySTARTTLS, got)
+	}
+	if got := customAccount.GetSMTPSecurity(); got != SecurityTLS {
+		t.Errorf("Expected SMTP security %q on port 465, got %q", SecurityTLS, got)
+	}
+
+	// Without a port, the port follows the security.
+	localAccount := Account{ServiceProvider: "custom", IMAPSecurity: SecurityNone, SMTPSecurity: SecurityTLS}
+	if got := localAccount.GetIMAPPort(); got != 143 {
+		t.Errorf("Expected IMAP port 143 without TLS, got %d", got)
+	}
+	if got := localAccount.GetSMTPPort(); got != 465 {
+		t.Errorf("Expected SMTP port 465 with TLS, got %d", got)
+	}
+}
+
+// TestAccountGetPOP3 tests the POP3 server, port and security of accounts.
+func TestAccountGetPOP3(t *testing.T) {
+	gmailAccount := Account{ServiceProvider: "gmail", POP3Server: "pop.example.com"}
+	if got := gmailAccount.GetPOP3Server(); got != "pop.gmail.com" {
+		t.Errorf("Expected Gmail POP3 server pop.gmail.com, got %q", got)
+	}
+	if got := gmailAccount.GetPOP3Port(); got != 995 {
+		t.Errorf("Expected Gmail POP3 port 995, got %d", got)
+	}
+
+	customAccount := Account{ServiceProvider: "custom", POP3Server: "pop.example.com", POP3Port: 110}
+	if got := customAccount.GetPOP3Server(); got != "pop.example.com" {
+		t.Errorf("Expected custom POP3 server, got %q", got)
+	}
+	if got := customAccount.GetPOP3Security(); got != SecuritySTARTTLS {
+		t.Errorf("Expected POP3 security %q on port 110, got %q", SecuritySTARTTLS, got)
+	}
+
+	localAccount := Account{ServiceProvider: "custom", POP3Security: SecurityNone}
+	if got := localAccount.GetPOP3Port(); got != 110 {
+		t.Errorf("Expected POP3 port 110 without TLS, got %d", got)
+	}
+}
+
+// TestIsLocalhost tests which hosts plaintext connections are allowed to.
+func TestIsLocalhost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"localhost":        true,
+		"127.0.0.1":        true,
+		"::1":              true,
+		"imap.example.com": false,
+		"192.168.1.10":     false,
+		"localhost.evil":   false,
+	} {
+		if got := IsLocalhost(host); got != want {
+			t.Errorf("IsLocalhost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+// TestAccountGetMaildirPath tests that a leading ~ is expanded.
+func TestAccountGetMaildirPath(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+
+	account := Account{MaildirPath: "~/Mail/work"}
+	if got := account.GetMaildirPath(); got != filepath.Join("/home/me", "Mail", "work") {
+		t.Errorf("Expected ~ to be expanded, got %q", got)
+	}
+
+	account.MaildirPath = "/var/mail/me"
+	if got := account.GetMaildirPath(); got != "/var/mail/me" {
+		t.Errorf("Expected an absolute path to be kept, got %q", got)
+	}
+}
+
+// TestLoadConfigMovesFetchEmail checks that the single address of older
+// configs becomes the account's addresses.
+func TestLoadConfigMovesFetchEmail(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	if err := SaveConfig(&Config{Accounts: []Account{{ID: "a", Email: "login", FetchEmail: "me@example.com"}}}); err != nil {
+		t.Fatalf("SaveConfig() failed: %v", err)
+	}
+	loaded, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() failed: %v", err)
+	}
+	account := loaded.Accounts[0]
+	if got := account.FetchAddresses(); !reflect.DeepEqual(got, []string{"me@example.com"}) || account.FetchEmail != "" {
+		t.Errorf("expected FetchEmail moved into Addresses, got %+v", account)
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	addresses, allMail := ParseAddresses(" me@example.com, *@example.org ,, ")
+	if !reflect.DeepEqual(addresses, []string{"me@example.com", "*@example.org"}) || allMail {
+		t.Errorf("expected two addresses, got %v and all mail %v", addresses, allMail)
+	}
+	if addresses, allMail := ParseAddresses("me@example.com, *"); addresses != nil || !allMail {
+		t.Errorf("expected all mail, got %v and %v", addresses, allMail)
+	}
+
+	account := Account{Email: "me@example.com"}
+	if got := account.FetchAddresses(); !reflect.DeepEqual(got, []string{"me@example.com"}) {
+		t.Errorf("expected the account's email without addresses, got %v", got)
+	}
+	account.AllMail = true
+	if got := account.FetchAddresses(); got != nil {
+		t.Errorf("expected no addresses with all mail shown, got %v", got)
+	}
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TLSConfig returns the TLS settings for connecting to host for the account.
+// Certificates are verified against the system's CAs, or those in CAFile,
+// unless their fingerprint is in CertFingerprints. A certificate that fails
+// verification is reported as a *CertificateError.
+func (a *Account) TLSConfig(host string) (*tls.Config, error) {
+	var roots *x509.CertPool
+	if a.CAFile != "" {
+		path := a.CAFile
+		if strings.HasPrefix(path, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, path[2:])
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA file: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in the CA file %s", a.CAFile)
+		}
+	}
+
+	pins := make(map[string]bool, len(a.CertFingerprints))
+	for _, pin := range a.CertFingerprints {
+		pins[normalizeFingerprint(pin)] = true
+	}
+
+	return &tls.Config{
+		ServerName: host,
+		// Verified in VerifyConnection instead, which also sees the
+		// certificates that fail, so that they can be shown to the user.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyCertificate(cs, host, roots, pins)
+		},
+	}, nil
+}
+
+func verifyCertificate(cs tls.ConnectionState, host string, roots *x509.CertPool, pins map[string]bool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%s sent no certificate", host)
+	}
+	leaf := cs.PeerCertificates[0]
+	if pins[normalizeFingerprint(CertFingerprint(leaf))] {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return &CertificateError{Host: host, Cert: leaf, Err: err}
+	}
+	return nil
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate, as
+// colon-separated hex like OpenSSL prints it.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// normalizeFingerprint makes fingerprints comparable however they are
+// written: with or without colons and a "SHA256:" prefix, in any case.
+func normalizeFingerprint(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "sha256:")
+	s = strings.NewReplacer(":", "", " ", "").Replace(s)
+	if _, err := hex.DecodeString(s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// CertificateError is returned when a server's certificate can't be
+// verified. Trusting it means adding its fingerprint to CertFingerprints.
+type CertificateError struct {
+	Host string
+	Cert *x509.Certificate
+	Err  error
+}
+
+func (e *CertificateError) Error() string {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(e.Err, &unknown):
+		if e.Cert.Issuer.String() == e.Cert.Subject.String() {
+			return fmt.Sprintf("the certificate of %s is self-signed", e.Host)
+		}
+		return fmt.Sprintf("the certificate of %s is signed by %q, which is not a trusted authority", e.Host, e.Cert.Issuer.CommonName)
+	case errors.As(e.Err, &hostname):
+		names := e.Cert.DNSNames
+		if len(names) == 0 {
+			names = []string{e.Cert.Subject.CommonName}
+		}
+		return fmt.Sprintf("the certificate of %s is for %s instead", e.Host, strings.Join(names, ", "))
+	case errors.As(e.Err, &invalid) && invalid.Reason == x509.Expired:
+		return fmt.Sprintf("the certificate of %s is only valid from %s to %s", e.Host,
+			e.Cert.NotBefore.Format("Jan 2 2006"), e.Cert.NotAfter.Format("Jan 2 2006"))
+	default:
+		return fmt.Sprintf("the certificate of %s could not be verified: %v", e.Host, e.Err)
+	}
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate.
+func (e *CertificateError) Fingerprint() string {
+	return CertFingerprint(e.Cert)
+}
+
+// explainedError replaces the message of a TLS error with an explanation.
+type explainedError struct {
+	msg string
+	err error
+}
+
+func (e *explainedError) Error() string { return e.msg }
+func (e *explainedError) Unwrap() error { return e.err }
+
+// ExplainTLSError returns err with a readable explanation if it comes from
+// a TLS handshake with host, and err itself otherwise.
+func ExplainTLSError(host string, err error) error {
+	var certErr *CertificateError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case err == nil, errors.As(err, &certErr):
+		return err
+	case errors.As(err, &recordErr):
+		return &explainedError{fmt.Sprintf("%s did not answer with TLS; the port may expect STARTTLS or no encryption, see the security setting", host), err}
+	case errors.As(err, &alertErr):
+		return &explainedError{fmt.Sprintf("%s refused the TLS handshake (%v); it may not support this TLS version or need a client certificate", host, err), err}
+	case strings.Contains(err.Error(), "tls: "):
+		return &explainedError{fmt.Sprintf("the TLS handshake with %s failed: %s", host, strings.TrimPrefix(err.Error(), "tls: ")), err}
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSelfSignedServer starts a TLS server on localhost with a self-signed
+// certificate for 127.0.0.1 and returns its address and certificate.
+func newSelfSignedServer(t *testing.T) (string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Mail Bridge"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), cert
+}
+
+func TestTLSConfigSelfSigned(t *testing.T) {
+	addr, cert := newSelfSignedServer(t)
+	dial := func(account *Account) error {
+		tlsConfig, err := account.TLSConfig("127.0.0.1")
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	var certErr *CertificateError
+	if err := dial(&Account{}); !errors.As(err, &certErr) {
+		t.Fatalf("expected a CertificateError, got %v", err)
+	}
+	if !strings.Contains(certErr.Error(), "self-signed") {
+		t.Errorf("expected a readable explanation, got %q", certErr.Error())
+	}
+	if certErr.Fingerprint() != CertFingerprint(cert) {
+		t.Errorf("expected the server's certificate in the error")
+	}
+
+	// Pins match however the fingerprint is written.
+	pin := "sha256:" + strings.ToLower(strings.ReplaceAll(CertFingerprint(cert), ":", ""))
+	if err := dial(&Account{CertFingerprints: []string{pin}}); err != nil {
+		t.Errorf("expected the pinned certificate to be trusted, got %v", err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(&Account{CAFile: caFile}); err != nil {
+		t.Errorf("expected the certificate to be trusted through the CA file, got %v", err)
+	}
+}
+
+func TestExplainTLSError(t *testing.T) {
+	// A plaintext server answering a TLS handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+		conn.Close()
+	}()
+
+	_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "127.0.0.1"})
+	explained := ExplainTLSError("127.0.0.1", err)
+	if !strings.Contains(explained.Error(), "did not answer with TLS") {
+		t.Errorf("expected an explanation, got %q", explained)
+	}
+	if !errors.Is(explained, err) {
+		t.Error("expected the original error to be wrapped")
+	}
+
+	plain := errors.New("connection refused")
+	if ExplainTLSError("127.0.0.1", plain) != plain {
+		t.Error("expected other errors to be left alone")
+	}
+}
@@ -0,0 +1,91 @@
+package fetcher
+
+import (
+	"path"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/floatpane/matcha/config"
+)
+
+// addressCriteria matches the messages of a mailbox that the account shows,
+// those to one of its addresses, or from one in the Sent folder, or is nil
+// if it shows all mail. A server's search matches substrings, so patterns
+// are searched by their longest run of text and may match more than they
+// should; matchesAddresses tells the messages that really match.
+func addressCriteria(account *config.Account, sent bool) *imap.SearchCriteria {
+	headers := []string{"To", "Cc", "Bcc"}
+	if sent {
+		headers = []string{"From"}
+	}
+	var criteria []*imap.SearchCriteria
+	for _, address := range account.FetchAddresses() {
+		text := patternText(address)
+		if text == "" {
+			// A pattern such as "*" matches every message.
+			return nil
+		}
+		for _, header := range headers {
+			c := imap.NewSearchCriteria()
+			c.Header.Add(header, text)
+			criteria = append(criteria, c)
+		}
+	}
+	return anyOf(criteria)
+}
+
+// patternText returns the longest run of text without wildcards of an
+// address pattern.
+func patternText(pattern string) string {
+	var longest string
+	for _, text := range strings.Split(strings.TrimSpace(pattern), "*") {
+		if len(text) > len(longest) {
+			longest = text
+		}
+	}
+	return longest
+}
+
+// restrictCriteria matches the messages that match both criteria and
+// filter, which addressCriteria made. Either may be nil, matching all.
+func restrictCriteria(criteria, filter *imap.SearchCriteria) *imap.SearchCriteria {
+	if filter == nil {
+		return criteria
+	}
+	if criteria == nil {
+		return filter
+	}
+	// Keys of a search must all match, and filter only has headers and ORs.
+	c := *criteria
+	c.Header = make(map[string][]string, len(criteria.Header)+len(filter.Header))
+	for _, h := range []*imap.SearchCriteria{criteria, filter} {
+		for key, values := range h.Header {
+			c.Header[key] = append(c.Header[key], values...)
+		}
+	}
+	c.Or = append(append([][2]*imap.SearchCriteria(nil), criteria.Or...), filter.Or...)
+	return &c
+}
+
+// matchesAddresses reports whether the account shows a message with the
+// given envelope: one to one of its addresses, or from one in the Sent
+// folder.
+func matchesAddresses(account *config.Account, sent bool, envelope *imap.Envelope) bool {
+	patterns := account.FetchAddresses()
+	if patterns == nil {
+		return true
+	}
+	candidates := envelope.From
+	if !sent {
+		candidates = append(append(append([]*imap.Address(nil), envelope.To...), envelope.Cc...), envelope.Bcc...)
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		for _, addr := range candidates {
+			if ok, _ := path.Match(pattern, strings.ToLower(addr.Address())); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/floatpane/matcha/config"
+)
+
+func TestFetchMailboxPageFiltersOnServer(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+	account.Addresses = []string{"contact@example.org", "alias@example.org", "*@catchall.example", "me+*@example.com"}
+
+	for _, msg := range []struct{ header, subject string }{
+		{"To: other@example.net", "noise"},
+		{"Cc: me+lists@example.com", "list"},
+		{"To: other@example.net", "noise"},
+		{"To: other@example.net\r\nBcc: alias@example.org", "bcc"},
+		{"To: someone@catchall.example", "catch-all"},
+		// Found by the server's substring search, but not to the account.
+		{"To: xcontact@example.org", "lookalike"},
+		{"To: other@example.net", "noise"},
+	} {
+		raw := "From: alice@example.com\r\n" + msg.header + "\r\nSubject: " + msg.subject + "\r\n\r\nHello\r\n"
+		if err := AppendMessage(account, "INBOX", nil, time.Time{}, []byte(raw)); err != nil {
+			t.Fatalf("AppendMessage() failed: %v", err)
+		}
+	}
+
+	subjects := func(page Page) []string {
+		var s []string
+		for _, e := range page.Emails {
+			s = append(s, e.Subject)
+		}
+		return s
+	}
+	first, err := FetchMailboxPage(account, "INBOX", 3, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxPage() failed: %v", err)
+	}
+	if got := subjects(first); len(got) != 3 || got[0] != "catch-all" || got[1] != "bcc" || got[2] != "list" {
+		t.Fatalf("expected a full page of mail to the account's addresses, got %v", got)
+	}
+	second, err := FetchMailboxPage(account, "INBOX", 3, first.OldestUID, first.UIDValidity)
+	if err != nil {
+		t.Fatalf("FetchMailboxPage() failed: %v", err)
+	}
+	if got := subjects(second); len(got) != 1 || got[0] != "A little message, just for you" {
+		t.Fatalf("expected the oldest email on the next page, got %v", got)
+	}
+
+	account.AllMail = true
+	all, err := FetchMailboxPage(account, "INBOX", 20, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxPage() failed: %v", err)
+	}
+	if len(all.Emails) != 8 {
+		t.Errorf("expected every email with all mail shown, got %v", subjects(all))
+	}
+}
+
+func TestMatchesAddresses(t *testing.T) {
+	account := &config.Account{Email: "me@example.com", Addresses: []string{"Me@Example.com", "*@shop.example"}}
+	envelope := func(to, from string) *imap.Envelope {
+		return &imap.Envelope{
+			To:   []*imap.Address{{MailboxName: to, HostName: "example.com"}},
+			From: []*imap.Address{{MailboxName: from, HostName: "shop.example"}},
+		}
+	}
+
+	if !matchesAddresses(account, false, envelope("me", "orders")) {
+		t.Error("expected mail to an address to match, whatever its case")
+	}
+	if matchesAddresses(account, false, envelope("someme", "orders")) {
+		t.Error("expected mail to another address not to match")
+	}
+	if !matchesAddresses(account, true, envelope("someone", "orders")) {
+		t.Error("expected sent mail from a pattern to match")
+	}
+
+	if got := addressCriteria(account, false); got == nil || len(got.Or) != 1 {
+		t.Errorf("expected the addresses ORed together, got %+v", got)
+	}
+	account.Addresses = []string{"*"}
+	if got := addressCriteria(account, false); got != nil {
+		t.Errorf("expected no criteria for a pattern matching all mail, got %+v", got)
+	}
+}
@@ -0,0 +1,102 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/floatpane/matcha/config"
+)
+
+// MessageInfo is a message of a mailbox without its content, as needed to
+// copy it somewhere else.
+type MessageInfo struct {
+	UID   uint32
+	Flags []string
+	Date  time.Time // When the message arrived, its INTERNALDATE
+}
+
+// ListMessages lists every message of mailbox in UID order, whoever it was
+// sent to, and returns the mailbox's UIDVALIDITY.
+func ListMessages(account *config.Account, mailbox string) ([]MessageInfo, uint32, error) {
+	var infos []MessageInfo
+	var uidValidity uint32
+	err := pool.withMailboxRetry(account, mailbox, func(c *client.Client) error {
+		infos = nil
+		mbox := c.Mailbox()
+		uidValidity = mbox.UidValidity
+		if mbox.Messages == 0 {
+			return nil
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddRange(1, 0)
+		messages := make(chan *imap.Message, 64)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate}, messages)
+		}()
+		for msg := range messages {
+			infos = append(infos, MessageInfo{UID: msg.Uid, Flags: msg.Flags, Date: msg.InternalDate})
+		}
+		return <-done
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].UID < infos[j].UID })
+	return infos, uidValidity, nil
+}
+
+// FetchRawMessage writes the full message of an email to w, without marking
+// it as seen.
+func FetchRawMessage(account *config.Account, mailbox string, uid uint32, w io.Writer) error {
+	return fetchSection(account, mailbox, uid, &imap.BodySectionName{Peek: true}, w)
+}
+
+// FetchRawHeader writes the header of an email as it was received to w,
+// without the rest of the message.
+func FetchRawHeader(account *config.Account, mailbox string, uid uint32, w io.Writer) error {
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	return fetchSection(account, mailbox, uid, section, w)
+}
+
+// fetchSection writes a section of an email's message to w.
+func fetchSection(account *config.Account, mailbox string, uid uint32, section *imap.BodySectionName, w io.Writer) error {
+	return pool.withMailboxRetry(account, mailbox, func(c *client.Client) error {
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		messages := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
+		}()
+
+		var literal imap.Literal
+		for msg := range messages {
+			literal = msg.GetBody(section)
+		}
+		if err := <-done; err != nil {
+			return err
+		}
+		if literal == nil {
+			return fmt.Errorf("message %d not found in %s", uid, mailbox)
+		}
+		_, err := io.Copy(w, literal)
+		return err
+	})
+}
+
+// AppendMessage stores a message in mailbox with the given flags and date.
+// A zero date leaves it to the server. It isn't tried again if the
+// connection drops while the message is sent, as the server may have
+// stored it already.
+func AppendMessage(account *config.Account, mailbox string, flags []string, date time.Time, raw []byte) error {
+	return pool.withClient(account, func(c *client.Client) error {
+		return c.Append(mailbox, flags, date, bytes.NewBuffer(raw))
+	})
+}
@@ -0,0 +1,62 @@
+package fetcher
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestAppendListAndFetchRaw(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	date := time.Date(2020, 5, 17, 9, 30, 0, 0, time.UTC)
+	raw := "From: old@example.org\r\nSubject: From the backup\r\n\r\nKept for years\r\n"
+	if err := AppendMessage(account, "INBOX", []string{imap.FlaggedFlag}, date, []byte(raw)); err != nil {
+		t.Fatalf("AppendMessage() failed: %v", err)
+	}
+
+	infos, uidValidity, err := ListMessages(account, "INBOX")
+	if err != nil {
+		t.Fatalf("ListMessages() failed: %v", err)
+	}
+	// The memory server starts with one message of its own.
+	if len(infos) != 2 || uidValidity == 0 || infos[0].UID >= infos[1].UID {
+		t.Fatalf("expected both messages in UID order, got %+v", infos)
+	}
+	appended := infos[1]
+	if !appended.Date.Equal(date) {
+		t.Errorf("expected the appended date to be kept, got %v", appended.Date)
+	}
+	if !strings.Contains(strings.Join(appended.Flags, " "), imap.FlaggedFlag) {
+		t.Errorf("expected the appended flags to be kept, got %v", appended.Flags)
+	}
+
+	var buf bytes.Buffer
+	if err := FetchRawMessage(account, "INBOX", appended.UID, &buf); err != nil {
+		t.Fatalf("FetchRawMessage() failed: %v", err)
+	}
+	if buf.String() != raw {
+		t.Errorf("expected the message as appended, got %q", buf.String())
+	}
+	buf.Reset()
+	if err := FetchRawHeader(account, "INBOX", appended.UID, &buf); err != nil {
+		t.Fatalf("FetchRawHeader() failed: %v", err)
+	}
+	if want := "From: old@example.org\r\nSubject: From the backup\r\n\r\n"; buf.String() != want {
+		t.Errorf("expected only the header, got %q", buf.String())
+	}
+
+	infos, _, err = ListMessages(account, "INBOX")
+	if err != nil {
+		t.Fatalf("ListMessages() failed: %v", err)
+	}
+	for _, flag := range infos[1].Flags {
+		if flag == imap.SeenFlag {
+			t.Error("expected fetching the raw message not to mark it as seen")
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package fetcher
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,12 +14,17 @@ import (
 	"mime/quotedprintable"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/oauth"
+	"github.com/floatpane/matcha/view"
 	"golang.org/x/text/encoding/ianaindex"
 	"golang.org/x/text/transform"
 )
@@ -29,6 +38,7 @@ type Attachment struct {
 	MIMEType  string // Full MIME type (e.g., image/png)
 	ContentID string // Content-ID for inline assets (e.g., cid: references)
 	Inline    bool   // True when the part is meant to be displayed inline
+	Size      int64  // Size in bytes before decoding, as BODYSTRUCTURE gives it
 }
 
 type Email struct {
@@ -39,9 +49,59 @@ type Email struct {
 	Body        string
 	Date        time.Time
 	MessageID   string
+	InReplyTo   string
 	References  []string
+	ThreadID    string // Message-ID of the conversation's root, set by ThreadEmails
 	Attachments []Attachment
+	Preview     string // Start of the text, for lists; fetched with the envelope
 	AccountID   string // ID of the account this email belongs to
+	Mailbox     string // Mailbox the email was fetched from
+	UIDValidity uint32 // UIDVALIDITY of the mailbox when the email was fetched
+	Flags       []string
+}
+
+// Message flags understood by the client.
+const (
+	FlagSeen    = imap.SeenFlag
+	FlagFlagged = imap.FlaggedFlag
+)
+
+// HasFlag reports whether the email carries flag.
+func (e Email) HasFlag(flag string) bool {
+	return hasFlag(e.Flags, flag)
+}
+
+// hasFlag reports whether flags include flag.
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnread reports whether the email has not been seen yet.
+func (e Email) IsUnread() bool {
+	return !e.HasFlag(FlagSeen)
+}
+
+// SetFlag adds or removes flag on the email's local copy.
+func (e *Email) SetFlag(flag string, enable bool) {
+	if e.HasFlag(flag) == enable {
+		return
+	}
+	if enable {
+		e.Flags = append(e.Flags, flag)
+		return
+	}
+	var flags []string
+	for _, f := range e.Flags {
+		if !strings.EqualFold(f, flag) {
+			flags = append(flags, f)
+		}
+	}
+	e.Flags = flags
 }
 
 func decodePart(reader io.Reader, header mail.PartHeader) (string, error) {
@@ -110,75 +170,414 @@ func connect(account *config.Account) (*client.Client, error) {
 		return nil, fmt.Errorf("unsupported service_provider: %s", account.ServiceProvider)
 	}
 
-	addr := fmt.Sprintf("%s:%d", imapServer, imapPort)
-	c, err := client.DialTLS(addr, nil)
+	tlsConfig, err := account.TLSConfig(imapServer)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := c.Login(account.Email, account.Password); err != nil {
+	addr := fmt.Sprintf("%s:%d", imapServer, imapPort)
+	c, err := dialIMAP(addr, imapServer, account.GetIMAPSecurity(), tlsConfig)
+	if err != nil {
+		var certErr *config.CertificateError
+		if errors.As(err, &certErr) {
+			reportUntrusted(account.ID, certErr)
+		}
+		return nil, config.ExplainTLSError(imapServer, err)
+	}
+
+	if err := authenticate(c, account); err != nil {
+		logout(c)
 		return nil, err
 	}
 
 	return c, nil
 }
 
-func getSentMailbox(account *config.Account) string {
-	switch account.ServiceProvider {
-	case "gmail":
-		return "[Gmail]/Sent Mail"
-	case "icloud":
-		return "Sent Messages"
+// authenticate logs in with the account's password, or with an OAuth2
+// access token, refreshed first if it is about to expire.
+func authenticate(c *client.Client, account *config.Account) error {
+	if !account.UsesOAuth2() {
+		return c.Login(account.Email, account.Password)
+	}
+	token, err := oauth.AccessToken(account)
+	if err != nil {
+		return err
+	}
+	saslClient := oauth.NewSASLClient(account.Email, token, func(mech string) bool {
+		ok, _ := c.SupportAuth(mech)
+		return ok
+	})
+	return c.Authenticate(saslClient)
+}
+
+// dialIMAP connects to addr with the given security, never settling for
+// less: STARTTLS fails if the server doesn't offer it, and plaintext is only
+// allowed to localhost.
+func dialIMAP(addr, host, security string, tlsConfig *tls.Config) (*client.Client, error) {
+	switch security {
+	case config.SecurityTLS:
+		return client.DialTLS(addr, tlsConfig)
+	case config.SecuritySTARTTLS:
+		c, err := client.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := c.SupportStartTLS()
+		if err == nil && !ok {
+			err = fmt.Errorf("%s does not support STARTTLS", host)
+		}
+		if err == nil {
+			err = c.StartTLS(tlsConfig)
+		}
+		if err != nil {
+			_ = c.Terminate()
+			return nil, err
+		}
+		return c, nil
+	case config.SecurityNone:
+		if !config.IsLocalhost(host) {
+			return nil, fmt.Errorf("plaintext IMAP is only allowed to localhost, not %s", host)
+		}
+		return client.Dial(addr)
 	default:
-		return "Sent"
+		return nil, fmt.Errorf("unknown IMAP security %q", security)
 	}
 }
 
-func FetchMailboxEmails(account *config.Account, mailbox string, limit, offset uint32) ([]Email, error) {
-	c, err := connect(account)
-	if err != nil {
-		return nil, err
+// UntrustedCertificate is a server certificate that failed verification.
+type UntrustedCertificate struct {
+	AccountID string
+	Err       *config.CertificateError
+}
+
+var (
+	untrusted         = make(chan UntrustedCertificate, 4)
+	untrustedReported sync.Map // Account ID and fingerprint of the certificates reported
+)
+
+// UntrustedCertificates returns the channel on which certificates that
+// failed verification are delivered, each once, so that the user can be
+// asked whether to trust them.
+func UntrustedCertificates() <-chan UntrustedCertificate {
+	return untrusted
+}
+
+func reportUntrusted(accountID string, err *config.CertificateError) {
+	if _, reported := untrustedReported.LoadOrStore(accountID+"|"+err.Fingerprint(), true); reported {
+		return
 	}
-	defer c.Logout()
+	select {
+	case untrusted <- UntrustedCertificate{AccountID: accountID, Err: err}:
+	default:
+	}
+}
+
+// ErrUIDValidityChanged is returned when a mailbox's UIDVALIDITY differs
+// from the one the caller's emails were fetched with: their UIDs no longer
+// refer to the same messages, so they must be fetched again.
+var ErrUIDValidityChanged = errors.New("mailbox UIDVALIDITY changed")
+
+// Page is a batch of emails fetched from a mailbox, newest first.
+type Page struct {
+	Emails      []Email
+	UIDValidity uint32
+	// OldestUID is the lowest UID fetched, including messages that were
+	// filtered out of Emails, and the next page starts below it. It is 0
+	// when the page reaches the oldest message, as there is no next page.
+	OldestUID uint32
+}
+
+// FetchMailboxEmails returns up to limit of the newest emails in mailbox
+// with a UID below beforeUID. A beforeUID of 0 returns the newest emails.
+func FetchMailboxEmails(account *config.Account, mailbox string, limit, beforeUID uint32) ([]Email, error) {
+	page, err := FetchMailboxPage(account, mailbox, limit, beforeUID, 0)
+	return page.Emails, err
+}
+
+// FetchMailboxPage is like FetchMailboxEmails, but also reports where the
+// page ends. If uidValidity is not 0 and the mailbox's UIDVALIDITY differs,
+// it returns ErrUIDValidityChanged.
+func FetchMailboxPage(account *config.Account, mailbox string, limit, beforeUID, uidValidity uint32) (Page, error) {
+	var page Page
+	var msgs []*imap.Message
+	var sent bool
+	err := pool.withClientRetry(account, func(c *client.Client) error {
+		msgs = nil
+
+		// Mail to the account's addresses is searched for on the server, so
+		// that pages are full however much other mail the mailbox has.
+		sent = mailbox == SentMailbox(account)
+		filter := addressCriteria(account, sent)
+
+		mbox, err := c.Select(mailbox, false)
+		if err != nil {
+			return err
+		}
+		page.UIDValidity = mbox.UidValidity
+		if uidValidity != 0 && mbox.UidValidity != uidValidity {
+			return ErrUIDValidityChanged
+		}
+
+		if mbox.Messages == 0 || beforeUID == 1 {
+			return nil
+		}
+
+		if beforeUID == 0 && filter == nil {
+			// The newest messages are simply the last sequence numbers.
+			from := uint32(1)
+			if mbox.Messages > limit {
+				from = mbox.Messages - limit + 1
+			}
+			seqset := new(imap.SeqSet)
+			seqset.AddRange(from, mbox.Messages)
+
+			messages := make(chan *imap.Message, limit)
+			done := make(chan error, 1)
+			items := listFetchItems(c)
+			go func() {
+				done <- c.Fetch(seqset, items, messages)
+			}()
+			for msg := range messages {
+				msgs = append(msgs, msg)
+				if page.OldestUID == 0 || msg.Uid < page.OldestUID {
+					page.OldestUID = msg.Uid
+				}
+			}
+			if err := <-done; err != nil {
+				return err
+			}
+			if from == 1 {
+				page.OldestUID = 0
+			}
+			fetchPreviews(c, msgs)
+			return nil
+		}
+
+		// Sequence numbers shift as mail arrives and is expunged, so older
+		// pages are anchored on the oldest UID already fetched.
+		criteria := imap.NewSearchCriteria()
+		if beforeUID != 0 {
+			criteria.Uid = new(imap.SeqSet)
+			criteria.Uid.AddRange(1, beforeUID-1)
+		}
+		uids, err := c.UidSearch(restrictCriteria(criteria, filter))
+		if err != nil {
+			return err
+		}
+		sortUIDs(uids)
+
+		// Patterns are searched for loosely, so older messages are fetched
+		// until enough of them really match.
+		for len(uids) > 0 && uint32(len(msgs)) < limit {
+			n := int(limit) - len(msgs)
+			if n > len(uids) {
+				n = len(uids)
+			}
+			chunk := uids[len(uids)-n:]
+			uids = uids[:len(uids)-n]
+			page.OldestUID = chunk[0]
 
-	mbox, err := c.Select(mailbox, false)
+			fetched, err := fetchEnvelopes(c, chunk)
+			if err != nil {
+				return err
+			}
+			for _, msg := range fetched {
+				if msg.Envelope != nil && matchesAddresses(account, sent, msg.Envelope) {
+					msgs = append(msgs, msg)
+				}
+			}
+		}
+		if len(uids) == 0 {
+			page.OldestUID = 0
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return Page{}, err
+	}
+
+	page.Emails = filterMessages(account, mailbox, sent, page.UIDValidity, msgs)
+	sortEmailsNewestFirst(page.Emails)
+	return page, nil
+}
+
+// referencesSection is the References header, which the envelope lacks.
+var referencesSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"References"}},
+	Peek:         true,
+}
+
+// previewItem is the PREVIEW fetch item of RFC 8970, with which a server
+// sends the start of a message's text itself.
+const previewItem imap.FetchItem = "PREVIEW"
+
+// previewFetchSize is how much of a text part is fetched for a preview
+// when the server can't make one.
+const previewFetchSize = 512
+
+// previewMaxLen is the most characters of text a preview keeps.
+const previewMaxLen = 200
+
+// listFetchItems returns the items fetched for emails shown in a list. The
+// structure is fetched for fetchPreviews, unless the server makes previews.
+func listFetchItems(c *client.Client) []imap.FetchItem {
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchUid, referencesSection.FetchItem()}
+	if ok, _ := c.Support("PREVIEW"); ok {
+		return append(items, previewItem)
+	}
+	return append(items, imap.FetchBodyStructure)
+}
+
+// fetchPreviews fetches the start of the text of messages fetched with
+// listFetchItems that the server made no preview for, adding it to their
+// body sections. Previews are a nicety, so failing to fetch them isn't an
+// error: the emails are shown without.
+func fetchPreviews(c *client.Client, msgs []*imap.Message) {
+	// Messages with their text in the same part are fetched together.
+	byPart := make(map[string]*imap.SeqSet)
+	byUID := make(map[uint32]*imap.Message)
+	for _, msg := range msgs {
+		if msg == nil || msg.BodyStructure == nil || msg.Items[previewItem] != nil {
+			continue
+		}
+		part, _ := previewPart(msg.BodyStructure)
+		if part.ID == "" {
+			continue
+		}
+		if byPart[part.ID] == nil {
+			byPart[part.ID] = new(imap.SeqSet)
+		}
+		byPart[part.ID].AddNum(msg.Uid)
+		byUID[msg.Uid] = msg
 	}
 
-	if mbox.Messages == 0 {
-		return []Email{}, nil
+	for partID, seqset := range byPart {
+		section, err := previewSection(partID)
+		if err != nil {
+			continue
+		}
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages)
+		}()
+		for fetched := range messages {
+			if msg := byUID[fetched.Uid]; msg != nil {
+				for s, literal := range fetched.Body {
+					msg.Body[s] = literal
+				}
+			}
+		}
+		if err := <-done; err != nil {
+			return
+		}
 	}
+}
 
-	to := mbox.Messages - offset
-	from := uint32(1)
-	if to > limit {
-		from = to - limit + 1
+// previewPart returns the text part of a message to preview, plain text if
+// there is one, and whether it is HTML.
+func previewPart(bs *imap.BodyStructure) (textPart, bool) {
+	plain, html, _ := findBodyParts(bs)
+	if plain.ID != "" {
+		return plain, false
 	}
+	return html, html.ID != ""
+}
 
-	if to < 1 {
-		return []Email{}, nil
+// previewSection returns the section fetchPreviews fetches of the part
+// partID, its first previewFetchSize bytes.
+func previewSection(partID string) (*imap.BodySectionName, error) {
+	return imap.ParseBodySectionName(imap.FetchItem(fmt.Sprintf("BODY.PEEK[%s]<0.%d>", partID, previewFetchSize)))
+}
+
+// messagePreview returns the preview of a message fetched with
+// listFetchItems and fetchPreviews, as a single line of plain text.
+func messagePreview(msg *imap.Message) string {
+	switch preview := msg.Items[previewItem].(type) {
+	case string:
+		return previewText(preview)
+	case imap.Literal:
+		b, _ := ioutil.ReadAll(preview)
+		return previewText(string(b))
 	}
 
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(from, to)
+	if msg.BodyStructure == nil {
+		return ""
+	}
+	part, isHTML := previewPart(msg.BodyStructure)
+	if part.ID == "" {
+		return ""
+	}
+	section, err := previewSection(part.ID)
+	if err != nil {
+		return ""
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return ""
+	}
+	buf, err := ioutil.ReadAll(literal)
+	if err != nil {
+		return ""
+	}
+	text := decodeText(buf, part.Encoding, part.Charset)
+	if isHTML {
+		text = view.PlainText(text)
+	}
+	return previewText(text)
+}
 
-	messages := make(chan *imap.Message, limit)
-	done := make(chan error, 1)
-	fetchItems := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
-	go func() {
-		done <- c.Fetch(seqset, fetchItems, messages)
-	}()
+// previewText collapses the whitespace of text to make a one-line preview
+// of at most previewMaxLen characters.
+func previewText(text string) string {
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, "")), " ")
+	if runes := []rune(text); len(runes) > previewMaxLen {
+		text = string(runes[:previewMaxLen])
+	}
+	return text
+}
 
-	var msgs []*imap.Message
-	for msg := range messages {
-		msgs = append(msgs, msg)
+// messageReferences returns the message IDs in the References header fetched
+// with listFetchItems.
+func messageReferences(msg *imap.Message) []string {
+	literal := msg.GetBody(referencesSection)
+	if literal == nil {
+		return nil
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(literal))
+	if err != nil {
+		return nil
 	}
+	return parseMessageIDs(header.Get("References"))
+}
 
-	if err := <-done; err != nil {
-		return nil, err
+// parseMessageIDs splits a header like References into "<id>" tokens.
+func parseMessageIDs(s string) []string {
+	var ids []string
+	for {
+		start := strings.Index(s, "<")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(s[start:], ">")
+		if end == -1 {
+			break
+		}
+		ids = append(ids, s[start:start+end+1])
+		s = s[start+end+1:]
 	}
+	return ids
+}
+
+// emailsFromMessages converts fetched envelopes to emails, in the same order,
+// dropping messages that don't match the account's fetch filter.
+func emailsFromMessages(account *config.Account, mailbox string, uidValidity uint32, msgs []*imap.Message) []Email {
+	return filterMessages(account, mailbox, mailbox == SentMailbox(account), uidValidity, msgs)
+}
 
+// filterMessages is emailsFromMessages for a mailbox known to be the Sent
+// folder or not. Sent mail is matched on its sender rather than recipients.
+func filterMessages(account *config.Account, mailbox string, isSentMailbox bool, uidValidity uint32, msgs []*imap.Message) []Email {
 	var emails []Email
 	for _, msg := range msgs {
 		if msg == nil || msg.Envelope == nil {
@@ -199,135 +598,208 @@ func FetchMailboxEmails(account *config.Account, mailbox string, limit, offset u
 			toAddrList = append(toAddrList, addr.Address())
 		}
 
-		// Determine which email to filter on: prefer Account.FetchEmail, fallback to Account.Email
-		fetchEmail := strings.ToLower(strings.TrimSpace(account.FetchEmail))
-		if fetchEmail == "" {
-			fetchEmail = strings.ToLower(strings.TrimSpace(account.Email))
-		}
-
-		// Determine if this is a sent mailbox
-		isSentMailbox := mailbox == getSentMailbox(account)
-
-		// Apply different filtering logic based on mailbox type
-		matched := false
-		if isSentMailbox {
-			// For sent mailbox, check if the sender matches the fetchEmail
-			if strings.EqualFold(strings.TrimSpace(fromAddr), fetchEmail) {
-				matched = true
-			}
-		} else {
-			// For inbox and other mailboxes, check if any recipient matches the fetchEmail
-			for _, r := range toAddrList {
-				if strings.EqualFold(strings.TrimSpace(r), fetchEmail) {
-					matched = true
-					break
-				}
-			}
+		if hasFlag(msg.Flags, imap.DeletedFlag) {
+			// Marked for deletion, e.g. by another client, and about to go.
+			continue
 		}
-
-		if !matched {
+		if !matchesAddresses(account, isSentMailbox, msg.Envelope) {
 			// Skip messages not matching the filter criteria
 			continue
 		}
 
 		emails = append(emails, Email{
-			UID:       msg.Uid,
-			From:      fromAddr,
-			To:        toAddrList,
-			Subject:   decodeHeader(msg.Envelope.Subject),
-			Date:      msg.Envelope.Date,
-			AccountID: account.ID,
+			UID:         msg.Uid,
+			From:        fromAddr,
+			To:          toAddrList,
+			Subject:     decodeHeader(msg.Envelope.Subject),
+			Date:        msg.Envelope.Date,
+			MessageID:   msg.Envelope.MessageId,
+			InReplyTo:   msg.Envelope.InReplyTo,
+			References:  messageReferences(msg),
+			Preview:     messagePreview(msg),
+			AccountID:   account.ID,
+			Mailbox:     mailbox,
+			UIDValidity: uidValidity,
+			Flags:       msg.Flags,
 		})
 	}
 
-	for i, j := 0, len(emails)-1; i < j; i, j = i+1, j-1 {
-		emails[i], emails[j] = emails[j], emails[i]
-	}
-
-	return emails, nil
+	return emails
 }
 
 func FetchEmailBodyFromMailbox(account *config.Account, mailbox string, uid uint32) (string, []Attachment, error) {
-	c, err := connect(account)
+	var (
+		body        string
+		attachments []Attachment
+	)
+	err := pool.withMailboxRetry(account, mailbox, func(c *client.Client) error {
+		var err error
+		body, attachments, err = fetchEmailBody(c, uid)
+		return err
+	})
 	if err != nil {
 		return "", nil, err
 	}
-	defer c.Logout()
+	return body, attachments, nil
+}
 
-	if _, err := c.Select(mailbox, false); err != nil {
-		return "", nil, err
-	}
+// inlineImageMaxSize is the largest inline image, in bytes before decoding,
+// fetched with the body of a message. Larger ones are only listed as
+// attachments.
+const inlineImageMaxSize = 512 << 10
+
+// textPart is a text part of a message, as its structure describes it.
+type textPart struct {
+	ID       string
+	Encoding string // Content-Transfer-Encoding
+	Charset  string
+}
 
+// fetchEmailBody fetches the structure of a message in the currently
+// selected mailbox, then only its preferred text part and small inline
+// images, in a single command. Other attachments are listed from the
+// structure alone, to be fetched on demand.
+func fetchEmailBody(c *client.Client, uid uint32) (string, []Attachment, error) {
 	seqset := new(imap.SeqSet)
 	seqset.AddNum(uid)
 
-	fetchInlinePart := func(partID, encoding string) ([]byte, error) {
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	fetchItems := []imap.FetchItem{imap.FetchBodyStructure}
+	go func() {
+		done <- c.UidFetch(seqset, fetchItems, messages)
+	}()
+
+	if err := <-done; err != nil {
+		return "", nil, err
+	}
+
+	msg := <-messages
+	if msg == nil || msg.BodyStructure == nil {
+		return "", nil, fmt.Errorf("no message or body structure found with UID %d", uid)
+	}
+
+	text, attachments := walkBodyStructure(msg.BodyStructure)
+	if os.Getenv("DEBUG_KITTY_IMAGES") != "" {
+		msg := fmt.Sprintf("[kitty-img] body selection chosen=%s\n", text.ID)
+		fmt.Print(msg)
+		if path := os.Getenv("DEBUG_KITTY_LOG"); path != "" {
+			if f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+				_, _ = f.WriteString(msg)
+				_ = f.Close()
+			}
+		}
+	}
+
+	sections := make(map[string]*imap.BodySectionName)
+	var items []imap.FetchItem
+	addSection := func(partID string) error {
 		fetchItem := imap.FetchItem(fmt.Sprintf("BODY.PEEK[%s]", partID))
 		section, err := imap.ParseBodySectionName(fetchItem)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		partMessages := make(chan *imap.Message, 1)
-		partDone := make(chan error, 1)
-		go func() {
-			partDone <- c.UidFetch(seqset, []imap.FetchItem{fetchItem}, partMessages)
-		}()
-
-		if err := <-partDone; err != nil {
-			return nil, err
+		sections[partID] = section
+		items = append(items, fetchItem)
+		return nil
+	}
+	if text.ID != "" {
+		if err := addSection(text.ID); err != nil {
+			return "", nil, err
 		}
-
-		partMsg := <-partMessages
-		if partMsg == nil {
-			return nil, fmt.Errorf("could not fetch inline part %s", partID)
+	}
+	for _, att := range attachments {
+		if fetchInline(att) {
+			if err := addSection(att.PartID); err != nil {
+				return "", nil, err
+			}
 		}
+	}
+	if len(items) == 0 {
+		return "", attachments, nil
+	}
 
-		literal := partMsg.GetBody(section)
+	partMessages := make(chan *imap.Message, 1)
+	partDone := make(chan error, 1)
+	go func() {
+		partDone <- c.UidFetch(seqset, items, partMessages)
+	}()
+	if err := <-partDone; err != nil {
+		return "", nil, err
+	}
+	partMsg := <-partMessages
+	if partMsg == nil {
+		return "", nil, fmt.Errorf("could not fetch the body of UID %d", uid)
+	}
+
+	section := func(partID string) ([]byte, error) {
+		literal := partMsg.GetBody(sections[partID])
 		if literal == nil {
-			return nil, fmt.Errorf("could not get inline part body %s", partID)
+			return nil, fmt.Errorf("could not get part %s", partID)
 		}
+		return ioutil.ReadAll(literal)
+	}
+	return bodyFromSections(text, attachments, section)
+}
 
-		rawBytes, err := ioutil.ReadAll(literal)
+// bodyFromSections decodes the text part of a message and fills in the data
+// of its inline images, with section returning the undecoded content of a
+// part. Inline images that can't be read are left without data.
+func bodyFromSections(text textPart, attachments []Attachment, section func(partID string) ([]byte, error)) (string, []Attachment, error) {
+	var body string
+	if text.ID != "" {
+		buf, err := section(text.ID)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-
-		return decodeAttachmentData(rawBytes, encoding)
+		body = decodeText(buf, text.Encoding, text.Charset)
 	}
-
-	messages := make(chan *imap.Message, 1)
-	done := make(chan error, 1)
-	fetchItems := []imap.FetchItem{imap.FetchBodyStructure}
-	go func() {
-		done <- c.UidFetch(seqset, fetchItems, messages)
-	}()
-
-	if err := <-done; err != nil {
-		return "", nil, err
+	for i, att := range attachments {
+		if !fetchInline(att) {
+			continue
+		}
+		if raw, err := section(att.PartID); err == nil {
+			if data, err := decodeAttachmentData(raw, att.Encoding); err == nil {
+				attachments[i].Data = data
+			}
+		}
 	}
+	return body, attachments, nil
+}
 
-	msg := <-messages
-	if msg == nil || msg.BodyStructure == nil {
-		return "", nil, fmt.Errorf("no message or body structure found with UID %d", uid)
+// fetchInline reports whether an attachment is an inline image small
+// enough to be fetched with the body, to be shown in it.
+func fetchInline(att Attachment) bool {
+	return att.Inline && att.ContentID != "" && strings.HasPrefix(att.MIMEType, "image/") && att.Size <= inlineImageMaxSize
+}
+
+// walkBodyStructure finds the text part to show of a message, HTML if there
+// is one, and lists its attachments from its structure.
+func walkBodyStructure(bs *imap.BodyStructure) (text textPart, attachments []Attachment) {
+	plain, html, attachments := findBodyParts(bs)
+	if html.ID != "" {
+		return html, attachments
 	}
+	return plain, attachments
+}
 
-	var plainPartID string
-	var htmlPartID string
-	var attachments []Attachment
+// findBodyParts finds the first plain text and HTML parts of a message and
+// lists its attachments from its structure.
+func findBodyParts(bs *imap.BodyStructure) (plain, html textPart, attachments []Attachment) {
 	var checkPart func(part *imap.BodyStructure, partID string)
 	checkPart = func(part *imap.BodyStructure, partID string) {
 		// Check for text content (prefer html over plain)
-		if part.MIMEType == "text" {
+		if strings.EqualFold(part.MIMEType, "text") && !strings.EqualFold(part.Disposition, "attachment") {
+			found := textPart{ID: partID, Encoding: part.Encoding, Charset: part.Params["charset"]}
 			sub := strings.ToLower(part.MIMESubType)
 			switch sub {
 			case "html":
-				if htmlPartID == "" {
-					htmlPartID = partID
+				if html.ID == "" {
+					html = found
 				}
 			case "plain":
-				if plainPartID == "" {
-					plainPartID = partID
+				if plain.ID == "" {
+					plain = found
 				}
 			}
 		}
@@ -368,20 +840,15 @@ func FetchEmailBodyFromMailbox(account *config.Account, mailbox string, uid uint
 			filename = "inline"
 		}
 		if (filename != "" || isCID) && (part.Disposition == "attachment" || isInline || part.MIMEType != "text") {
-			att := Attachment{
+			attachments = append(attachments, Attachment{
 				Filename:  filename,
 				PartID:    partID,
 				Encoding:  part.Encoding, // Store encoding for proper decoding
 				MIMEType:  mimeType,
 				ContentID: contentID,
 				Inline:    isInline,
-			}
-			if att.Inline && strings.HasPrefix(att.MIMEType, "image/") {
-				if data, err := fetchInlinePart(partID, part.Encoding); err == nil {
-					att.Data = data
-				}
-			}
-			attachments = append(attachments, att)
+				Size:      int64(part.Size),
+			})
 		}
 	}
 
@@ -411,98 +878,47 @@ func FetchEmailBodyFromMailbox(account *config.Account, mailbox string, uid uint
 			}
 		}
 	}
-	findParts(msg.BodyStructure, "")
+	findParts(bs, "")
+	return plain, html, attachments
+}
 
-	var body string
-	textPartID := ""
-	if htmlPartID != "" {
-		textPartID = htmlPartID
-	} else if plainPartID != "" {
-		textPartID = plainPartID
+// decodeText decodes the fetched content of a text part, with the
+// Content-Transfer-Encoding and charset its structure gives. Content that
+// fails to decode is shown as it is, but the start of a part, cut off in
+// the middle of a line, keeps what decoded before the cut.
+func decodeText(buf []byte, encoding, charset string) string {
+	decoded, err := ioutil.ReadAll(decodingReader(bytes.NewReader(buf), encoding))
+	if err != nil && len(decoded) == 0 {
+		decoded = buf
 	}
-	if os.Getenv("DEBUG_KITTY_IMAGES") != "" {
-		msg := fmt.Sprintf("[kitty-img] body selection html=%s plain=%s chosen=%s\n", htmlPartID, plainPartID, textPartID)
-		fmt.Print(msg)
-		if path := os.Getenv("DEBUG_KITTY_LOG"); path != "" {
-			if f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
-				_, _ = f.WriteString(msg)
-				_ = f.Close()
-			}
-		}
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return string(decoded)
 	}
-	if textPartID != "" {
-		partMessages := make(chan *imap.Message, 1)
-		partDone := make(chan error, 1)
-
-		fetchItem := imap.FetchItem(fmt.Sprintf("BODY.PEEK[%s]", textPartID))
-		section, err := imap.ParseBodySectionName(fetchItem)
-		if err != nil {
-			return "", nil, err
-		}
-
-		go func() {
-			partDone <- c.UidFetch(seqset, []imap.FetchItem{fetchItem}, partMessages)
-		}()
-
-		if err := <-partDone; err != nil {
-			return "", nil, err
-		}
-
-		partMsg := <-partMessages
-		if partMsg != nil {
-			literal := partMsg.GetBody(section)
-			if literal != nil {
-				// The new decoding logic starts here
-				buf, _ := ioutil.ReadAll(literal)
-				mr, err := mail.CreateReader(bytes.NewReader(buf))
-				if err != nil {
-					body = string(buf)
-				} else {
-					p, err := mr.NextPart()
-					if err != nil {
-						body = string(buf)
-					} else {
-						encoding := p.Header.Get("Content-Transfer-Encoding")
-						bodyBytes, _ := ioutil.ReadAll(p.Body)
-
-						switch strings.ToLower(encoding) {
-						case "base64":
-							decoded, err := base64.StdEncoding.DecodeString(string(bodyBytes))
-							if err == nil {
-								body = string(decoded)
-							} else {
-								body = string(bodyBytes)
-							}
-						case "quoted-printable":
-							decoded, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(string(bodyBytes))))
-							if err == nil {
-								body = string(decoded)
-							} else {
-								body = string(bodyBytes)
-							}
-						default:
-							body = string(bodyBytes)
-						}
-					}
-				}
-			}
-		}
+	enc, err := ianaindex.IANA.Encoding(strings.ToLower(charset))
+	if err != nil || enc == nil {
+		return string(decoded)
 	}
-
-	return body, attachments, nil
+	text, err := ioutil.ReadAll(transform.NewReader(bytes.NewReader(decoded), enc.NewDecoder()))
+	if err != nil {
+		return string(decoded)
+	}
+	return string(text)
 }
 
 func FetchAttachmentFromMailbox(account *config.Account, mailbox string, uid uint32, partID string, encoding string) ([]byte, error) {
-	c, err := connect(account)
+	var data []byte
+	err := pool.withMailboxRetry(account, mailbox, func(c *client.Client) error {
+		var err error
+		data, err = fetchAttachment(c, uid, partID, encoding)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer c.Logout()
-
-	if _, err := c.Select(mailbox, false); err != nil {
-		return nil, err
-	}
+	return data, nil
+}
 
+func fetchAttachment(c *client.Client, uid uint32, partID string, encoding string) ([]byte, error) {
 	seqset := new(imap.SeqSet)
 	seqset.AddNum(uid)
 
@@ -544,74 +960,279 @@ func FetchAttachmentFromMailbox(account *config.Account, mailbox string, uid uin
 	return decoded, nil
 }
 
-func moveEmail(account *config.Account, uid uint32, sourceMailbox, destMailbox string) error {
-	c, err := connect(account)
+// attachmentChunkSize is how much of an attachment is fetched at a time
+// when it is saved. go-imap holds a whole literal in memory, so attachments
+// are fetched in partial fetches of this size rather than in one.
+var attachmentChunkSize = 1 << 20
+
+// SaveAttachmentFromMailbox writes the decoded content of an attachment to w
+// as it is downloaded, calling progress with how many bytes of the part,
+// still encoded as BODYSTRUCTURE counts them, have been fetched. Other
+// commands may use the connection between chunks. The download stops with
+// ctx's error once ctx is done.
+func SaveAttachmentFromMailbox(ctx context.Context, account *config.Account, mailbox string, uid uint32, partID, encoding string, w io.Writer, progress func(fetched int64)) error {
+	r := &partReader{ctx: ctx, progress: progress}
+	r.fetch = func(offset int) ([]byte, error) {
+		var chunk []byte
+		err := pool.withMailboxRetry(account, mailbox, func(c *client.Client) error {
+			var err error
+			chunk, err = fetchPartChunk(c, uid, partID, offset, attachmentChunkSize)
+			return err
+		})
+		return chunk, err
+	}
+	_, err := io.Copy(w, decodingReader(r, encoding))
+	return err
+}
+
+// partReader reads a part of a message chunk by chunk.
+type partReader struct {
+	ctx      context.Context
+	fetch    func(offset int) ([]byte, error)
+	progress func(fetched int64)
+	buf      []byte
+	offset   int
+	eof      bool
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		chunk, err := r.fetch(r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk
+		r.offset += len(chunk)
+		// A short chunk is the end of the part.
+		r.eof = len(chunk) < attachmentChunkSize
+		if r.progress != nil {
+			r.progress(int64(r.offset))
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fetchPartChunk fetches up to size bytes of a part of a message in the
+// currently selected mailbox, starting at offset.
+func fetchPartChunk(c *client.Client, uid uint32, partID string, offset, size int) ([]byte, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	fetchItem := imap.FetchItem(fmt.Sprintf("BODY.PEEK[%s]<%d.%d>", partID, offset, size))
+	section, err := imap.ParseBodySectionName(fetchItem)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Logout()
 
-	if _, err := c.Select(sourceMailbox, false); err != nil {
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{fetchItem}, messages)
+	}()
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	msg := <-messages
+	if msg == nil {
+		return nil, fmt.Errorf("could not fetch attachment")
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return nil, fmt.Errorf("could not get attachment body")
+	}
+	return ioutil.ReadAll(literal)
+}
+
+// decodingReader decodes what is read from r with a Content-Transfer-Encoding.
+func decodingReader(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// MoveEmails moves emails from one folder to another with a single UID
+// command.
+func MoveEmails(account *config.Account, sourceMailbox string, uids []uint32, destMailbox string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	return pool.withMailbox(account, sourceMailbox, func(c *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids...)
+
+		return moveMessages(c, seqSet, destMailbox)
+	})
+}
+
+// moveMessages moves messages of the selected mailbox to dest. Servers
+// without MOVE get a COPY, after which only the copied messages are expunged.
+func moveMessages(c *client.Client, seqSet *imap.SeqSet, dest string) error {
+	if ok, err := c.Support("MOVE"); err != nil {
 		return err
+	} else if ok {
+		return c.UidMove(seqSet, dest)
 	}
+	if err := c.UidCopy(seqSet, dest); err != nil {
+		return err
+	}
+	return expungeMessages(c, seqSet)
+}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+// uidExpungeCommand is the UID EXPUNGE command of UIDPLUS (RFC 4315), to be
+// wrapped in commands.Uid.
+type uidExpungeCommand struct {
+	seqSet *imap.SeqSet
+}
 
-	return c.UidMove(seqSet, destMailbox)
+func (cmd *uidExpungeCommand) Command() *imap.Command {
+	return &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{cmd.seqSet}}
 }
 
-func DeleteEmailFromMailbox(account *config.Account, mailbox string, uid uint32) error {
-	c, err := connect(account)
-	if err != nil {
+// expungeMessages permanently removes messages of the selected mailbox.
+// A plain EXPUNGE also removes every other message marked \Deleted, so
+// without UIDPLUS the others are unmarked for it and marked again after.
+func expungeMessages(c *client.Client, seqSet *imap.SeqSet) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
 		return err
 	}
-	defer c.Logout()
 
-	if _, err := c.Select(mailbox, false); err != nil {
+	if ok, err := c.Support("UIDPLUS"); err != nil {
 		return err
+	} else if ok {
+		status, err := c.Execute(&commands.Uid{Cmd: &uidExpungeCommand{seqSet: seqSet}}, nil)
+		if err != nil {
+			return err
+		}
+		return status.Err()
 	}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	deleted, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	others := new(imap.SeqSet)
+	for _, uid := range deleted {
+		if !seqSet.Contains(uid) {
+			others.AddNum(uid)
+		}
+	}
+	if others.Empty() {
+		return c.Expunge(nil)
+	}
 
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
 	flags := []interface{}{imap.DeletedFlag}
-
-	if err := c.UidStore(seqSet, item, flags, nil); err != nil {
+	if err := c.UidStore(others, imap.FormatFlagsOp(imap.RemoveFlags, true), flags, nil); err != nil {
 		return err
 	}
+	expungeErr := c.Expunge(nil)
+	if err := c.UidStore(others, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+		return fmt.Errorf("could not mark messages \\Deleted again: %w", err)
+	}
+	return expungeErr
+}
 
-	return c.Expunge(nil)
+// DeleteEmailFromMailbox moves an email to the account's trash folder. In the
+// trash folder itself, it deletes the email permanently.
+func DeleteEmailFromMailbox(account *config.Account, mailbox string, uid uint32) error {
+	return DeleteEmailsFromMailbox(account, mailbox, []uint32{uid})
 }
 
-func ArchiveEmailFromMailbox(account *config.Account, mailbox string, uid uint32) error {
-	var archiveMailbox string
-	switch account.ServiceProvider {
-	case "gmail":
-		archiveMailbox = "[Gmail]/All Mail"
-	default:
-		archiveMailbox = "Archive"
+// DeleteEmailsFromMailbox is like DeleteEmailFromMailbox for several emails,
+// with a single UID command.
+func DeleteEmailsFromMailbox(account *config.Account, mailbox string, uids []uint32) error {
+	trash := TrashMailbox(account)
+	if mailbox != trash {
+		return MoveEmails(account, mailbox, uids, trash)
 	}
-	return moveEmail(account, uid, mailbox, archiveMailbox)
+	if len(uids) == 0 {
+		return nil
+	}
+	return pool.withMailbox(account, mailbox, func(c *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids...)
+
+		return expungeMessages(c, seqSet)
+	})
 }
 
-// Convenience wrappers defaulting to INBOX for existing call sites.
+// RestoreEmail moves the email with messageID from one folder back to
+// another, undoing a delete or archive. The moved message got a new UID, so
+// it is found by its Message-ID.
+func RestoreEmail(account *config.Account, messageID, from, to string) error {
+	return pool.withMailbox(account, from, func(c *client.Client) error {
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Add("Message-Id", messageID)
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			return fmt.Errorf("%s not found in %s", messageID, from)
+		}
 
-func FetchEmails(account *config.Account, limit, offset uint32) ([]Email, error) {
-	return FetchMailboxEmails(account, "INBOX", limit, offset)
+		// The message moved last is the newest copy.
+		sortUIDs(uids)
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids[len(uids)-1])
+		return moveMessages(c, seqSet, to)
+	})
 }
 
-func FetchSentEmails(account *config.Account, limit, offset uint32) ([]Email, error) {
-	return FetchMailboxEmails(account, getSentMailbox(account), limit, offset)
+// SetFlagInMailbox adds or removes flag on the given messages with a single
+// UID STORE.
+func SetFlagInMailbox(account *config.Account, mailbox string, uids []uint32, flag string, enable bool) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	return pool.withMailbox(account, mailbox, func(c *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids...)
+
+		op := imap.FlagsOp(imap.RemoveFlags)
+		if enable {
+			op = imap.AddFlags
+		}
+		item := imap.FormatFlagsOp(op, true)
+		return c.UidStore(seqSet, item, []interface{}{flag}, nil)
+	})
 }
 
+func ArchiveEmailFromMailbox(account *config.Account, mailbox string, uid uint32) error {
+	return ArchiveEmailsFromMailbox(account, mailbox, []uint32{uid})
+}
+
+// ArchiveEmailsFromMailbox moves emails to the account's archive folder with
+// a single UID command.
+func ArchiveEmailsFromMailbox(account *config.Account, mailbox string, uids []uint32) error {
+	return MoveEmails(account, mailbox, uids, ArchiveMailbox(account))
+}
+
+// Convenience wrappers defaulting to INBOX for existing call sites.
+
 func FetchEmailBody(account *config.Account, uid uint32) (string, []Attachment, error) {
 	return FetchEmailBodyFromMailbox(account, "INBOX", uid)
 }
 
 func FetchSentEmailBody(account *config.Account, uid uint32) (string, []Attachment, error) {
-	return FetchEmailBodyFromMailbox(account, getSentMailbox(account), uid)
+	return FetchEmailBodyFromMailbox(account, SentMailbox(account), uid)
 }
 
 func FetchAttachment(account *config.Account, uid uint32, partID string, encoding string) ([]byte, error) {
@@ -619,7 +1240,7 @@ func FetchAttachment(account *config.Account, uid uint32, partID string, encodin
 }
 
 func FetchSentAttachment(account *config.Account, uid uint32, partID string, encoding string) ([]byte, error) {
-	return FetchAttachmentFromMailbox(account, getSentMailbox(account), uid, partID, encoding)
+	return FetchAttachmentFromMailbox(account, SentMailbox(account), uid, partID, encoding)
 }
 
 func DeleteEmail(account *config.Account, uid uint32) error {
@@ -627,7 +1248,7 @@ func DeleteEmail(account *config.Account, uid uint32) error {
 }
 
 func DeleteSentEmail(account *config.Account, uid uint32) error {
-	return DeleteEmailFromMailbox(account, getSentMailbox(account), uid)
+	return DeleteEmailFromMailbox(account, SentMailbox(account), uid)
 }
 
 func ArchiveEmail(account *config.Account, uid uint32) error {
@@ -635,5 +1256,5 @@ func ArchiveEmail(account *config.Account, uid uint32) error {
 }
 
 func ArchiveSentEmail(account *config.Account, uid uint32) error {
-	return ArchiveEmailFromMailbox(account, getSentMailbox(account), uid)
+	return ArchiveEmailFromMailbox(account, SentMailbox(account), uid)
 }
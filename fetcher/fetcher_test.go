@@ -1,8 +1,17 @@
 package fetcher
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
 	"github.com/floatpane/matcha/config"
 )
 
@@ -34,14 +43,14 @@ func TestFetchEmails(t *testing.T) {
 		t.Skip("Skipping TestFetchEmails: placeholder or empty password found in config.")
 	}
 
-	emails, err := FetchEmails(account, 10, 10)
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
 	if err != nil {
-		t.Fatalf("FetchEmails() failed with error: %v", err)
+		t.Fatalf("FetchMailboxEmails() failed with error: %v", err)
 	}
 
 	if len(emails) == 0 {
 		// This is not necessarily a failure, but we can log it.
-		t.Log("FetchEmails() returned 0 emails. This might be expected.")
+		t.Log("FetchMailboxEmails() returned 0 emails. This might be expected.")
 	}
 
 	// Check that the emails are sorted from newest to oldest.
@@ -105,10 +114,465 @@ func TestFetchEmailsWithCustomServer(t *testing.T) {
 		t.Skip("Skipping TestFetchEmailsWithCustomServer: no IMAP server configured.")
 	}
 
-	emails, err := FetchEmails(customAccount, 5, 0)
+	emails, err := FetchMailboxEmails(customAccount, "INBOX", 5, 0)
 	if err != nil {
-		t.Fatalf("FetchEmails() with custom server failed: %v", err)
+		t.Fatalf("FetchMailboxEmails() with custom server failed: %v", err)
 	}
 
 	t.Logf("Fetched %d emails from custom server %s", len(emails), customAccount.IMAPServer)
 }
+
+func TestSetFlagInMailbox(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxEmails() failed: %v", err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+	uid := emails[0].UID
+
+	for _, seen := range []bool{true, false} {
+		if err := SetFlagInMailbox(account, "INBOX", []uint32{uid}, FlagSeen, seen); err != nil {
+			t.Fatalf("SetFlagInMailbox(%v) failed: %v", seen, err)
+		}
+		emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+		if err != nil {
+			t.Fatalf("FetchMailboxEmails() failed: %v", err)
+		}
+		if emails[0].IsUnread() == seen {
+			t.Errorf("after setting \\Seen to %v, IsUnread() = %v (flags %v)", seen, emails[0].IsUnread(), emails[0].Flags)
+		}
+	}
+}
+
+func TestEmailSetFlag(t *testing.T) {
+	var e Email
+	if !e.IsUnread() {
+		t.Error("expected an email without flags to be unread")
+	}
+	e.SetFlag(FlagSeen, true)
+	e.SetFlag(FlagSeen, true)
+	if len(e.Flags) != 1 || e.IsUnread() {
+		t.Errorf("expected a single \\Seen flag, got %v", e.Flags)
+	}
+	e.SetFlag(FlagSeen, false)
+	if !e.IsUnread() || len(e.Flags) != 0 {
+		t.Errorf("expected \\Seen to be removed, got %v", e.Flags)
+	}
+}
+
+func TestSearchFlaggedEmails(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+	flagged := imap.NewSearchCriteria()
+	flagged.WithFlags = []string{imap.FlaggedFlag}
+
+	emails, err := SearchMailboxEmails(account, "INBOX", flagged, 0)
+	if err != nil {
+		t.Fatalf("SearchMailboxEmails() failed: %v", err)
+	}
+	if len(emails) != 0 {
+		t.Fatalf("expected no flagged emails, got %d", len(emails))
+	}
+
+	if err := SetFlagInMailbox(account, "INBOX", []uint32{6}, FlagFlagged, true); err != nil {
+		t.Fatalf("SetFlagInMailbox() failed: %v", err)
+	}
+
+	emails, err = SearchMailboxEmails(account, "INBOX", flagged, 0)
+	if err != nil {
+		t.Fatalf("SearchMailboxEmails() failed: %v", err)
+	}
+	if len(emails) != 1 || emails[0].UID != 6 || !emails[0].HasFlag(FlagFlagged) {
+		t.Fatalf("expected flagged email with UID 6, got %+v", emails)
+	}
+}
+
+func TestFetchMailboxPageAnchorsOnUIDs(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	appendMessage := func(subject string) {
+		t.Helper()
+		msg := "From: sender@example.org\r\n" +
+			"To: contact@example.org\r\n" +
+			"Subject: " + subject + "\r\n" +
+			"\r\n" +
+			"Hello"
+		if err := c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(msg)); err != nil {
+			t.Fatalf("could not append %s: %v", subject, err)
+		}
+	}
+	for _, subject := range []string{"one", "two", "three"} {
+		appendMessage(subject)
+	}
+
+	first, err := FetchMailboxPage(account, "INBOX", 2, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxPage() failed: %v", err)
+	}
+	if len(first.Emails) != 2 || first.Emails[0].Subject != "three" || first.UIDValidity == 0 {
+		t.Fatalf("expected the 2 newest emails and a UIDVALIDITY, got %+v", first)
+	}
+	if whole, err := FetchMailboxPage(account, "INBOX", 10, 0, 0); err != nil || whole.OldestUID != 0 {
+		t.Fatalf("expected a page of the whole mailbox to be the last, got %+v, %v", whole, err)
+	}
+
+	// New mail between page loads must not shift the next page.
+	appendMessage("four")
+
+	second, err := FetchMailboxPage(account, "INBOX", 2, first.OldestUID, first.UIDValidity)
+	if err != nil {
+		t.Fatalf("FetchMailboxPage() failed: %v", err)
+	}
+	var subjects []string
+	for _, e := range second.Emails {
+		subjects = append(subjects, e.Subject)
+	}
+	if len(subjects) != 2 || subjects[0] != "one" || subjects[1] != "A little message, just for you" {
+		t.Fatalf("expected the 2 emails older than the first page, got %v", subjects)
+	}
+
+	if second.OldestUID != 0 {
+		t.Fatalf("expected the page reaching the oldest email to be the last, got OldestUID %d", second.OldestUID)
+	}
+
+	if _, err := FetchMailboxPage(account, "INBOX", 2, first.OldestUID, first.UIDValidity+1); !errors.Is(err, ErrUIDValidityChanged) {
+		t.Fatalf("expected ErrUIDValidityChanged, got %v", err)
+	}
+}
+
+func TestDeleteEmailMovesToTrashAndRestores(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	if err := c.Create(TrashMailbox(account)); err != nil {
+		t.Fatalf("could not create Trash: %v", err)
+	}
+
+	if err := DeleteEmail(account, 6); err != nil {
+		t.Fatalf("DeleteEmail() failed: %v", err)
+	}
+	if emails, _ := FetchMailboxEmails(account, "INBOX", 10, 0); len(emails) != 0 {
+		t.Fatalf("expected the inbox to be empty, got %+v", emails)
+	}
+	trashed, err := FetchMailboxEmails(account, "Trash", 10, 0)
+	if err != nil || len(trashed) != 1 {
+		t.Fatalf("expected the email in Trash, got %v, %v", trashed, err)
+	}
+
+	if err := RestoreEmail(account, trashed[0].MessageID, "Trash", "INBOX"); err != nil {
+		t.Fatalf("RestoreEmail() failed: %v", err)
+	}
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil || len(emails) != 1 || emails[0].MessageID != trashed[0].MessageID {
+		t.Fatalf("expected the email back in the inbox, got %v, %v", emails, err)
+	}
+
+	// Deleting from Trash is permanent.
+	if err := MoveEmails(account, "INBOX", []uint32{emails[0].UID}, "Trash"); err != nil {
+		t.Fatalf("MoveEmails() failed: %v", err)
+	}
+	trashed, _ = FetchMailboxEmails(account, "Trash", 10, 0)
+	if err := DeleteEmailFromMailbox(account, "Trash", trashed[0].UID); err != nil {
+		t.Fatalf("DeleteEmailFromMailbox() failed: %v", err)
+	}
+	if trashed, _ := FetchMailboxEmails(account, "Trash", 10, 0); len(trashed) != 0 {
+		t.Fatalf("expected Trash to be empty, got %+v", trashed)
+	}
+}
+
+func TestDeleteEmailsMovesAllToTrash(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	if err := c.Create(TrashMailbox(account)); err != nil {
+		t.Fatalf("could not create Trash: %v", err)
+	}
+	for _, subject := range []string{"One", "Two"} {
+		msg := "From: sender@example.org\r\n" +
+			"To: contact@example.org\r\n" +
+			"Subject: " + subject + "\r\n" +
+			"\r\n" +
+			"Hello"
+		if err := c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(msg)); err != nil {
+			t.Fatalf("could not append: %v", err)
+		}
+	}
+
+	if err := DeleteEmailsFromMailbox(account, "INBOX", []uint32{6, 8}); err != nil {
+		t.Fatalf("DeleteEmailsFromMailbox() failed: %v", err)
+	}
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil || len(emails) != 1 || emails[0].UID != 7 {
+		t.Fatalf("expected only UID 7 to be left, got %+v, %v", emails, err)
+	}
+	if trashed, _ := FetchMailboxEmails(account, "Trash", 10, 0); len(trashed) != 2 {
+		t.Fatalf("expected 2 emails in Trash, got %+v", trashed)
+	}
+}
+
+func TestExpungeMessagesKeepsOtherDeletedMessages(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	msg := "From: sender@example.org\r\n" +
+		"To: contact@example.org\r\n" +
+		"Subject: Mine\r\n" +
+		"\r\n" +
+		"Hello"
+	if err := c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(msg)); err != nil {
+		t.Fatalf("could not append: %v", err)
+	}
+	// Another client marked UID 6 for deletion.
+	if err := SetFlagInMailbox(account, "INBOX", []uint32{6}, imap.DeletedFlag, true); err != nil {
+		t.Fatalf("SetFlagInMailbox() failed: %v", err)
+	}
+
+	err = pool.withMailbox(account, "INBOX", func(c *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(7)
+		return expungeMessages(c, seqSet)
+	})
+	if err != nil {
+		t.Fatalf("expungeMessages() failed: %v", err)
+	}
+
+	// The server lacks UIDPLUS, so a plain EXPUNGE would have removed UID 6.
+	infos, _, err := ListMessages(account, "INBOX")
+	if err != nil {
+		t.Fatalf("ListMessages() failed: %v", err)
+	}
+	if len(infos) != 1 || infos[0].UID != 6 || !hasFlag(infos[0].Flags, imap.DeletedFlag) {
+		t.Fatalf("expected only UID 7 to be expunged and UID 6 to stay marked, got %+v", infos)
+	}
+
+	// Messages marked for deletion aren't listed.
+	if emails, err := FetchMailboxEmails(account, "INBOX", 10, 0); err != nil || len(emails) != 0 {
+		t.Errorf("expected no emails listed, got %+v, %v", emails, err)
+	}
+}
+
+func TestMoveWithoutMoveOrUIDPlus(t *testing.T) {
+	usePlainPool(t, newTestServerWithout(t, "MOVE"))
+	account := testAccount()
+	if err := pool.withClient(account, func(c *client.Client) error {
+		if ok, _ := c.Support("MOVE"); ok {
+			t.Fatal("expected the server not to advertise MOVE")
+		}
+		return c.Create(TrashMailbox(account))
+	}); err != nil {
+		t.Fatalf("could not create Trash: %v", err)
+	}
+	msg := "From: sender@example.org\r\nTo: contact@example.org\r\nSubject: Mine\r\n\r\nHello"
+	if err := AppendMessage(account, "INBOX", nil, time.Now(), []byte(msg)); err != nil {
+		t.Fatalf("AppendMessage() failed: %v", err)
+	}
+	// Another client marked UID 6 for deletion, which a plain EXPUNGE would
+	// otherwise leave blocking the move.
+	if err := SetFlagInMailbox(account, "INBOX", []uint32{6}, imap.DeletedFlag, true); err != nil {
+		t.Fatalf("SetFlagInMailbox() failed: %v", err)
+	}
+
+	if err := DeleteEmailsFromMailbox(account, "INBOX", []uint32{7}); err != nil {
+		t.Fatalf("DeleteEmailsFromMailbox() failed: %v", err)
+	}
+	infos, _, err := ListMessages(account, "INBOX")
+	if err != nil {
+		t.Fatalf("ListMessages() failed: %v", err)
+	}
+	if len(infos) != 1 || infos[0].UID != 6 || !hasFlag(infos[0].Flags, imap.DeletedFlag) {
+		t.Errorf("expected the email copied away and UID 6 still marked, got %+v", infos)
+	}
+	if trashed, _ := FetchMailboxEmails(account, "Trash", 10, 0); len(trashed) != 1 || trashed[0].Subject != "Mine" {
+		t.Errorf("expected the email in Trash, got %+v", trashed)
+	}
+}
+
+func TestSaveAttachmentInChunks(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+	previous := attachmentChunkSize
+	attachmentChunkSize = 16
+	t.Cleanup(func() { attachmentChunkSize = previous })
+
+	content := bytes.Repeat([]byte("attachment data "), 10)
+	encoded := base64.StdEncoding.EncodeToString(content)
+	raw := "From: alice@example.com\r\nSubject: Report\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nAttached.\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=report.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" + encoded[:60] + "\r\n" + encoded[60:] + "\r\n--b--\r\n"
+	if err := AppendMessage(account, "INBOX", nil, time.Time{}, []byte(raw)); err != nil {
+		t.Fatalf("AppendMessage() failed: %v", err)
+	}
+	infos, _, err := ListMessages(account, "INBOX")
+	if err != nil {
+		t.Fatalf("ListMessages() failed: %v", err)
+	}
+	uid := infos[len(infos)-1].UID
+
+	var fetched []int64
+	var buf bytes.Buffer
+	err = SaveAttachmentFromMailbox(context.Background(), account, "INBOX", uid, "2", "base64", &buf, func(n int64) {
+		fetched = append(fetched, n)
+	})
+	if err != nil {
+		t.Fatalf("SaveAttachmentFromMailbox() failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("expected the decoded attachment, got %q", buf.String())
+	}
+	if len(fetched) < 2 || fetched[len(fetched)-1] != int64(len(encoded)+2) {
+		t.Errorf("expected progress after each chunk up to the part's size, got %v", fetched)
+	}
+
+	// A cancelled download stops before the next chunk.
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks := 0
+	err = SaveAttachmentFromMailbox(ctx, account, "INBOX", uid, "2", "base64", io.Discard, func(n int64) {
+		chunks++
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) || chunks != 1 {
+		t.Errorf("expected the download to stop after one chunk, got %v after %d", err, chunks)
+	}
+}
+
+// lazyBodyMessage has an HTML part that needs decoding, a small inline
+// image, a large inline image and a PDF.
+func lazyBodyMessage() string {
+	small := base64.StdEncoding.EncodeToString([]byte("small png"))
+	large := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x89}, inlineImageMaxSize))
+	return "From: alice@example.com\r\nTo: me@example.com\r\nSubject: Newsletter\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/related; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/html; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"<p>Caf=E9 <img src=3D\"cid:logo\"></p>\r\n" +
+		"--inner\r\nContent-Type: image/png\r\nContent-ID: <logo>\r\nContent-Transfer-Encoding: base64\r\n\r\n" + small + "\r\n" +
+		"--inner\r\nContent-Type: image/png\r\nContent-ID: <banner>\r\nContent-Transfer-Encoding: base64\r\n\r\n" + large + "\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=report.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("%PDF-1.4")) + "\r\n" +
+		"--outer--\r\n"
+}
+
+func checkLazyBody(t *testing.T, body string, attachments []Attachment) {
+	t.Helper()
+	if body != "<p>Café <img src=\"cid:logo\"></p>" {
+		t.Errorf("expected the HTML part decoded, got %q", body)
+	}
+	if len(attachments) != 3 {
+		t.Fatalf("expected 3 attachments, got %+v", attachments)
+	}
+	logo, banner, report := attachments[0], attachments[1], attachments[2]
+	if logo.ContentID != "logo" || string(logo.Data) != "small png" {
+		t.Errorf("expected the small inline image to be fetched, got %+v", logo)
+	}
+	if banner.ContentID != "banner" || banner.Data != nil || banner.Size <= inlineImageMaxSize {
+		t.Errorf("expected the large inline image to be listed but not fetched, got size %d and %d bytes", banner.Size, len(banner.Data))
+	}
+	if report.Filename != "report.pdf" || report.PartID != "2" || report.Data != nil || report.Size == 0 {
+		t.Errorf("expected the PDF to be listed but not fetched, got %+v", report)
+	}
+}
+
+func TestFetchEmailBodyFetchesOnlyWhatIsShown(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+	if err := AppendMessage(account, "INBOX", nil, time.Time{}, []byte(lazyBodyMessage())); err != nil {
+		t.Fatalf("AppendMessage() failed: %v", err)
+	}
+	infos, _, err := ListMessages(account, "INBOX")
+	if err != nil {
+		t.Fatalf("ListMessages() failed: %v", err)
+	}
+
+	body, attachments, err := FetchEmailBodyFromMailbox(account, "INBOX", infos[len(infos)-1].UID)
+	if err != nil {
+		t.Fatalf("FetchEmailBodyFromMailbox() failed: %v", err)
+	}
+	checkLazyBody(t, strings.TrimSpace(body), attachments)
+
+	body, attachments, err = ParseMessage(strings.NewReader(lazyBodyMessage()))
+	if err != nil {
+		t.Fatalf("ParseMessage() failed: %v", err)
+	}
+	checkLazyBody(t, strings.TrimSpace(body), attachments)
+}
+
+func TestFetchMailboxPageFetchesPreviews(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+	html := "From: alice@example.com\r\nTo: contact@example.org\r\nSubject: Newsletter\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"<html><head><style>p { color: red; }</style></head><body><p>Caf=E9 opens</p><p>at noon</p></body></html>\r\n"
+	// The plain text part is longer than what is fetched of it, and is cut
+	// in the middle of an encoded character.
+	plain := "From: bob@example.com\r\nTo: contact@example.org\r\nSubject: Report\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Hello,\r\n\r\n   the report is attached.\r\n" + strings.Repeat("=C3=A9", 200) + "\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>Hello in HTML</p>\r\n--b--\r\n"
+	for _, msg := range []string{html, plain} {
+		if err := AppendMessage(account, "INBOX", nil, time.Time{}, []byte(msg)); err != nil {
+			t.Fatalf("AppendMessage() failed: %v", err)
+		}
+	}
+
+	page, err := FetchMailboxPage(account, "INBOX", 10, 0, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxPage() failed: %v", err)
+	}
+	previews := make(map[string]string)
+	for _, e := range page.Emails {
+		previews[e.Subject] = e.Preview
+	}
+	if previews["Newsletter"] != "Café opens at noon" {
+		t.Errorf("expected the HTML stripped from the preview, got %q", previews["Newsletter"])
+	}
+	report := previews["Report"]
+	if !strings.HasPrefix(report, "Hello, the report is attached. éé") || len([]rune(report)) > previewMaxLen {
+		t.Errorf("expected the start of the plain text part on one line, got %q", report)
+	}
+}
@@ -0,0 +1,118 @@
+package fetcher
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/floatpane/matcha/config"
+)
+
+// Folder is a mailbox on the server, as returned by LIST, with its message
+// counts from STATUS.
+type Folder struct {
+	Name       string
+	Delimiter  string
+	Attributes []string
+	Messages   uint32
+	Unseen     uint32
+}
+
+// Selectable reports whether the folder can be opened. Folders marked
+// \Noselect only exist to hold child folders.
+func (f Folder) Selectable() bool {
+	for _, attr := range f.Attributes {
+		if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, "\\NonExistent") {
+			return false
+		}
+	}
+	return true
+}
+
+// Depth returns how deeply the folder is nested, 0 for top-level folders.
+func (f Folder) Depth() int {
+	if f.Delimiter == "" {
+		return 0
+	}
+	return strings.Count(f.Name, f.Delimiter)
+}
+
+// DisplayName returns the last component of the folder's hierarchical name.
+func (f Folder) DisplayName() string {
+	if f.Delimiter == "" {
+		return f.Name
+	}
+	parts := strings.Split(f.Name, f.Delimiter)
+	return parts[len(parts)-1]
+}
+
+// FetchFolders lists all folders of the account, sorted so that children
+// follow their parent, with message and unread counts for each selectable one.
+func FetchFolders(account *config.Account) ([]Folder, error) {
+	var folders []Folder
+	err := pool.withClientRetry(account, func(c *client.Client) error {
+		folders = nil
+
+		mailboxes := make(chan *imap.MailboxInfo, 16)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.List("", "*", mailboxes)
+		}()
+		for info := range mailboxes {
+			folders = append(folders, Folder{
+				Name:       info.Name,
+				Delimiter:  info.Delimiter,
+				Attributes: info.Attributes,
+			})
+		}
+		if err := <-done; err != nil {
+			return err
+		}
+
+		for i := range folders {
+			if !folders[i].Selectable() {
+				continue
+			}
+			status, err := c.Status(folders[i].Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+			if err != nil {
+				// Some servers refuse STATUS on special folders; keep them without counts.
+				continue
+			}
+			folders[i].Messages = status.Messages
+			folders[i].Unseen = status.Unseen
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	SortFolders(folders)
+	return folders, nil
+}
+
+// SortFolders orders folders alphabetically by path with INBOX first, so
+// that every folder is directly followed by its children.
+func SortFolders(folders []Folder) {
+	key := func(f Folder) []string {
+		if f.Delimiter == "" {
+			return []string{f.Name}
+		}
+		return strings.Split(f.Name, f.Delimiter)
+	}
+	sort.SliceStable(folders, func(i, j int) bool {
+		a, b := key(folders[i]), key(folders[j])
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] == b[k] {
+				continue
+			}
+			aInbox, bInbox := strings.EqualFold(a[k], "INBOX"), strings.EqualFold(b[k], "INBOX")
+			if aInbox != bInbox {
+				return aInbox
+			}
+			return strings.ToLower(a[k]) < strings.ToLower(b[k])
+		}
+		return len(a) < len(b)
+	})
+}
@@ -0,0 +1,65 @@
+package fetcher
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/client"
+)
+
+func TestFetchFolders(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	for _, name := range []string{"Work", "Archive", "Work/Projects"} {
+		if err := c.Create(name); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+
+	folders, err := FetchFolders(account)
+	if err != nil {
+		t.Fatalf("FetchFolders() failed: %v", err)
+	}
+
+	var names []string
+	for _, f := range folders {
+		names = append(names, f.Name)
+	}
+	want := []string{"INBOX", "Archive", "Work", "Work/Projects"}
+	if len(names) != len(want) {
+		t.Fatalf("expected folders %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected folders %v, got %v", want, names)
+		}
+	}
+
+	inbox := folders[0]
+	if inbox.Messages != 1 {
+		t.Errorf("expected INBOX to have 1 message, got %d", inbox.Messages)
+	}
+
+	projects := folders[3]
+	if projects.Depth() != 1 || projects.DisplayName() != "Projects" {
+		t.Errorf("expected Work/Projects at depth 1 named Projects, got depth %d named %q", projects.Depth(), projects.DisplayName())
+	}
+}
+
+func TestFolderSelectable(t *testing.T) {
+	if !(Folder{Name: "INBOX"}).Selectable() {
+		t.Error("expected a folder without attributes to be selectable")
+	}
+	if (Folder{Name: "[Gmail]", Attributes: []string{"\\Noselect"}}).Selectable() {
+		t.Error("expected a \\Noselect folder not to be selectable")
+	}
+}
@@ -0,0 +1,323 @@
+package fetcher
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/floatpane/matcha/config"
+)
+
+const (
+	// idleRestartInterval restarts IDLE before servers drop idle clients (RFC 2177 says 29 minutes).
+	idleRestartInterval = 25 * time.Minute
+	minReconnectDelay   = 5 * time.Second
+	maxReconnectDelay   = 5 * time.Minute
+)
+
+// MailboxUpdate describes changes pushed by the server for a watched mailbox.
+type MailboxUpdate struct {
+	AccountID string
+	Mailbox   string
+	New       []Email  // Newly arrived emails, newest first
+	Expunged  []uint32 // UIDs removed from the mailbox
+}
+
+// Watcher keeps a dedicated IDLE connection per account on a mailbox and
+// reports new and expunged messages. Servers without IDLE are polled at the
+// account's poll interval instead.
+type Watcher struct {
+	updates chan MailboxUpdate
+	dial    func(account *config.Account) (*client.Client, error)
+
+	mu      sync.Mutex
+	stops   map[string]chan struct{}
+	wg      sync.WaitGroup
+	closed  bool
+	closeCh chan struct{}
+}
+
+// NewWatcher creates a watcher with no accounts.
+func NewWatcher() *Watcher {
+	return newWatcher(connect)
+}
+
+func newWatcher(dial func(account *config.Account) (*client.Client, error)) *Watcher {
+	return &Watcher{
+		updates: make(chan MailboxUpdate),
+		dial:    dial,
+		stops:   make(map[string]chan struct{}),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Updates returns the channel on which mailbox changes are delivered.
+func (w *Watcher) Updates() <-chan MailboxUpdate {
+	return w.updates
+}
+
+// Watch starts watching mailbox for the account, replacing any previous watch
+// for the same account.
+func (w *Watcher) Watch(account config.Account, mailbox string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if stop, ok := w.stops[account.ID]; ok {
+		close(stop)
+	}
+	stop := make(chan struct{})
+	w.stops[account.ID] = stop
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run(&account, mailbox, stop)
+	}()
+}
+
+// Unwatch stops watching the account.
+func (w *Watcher) Unwatch(accountID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if stop, ok := w.stops[accountID]; ok {
+		close(stop)
+		delete(w.stops, accountID)
+	}
+}
+
+// Close stops all watches and waits for their connections to log out.
+func (w *Watcher) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.closeCh)
+	for id, stop := range w.stops {
+		close(stop)
+		delete(w.stops, id)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// run keeps a watch alive, reconnecting with backoff when the connection fails.
+func (w *Watcher) run(account *config.Account, mailbox string, stop <-chan struct{}) {
+	delay := minReconnectDelay
+	for {
+		connected, err := w.watch(account, mailbox, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("watch %s on %s: %v", mailbox, account.Email, err)
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// watch runs one connection until it fails or stop is closed. connected
+// reports whether the mailbox was selected successfully.
+func (w *Watcher) watch(account *config.Account, mailbox string, stop <-chan struct{}) (connected bool, err error) {
+	c, err := w.dial(account)
+	if err != nil {
+		return false, err
+	}
+	defer logout(c)
+
+	queue := newUpdateQueue()
+	raw := make(chan client.Update, 16)
+	c.Updates = raw
+	go queue.relay(raw, c.LoggedOut())
+
+	if _, err := c.Select(mailbox, true); err != nil {
+		return false, err
+	}
+	uids, err := c.UidSearch(&imap.SearchCriteria{})
+	if err != nil {
+		return false, err
+	}
+	sortUIDs(uids)
+
+	opts := &client.IdleOptions{
+		LogoutTimeout: idleRestartInterval,
+		PollInterval:  account.GetPollInterval(),
+	}
+
+	for {
+		idleStop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- c.Idle(idleStop, opts)
+		}()
+
+		select {
+		case <-stop:
+			close(idleStop)
+			<-idleDone
+			return true, nil
+		case err := <-idleDone:
+			close(idleStop)
+			return true, err
+		case <-queue.notify:
+		}
+
+		close(idleStop)
+		if err := <-idleDone; err != nil {
+			return true, err
+		}
+
+		update, err := applyUpdates(c, account, mailbox, &uids, queue.take())
+		if err != nil {
+			return true, err
+		}
+		if len(update.New) == 0 && len(update.Expunged) == 0 {
+			continue
+		}
+
+		select {
+		case w.updates <- update:
+		case <-stop:
+			return true, nil
+		case <-w.closeCh:
+			return true, nil
+		}
+	}
+}
+
+// applyUpdates turns unilateral server responses into a MailboxUpdate,
+// keeping uids (the mailbox's UIDs in sequence order) in sync.
+func applyUpdates(c *client.Client, account *config.Account, mailbox string, uids *[]uint32, pending []client.Update) (MailboxUpdate, error) {
+	update := MailboxUpdate{AccountID: account.ID, Mailbox: mailbox}
+
+	for _, u := range pending {
+		if expunge, ok := u.(*client.ExpungeUpdate); ok {
+			seq := int(expunge.SeqNum)
+			if seq >= 1 && seq <= len(*uids) {
+				update.Expunged = append(update.Expunged, (*uids)[seq-1])
+				*uids = append((*uids)[:seq-1], (*uids)[seq:]...)
+			}
+		}
+	}
+
+	mbox := c.Mailbox()
+	if mbox == nil {
+		return update, nil
+	}
+
+	switch {
+	case mbox.Messages < uint32(len(*uids)):
+		// Our view drifted from the server; diff against the full UID list.
+		current, err := c.UidSearch(&imap.SearchCriteria{})
+		if err != nil {
+			return update, err
+		}
+		sortUIDs(current)
+		present := make(map[uint32]bool, len(current))
+		for _, uid := range current {
+			present[uid] = true
+		}
+		for _, uid := range *uids {
+			if !present[uid] {
+				update.Expunged = append(update.Expunged, uid)
+			}
+		}
+		*uids = current
+
+	case mbox.Messages > uint32(len(*uids)):
+		var lastUID uint32
+		if len(*uids) > 0 {
+			lastUID = (*uids)[len(*uids)-1]
+		}
+		seqset := new(imap.SeqSet)
+		seqset.AddRange(lastUID+1, 0)
+
+		messages := make(chan *imap.Message, 16)
+		done := make(chan error, 1)
+		items := listFetchItems(c)
+		go func() {
+			done <- c.UidFetch(seqset, items, messages)
+		}()
+
+		var msgs []*imap.Message
+		for msg := range messages {
+			// "N:*" always includes the last message, even if its UID is below N.
+			if msg.Uid > lastUID {
+				msgs = append(msgs, msg)
+				*uids = append(*uids, msg.Uid)
+			}
+		}
+		if err := <-done; err != nil {
+			return update, err
+		}
+		fetchPreviews(c, msgs)
+		sortUIDs(*uids)
+
+		update.New = emailsFromMessages(account, mailbox, mbox.UidValidity, msgs)
+		for i, j := 0, len(update.New)-1; i < j; i, j = i+1, j-1 {
+			update.New[i], update.New[j] = update.New[j], update.New[i]
+		}
+	}
+
+	return update, nil
+}
+
+func sortUIDs(uids []uint32) {
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+}
+
+// updateQueue buffers unilateral updates without limit, so the client's
+// reader never blocks on us while a command is running.
+type updateQueue struct {
+	mu     sync.Mutex
+	items  []client.Update
+	notify chan struct{}
+}
+
+func newUpdateQueue() *updateQueue {
+	return &updateQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *updateQueue) relay(in <-chan client.Update, done <-chan struct{}) {
+	for {
+		select {
+		case u := <-in:
+			q.mu.Lock()
+			q.items = append(q.items, u)
+			q.mu.Unlock()
+			select {
+			case q.notify <- struct{}{}:
+			default:
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (q *updateQueue) take() []client.Update {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
@@ -0,0 +1,187 @@
+package fetcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/floatpane/matcha/config"
+)
+
+// pushBackend is a memory backend that can push unilateral updates to
+// connected clients and reports when a mailbox has been searched.
+type pushBackend struct {
+	*memory.Backend
+	updates  chan backend.Update
+	searched chan struct{}
+}
+
+func (be *pushBackend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func (be *pushBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &pushUser{User: u, searched: be.searched}, nil
+}
+
+type pushUser struct {
+	backend.User
+	searched chan struct{}
+}
+
+func (u *pushUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &pushMailbox{Mailbox: mbox, searched: u.searched}, nil
+}
+
+type pushMailbox struct {
+	backend.Mailbox
+	searched chan struct{}
+}
+
+func (m *pushMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	uids, err := m.Mailbox.SearchMessages(uid, criteria)
+	select {
+	case m.searched <- struct{}{}:
+	default:
+	}
+	return uids, err
+}
+
+func newPushServer(t *testing.T) (*pushBackend, string) {
+	t.Helper()
+
+	be := &pushBackend{
+		Backend:  memory.New(),
+		updates:  make(chan backend.Update, 1),
+		searched: make(chan struct{}, 1),
+	}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return be, l.Addr().String()
+}
+
+func plainDialer(addr string) func(*config.Account) (*client.Client, error) {
+	return func(account *config.Account) (*client.Client, error) {
+		c, err := client.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Login(account.Email, account.Password); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+func waitForUpdate(t *testing.T, w *Watcher) MailboxUpdate {
+	t.Helper()
+	select {
+	case u := <-w.Updates():
+		return u
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a mailbox update")
+		return MailboxUpdate{}
+	}
+}
+
+func TestWatcherReportsNewAndExpungedMessages(t *testing.T) {
+	be, addr := newPushServer(t)
+	account := testAccount()
+
+	w := newWatcher(plainDialer(addr))
+	defer w.Close()
+	w.Watch(*account, "INBOX")
+
+	select {
+	case <-be.searched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher never searched the mailbox")
+	}
+
+	user, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatalf("could not get INBOX: %v", err)
+	}
+	body := "From: sender@example.org\r\n" +
+		"To: contact@example.org\r\n" +
+		"Subject: Pushed\r\n" +
+		"\r\n" +
+		"New mail"
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+		t.Fatalf("could not create message: %v", err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatalf("could not get status: %v", err)
+	}
+	be.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate("username", "INBOX"), MailboxStatus: status}
+
+	u := waitForUpdate(t, w)
+	if u.AccountID != account.ID || u.Mailbox != "INBOX" {
+		t.Errorf("update for %s/%s, want %s/INBOX", u.AccountID, u.Mailbox, account.ID)
+	}
+	if len(u.New) != 1 || u.New[0].Subject != "Pushed" {
+		t.Fatalf("expected the pushed email, got %+v", u.New)
+	}
+
+	be.updates <- &backend.ExpungeUpdate{Update: backend.NewUpdate("username", "INBOX"), SeqNum: 1}
+
+	u = waitForUpdate(t, w)
+	if len(u.Expunged) != 1 || u.Expunged[0] != 6 {
+		t.Fatalf("expected UID 6 to be expunged, got %v", u.Expunged)
+	}
+	if len(u.New) != 0 {
+		t.Errorf("expected no new emails with the expunge, got %d", len(u.New))
+	}
+}
+
+func TestWatcherUnwatchStopsConnection(t *testing.T) {
+	be, addr := newPushServer(t)
+
+	w := newWatcher(plainDialer(addr))
+	w.Watch(*testAccount(), "INBOX")
+	select {
+	case <-be.searched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher never searched the mailbox")
+	}
+
+	w.Unwatch(testAccount().ID)
+
+	done := make(chan struct{})
+	go func() {
+		w.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after Unwatch")
+	}
+}
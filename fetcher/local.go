@@ -0,0 +1,137 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/floatpane/matcha/config"
+)
+
+// LocalMessage is a message read from a store on disk, such as a Maildir,
+// rather than fetched from a server.
+type LocalMessage struct {
+	UID     uint32
+	Flags   []string
+	Header  textproto.Header
+	Preview string // Start of the text, if the store keeps one
+}
+
+// LocalEmails converts local messages to emails like fetched ones, in the
+// same order, dropping messages that don't match the account's fetch filter.
+// sent tells whether mailbox is the account's Sent folder.
+func LocalEmails(account *config.Account, mailbox string, sent bool, uidValidity uint32, msgs []LocalMessage) []Email {
+	// The section emailsFromMessages looks the References header up by.
+	references := &imap.BodySectionName{BodyPartName: referencesSection.BodyPartName}
+
+	fetched := make([]*imap.Message, 0, len(msgs))
+	for _, m := range msgs {
+		envelope, err := backendutil.FetchEnvelope(m.Header)
+		if err != nil {
+			continue
+		}
+		literal := bytes.NewBufferString(fmt.Sprintf("References: %s\r\n\r\n", m.Header.Get("References")))
+		msg := &imap.Message{
+			Uid:      m.UID,
+			Envelope: envelope,
+			Flags:    m.Flags,
+			Body:     map[*imap.BodySectionName]imap.Literal{references: literal},
+			Items:    map[imap.FetchItem]interface{}{},
+		}
+		if m.Preview != "" {
+			msg.Items[previewItem] = m.Preview
+		}
+		fetched = append(fetched, msg)
+	}
+	return filterMessages(account, mailbox, sent, uidValidity, fetched)
+}
+
+// ParseMessage returns the text of a whole RFC 822 message and lists its
+// attachments, like FetchEmailBodyFromMailbox does for a message on the
+// server. Attachments get the same part IDs as on an IMAP server.
+func ParseMessage(r io.Reader) (string, []Attachment, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+	header, body, err := splitMessage(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	bs, err := backendutil.FetchBodyStructure(header, body, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	text, attachments := walkBodyStructure(bs)
+	return bodyFromSections(text, attachments, func(partID string) ([]byte, error) {
+		return messageSection(raw, partID)
+	})
+}
+
+// MessagePart returns the decoded content of a part of a whole RFC 822
+// message, like FetchAttachmentFromMailbox does for a message on the server.
+func MessagePart(r io.Reader, partID, encoding string) ([]byte, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := messageSection(raw, partID)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeAttachmentData(data, encoding)
+	if err != nil {
+		return data, nil
+	}
+	return decoded, nil
+}
+
+// MatchMessage reports whether a whole RFC 822 message with the given UID
+// and flags matches criteria, as a server's UID SEARCH would.
+func MatchMessage(r io.Reader, uid uint32, flags []string, criteria *imap.SearchCriteria) (bool, error) {
+	entity, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return false, err
+	}
+	// Without an arrival time, the message is taken to have arrived when sent.
+	header := mail.Header{Header: entity.Header}
+	date, _ := header.Date()
+	return backendutil.Match(entity, uid, uid, date, flags, criteria)
+}
+
+// splitMessage parses the header of a raw message and returns it with a
+// reader of the body.
+func splitMessage(raw []byte) (textproto.Header, io.Reader, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, br, nil
+}
+
+// messageSection returns the undecoded content of the part with the IMAP
+// part ID partID, e.g. "1.2", of a raw message.
+func messageSection(raw []byte, partID string) ([]byte, error) {
+	section, err := imap.ParseBodySectionName(imap.FetchItem(fmt.Sprintf("BODY[%s]", partID)))
+	if err != nil {
+		return nil, err
+	}
+	header, body, err := splitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	literal, err := backendutil.FetchBodySection(header, body, section)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(literal)
+}
@@ -0,0 +1,52 @@
+package fetcher
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/floatpane/matcha/config"
+)
+
+func readTestHeader(t *testing.T, s string) textproto.Header {
+	t.Helper()
+	header, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(s + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestLocalEmails(t *testing.T) {
+	account := &config.Account{ID: "local", Email: "me@example.com"}
+	msgs := []LocalMessage{
+		{UID: 2, Flags: []string{FlagSeen}, Header: readTestHeader(t, "From: Alice <alice@example.com>\r\n"+
+			"To: me@example.com\r\n"+
+			"Subject: =?utf-8?q?Caf=C3=A9?=\r\n"+
+			"Message-Id: <b@example.com>\r\n"+
+			"In-Reply-To: <a@example.com>\r\n"+
+			"References: <root@example.com> <a@example.com>\r\n")},
+		{UID: 1, Header: readTestHeader(t, "From: alice@example.com\r\nTo: someone@example.com\r\nSubject: Not for me\r\n")},
+	}
+
+	emails := LocalEmails(account, "INBOX", false, 7, msgs)
+	if len(emails) != 1 {
+		t.Fatalf("expected mail to other addresses to be filtered out, got %+v", emails)
+	}
+	e := emails[0]
+	if e.UID != 2 || e.From != "alice@example.com" || e.Subject != "Café" || e.UIDValidity != 7 || e.AccountID != "local" {
+		t.Errorf("unexpected email %+v", e)
+	}
+	if len(e.References) != 2 || e.References[0] != "<root@example.com>" || e.InReplyTo != "<a@example.com>" {
+		t.Errorf("expected the references to be read, got %v and %q", e.References, e.InReplyTo)
+	}
+	if e.IsUnread() {
+		t.Error("expected the email to keep its flags")
+	}
+
+	// In the Sent folder, mail is matched on its sender.
+	if sent := LocalEmails(account, "Sent", true, 7, msgs); len(sent) != 0 {
+		t.Errorf("expected no email sent by me, got %+v", sent)
+	}
+}
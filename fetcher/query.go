@@ -0,0 +1,154 @@
+package fetcher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+)
+
+// queryDateLayout is the date format accepted by since: and before:.
+const queryDateLayout = "2006-01-02"
+
+// Query is a parsed search query. Every condition must match.
+//
+// The query language is a list of space-separated terms:
+//
+//	from:alice to:bob subject:"weekly report" body:invoice
+//	since:2024-01-31 before:2024-03-01 has:attachment is:unread
+//
+// Terms without a prefix are searched for in headers and body.
+type Query struct {
+	From          []string
+	To            []string
+	Subject       []string
+	Body          []string
+	Text          []string
+	Since         time.Time
+	Before        time.Time
+	HasAttachment bool
+	Unread        bool
+}
+
+// ParseQuery parses a search query. Values containing spaces can be quoted.
+func ParseQuery(s string) (Query, error) {
+	var q Query
+
+	terms, err := splitQuery(s)
+	if err != nil {
+		return q, err
+	}
+	if len(terms) == 0 {
+		return q, fmt.Errorf("empty search query")
+	}
+
+	for _, term := range terms {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok || value == "" {
+			q.Text = append(q.Text, term)
+			continue
+		}
+
+		switch strings.ToLower(field) {
+		case "from":
+			q.From = append(q.From, value)
+		case "to":
+			q.To = append(q.To, value)
+		case "subject":
+			q.Subject = append(q.Subject, value)
+		case "body":
+			q.Body = append(q.Body, value)
+		case "since":
+			t, err := time.ParseInLocation(queryDateLayout, value, time.Local)
+			if err != nil {
+				return q, fmt.Errorf("since: expects a date like 2024-01-31, got %q", value)
+			}
+			q.Since = t
+		case "before":
+			t, err := time.ParseInLocation(queryDateLayout, value, time.Local)
+			if err != nil {
+				return q, fmt.Errorf("before: expects a date like 2024-01-31, got %q", value)
+			}
+			q.Before = t
+		case "has":
+			if !strings.EqualFold(value, "attachment") {
+				return q, fmt.Errorf("unknown has: value %q, expected has:attachment", value)
+			}
+			q.HasAttachment = true
+		case "is":
+			if !strings.EqualFold(value, "unread") {
+				return q, fmt.Errorf("unknown is: value %q, expected is:unread", value)
+			}
+			q.Unread = true
+		default:
+			// Not an operator, e.g. a time like 10:30.
+			q.Text = append(q.Text, term)
+		}
+	}
+
+	return q, nil
+}
+
+// splitQuery splits s at spaces, keeping quoted sections together and
+// dropping the quotes.
+func splitQuery(s string) ([]string, error) {
+	var (
+		terms   []string
+		current strings.Builder
+		quoted  bool
+		started bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case unicode.IsSpace(r) && !quoted:
+			if started {
+				terms = append(terms, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in search query")
+	}
+	if started {
+		terms = append(terms, current.String())
+	}
+	return terms, nil
+}
+
+// Criteria converts the query to IMAP SEARCH criteria.
+func (q Query) Criteria() *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	for _, v := range q.From {
+		c.Header.Add("From", v)
+	}
+	for _, v := range q.To {
+		c.Header.Add("To", v)
+	}
+	for _, v := range q.Subject {
+		c.Header.Add("Subject", v)
+	}
+	c.Body = append(c.Body, q.Body...)
+	c.Text = append(c.Text, q.Text...)
+	c.SentSince = q.Since
+	// SENTBEFORE is exclusive, like the before: operator.
+	c.SentBefore = q.Before
+	if q.HasAttachment {
+		// IMAP has no attachment criterion; mail with attachments is sent as
+		// multipart/mixed.
+		c.Header.Add("Content-Type", "multipart/mixed")
+	}
+	if q.Unread {
+		c.WithoutFlags = append(c.WithoutFlags, imap.SeenFlag)
+	}
+	return c
+}
@@ -0,0 +1,88 @@
+package fetcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(`from:alice subject:"weekly report" since:2024-01-31 has:attachment is:unread invoice`)
+	if err != nil {
+		t.Fatalf("ParseQuery() failed: %v", err)
+	}
+
+	if len(q.From) != 1 || q.From[0] != "alice" {
+		t.Errorf("expected From [alice], got %v", q.From)
+	}
+	if len(q.Subject) != 1 || q.Subject[0] != "weekly report" {
+		t.Errorf("expected Subject [weekly report], got %v", q.Subject)
+	}
+	want := time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)
+	if !q.Since.Equal(want) {
+		t.Errorf("expected Since %v, got %v", want, q.Since)
+	}
+	if !q.HasAttachment || !q.Unread {
+		t.Errorf("expected has:attachment and is:unread to be set, got %+v", q)
+	}
+	if len(q.Text) != 1 || q.Text[0] != "invoice" {
+		t.Errorf("expected Text [invoice], got %v", q.Text)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, s := range []string{"", "   ", "since:yesterday", "is:starred", "has:pdf", `subject:"open`} {
+		if _, err := ParseQuery(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestQueryCriteria(t *testing.T) {
+	q, err := ParseQuery("to:bob body:invoice before:2024-03-01 is:unread")
+	if err != nil {
+		t.Fatalf("ParseQuery() failed: %v", err)
+	}
+
+	c := q.Criteria()
+	if got := c.Header.Get("To"); got != "bob" {
+		t.Errorf("expected To header criterion bob, got %q", got)
+	}
+	if len(c.Body) != 1 || c.Body[0] != "invoice" {
+		t.Errorf("expected Body [invoice], got %v", c.Body)
+	}
+	if !c.SentBefore.Equal(q.Before) {
+		t.Errorf("expected SentBefore %v, got %v", q.Before, c.SentBefore)
+	}
+	if len(c.WithoutFlags) != 1 || c.WithoutFlags[0] != imap.SeenFlag {
+		t.Errorf("expected WithoutFlags [\\Seen], got %v", c.WithoutFlags)
+	}
+}
+
+func TestSearchEmails(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	q, err := ParseQuery("to:contact@example.org")
+	if err != nil {
+		t.Fatalf("ParseQuery() failed: %v", err)
+	}
+	emails, err := SearchMailboxEmails(account, "INBOX", q.Criteria(), 0)
+	if err != nil {
+		t.Fatalf("SearchMailboxEmails() failed: %v", err)
+	}
+	if len(emails) != 1 || emails[0].UID != 6 {
+		t.Fatalf("expected the inbox message to match, got %+v", emails)
+	}
+
+	q, _ = ParseQuery("to:nobody@example.org")
+	emails, err = SearchMailboxEmails(account, "INBOX", q.Criteria(), 0)
+	if err != nil {
+		t.Fatalf("SearchMailboxEmails() failed: %v", err)
+	}
+	if len(emails) != 0 {
+		t.Errorf("expected no matches, got %d", len(emails))
+	}
+}
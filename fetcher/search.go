@@ -0,0 +1,81 @@
+package fetcher
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/floatpane/matcha/config"
+)
+
+// SearchMailboxEmails runs a UID SEARCH in mailbox and returns the matching
+// emails, newest first. A limit of 0 returns all matches.
+func SearchMailboxEmails(account *config.Account, mailbox string, criteria *imap.SearchCriteria, limit int) ([]Email, error) {
+	var msgs []*imap.Message
+	var uidValidity uint32
+	var sent bool
+	err := pool.withClientRetry(account, func(c *client.Client) error {
+		msgs = nil
+		sent = mailbox == SentMailbox(account)
+
+		// Select explicitly so the search sees the current state of the mailbox.
+		mbox, err := c.Select(mailbox, false)
+		if err != nil {
+			return err
+		}
+		uidValidity = mbox.UidValidity
+
+		uids, err := c.UidSearch(restrictCriteria(criteria, addressCriteria(account, sent)))
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+
+		sortUIDs(uids)
+		if limit > 0 && len(uids) > limit {
+			uids = uids[len(uids)-limit:]
+		}
+
+		msgs, err = fetchEnvelopes(c, uids)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	emails := filterMessages(account, mailbox, sent, uidValidity, msgs)
+	sortEmailsNewestFirst(emails)
+	return emails, nil
+}
+
+// fetchEnvelopes fetches the list items of the given messages in the
+// selected mailbox.
+func fetchEnvelopes(c *client.Client, uids []uint32) ([]*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	items := listFetchItems(c)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range messages {
+		msgs = append(msgs, msg)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	fetchPreviews(c, msgs)
+	return msgs, nil
+}
+
+// sortEmailsNewestFirst orders emails by UID, highest first, which matches
+// arrival order within a mailbox.
+func sortEmailsNewestFirst(emails []Email) {
+	sort.SliceStable(emails, func(i, j int) bool { return emails[i].UID > emails[j].UID })
+}
@@ -0,0 +1,315 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/floatpane/matcha/config"
+)
+
+const (
+	// keepAliveInterval is how long a pooled connection may sit unused before
+	// it is checked with a NOOP on its next use.
+	keepAliveInterval = 5 * time.Minute
+	// logoutTimeout bounds how long closing a connection may block on LOGOUT.
+	logoutTimeout = 3 * time.Second
+)
+
+// session is a single authenticated IMAP connection for one account.
+// Its mutex serializes commands on the connection.
+type session struct {
+	mu       sync.Mutex
+	client   *client.Client
+	key      string
+	lastUsed time.Time
+}
+
+// sessionPool keeps one long-lived session per account, and the special
+// folders discovered on its first connection.
+type sessionPool struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	special  map[string]specialFolders
+	dial     func(account *config.Account) (*client.Client, error)
+}
+
+// specialFolders are the special folders discovered for an account.
+type specialFolders struct {
+	key     string // sessionKey of the account they were discovered with
+	folders map[SpecialUse]string
+	failed  bool // Discovery failed and is retried on the next command
+}
+
+var pool = newSessionPool(connect)
+
+func newSessionPool(dial func(account *config.Account) (*client.Client, error)) *sessionPool {
+	return &sessionPool{
+		sessions: make(map[string]*session),
+		special:  make(map[string]specialFolders),
+		dial:     dial,
+	}
+}
+
+// sessionKey identifies the connection settings of an account, so that a
+// pooled connection is replaced when the account is edited.
+func sessionKey(account *config.Account) string {
+	return fmt.Sprintf("%s:%d|%s|%s", account.GetIMAPServer(), account.GetIMAPPort(), account.Email, account.Password)
+}
+
+func (p *sessionPool) get(accountID string) *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[accountID]
+	if !ok {
+		s = &session{}
+		p.sessions[accountID] = s
+	}
+	return s
+}
+
+// withClient runs fn with the account's pooled connection, dialing a new one
+// if there is none or the previous one dropped. If the connection goes away
+// while fn runs, fn is not run again, as its commands may have taken effect
+// already; commands that only read use withClientRetry.
+func (p *sessionPool) withClient(account *config.Account, fn func(c *client.Client) error) error {
+	return p.run(account, "", false, fn)
+}
+
+// withClientRetry is like withClient, but if fn fails because the
+// connection went away, it is retried once on a fresh connection. fn must
+// only read, so that running it twice does no harm.
+func (p *sessionPool) withClientRetry(account *config.Account, fn func(c *client.Client) error) error {
+	return p.run(account, "", true, fn)
+}
+
+// withMailbox is like withClient but makes sure mailbox is selected first.
+func (p *sessionPool) withMailbox(account *config.Account, mailbox string, fn func(c *client.Client) error) error {
+	return p.run(account, mailbox, false, fn)
+}
+
+// withMailboxRetry is like withClientRetry but makes sure mailbox is
+// selected first.
+func (p *sessionPool) withMailboxRetry(account *config.Account, mailbox string, fn func(c *client.Client) error) error {
+	return p.run(account, mailbox, true, fn)
+}
+
+// run runs fn with the account's connection, after selecting mailbox unless
+// it is "". A connection that went away before fn ran, such as while
+// selecting, is always replaced and tried again; one that went away while
+// fn ran only if retry is set.
+func (p *sessionPool) run(account *config.Account, mailbox string, retry bool, fn func(c *client.Client) error) error {
+	s := p.get(account.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.ensure(account, p.dial)
+	if err != nil {
+		return err
+	}
+	p.discoverSpecial(account, c)
+
+	ran, err := runIn(c, mailbox, fn)
+	if err != nil && isDisconnected(c, err) && (retry || !ran) {
+		s.drop()
+		c, dialErr := s.ensure(account, p.dial)
+		if dialErr != nil {
+			return err
+		}
+		_, err = runIn(c, mailbox, fn)
+	}
+	s.lastUsed = time.Now()
+	return err
+}
+
+// runIn selects mailbox unless it is "" and runs fn, telling whether fn
+// was run.
+func runIn(c *client.Client, mailbox string, fn func(c *client.Client) error) (bool, error) {
+	if mailbox != "" {
+		if err := selectMailbox(c, mailbox); err != nil {
+			return false, err
+		}
+	}
+	return true, fn(c)
+}
+
+// discoverSpecial discovers the account's special folders with c, unless
+// they are known already. A failure is remembered too, so that looking them
+// up from within fn never needs the connection.
+func (p *sessionPool) discoverSpecial(account *config.Account, c *client.Client) {
+	key := sessionKey(account)
+	p.mu.Lock()
+	cached, ok := p.special[account.ID]
+	p.mu.Unlock()
+	if ok && cached.key == key && !cached.failed {
+		return
+	}
+
+	folders, err := discoverSpecialMailboxes(c)
+	p.mu.Lock()
+	p.special[account.ID] = specialFolders{key: key, folders: folders, failed: err != nil}
+	p.mu.Unlock()
+}
+
+// specialMailboxes returns the account's discovered special folders,
+// connecting first if the account has no connection yet.
+func (p *sessionPool) specialMailboxes(account *config.Account) map[SpecialUse]string {
+	key := sessionKey(account)
+	p.mu.Lock()
+	cached, ok := p.special[account.ID]
+	p.mu.Unlock()
+	if ok && cached.key == key {
+		return cached.folders
+	}
+
+	if err := p.withClient(account, func(*client.Client) error { return nil }); err != nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.special[account.ID].folders
+}
+
+// closeSession logs out and forgets the session for one account.
+func (p *sessionPool) closeSession(accountID string) {
+	p.mu.Lock()
+	s, ok := p.sessions[accountID]
+	delete(p.sessions, accountID)
+	p.mu.Unlock()
+
+	if ok {
+		s.mu.Lock()
+		s.close()
+		s.mu.Unlock()
+	}
+}
+
+// closeAll logs out of every pooled connection in parallel.
+func (p *sessionPool) closeAll() {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = make(map[string]*session)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			s.mu.Lock()
+			s.close()
+			s.mu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// ensure returns a live connection, reconnecting when needed.
+// The caller must hold s.mu.
+func (s *session) ensure(account *config.Account, dial func(*config.Account) (*client.Client, error)) (*client.Client, error) {
+	key := sessionKey(account)
+	if s.client != nil && s.key != key {
+		s.close()
+	}
+
+	if s.client != nil {
+		select {
+		case <-s.client.LoggedOut():
+			s.drop()
+		default:
+		}
+	}
+
+	if s.client != nil && time.Since(s.lastUsed) > keepAliveInterval {
+		if err := s.client.Noop(); err != nil {
+			s.drop()
+		}
+	}
+
+	if s.client == nil {
+		c, err := dial(account)
+		if err != nil {
+			return nil, err
+		}
+		s.client = c
+		s.key = key
+		s.lastUsed = time.Now()
+	}
+	return s.client, nil
+}
+
+// drop discards a connection that is known to be dead.
+func (s *session) drop() {
+	if s.client != nil {
+		_ = s.client.Terminate()
+		s.client = nil
+	}
+}
+
+// close logs out of the connection.
+func (s *session) close() {
+	if s.client == nil {
+		return
+	}
+	logout(s.client)
+	s.client = nil
+}
+
+// logout logs out of c, closing the connection if the server does not answer
+// within logoutTimeout.
+func logout(c *client.Client) {
+	done := make(chan struct{})
+	go func() {
+		_ = c.Logout()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(logoutTimeout):
+		_ = c.Terminate()
+	}
+}
+
+// selectMailbox selects mailbox unless it is already selected read-write.
+func selectMailbox(c *client.Client, mailbox string) error {
+	if mbox := c.Mailbox(); mbox != nil && mbox.Name == mailbox && !mbox.ReadOnly {
+		return nil
+	}
+	_, err := c.Select(mailbox, false)
+	return err
+}
+
+// isDisconnected reports whether err means the connection itself is gone,
+// as opposed to the server rejecting a command.
+func isDisconnected(c *client.Client, err error) bool {
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+	}
+	if c.State() == imap.LogoutState {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// CloseSessions logs out of all pooled IMAP connections. It is meant to be
+// called once when the application exits.
+func CloseSessions() {
+	pool.closeAll()
+}
+
+// CloseSession logs out of the pooled connection of a single account, e.g.
+// after the account was removed.
+func CloseSession(accountID string) {
+	pool.closeSession(accountID)
+}
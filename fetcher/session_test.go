@@ -0,0 +1,347 @@
+package fetcher
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/oauth"
+)
+
+// newTestServer starts an in-memory IMAP server on localhost and returns its address.
+// The server has a single user "username"/"password" with one message in INBOX.
+func newTestServer(t *testing.T) string {
+	return newTestServerWithout(t)
+}
+
+// newTestServerWithout is newTestServer for a server that doesn't advertise
+// the given capabilities, such as MOVE, which go-imap's server always does.
+func newTestServerWithout(t *testing.T, caps ...string) string {
+	t.Helper()
+
+	s := server.New(moveBackend{memory.New()})
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go s.Serve(&capsListener{l, caps})
+	t.Cleanup(func() { s.Close() })
+
+	return l.Addr().String()
+}
+
+// capsListener accepts connections that leave capabilities out of what the
+// server advertises.
+type capsListener struct {
+	net.Listener
+	drop []string
+}
+
+func (l *capsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return capsConn{c, l.drop}, nil
+}
+
+type capsConn struct {
+	net.Conn
+	drop []string
+}
+
+func (c capsConn) Write(b []byte) (int, error) {
+	if len(c.drop) == 0 || !bytes.Contains(b, []byte("CAPABILITY")) {
+		return c.Conn.Write(b)
+	}
+	out := b
+	for _, capability := range c.drop {
+		out = bytes.ReplaceAll(out, []byte(" "+capability), nil)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// moveBackend wraps the memory backend, which advertises MOVE without
+// implementing it, so that moving messages works in tests.
+type moveBackend struct {
+	*memory.Backend
+}
+
+func (b moveBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := b.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return moveUser{u}, nil
+}
+
+type moveUser struct {
+	backend.User
+}
+
+func (u moveUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return moveMailbox{mbox}, nil
+}
+
+type moveMailbox struct {
+	backend.Mailbox
+}
+
+func (m moveMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := m.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	if err := m.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return m.Expunge()
+}
+
+// usePlainPool replaces the global session pool with one that dials addr without TLS,
+// counting how many connections are opened.
+func usePlainPool(t *testing.T, addr string) *int32 {
+	t.Helper()
+
+	var dials int32
+	previous := pool
+	pool = newSessionPool(func(account *config.Account) (*client.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		c, err := client.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Login(account.Email, account.Password); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+	t.Cleanup(func() {
+		pool.closeAll()
+		pool = previous
+	})
+	return &dials
+}
+
+func testAccount() *config.Account {
+	return &config.Account{
+		ID:              "test-account",
+		Email:           "username",
+		Password:        "password",
+		ServiceProvider: "custom",
+		Addresses:       []string{"contact@example.org"},
+	}
+}
+
+func TestSessionPoolReusesConnection(t *testing.T) {
+	dials := usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxEmails() failed: %v", err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+
+	if _, _, err := FetchEmailBodyFromMailbox(account, "INBOX", emails[0].UID); err != nil {
+		t.Fatalf("FetchEmailBodyFromMailbox() failed: %v", err)
+	}
+	if _, err := FetchMailboxEmails(account, "INBOX", 10, 0); err != nil {
+		t.Fatalf("second FetchMailboxEmails() failed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(dials); got != 1 {
+		t.Errorf("expected a single connection to be reused, got %d dials", got)
+	}
+}
+
+func TestSessionPoolReconnectsAfterDrop(t *testing.T) {
+	dials := usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	if _, err := FetchMailboxEmails(account, "INBOX", 10, 0); err != nil {
+		t.Fatalf("FetchMailboxEmails() failed: %v", err)
+	}
+
+	// Simulate the server dropping the connection.
+	s := pool.get(account.ID)
+	if err := s.client.Terminate(); err != nil {
+		t.Fatalf("could not terminate connection: %v", err)
+	}
+	<-s.client.LoggedOut()
+
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxEmails() after drop failed: %v", err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email after reconnect, got %d", len(emails))
+	}
+	if got := atomic.LoadInt32(dials); got != 2 {
+		t.Errorf("expected 2 dials after reconnect, got %d", got)
+	}
+}
+
+func TestSessionPoolRetriesOnlyReads(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	// dropOnce drops the connection in the middle of the first run.
+	runs := 0
+	dropOnce := func(c *client.Client) error {
+		runs++
+		if runs == 1 {
+			_ = c.Terminate()
+			<-c.LoggedOut()
+		}
+		return c.Noop()
+	}
+
+	if err := pool.withMailbox(account, "INBOX", dropOnce); err == nil {
+		t.Error("expected a command cut off by the drop to fail")
+	}
+	if runs != 1 {
+		t.Errorf("expected a command that may change the mailbox to run once, ran %d times", runs)
+	}
+
+	runs = 0
+	if err := pool.withMailboxRetry(account, "INBOX", dropOnce); err != nil {
+		t.Errorf("expected a read to be retried after the drop, got %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("expected a read to run again, ran %d times", runs)
+	}
+}
+
+func TestSessionPoolReconnectsWhenAccountChanges(t *testing.T) {
+	dials := usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	if _, err := FetchMailboxEmails(account, "INBOX", 10, 0); err != nil {
+		t.Fatalf("FetchMailboxEmails() failed: %v", err)
+	}
+
+	edited := *account
+	edited.Password = "wrong"
+	if _, err := FetchMailboxEmails(&edited, "INBOX", 10, 0); err == nil {
+		t.Fatal("expected login with the edited password to fail")
+	}
+	if got := atomic.LoadInt32(dials); got != 2 {
+		t.Errorf("expected edited account settings to force a new connection, got %d dials", got)
+	}
+}
+
+func TestCloseSessions(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	if _, err := FetchMailboxEmails(account, "INBOX", 10, 0); err != nil {
+		t.Fatalf("FetchMailboxEmails() failed: %v", err)
+	}
+	c := pool.get(account.ID).client
+
+	CloseSessions()
+
+	if c.State() != imap.LogoutState {
+		t.Errorf("expected connection to be logged out, state is %v", c.State())
+	}
+	if len(pool.sessions) != 0 {
+		t.Errorf("expected no pooled sessions after CloseSessions, got %d", len(pool.sessions))
+	}
+}
+
+func TestConnectSecurity(t *testing.T) {
+	host, portStr, err := net.SplitHostPort(newTestServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	account := testAccount()
+	account.IMAPServer = host
+	account.IMAPPort = port
+
+	// The test server offers neither TLS nor STARTTLS.
+	account.IMAPSecurity = config.SecuritySTARTTLS
+	if _, err := connect(account); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("expected STARTTLS to be required, got %v", err)
+	}
+
+	account.IMAPSecurity = config.SecurityNone
+	c, err := connect(account)
+	if err != nil {
+		t.Fatalf("expected a plaintext connection to localhost, got %v", err)
+	}
+	c.Logout()
+
+	account.IMAPServer = "imap.example.com"
+	if _, err := connect(account); err == nil || !strings.Contains(err.Error(), "only allowed to localhost") {
+		t.Errorf("expected plaintext to be refused for a remote host, got %v", err)
+	}
+}
+
+func TestConnectOAuth2(t *testing.T) {
+	bkd := memory.New()
+	s := server.New(bkd)
+	s.AllowInsecureAuth = true
+	s.EnableAuth(sasl.OAuthBearer, func(conn server.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if opts.Username != "username" || opts.Token != "access-token" {
+				return &sasl.OAuthBearerError{Status: "invalid_token"}
+			}
+			user, err := bkd.Login(conn.Info(), "username", "password")
+			if err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_request"}
+			}
+			conn.Context().State = imap.AuthenticatedState
+			conn.Context().User = user
+			return nil
+		})
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	account := testAccount()
+	account.IMAPServer = "127.0.0.1"
+	account.IMAPPort = l.Addr().(*net.TCPAddr).Port
+	account.IMAPSecurity = config.SecurityNone
+	account.Password = ""
+	account.AuthMethod = config.AuthOAuth2
+	account.OAuth2 = &config.OAuth2{ClientID: "client"}
+
+	if _, err := connect(account); !errors.Is(err, oauth.ErrNotSignedIn) {
+		t.Errorf("expected ErrNotSignedIn before signing in, got %v", err)
+	}
+
+	oauth.Store(account.ID, &oauth.Token{AccessToken: "access-token"})
+	t.Cleanup(func() { oauth.Store(account.ID, nil) })
+	c, err := connect(account)
+	if err != nil {
+		t.Fatalf("expected to log in with the access token, got %v", err)
+	}
+	c.Logout()
+}
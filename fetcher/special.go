@@ -0,0 +1,234 @@
+package fetcher
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/floatpane/matcha/config"
+)
+
+// SpecialUse is the role of a special folder, named by its RFC 6154
+// attribute.
+type SpecialUse string
+
+const (
+	SpecialSent    SpecialUse = imap.SentAttr
+	SpecialArchive SpecialUse = imap.ArchiveAttr
+	SpecialTrash   SpecialUse = imap.TrashAttr
+	SpecialDrafts  SpecialUse = imap.DraftsAttr
+	SpecialJunk    SpecialUse = imap.JunkAttr
+)
+
+// specialUses are the roles that are discovered, in no particular order.
+var specialUses = []SpecialUse{SpecialSent, SpecialArchive, SpecialTrash, SpecialDrafts, SpecialJunk}
+
+// xlistAttrs maps the attributes of Gmail's XLIST that differ from RFC 6154.
+var xlistAttrs = map[string]string{
+	"\\AllMail": imap.AllAttr,
+	"\\Spam":    imap.JunkAttr,
+}
+
+// specialNames are common names of special folders, most likely first, for
+// servers that don't mark them. They match the last component of a folder
+// name, ignoring case.
+var specialNames = map[SpecialUse][]string{
+	SpecialSent:    {"Sent", "Sent Items", "Sent Messages", "Sent Mail", "Gesendet", "Gesendete Elemente", "Envoyés", "Éléments envoyés", "Enviados", "Posta inviata"},
+	SpecialArchive: {"Archive", "Archives", "Archived", "Archiv"},
+	SpecialTrash:   {"Trash", "Deleted Items", "Deleted Messages", "Bin", "Papierkorb", "Gelöschte Elemente", "Corbeille", "Papelera", "Cestino"},
+	SpecialDrafts:  {"Drafts", "Draft", "Entwürfe", "Brouillons", "Borradores", "Bozze"},
+	SpecialJunk:    {"Junk", "Junk E-mail", "Junk Email", "Spam", "Bulk Mail", "Spamverdacht", "Courrier indésirable"},
+}
+
+// SpecialMailbox returns the name of the account's folder with the given
+// role. A folder set in the account's config wins over the one discovered on
+// the server, which wins over the provider's usual name.
+func SpecialMailbox(account *config.Account, use SpecialUse) string {
+	if name := specialOverride(account, use); name != "" {
+		return name
+	}
+	if name := pool.specialMailboxes(account)[use]; name != "" {
+		return name
+	}
+	return defaultSpecialMailbox(account, use)
+}
+
+// SpecialFolder is SpecialMailbox for stores whose folders are listed
+// locally rather than on a server, such as a Maildir.
+func SpecialFolder(account *config.Account, use SpecialUse, folders []Folder) string {
+	if name := specialOverride(account, use); name != "" {
+		return name
+	}
+	mailboxes := make([]*imap.MailboxInfo, 0, len(folders))
+	for _, f := range folders {
+		mailboxes = append(mailboxes, &imap.MailboxInfo{Name: f.Name, Delimiter: f.Delimiter, Attributes: f.Attributes})
+	}
+	if name := pickSpecialMailboxes(mailboxes, false)[use]; name != "" {
+		return name
+	}
+	return specialNames[use][0]
+}
+
+// SentMailbox returns the name of the account's sent mail folder.
+func SentMailbox(account *config.Account) string {
+	return SpecialMailbox(account, SpecialSent)
+}
+
+// TrashMailbox returns the name of the account's trash folder.
+func TrashMailbox(account *config.Account) string {
+	return SpecialMailbox(account, SpecialTrash)
+}
+
+// ArchiveMailbox returns the name of the account's archive folder.
+func ArchiveMailbox(account *config.Account) string {
+	return SpecialMailbox(account, SpecialArchive)
+}
+
+func specialOverride(account *config.Account, use SpecialUse) string {
+	switch use {
+	case SpecialSent:
+		return account.SentFolder
+	case SpecialArchive:
+		return account.ArchiveFolder
+	case SpecialTrash:
+		return account.TrashFolder
+	case SpecialDrafts:
+		return account.DraftsFolder
+	case SpecialJunk:
+		return account.JunkFolder
+	}
+	return ""
+}
+
+// defaultSpecialMailbox returns the provider's usual name for a special
+// folder, for when the server's folders can't be listed.
+func defaultSpecialMailbox(account *config.Account, use SpecialUse) string {
+	switch account.ServiceProvider {
+	case "gmail":
+		return map[SpecialUse]string{
+			SpecialSent:    "[Gmail]/Sent Mail",
+			SpecialArchive: "[Gmail]/All Mail",
+			SpecialTrash:   "[Gmail]/Trash",
+			SpecialDrafts:  "[Gmail]/Drafts",
+			SpecialJunk:    "[Gmail]/Spam",
+		}[use]
+	case "icloud":
+		return map[SpecialUse]string{
+			SpecialSent:    "Sent Messages",
+			SpecialArchive: "Archive",
+			SpecialTrash:   "Deleted Messages",
+			SpecialDrafts:  "Drafts",
+			SpecialJunk:    "Junk",
+		}[use]
+	default:
+		return specialNames[use][0]
+	}
+}
+
+// specialUseList is a LIST that asks for special-use attributes, or Gmail's
+// older XLIST.
+type specialUseList struct {
+	name             string
+	returnSpecialUse bool // Add RETURN (SPECIAL-USE) of RFC 6154
+}
+
+func (cmd *specialUseList) Command() *imap.Command {
+	args := []interface{}{"", "*"}
+	if cmd.returnSpecialUse {
+		args = append(args, imap.RawString("RETURN"), []interface{}{imap.RawString("SPECIAL-USE")})
+	}
+	return &imap.Command{Name: cmd.name, Arguments: args}
+}
+
+// listResponse collects the LIST or XLIST responses of a specialUseList.
+type listResponse struct {
+	name      string
+	mailboxes []*imap.MailboxInfo
+}
+
+func (r *listResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || !strings.EqualFold(name, r.name) {
+		return responses.ErrUnhandled
+	}
+	info := &imap.MailboxInfo{}
+	if err := info.Parse(fields); err != nil {
+		return err
+	}
+	r.mailboxes = append(r.mailboxes, info)
+	return nil
+}
+
+// discoverSpecialMailboxes finds the account's special folders from their
+// SPECIAL-USE attributes, falling back to XLIST and then to common names.
+// Roles without a folder on the server are left out.
+func discoverSpecialMailboxes(c *client.Client) (map[SpecialUse]string, error) {
+	cmd := &specialUseList{name: "LIST"}
+	if ok, _ := c.Support("SPECIAL-USE"); ok {
+		// Some servers only return the attributes when asked for them.
+		cmd.returnSpecialUse, _ = c.Support("LIST-EXTENDED")
+	} else if ok, _ := c.Support("XLIST"); ok {
+		cmd.name = "XLIST"
+	}
+
+	res := &listResponse{name: cmd.name}
+	status, err := c.Execute(cmd, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only Gmail's All Mail archives by moving there; elsewhere \All is a
+	// virtual folder that can't be moved to.
+	gmail, _ := c.Support("X-GM-EXT-1")
+	return pickSpecialMailboxes(res.mailboxes, gmail), nil
+}
+
+// pickSpecialMailboxes assigns listed folders to roles, first by attribute
+// and then by name.
+func pickSpecialMailboxes(mailboxes []*imap.MailboxInfo, gmail bool) map[SpecialUse]string {
+	found := make(map[SpecialUse]string)
+	byName := make(map[string]string)
+	var all string
+	for _, info := range mailboxes {
+		f := Folder{Name: info.Name, Delimiter: info.Delimiter, Attributes: info.Attributes}
+		if !f.Selectable() {
+			continue
+		}
+		if _, ok := byName[strings.ToLower(f.DisplayName())]; !ok {
+			byName[strings.ToLower(f.DisplayName())] = f.Name
+		}
+		for _, attr := range f.Attributes {
+			if mapped, ok := xlistAttrs[attr]; ok {
+				attr = mapped
+			}
+			if strings.EqualFold(attr, imap.AllAttr) && all == "" {
+				all = f.Name
+			}
+			for _, use := range specialUses {
+				if strings.EqualFold(attr, string(use)) && found[use] == "" {
+					found[use] = f.Name
+				}
+			}
+		}
+	}
+	if found[SpecialArchive] == "" && gmail && all != "" {
+		found[SpecialArchive] = all
+	}
+
+	for _, use := range specialUses {
+		if found[use] != "" {
+			continue
+		}
+		for _, name := range specialNames[use] {
+			if mailbox, ok := byName[strings.ToLower(name)]; ok {
+				found[use] = mailbox
+				break
+			}
+		}
+	}
+	return found
+}
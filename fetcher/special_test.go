@@ -0,0 +1,95 @@
+package fetcher
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestPickSpecialMailboxes(t *testing.T) {
+	mailboxes := []*imap.MailboxInfo{
+		{Name: "INBOX", Delimiter: "/"},
+		{Name: "[Gmail]", Delimiter: "/", Attributes: []string{imap.NoSelectAttr}},
+		{Name: "[Gmail]/Gesendet", Delimiter: "/", Attributes: []string{"\\HasNoChildren", "\\Sent"}},
+		{Name: "[Gmail]/Alle Nachrichten", Delimiter: "/", Attributes: []string{"\\AllMail"}},
+		{Name: "[Gmail]/Papierkorb", Delimiter: "/", Attributes: []string{"\\Trash"}},
+		{Name: "[Gmail]/Spam", Delimiter: "/", Attributes: []string{"\\Spam"}},
+		// A user folder named like a special one doesn't win over the attribute.
+		{Name: "Trash", Delimiter: "/"},
+		{Name: "Projects/Drafts", Delimiter: "/"},
+	}
+
+	got := pickSpecialMailboxes(mailboxes, true)
+	want := map[SpecialUse]string{
+		SpecialSent:    "[Gmail]/Gesendet",
+		SpecialArchive: "[Gmail]/Alle Nachrichten",
+		SpecialTrash:   "[Gmail]/Papierkorb",
+		SpecialJunk:    "[Gmail]/Spam",
+		SpecialDrafts:  "Projects/Drafts",
+	}
+	for use, name := range want {
+		if got[use] != name {
+			t.Errorf("%s: expected %q, got %q", use, name, got[use])
+		}
+	}
+
+	// Elsewhere \All is virtual and can't be archived to.
+	if got := pickSpecialMailboxes(mailboxes, false); got[SpecialArchive] != "" {
+		t.Errorf("expected no archive without Gmail, got %q", got[SpecialArchive])
+	}
+}
+
+func TestSpecialUseListCommand(t *testing.T) {
+	cmd := (&specialUseList{name: "LIST", returnSpecialUse: true}).Command()
+	if cmd.Name != "LIST" || len(cmd.Arguments) != 4 || cmd.Arguments[2] != imap.RawString("RETURN") {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	if cmd := (&specialUseList{name: "XLIST"}).Command(); cmd.Name != "XLIST" || len(cmd.Arguments) != 2 {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+
+	r := &listResponse{name: "XLIST"}
+	resp := &imap.DataResp{Fields: []interface{}{"XLIST", []interface{}{"\\Sent"}, "/", "Sent Mail"}}
+	if err := r.Handle(resp); err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	if len(r.mailboxes) != 1 || r.mailboxes[0].Name != "Sent Mail" {
+		t.Errorf("unexpected mailboxes %+v", r.mailboxes)
+	}
+}
+
+func TestSpecialMailboxDiscoveryAndOverrides(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	for _, name := range []string{"Sent Items", "Deleted Items"} {
+		if err := c.Create(name); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+
+	if got := SentMailbox(account); got != "Sent Items" {
+		t.Errorf("expected Sent Items, got %q", got)
+	}
+	if got := TrashMailbox(account); got != "Deleted Items" {
+		t.Errorf("expected Deleted Items, got %q", got)
+	}
+	if got := ArchiveMailbox(account); got != "Archive" {
+		t.Errorf("expected the default archive, got %q", got)
+	}
+
+	account.TrashFolder = "Bin"
+	if got := TrashMailbox(account); got != "Bin" {
+		t.Errorf("expected the configured trash, got %q", got)
+	}
+}
@@ -0,0 +1,307 @@
+package fetcher
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/floatpane/matcha/config"
+)
+
+// statusHighestModSeq is the STATUS item of CONDSTORE (RFC 7162).
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// SyncState is what is remembered about a mailbox between refreshes, so
+// that the next refresh only asks for what changed since.
+type SyncState struct {
+	UIDValidity uint32
+	UIDNext     uint32
+	Messages    uint32
+	// HighestModSeq is the mailbox's HIGHESTMODSEQ, or 0 if the server
+	// doesn't support CONDSTORE.
+	HighestModSeq uint64
+}
+
+// Changes is what happened in a mailbox since a SyncState was taken.
+type Changes struct {
+	New      []Email             // Newly arrived emails, newest first
+	Flags    map[uint32][]string // Flags of known emails that may have changed
+	Vanished []uint32            // Known UIDs that were expunged
+	State    SyncState           // The state to sync from next time
+}
+
+// Apply returns emails with the changes applied: vanished emails are dropped,
+// flags are updated and new emails are added in front.
+func (ch Changes) Apply(emails []Email) []Email {
+	vanished := make(map[uint32]bool, len(ch.Vanished))
+	for _, uid := range ch.Vanished {
+		vanished[uid] = true
+	}
+
+	known := make(map[uint32]bool, len(emails))
+	var kept []Email
+	for _, e := range emails {
+		if vanished[e.UID] {
+			continue
+		}
+		if flags, ok := ch.Flags[e.UID]; ok {
+			e.Flags = append([]string(nil), flags...)
+		}
+		known[e.UID] = true
+		kept = append(kept, e)
+	}
+
+	var added []Email
+	for _, e := range ch.New {
+		if !known[e.UID] && !vanished[e.UID] {
+			added = append(added, e)
+		}
+	}
+	return append(added, kept...)
+}
+
+// FetchSyncState returns the current sync state of mailbox. Take it before
+// fetching the emails it will be synced against, so that nothing arriving
+// in between is missed.
+func FetchSyncState(account *config.Account, mailbox string) (SyncState, error) {
+	var state SyncState
+	err := pool.withClientRetry(account, func(c *client.Client) error {
+		var err error
+		state, err = mailboxState(c, mailbox, supportsCondStore(c))
+		return err
+	})
+	return state, err
+}
+
+// SyncMailbox returns the changes to mailbox since state was taken. known
+// are the UIDs of the emails the caller has loaded from it; only those are
+// checked for flag changes and expunges.
+//
+// On servers with CONDSTORE an unchanged mailbox costs a single STATUS, and
+// flags are only fetched for messages changed since the last HIGHESTMODSEQ.
+// Other servers get a UID-range diff: the flags of all known messages are
+// fetched and expunges are found with UID SEARCH. QRESYNC's VANISHED
+// responses are not used, because enabling QRESYNC also replaces EXPUNGE
+// responses for the whole connection.
+//
+// If the mailbox's UIDVALIDITY changed, it returns ErrUIDValidityChanged.
+func SyncMailbox(account *config.Account, mailbox string, state SyncState, known []uint32) (Changes, error) {
+	var changes Changes
+	var msgs []*imap.Message
+	err := pool.withClientRetry(account, func(c *client.Client) error {
+		changes = Changes{}
+		msgs = nil
+
+		condstore := supportsCondStore(c)
+		current, err := mailboxState(c, mailbox, condstore)
+		if err != nil {
+			return err
+		}
+		if current.UIDValidity != state.UIDValidity {
+			return ErrUIDValidityChanged
+		}
+		changes.State = current
+		if condstore && current == state {
+			return nil
+		}
+
+		if _, err := c.Select(mailbox, false); err != nil {
+			return err
+		}
+
+		arrived := make(map[uint32]bool)
+		if current.UIDNext > state.UIDNext {
+			msgs, err = fetchNewMessages(c, state.UIDNext)
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				arrived[msg.Uid] = true
+			}
+		}
+
+		// Messages that arrived since the state was taken are accounted for,
+		// so any other difference in the message count is expunges.
+		expunged := int64(state.Messages) + int64(len(arrived)) - int64(current.Messages)
+		present := make(map[uint32]bool, len(known))
+		if expunged > 0 && len(known) > 0 {
+			criteria := imap.NewSearchCriteria()
+			criteria.Uid = new(imap.SeqSet)
+			criteria.Uid.AddNum(known...)
+			uids, err := c.UidSearch(criteria)
+			if err != nil {
+				return err
+			}
+			for _, uid := range uids {
+				present[uid] = true
+			}
+		} else {
+			for _, uid := range known {
+				// Emails learned of after the state was taken must still be here.
+				present[uid] = uid < state.UIDNext || arrived[uid]
+			}
+		}
+
+		var remaining []uint32
+		for _, uid := range known {
+			if present[uid] {
+				remaining = append(remaining, uid)
+			} else {
+				changes.Vanished = append(changes.Vanished, uid)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+
+		var modSeq uint64
+		if condstore {
+			if current.HighestModSeq == state.HighestModSeq {
+				return nil
+			}
+			modSeq = state.HighestModSeq
+		}
+		changes.Flags, err = fetchFlags(c, remaining, modSeq)
+		return err
+	})
+	if err != nil {
+		return Changes{}, err
+	}
+
+	changes.New = emailsFromMessages(account, mailbox, state.UIDValidity, msgs)
+	sortEmailsNewestFirst(changes.New)
+	return changes, nil
+}
+
+// supportsCondStore reports whether the server supports CONDSTORE, which
+// QRESYNC implies.
+func supportsCondStore(c *client.Client) bool {
+	for _, capability := range []string{"CONDSTORE", "QRESYNC"} {
+		if ok, _ := c.Support(capability); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mailboxState returns the sync state of mailbox with a STATUS command.
+func mailboxState(c *client.Client, mailbox string, condstore bool) (SyncState, error) {
+	items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages}
+	if condstore {
+		items = append(items, statusHighestModSeq)
+	}
+	status, err := c.Status(mailbox, items)
+	if err != nil {
+		return SyncState{}, err
+	}
+
+	state := SyncState{
+		UIDValidity: status.UidValidity,
+		UIDNext:     status.UidNext,
+		Messages:    status.Messages,
+	}
+	if v, ok := status.Items[statusHighestModSeq]; ok && v != nil {
+		if state.HighestModSeq, err = parseModSeq(v); err != nil {
+			return SyncState{}, err
+		}
+	}
+	return state, nil
+}
+
+// parseModSeq parses a mod-sequence, which unlike other numbers in IMAP
+// may not fit in 32 bits.
+func parseModSeq(f interface{}) (uint64, error) {
+	var s string
+	switch f := f.(type) {
+	case uint32:
+		return uint64(f), nil
+	case string:
+		s = f
+	case imap.RawString:
+		s = string(f)
+	default:
+		return 0, fmt.Errorf("imap: expected a mod-sequence, got %T", f)
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("imap: invalid mod-sequence %q", s)
+	}
+	return n, nil
+}
+
+// fetchNewMessages fetches the list items of the messages in the selected
+// mailbox with a UID of at least uidNext.
+func fetchNewMessages(c *client.Client, uidNext uint32) ([]*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(uidNext, 0)
+
+	messages := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	items := listFetchItems(c)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range messages {
+		// "N:*" always includes the last message, even if its UID is below N.
+		if msg.Uid >= uidNext {
+			msgs = append(msgs, msg)
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	fetchPreviews(c, msgs)
+	return msgs, nil
+}
+
+// changedSinceFetch is a UID FETCH of flags with the CHANGEDSINCE modifier
+// of RFC 7162.
+type changedSinceFetch struct {
+	seqset *imap.SeqSet
+	modSeq uint64
+}
+
+func (cmd *changedSinceFetch) Command() *imap.Command {
+	return &imap.Command{
+		Name: "FETCH",
+		Arguments: []interface{}{
+			cmd.seqset,
+			[]interface{}{imap.RawString(imap.FetchUid), imap.RawString(imap.FetchFlags)},
+			[]interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.modSeq, 10))},
+		},
+	}
+}
+
+// fetchFlags returns the flags of the given messages in the selected mailbox.
+// A non-zero modSeq restricts them to messages changed since that
+// mod-sequence.
+func fetchFlags(c *client.Client, uids []uint32, modSeq uint64) (map[uint32][]string, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	// Buffered for every message, as the handler can't block the reader.
+	messages := make(chan *imap.Message, len(uids))
+	var err error
+	if modSeq > 0 {
+		var status *imap.StatusResp
+		res := &responses.Fetch{Messages: messages, SeqSet: seqset, Uid: true}
+		status, err = c.Execute(&commands.Uid{Cmd: &changedSinceFetch{seqset: seqset, modSeq: modSeq}}, res)
+		if err == nil {
+			err = status.Err()
+		}
+		close(messages)
+	} else {
+		err = c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+	}
+
+	flags := make(map[uint32][]string)
+	for msg := range messages {
+		flags[msg.Uid] = msg.Flags
+	}
+	return flags, err
+}
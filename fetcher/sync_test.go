@@ -0,0 +1,138 @@
+package fetcher
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestSyncMailboxWithoutCondStore(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	state, err := FetchSyncState(account, "INBOX")
+	if err != nil {
+		t.Fatalf("FetchSyncState() failed: %v", err)
+	}
+	if state.UIDValidity == 0 || state.UIDNext != 7 || state.Messages != 1 || state.HighestModSeq != 0 {
+		t.Fatalf("unexpected initial state %+v", state)
+	}
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	if err := c.Create("Trash"); err != nil {
+		t.Fatalf("could not create Trash: %v", err)
+	}
+	msg := "From: sender@example.org\r\n" +
+		"To: contact@example.org\r\n" +
+		"Subject: New\r\n" +
+		"\r\n" +
+		"Hello"
+	if err := c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(msg)); err != nil {
+		t.Fatalf("could not append: %v", err)
+	}
+	if err := SetFlagInMailbox(account, "INBOX", []uint32{6}, FlagFlagged, true); err != nil {
+		t.Fatalf("SetFlagInMailbox() failed: %v", err)
+	}
+
+	changes, err := SyncMailbox(account, "INBOX", state, []uint32{6})
+	if err != nil {
+		t.Fatalf("SyncMailbox() failed: %v", err)
+	}
+	if len(changes.New) != 1 || changes.New[0].UID != 7 || changes.New[0].Subject != "New" {
+		t.Fatalf("expected the new email, got %+v", changes.New)
+	}
+	if len(changes.Vanished) != 0 {
+		t.Errorf("expected nothing to vanish, got %v", changes.Vanished)
+	}
+	if e := (Email{Flags: changes.Flags[6]}); !e.HasFlag(FlagFlagged) {
+		t.Errorf("expected the flag change of UID 6, got %v", changes.Flags)
+	}
+	if changes.State.UIDNext != 8 || changes.State.Messages != 2 {
+		t.Errorf("unexpected state after sync %+v", changes.State)
+	}
+
+	if err := DeleteEmailFromMailbox(account, "INBOX", 6); err != nil {
+		t.Fatalf("DeleteEmailFromMailbox() failed: %v", err)
+	}
+
+	changes, err = SyncMailbox(account, "INBOX", changes.State, []uint32{6, 7})
+	if err != nil {
+		t.Fatalf("SyncMailbox() failed: %v", err)
+	}
+	if len(changes.Vanished) != 1 || changes.Vanished[0] != 6 || len(changes.New) != 0 {
+		t.Fatalf("expected UID 6 to vanish and nothing new, got %+v", changes)
+	}
+
+	stale := changes.State
+	stale.UIDValidity++
+	if _, err := SyncMailbox(account, "INBOX", stale, []uint32{7}); !errors.Is(err, ErrUIDValidityChanged) {
+		t.Fatalf("expected ErrUIDValidityChanged, got %v", err)
+	}
+}
+
+func TestChangesApply(t *testing.T) {
+	emails := []Email{
+		{UID: 3, Subject: "three"},
+		{UID: 2, Subject: "two"},
+		{UID: 1, Subject: "one", Flags: []string{FlagSeen}},
+	}
+	changes := Changes{
+		// UID 3 was already added by the watcher.
+		New:      []Email{{UID: 4, Subject: "four"}, {UID: 3, Subject: "three"}},
+		Flags:    map[uint32][]string{1: {}, 3: {FlagFlagged}},
+		Vanished: []uint32{2},
+	}
+
+	got := changes.Apply(emails)
+
+	var uids []uint32
+	for _, e := range got {
+		uids = append(uids, e.UID)
+	}
+	if len(uids) != 3 || uids[0] != 4 || uids[1] != 3 || uids[2] != 1 {
+		t.Fatalf("expected UIDs [4 3 1], got %v", uids)
+	}
+	if !got[1].HasFlag(FlagFlagged) || !got[2].IsUnread() {
+		t.Errorf("expected flags to be updated, got %+v", got)
+	}
+	if emails[2].IsUnread() {
+		t.Error("expected Apply not to modify the input emails")
+	}
+}
+
+func TestParseModSeq(t *testing.T) {
+	// Mod-sequences are 63-bit, larger than other IMAP numbers.
+	n, err := parseModSeq("9223372036854775807")
+	if err != nil || n != 9223372036854775807 {
+		t.Fatalf("parseModSeq() = %d, %v", n, err)
+	}
+	if _, err := parseModSeq([]interface{}{}); err == nil {
+		t.Error("expected an error for a list")
+	}
+}
+
+func TestChangedSinceFetchCommand(t *testing.T) {
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 5)
+
+	cmd := (&changedSinceFetch{seqset: seqset, modSeq: 12345}).Command()
+	if cmd.Name != "FETCH" || len(cmd.Arguments) != 3 {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	modifier, _ := cmd.Arguments[2].([]interface{})
+	if len(modifier) != 2 || modifier[0] != imap.RawString("CHANGEDSINCE") || modifier[1] != imap.RawString("12345") {
+		t.Errorf("unexpected CHANGEDSINCE modifier %v", cmd.Arguments[2])
+	}
+}
@@ -0,0 +1,540 @@
+package fetcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/floatpane/matcha/config"
+)
+
+// maxConversationIDs caps the message IDs searched for when fetching a
+// conversation, so long threads don't produce huge SEARCH commands.
+const maxConversationIDs = 20
+
+// Thread is a conversation: emails linked by Message-ID, In-Reply-To and
+// References, oldest first.
+type Thread struct {
+	ID     string
+	Emails []Email
+}
+
+// Latest returns the newest email of the thread.
+func (t Thread) Latest() Email {
+	return t.Emails[len(t.Emails)-1]
+}
+
+// Unread returns the number of unread emails in the thread.
+func (t Thread) Unread() int {
+	n := 0
+	for _, e := range t.Emails {
+		if e.IsUnread() {
+			n++
+		}
+	}
+	return n
+}
+
+// ThreadEmails sets the ThreadID of emails fetched from mailbox. It uses the
+// THREAD=REFERENCES extension when the server has it and threads the emails
+// locally otherwise.
+func ThreadEmails(account *config.Account, mailbox string, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	var threads [][]uint32
+	err := pool.withMailboxRetry(account, mailbox, func(c *client.Client) error {
+		threads = nil
+		ok, err := c.Support("THREAD=REFERENCES")
+		if err != nil || !ok {
+			return err
+		}
+
+		uids := new(imap.SeqSet)
+		for _, e := range emails {
+			uids.AddNum(e.UID)
+		}
+		criteria := imap.NewSearchCriteria()
+		criteria.Uid = uids
+
+		threads, err = uidThread(c, "REFERENCES", criteria)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if threads == nil {
+		assignThreads(emails)
+		return nil
+	}
+
+	byUID := make(map[uint32]int, len(emails))
+	for i, e := range emails {
+		byUID[e.UID] = i
+	}
+	for _, uids := range threads {
+		// The first UID of a thread is its root, or the oldest child of a
+		// missing root.
+		root, ok := byUID[uids[0]]
+		if !ok {
+			continue
+		}
+		id := threadRoot(emails[root])
+		for _, uid := range uids {
+			if i, ok := byUID[uid]; ok {
+				emails[i].ThreadID = id
+			}
+		}
+	}
+	// Anything the server left out is threaded locally.
+	assignThreads(emails)
+	return nil
+}
+
+// threadRoot returns the ID a thread rooted at e is known by. It matches the
+// root container the local threader builds for the same emails.
+func threadRoot(e Email) string {
+	if len(e.References) > 0 {
+		return e.References[0]
+	}
+	if e.InReplyTo != "" {
+		return e.InReplyTo
+	}
+	return messageKey(e)
+}
+
+// messageKey returns e's Message-ID, or a stand-in for emails without one.
+func messageKey(e Email) string {
+	if e.MessageID != "" {
+		return e.MessageID
+	}
+	return fmt.Sprintf("uid:%s:%s:%d", e.AccountID, e.Mailbox, e.UID)
+}
+
+// GroupThreads groups emails into threads. Threads are ordered like their
+// newest email is in emails, so newest-first input gives newest-first threads.
+// Emails without a ThreadID are threaded locally.
+func GroupThreads(emails []Email) []Thread {
+	emails = append([]Email(nil), emails...)
+	assignThreads(emails)
+
+	var threads []Thread
+	index := make(map[string]int)
+	for _, e := range emails {
+		key := e.AccountID + "\x00" + e.ThreadID
+		i, ok := index[key]
+		if !ok {
+			i = len(threads)
+			index[key] = i
+			threads = append(threads, Thread{ID: e.ThreadID})
+		}
+		threads[i].Emails = append(threads[i].Emails, e)
+	}
+	for _, t := range threads {
+		sort.SliceStable(t.Emails, func(i, j int) bool { return t.Emails[i].Date.Before(t.Emails[j].Date) })
+	}
+	return threads
+}
+
+// container is a node of the local threader: a message ID that may or may
+// not belong to an email we have.
+type container struct {
+	id       string
+	email    int // Index into the emails being threaded, -1 if missing
+	parent   *container
+	children []*container
+}
+
+func (c *container) isAncestorOf(other *container) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) setParent(parent *container) {
+	if c.parent == parent || c == parent || c.isAncestorOf(parent) {
+		return
+	}
+	if c.parent != nil {
+		siblings := c.parent.children
+		for i, s := range siblings {
+			if s == c {
+				c.parent.children = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	c.parent = parent
+	parent.children = append(parent.children, c)
+}
+
+func (c *container) root() *container {
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
+
+// assignThreads sets the ThreadID of emails that have none, following the
+// first steps of Jamie Zawinski's threading algorithm: build a container per
+// message ID, link them along References and In-Reply-To, then merge roots
+// that are replies to the same subject.
+func assignThreads(emails []Email) {
+	byAccount := make(map[string][]int)
+	for i, e := range emails {
+		if e.ThreadID == "" {
+			byAccount[e.AccountID] = append(byAccount[e.AccountID], i)
+		}
+	}
+	if len(byAccount) == 0 {
+		return
+	}
+
+	for accountID, pending := range byAccount {
+		containers := make(map[string]*container)
+		get := func(id string) *container {
+			c, ok := containers[id]
+			if !ok {
+				c = &container{id: id, email: -1}
+				containers[id] = c
+			}
+			return c
+		}
+
+		// Link all of the account's emails, so new ones join known threads.
+		for i, e := range emails {
+			if e.AccountID != accountID {
+				continue
+			}
+			c := get(messageKey(e))
+			if c.email != -1 {
+				// Duplicate Message-ID, e.g. a copy in Sent and INBOX.
+				continue
+			}
+			c.email = i
+
+			refs := e.References
+			if e.InReplyTo != "" && (len(refs) == 0 || refs[len(refs)-1] != e.InReplyTo) {
+				refs = append(append([]string(nil), refs...), e.InReplyTo)
+			}
+			var prev *container
+			for _, id := range refs {
+				ref := get(id)
+				if prev != nil && ref.parent == nil {
+					ref.setParent(prev)
+				}
+				prev = ref
+			}
+			if prev != nil {
+				c.setParent(prev)
+			}
+		}
+
+		// Merge "Re:" roots into the root of the conversation they reply to.
+		bySubject := make(map[string]*container)
+		var replies []*container
+		roots := make(map[*container]bool)
+		for _, e := range emails {
+			if e.AccountID != accountID {
+				continue
+			}
+			c := get(messageKey(e)).root()
+			if roots[c] {
+				continue
+			}
+			roots[c] = true
+			subject, reply := rootSubject(c, emails)
+			if subject == "" {
+				continue
+			}
+			if reply {
+				replies = append(replies, c)
+			} else if _, ok := bySubject[subject]; !ok {
+				bySubject[subject] = c
+			}
+		}
+		for _, c := range replies {
+			subject, _ := rootSubject(c, emails)
+			if root, ok := bySubject[subject]; ok {
+				c.setParent(root)
+			}
+		}
+
+		for _, i := range pending {
+			root := get(messageKey(emails[i])).root()
+			// Join a thread the server already identified, if any.
+			id := knownThreadID(root, emails)
+			if id == "" {
+				id = root.id
+			}
+			emails[i].ThreadID = id
+		}
+	}
+}
+
+// knownThreadID returns the ThreadID of any email in the tree under c.
+func knownThreadID(c *container, emails []Email) string {
+	if c.email != -1 && emails[c.email].ThreadID != "" {
+		return emails[c.email].ThreadID
+	}
+	for _, child := range c.children {
+		if id := knownThreadID(child, emails); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// rootSubject returns the normalized subject of a root container, taken from
+// its email or its oldest child's, and whether it is a reply.
+func rootSubject(c *container, emails []Email) (string, bool) {
+	for c.email == -1 {
+		if len(c.children) == 0 {
+			return "", false
+		}
+		c = c.children[0]
+	}
+	return normalizeSubject(emails[c.email].Subject)
+}
+
+// normalizeSubject strips reply and forward prefixes from a subject and
+// reports whether there were any.
+func normalizeSubject(subject string) (string, bool) {
+	s := strings.TrimSpace(subject)
+	stripped := false
+	for {
+		lower := strings.ToLower(s)
+		found := false
+		for _, prefix := range []string{"re:", "fwd:", "fw:", "aw:"} {
+			if strings.HasPrefix(lower, prefix) {
+				s = strings.TrimSpace(s[len(prefix):])
+				stripped = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return strings.ToLower(s), stripped
+}
+
+// threadCommand is a THREAD command, as defined in RFC 5256.
+type threadCommand struct {
+	algorithm string
+	criteria  *imap.SearchCriteria
+}
+
+func (cmd *threadCommand) Command() *imap.Command {
+	args := []interface{}{imap.RawString(cmd.algorithm), imap.RawString("UTF-8")}
+	args = append(args, cmd.criteria.Format()...)
+	return &imap.Command{Name: "THREAD", Arguments: args}
+}
+
+// threadResponse collects the UIDs of each thread of a THREAD response, in
+// tree order.
+type threadResponse struct {
+	threads [][]uint32
+}
+
+func (r *threadResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "THREAD" {
+		return responses.ErrUnhandled
+	}
+	for _, f := range fields {
+		list, ok := f.([]interface{})
+		if !ok {
+			return fmt.Errorf("imap: malformed THREAD response")
+		}
+		var uids []uint32
+		if err := flattenThread(list, &uids); err != nil {
+			return err
+		}
+		if len(uids) > 0 {
+			r.threads = append(r.threads, uids)
+		}
+	}
+	return nil
+}
+
+// flattenThread appends the numbers of a nested thread list to uids,
+// depth first.
+func flattenThread(list []interface{}, uids *[]uint32) error {
+	for _, f := range list {
+		if sub, ok := f.([]interface{}); ok {
+			if err := flattenThread(sub, uids); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := imap.ParseNumber(f)
+		if err != nil {
+			return err
+		}
+		*uids = append(*uids, n)
+	}
+	return nil
+}
+
+// uidThread runs UID THREAD in the selected mailbox.
+func uidThread(c *client.Client, algorithm string, criteria *imap.SearchCriteria) ([][]uint32, error) {
+	res := &threadResponse{}
+	status, err := c.Execute(&commands.Uid{Cmd: &threadCommand{algorithm: algorithm, criteria: criteria}}, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return res.threads, nil
+}
+
+// FetchConversation returns every email of the conversation e belongs to,
+// from the inbox and the Sent folder, oldest first and with bodies. Bodies
+// of e and of the loaded emails are reused instead of being fetched again.
+func FetchConversation(account *config.Account, e Email, loaded LoadedBodies) ([]Email, error) {
+	criteria := ConversationCriteria(e)
+	if criteria == nil {
+		return []Email{e}, nil
+	}
+
+	var conversation []Email
+	seen := make(map[string]bool)
+	for _, mailbox := range []string{"INBOX", SentMailbox(account)} {
+		emails, err := SearchMailboxEmails(account, mailbox, criteria, 0)
+		if err != nil {
+			if mailbox == "INBOX" {
+				return nil, err
+			}
+			// Not every account has a Sent folder.
+			continue
+		}
+		for _, found := range emails {
+			key := messageKey(found)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			found.Mailbox = mailbox
+			conversation = append(conversation, found)
+		}
+	}
+	// A conversation of e alone needs no bodies beyond its own.
+	if len(conversation) == 0 || len(conversation) == 1 && messageKey(conversation[0]) == messageKey(e) {
+		return []Email{e}, nil
+	}
+
+	loaded = loaded.With(e)
+	for i := range conversation {
+		if loaded.Fill(&conversation[i]) {
+			continue
+		}
+		body, attachments, err := FetchEmailBodyFromMailbox(account, conversation[i].Mailbox, conversation[i].UID)
+		if err != nil {
+			return nil, err
+		}
+		conversation[i].Body = body
+		conversation[i].Attachments = attachments
+	}
+
+	sort.SliceStable(conversation, func(i, j int) bool { return conversation[i].Date.Before(conversation[j].Date) })
+	return conversation, nil
+}
+
+// LoadedBodies holds emails whose bodies have been fetched already, by
+// message, so that fetching a conversation doesn't fetch them again.
+type LoadedBodies map[string]Email
+
+// NewLoadedBodies indexes the emails among emails that have a body.
+func NewLoadedBodies(emails []Email) LoadedBodies {
+	loaded := make(LoadedBodies)
+	for _, e := range emails {
+		loaded = loaded.With(e)
+	}
+	return loaded
+}
+
+// With returns l with e added, if e has a body.
+func (l LoadedBodies) With(e Email) LoadedBodies {
+	if e.Body == "" {
+		return l
+	}
+	if l == nil {
+		l = make(LoadedBodies)
+	}
+	l[messageKey(e)] = e
+	return l
+}
+
+// Fill copies the body of the loaded copy of e onto e, reporting whether
+// there was one.
+func (l LoadedBodies) Fill(e *Email) bool {
+	known, ok := l[messageKey(*e)]
+	if !ok {
+		return false
+	}
+	e.Body = known.Body
+	e.Attachments = known.Attachments
+	return true
+}
+
+// ConversationCriteria matches the emails of the conversation e belongs to,
+// or is nil if e has no message IDs to match them by.
+func ConversationCriteria(e Email) *imap.SearchCriteria {
+	ids := append(append([]string(nil), e.References...), e.MessageID)
+	if e.InReplyTo != "" {
+		ids = append(ids, e.InReplyTo)
+	}
+	return conversationCriteria(ids)
+}
+
+// conversationCriteria matches emails with one of ids as Message-ID or in
+// their References, or nil if there are no ids.
+func conversationCriteria(ids []string) *imap.SearchCriteria {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) > maxConversationIDs {
+		// Keep the root and the most recent messages.
+		unique = append(unique[:1], unique[len(unique)-maxConversationIDs+1:]...)
+	}
+
+	var criteria []*imap.SearchCriteria
+	for _, id := range unique {
+		for _, header := range []string{"Message-Id", "References"} {
+			c := imap.NewSearchCriteria()
+			c.Header.Add(header, id)
+			criteria = append(criteria, c)
+		}
+	}
+	return anyOf(criteria)
+}
+
+// anyOf combines criteria with OR.
+func anyOf(criteria []*imap.SearchCriteria) *imap.SearchCriteria {
+	switch len(criteria) {
+	case 0:
+		return nil
+	case 1:
+		return criteria[0]
+	}
+	c := imap.NewSearchCriteria()
+	c.Or = [][2]*imap.SearchCriteria{{criteria[0], anyOf(criteria[1:])}}
+	return c
+}
@@ -0,0 +1,184 @@
+package fetcher
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestGroupThreads(t *testing.T) {
+	base := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	emails := []Email{
+		// Newest first, like the inbox.
+		{UID: 6, Subject: "Re: Lunch", MessageID: "<f@x>", Date: base.Add(5 * time.Hour), AccountID: "a"},
+		{UID: 5, Subject: "Lunch", MessageID: "<e@x>", Date: base.Add(4 * time.Hour), AccountID: "a"},
+		{UID: 4, Subject: "Other", MessageID: "<d@x>", Date: base.Add(3 * time.Hour), AccountID: "a"},
+		// Only In-Reply-To: still joins the thread through B.
+		{UID: 3, Subject: "Re: Plan", MessageID: "<c@x>", InReplyTo: "<b@x>", Date: base.Add(2 * time.Hour), AccountID: "a"},
+		{UID: 2, Subject: "Re: Plan", MessageID: "<b@x>", References: []string{"<a@x>"}, Date: base.Add(time.Hour), AccountID: "a"},
+		{UID: 1, Subject: "Plan", MessageID: "<a@x>", Date: base, AccountID: "a"},
+		// Same Message-ID on another account is another thread.
+		{UID: 9, Subject: "Plan", MessageID: "<a@x>", Date: base, AccountID: "b"},
+	}
+
+	threads := GroupThreads(emails)
+
+	want := [][]uint32{{5, 6}, {4}, {1, 2, 3}, {9}}
+	if len(threads) != len(want) {
+		t.Fatalf("expected %d threads, got %d: %+v", len(want), len(threads), threads)
+	}
+	for i, w := range want {
+		var got []uint32
+		for _, e := range threads[i].Emails {
+			got = append(got, e.UID)
+		}
+		if len(got) != len(w) {
+			t.Fatalf("thread %d: expected UIDs %v, got %v", i, w, got)
+		}
+		for j := range w {
+			if got[j] != w[j] {
+				t.Fatalf("thread %d: expected UIDs %v, got %v", i, w, got)
+			}
+		}
+	}
+	if latest := threads[2].Latest(); latest.UID != 3 {
+		t.Errorf("expected the latest email of the Plan thread to be UID 3, got %d", latest.UID)
+	}
+	if threads[2].ID != "<a@x>" {
+		t.Errorf("expected the Plan thread to be rooted at <a@x>, got %q", threads[2].ID)
+	}
+}
+
+func TestGroupThreadsKeepsServerThreads(t *testing.T) {
+	emails := []Email{
+		{UID: 3, MessageID: "<c@x>", References: []string{"<a@x>", "<b@x>"}, AccountID: "a"},
+		{UID: 2, MessageID: "<b@x>", References: []string{"<a@x>"}, ThreadID: "server-thread", AccountID: "a"},
+	}
+
+	threads := GroupThreads(emails)
+	if len(threads) != 1 || threads[0].ID != "server-thread" {
+		t.Fatalf("expected the new email to join the server's thread, got %+v", threads)
+	}
+}
+
+func TestThreadResponse(t *testing.T) {
+	// * THREAD (2)(3 6 (4 23)(44 7 96))
+	resp := &imap.DataResp{Fields: []interface{}{
+		"THREAD",
+		[]interface{}{"2"},
+		[]interface{}{"3", "6", []interface{}{"4", "23"}, []interface{}{"44", "7", "96"}},
+	}}
+
+	var r threadResponse
+	if err := r.Handle(resp); err != nil {
+		t.Fatalf("Handle() failed: %v", err)
+	}
+	want := [][]uint32{{2}, {3, 6, 4, 23, 44, 7, 96}}
+	if len(r.threads) != len(want) {
+		t.Fatalf("expected threads %v, got %v", want, r.threads)
+	}
+	for i := range want {
+		if len(r.threads[i]) != len(want[i]) || r.threads[i][0] != want[i][0] {
+			t.Fatalf("expected threads %v, got %v", want, r.threads)
+		}
+	}
+}
+
+func TestFetchConversation(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+	if err := c.Create("Sent"); err != nil {
+		t.Fatalf("could not create Sent: %v", err)
+	}
+	reply := "From: contact@example.org\r\n" +
+		"To: someone@example.org\r\n" +
+		"Subject: Re: A little message, just for you\r\n" +
+		"Date: Thu, 12 May 2016 10:00:00 +0000\r\n" +
+		"Message-ID: <reply@localhost>\r\n" +
+		"In-Reply-To: <0000000@localhost/>\r\n" +
+		"References: <0000000@localhost/>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Thanks!"
+	if err := c.Append("Sent", nil, time.Now(), bytes.NewBufferString(reply)); err != nil {
+		t.Fatalf("could not append reply: %v", err)
+	}
+
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("FetchMailboxEmails() = %v, %v", emails, err)
+	}
+	if emails[0].MessageID != "<0000000@localhost/>" {
+		t.Fatalf("expected the Message-ID to be fetched, got %q", emails[0].MessageID)
+	}
+
+	// The opened email's body is reused rather than fetched again.
+	opened := emails[0]
+	opened.Body = "already loaded"
+	conversation, err := FetchConversation(account, opened, nil)
+	if err != nil {
+		t.Fatalf("FetchConversation() failed: %v", err)
+	}
+	if len(conversation) != 2 {
+		t.Fatalf("expected the email and its reply from Sent, got %d emails", len(conversation))
+	}
+	if conversation[1].MessageID != "<reply@localhost>" || conversation[1].Mailbox != "Sent" {
+		t.Errorf("expected the reply from Sent last, got %+v", conversation[1])
+	}
+	if len(conversation[1].References) != 1 || conversation[1].Body == "" {
+		t.Errorf("expected the reply's References and body, got %+v", conversation[1])
+	}
+	if conversation[0].Body != "already loaded" {
+		t.Errorf("expected the opened email's body to be reused, got %q", conversation[0].Body)
+	}
+}
+
+func TestFetchConversationOfOneEmail(t *testing.T) {
+	usePlainPool(t, newTestServer(t))
+	account := testAccount()
+
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("FetchMailboxEmails() = %v, %v", emails, err)
+	}
+	opened := emails[0]
+	opened.Body = "already loaded"
+
+	conversation, err := FetchConversation(account, opened, nil)
+	if err != nil {
+		t.Fatalf("FetchConversation() failed: %v", err)
+	}
+	if len(conversation) != 1 || conversation[0].Body != "already loaded" {
+		t.Errorf("expected the opened email alone, got %+v", conversation)
+	}
+}
+
+func TestThreadEmailsFallsBackToLocalThreading(t *testing.T) {
+	addr := newTestServer(t)
+	usePlainPool(t, addr)
+	account := testAccount()
+
+	emails, err := FetchMailboxEmails(account, "INBOX", 10, 0)
+	if err != nil {
+		t.Fatalf("FetchMailboxEmails() failed: %v", err)
+	}
+	if err := ThreadEmails(account, "INBOX", emails); err != nil {
+		t.Fatalf("ThreadEmails() failed: %v", err)
+	}
+	if emails[0].ThreadID != "<0000000@localhost/>" {
+		t.Errorf("expected the email to root its own thread, got %q", emails[0].ThreadID)
+	}
+}
@@ -0,0 +1,339 @@
+// Package jmap is a client for the parts of JMAP (RFC 8620) and JMAP for
+// Mail (RFC 8621) that matcha uses: reading and changing mailboxes and
+// emails, and sending.
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Capabilities used by the client.
+const (
+	CapabilityCore       = "urn:ietf:params:jmap:core"
+	CapabilityMail       = "urn:ietf:params:jmap:mail"
+	CapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+// Session is the JMAP session resource, which tells where the API is and
+// which accounts the user has.
+type Session struct {
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	Username        string                     `json:"username"`
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	UploadURL       string                     `json:"uploadUrl"`
+	State           string                     `json:"state"`
+}
+
+// Client makes JMAP requests for the user's primary mail account.
+type Client struct {
+	HTTP      *http.Client
+	Session   *Session
+	AccountID string
+	// authorize adds credentials to a request.
+	authorize func(req *http.Request) error
+}
+
+// Auth adds credentials to a request, such as BasicAuth or BearerAuth.
+type Auth func(req *http.Request) error
+
+// BasicAuth authenticates with a username and password.
+func BasicAuth(username, password string) Auth {
+	return func(req *http.Request) error {
+		req.SetBasicAuth(username, password)
+		return nil
+	}
+}
+
+// BearerAuth authenticates with an access token from token, which is called
+// for every request so that the token can be refreshed.
+func BearerAuth(token func() (string, error)) Auth {
+	return func(req *http.Request) error {
+		t, err := token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+t)
+		return nil
+	}
+}
+
+// Dial discovers the session at sessionURL. A URL without a path is a
+// server's address, whose session is at /.well-known/jmap (RFC 8620,
+// section 2.2).
+func Dial(httpClient *http.Client, sessionURL string, auth Auth) (*Client, error) {
+	u, err := url.Parse(sessionURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		u, err = url.Parse("https://" + sessionURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/.well-known/jmap"
+	}
+
+	c := &Client{HTTP: httpClient, authorize: auth}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := c.do(req, &session); err != nil {
+		return nil, fmt.Errorf("jmap session: %w", err)
+	}
+	if session.APIURL == "" {
+		return nil, fmt.Errorf("jmap session at %s has no apiUrl", u)
+	}
+	c.AccountID = session.PrimaryAccounts[CapabilityMail]
+	if c.AccountID == "" {
+		return nil, fmt.Errorf("jmap session at %s has no mail account", u)
+	}
+	// The session's URLs may be relative to where it was found.
+	for _, s := range []*string{&session.APIURL, &session.DownloadURL, &session.UploadURL} {
+		*s = resolve(u, *s)
+	}
+	c.Session = &session
+	return c, nil
+}
+
+// resolve makes ref absolute, keeping URL templates like {blobId} intact.
+func resolve(base *url.URL, ref string) string {
+	if strings.Contains(ref, "://") || ref == "" {
+		return ref
+	}
+	if strings.HasPrefix(ref, "/") {
+		return base.Scheme + "://" + base.Host + ref
+	}
+	return base.Scheme + "://" + base.Host + "/" + ref
+}
+
+// HasCapability reports whether the server supports capability.
+func (c *Client) HasCapability(capability string) bool {
+	_, ok := c.Session.Capabilities[capability]
+	return ok
+}
+
+// defaultMaxObjectsInGet is assumed of a server that doesn't say how many
+// objects it returns at once. RFC 8620 recommends at least 500.
+const defaultMaxObjectsInGet = 500
+
+// MaxObjectsInGet returns the most objects the server returns from a
+// single /get call.
+func (c *Client) MaxObjectsInGet() int {
+	var core struct {
+		MaxObjectsInGet int `json:"maxObjectsInGet"`
+	}
+	if json.Unmarshal(c.Session.Capabilities[CapabilityCore], &core) != nil || core.MaxObjectsInGet <= 0 {
+		return defaultMaxObjectsInGet
+	}
+	return core.MaxObjectsInGet
+}
+
+// Invocation is a method call of a request, such as Email/get.
+type Invocation struct {
+	Name   string
+	Args   interface{}
+	CallID string
+}
+
+func (inv Invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+// Response is a method response. A method that failed responds with
+// "error" as its name, which Call turns into a MethodError.
+type Response struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (r *Response) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("jmap: invalid method response %s", data)
+	}
+	if err := json.Unmarshal(parts[0], &r.Name); err != nil {
+		return err
+	}
+	r.Args = parts[1]
+	return json.Unmarshal(parts[2], &r.CallID)
+}
+
+// Ref refers to a result of an earlier call of the same request, as a
+// "#"-prefixed argument (RFC 8620, section 3.7).
+type Ref struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// MethodError is an error response to a method call.
+type MethodError struct {
+	Method      string
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *MethodError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("jmap: %s: %s: %s", e.Method, e.Type, e.Description)
+	}
+	return fmt.Sprintf("jmap: %s: %s", e.Method, e.Type)
+}
+
+// SetError is why an object could not be created, updated or destroyed.
+type SetError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *SetError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("jmap: %s: %s", e.Type, e.Description)
+	}
+	return "jmap: " + e.Type
+}
+
+// Call makes a request with the given method calls and returns their
+// responses in order. It fails with a *MethodError if any of them failed.
+func (c *Client) Call(calls ...Invocation) ([]Response, error) {
+	body, err := json.Marshal(struct {
+		Using       []string     `json:"using"`
+		MethodCalls []Invocation `json:"methodCalls"`
+	}{
+		Using:       []string{CapabilityCore, CapabilityMail, CapabilitySubmission},
+		MethodCalls: calls,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Session.APIURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp struct {
+		MethodResponses []Response `json:"methodResponses"`
+	}
+	if err := c.do(req, &resp); err != nil {
+		return nil, err
+	}
+	for i, r := range resp.MethodResponses {
+		if r.Name != "error" {
+			continue
+		}
+		methodErr := &MethodError{}
+		if i < len(calls) {
+			methodErr.Method = calls[i].Name
+		}
+		if err := json.Unmarshal(r.Args, methodErr); err != nil {
+			return nil, err
+		}
+		return nil, methodErr
+	}
+	return resp.MethodResponses, nil
+}
+
+// call makes a single method call and decodes its response into v.
+func (c *Client) call(name string, args, v interface{}) error {
+	resps, err := c.Call(Invocation{Name: name, Args: args, CallID: "0"})
+	if err != nil {
+		return err
+	}
+	if len(resps) != 1 {
+		return fmt.Errorf("jmap: %s: expected 1 response, got %d", name, len(resps))
+	}
+	return json.Unmarshal(resps[0].Args, v)
+}
+
+// Download returns the content of a blob, such as an attachment.
+func (c *Client) Download(blobID, name, typ string) ([]byte, error) {
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	u := c.Session.DownloadURL
+	for variable, value := range map[string]string{
+		"{accountId}": c.AccountID,
+		"{blobId}":    blobID,
+		"{name}":      name,
+		"{type}":      typ,
+	} {
+		u = strings.ReplaceAll(u, variable, url.PathEscape(value))
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if err := c.do(req, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Upload stores data as a blob and returns its ID.
+func (c *Client) Upload(data []byte, typ string) (string, error) {
+	u := strings.ReplaceAll(c.Session.UploadURL, "{accountId}", url.PathEscape(c.AccountID))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", typ)
+	var resp struct {
+		BlobID string `json:"blobId"`
+	}
+	if err := c.do(req, &resp); err != nil {
+		return "", err
+	}
+	return resp.BlobID, nil
+}
+
+// do sends req with credentials and decodes the JSON response into v, or
+// copies the raw response if v is a *[]byte.
+func (c *Client) do(req *http.Request, v interface{}) error {
+	if c.authorize != nil {
+		if err := c.authorize(req); err != nil {
+			return err
+		}
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Request-level errors are problem details (RFC 7807).
+		var problem struct {
+			Type   string `json:"type"`
+			Detail string `json:"detail"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &problem) == nil && problem.Detail != "" {
+			return fmt.Errorf("jmap: %s: %s", resp.Status, problem.Detail)
+		}
+		return fmt.Errorf("jmap: %s", resp.Status)
+	}
+
+	if raw, ok := v.(*[]byte); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
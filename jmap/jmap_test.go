@@ -0,0 +1,145 @@
+package jmap_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/floatpane/matcha/jmap"
+	"github.com/floatpane/matcha/jmap/jmaptest"
+)
+
+func testMessage(subject string) []byte {
+	return []byte("From: alice@example.com\r\n" +
+		"To: me@example.com\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Message-Id: <" + strings.ReplaceAll(subject, " ", "") + "@example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"About " + subject + "\r\n")
+}
+
+func dialTestServer(t *testing.T) (*jmaptest.Server, *jmap.Client) {
+	t.Helper()
+	s := jmaptest.NewServer("me@example.com", "secret")
+	t.Cleanup(s.Close)
+	c, err := jmap.Dial(http.DefaultClient, s.URL, jmap.BasicAuth("me@example.com", "secret"))
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	return s, c
+}
+
+func TestDial(t *testing.T) {
+	s, c := dialTestServer(t)
+	if c.AccountID != jmaptest.AccountID {
+		t.Errorf("expected the primary mail account, got %q", c.AccountID)
+	}
+	if !strings.HasPrefix(c.Session.APIURL, s.URL) {
+		t.Errorf("expected the API URL to be made absolute, got %q", c.Session.APIURL)
+	}
+	if !c.HasCapability(jmap.CapabilitySubmission) {
+		t.Error("expected the server to support submission")
+	}
+
+	if _, err := jmap.Dial(http.DefaultClient, s.URL, jmap.BasicAuth("me@example.com", "wrong")); err == nil {
+		t.Error("expected wrong credentials to fail")
+	}
+}
+
+func TestQueryEmails(t *testing.T) {
+	s, c := dialTestServer(t)
+	inbox := s.AddMailbox("Inbox", "inbox", "")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, subject := range []string{"one", "two", "three"} {
+		s.AddEmail(inbox, testMessage(subject), start.Add(time.Duration(i)*time.Hour))
+	}
+
+	newest := []jmap.Comparator{{Property: "receivedAt"}}
+	props := []string{"id", "headers", "receivedAt"}
+	page, err := c.QueryEmails(jmap.Query{Filter: map[string]interface{}{"inMailbox": inbox}, Sort: newest, Limit: 2}, props)
+	if err != nil {
+		t.Fatalf("QueryEmails() failed: %v", err)
+	}
+	if len(page) != 2 || !page[0].ReceivedAt.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("expected the 2 newest emails, got %+v", page)
+	}
+
+	older, err := c.QueryEmails(jmap.Query{
+		Filter: map[string]interface{}{"inMailbox": inbox}, Sort: newest,
+		Anchor: page[1].ID, AnchorOffset: 1, Limit: 2,
+	}, props)
+	if err != nil {
+		t.Fatalf("QueryEmails() failed: %v", err)
+	}
+	if len(older) != 1 || !older[0].ReceivedAt.Equal(start) {
+		t.Errorf("expected the oldest email after the anchor, got %+v", older)
+	}
+
+	_, err = c.QueryEmails(jmap.Query{Anchor: "missing"}, props)
+	if methodErr, ok := err.(*jmap.MethodError); !ok || methodErr.Type != "anchorNotFound" {
+		t.Errorf("expected an anchorNotFound error, got %v", err)
+	}
+}
+
+func TestEmailChangesAndSubmission(t *testing.T) {
+	s, c := dialTestServer(t)
+	inbox := s.AddMailbox("Inbox", "inbox", "")
+	sent := s.AddMailbox("Sent", "sent", "")
+	id := s.AddEmail(inbox, testMessage("hello"), time.Now())
+
+	emails, err := c.GetEmails([]string{id}, []string{"id", "textBody", "bodyValues"}, true)
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("GetEmails() failed: %v", err)
+	}
+	part := emails[0].TextBody[0]
+	if got := emails[0].BodyValues[part.PartID].Value; !strings.Contains(got, "About hello") {
+		t.Errorf("expected the body's text, got %q", got)
+	}
+	data, err := c.Download(part.BlobID, "body.txt", "text/plain")
+	if err != nil || !strings.Contains(string(data), "About hello") {
+		t.Errorf("expected to download the part, got %q, %v", data, err)
+	}
+
+	err = c.UpdateEmails(map[string]map[string]interface{}{
+		id: {"keywords/" + jmap.KeywordSeen: true, "mailboxIds/" + inbox: nil, "mailboxIds/" + sent: true},
+	})
+	if err != nil {
+		t.Fatalf("UpdateEmails() failed: %v", err)
+	}
+	if e, _ := s.Email(id); !e.Keywords[jmap.KeywordSeen] || e.MailboxIDs[inbox] || !e.MailboxIDs[sent] {
+		t.Errorf("expected the email to be seen and moved, got %+v", e)
+	}
+	if err := c.DestroyEmails([]string{id}); err != nil {
+		t.Fatalf("DestroyEmails() failed: %v", err)
+	}
+	if _, ok := s.Email(id); ok {
+		t.Error("expected the email to be destroyed")
+	}
+
+	blobID, err := c.Upload(testMessage("outgoing"), "message/rfc822")
+	if err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	emailID, err := c.ImportEmail(blobID, map[string]bool{sent: true}, map[string]bool{jmap.KeywordDraft: true})
+	if err != nil {
+		t.Fatalf("ImportEmail() failed: %v", err)
+	}
+	identities, err := c.Identities()
+	if err != nil || len(identities) == 0 {
+		t.Fatalf("Identities() failed: %v", err)
+	}
+	envelope := &jmap.Envelope{MailFrom: jmap.Address{Email: "me@example.com"}, RcptTo: []jmap.Address{{Email: "bob@example.com"}}}
+	err = c.Submit(identities[0].ID, emailID, envelope, map[string]interface{}{"keywords/" + jmap.KeywordDraft: nil})
+	if err != nil {
+		t.Fatalf("Submit() failed: %v", err)
+	}
+	subs := s.Submissions()
+	if len(subs) != 1 || subs[0].EmailID != emailID || subs[0].Envelope.RcptTo[0].Email != "bob@example.com" {
+		t.Errorf("expected the email to be submitted, got %+v", subs)
+	}
+	if e, _ := s.Email(emailID); e.Keywords[jmap.KeywordDraft] {
+		t.Error("expected the sent email to no longer be a draft")
+	}
+}
@@ -0,0 +1,689 @@
+// Package jmaptest is a JMAP server that keeps its mail in memory, standing
+// in for a real one in tests. It implements enough of JMAP for Mail for the
+// jmap package's client, not the whole specification.
+package jmaptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/floatpane/matcha/jmap"
+)
+
+// AccountID is the ID of the server's only account.
+const AccountID = "account"
+
+// Server is a JMAP server for a single account.
+type Server struct {
+	*httptest.Server
+	// Username and Password are the credentials accepted with basic auth.
+	// Token, if set, is accepted as a bearer token instead.
+	Username string
+	Password string
+	Token    string
+	// MaxObjectsInGet, if set, is the most emails Email/get returns at
+	// once, and MaxQueryResults the most IDs Email/query does.
+	MaxObjectsInGet int
+	MaxQueryResults int
+
+	mu          sync.Mutex
+	nextID      int
+	mailboxes   []jmap.Mailbox
+	emails      map[string]*email
+	blobs       map[string][]byte
+	submissions []Submission
+}
+
+// email is a stored email and what was parsed from it.
+type email struct {
+	jmap.Email
+	rootID string // Message-ID of the first message of the thread
+}
+
+// Submission is an email sent with EmailSubmission/set.
+type Submission struct {
+	IdentityID string
+	EmailID    string
+	Envelope   *jmap.Envelope
+}
+
+// NewServer starts a server with the given credentials and no mailboxes.
+// Close it when done.
+func NewServer(username, password string) *Server {
+	s := &Server{
+		Username: username,
+		Password: password,
+		emails:   make(map[string]*email),
+		blobs:    make(map[string][]byte),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jmap", s.serveSession)
+	mux.HandleFunc("/api", s.serveAPI)
+	mux.HandleFunc("/download/", s.serveDownload)
+	mux.HandleFunc("/upload/", s.serveUpload)
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" && r.Header.Get("Authorization") == "Bearer "+s.Token {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); ok && user == s.Username && pass == s.Password {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (s *Server) id(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%d", prefix, s.nextID)
+}
+
+// AddMailbox adds a mailbox with a role such as "inbox" or "trash", or
+// none, and returns its ID.
+func (s *Server) AddMailbox(name, role, parentID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.id("M")
+	s.mailboxes = append(s.mailboxes, jmap.Mailbox{ID: id, Name: name, Role: role, ParentID: parentID})
+	return id
+}
+
+// AddEmail adds an RFC 5322 message to a mailbox and returns its ID.
+func (s *Server) AddEmail(mailboxID string, raw []byte, receivedAt time.Time, keywords ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kw := make(map[string]bool)
+	for _, k := range keywords {
+		kw[k] = true
+	}
+	e, err := s.store(raw, map[string]bool{mailboxID: true}, kw, receivedAt)
+	if err != nil {
+		panic(err)
+	}
+	return e.ID
+}
+
+// Email returns the mailboxes and keywords of an email, or false if it
+// doesn't exist.
+func (s *Server) Email(id string) (jmap.Email, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.emails[id]
+	if !ok {
+		return jmap.Email{}, false
+	}
+	return jmap.Email{ID: e.ID, MailboxIDs: copyMap(e.MailboxIDs), Keywords: copyMap(e.Keywords)}, true
+}
+
+// Submissions returns the emails sent so far.
+func (s *Server) Submissions() []Submission {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Submission(nil), s.submissions...)
+}
+
+func copyMap(m map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// store parses and adds a message. s.mu must be locked.
+func (s *Server) store(raw []byte, mailboxIDs, keywords map[string]bool, receivedAt time.Time) (*email, error) {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	e := &email{}
+	e.ID = s.id("E")
+	e.BlobID = "B" + e.ID
+	e.MailboxIDs = mailboxIDs
+	e.Keywords = keywords
+	e.ReceivedAt = receivedAt.UTC()
+	e.Size = int64(len(raw))
+	s.blobs[e.BlobID] = raw
+
+	for f := entity.Header.Fields(); f.Next(); {
+		e.Headers = append(e.Headers, jmap.Header{Name: f.Key(), Value: " " + f.Value()})
+	}
+	h := mail.Header{Header: entity.Header}
+	e.rootID = entity.Header.Get("Message-Id")
+	if refs, err := h.MsgIDList("References"); err == nil && len(refs) > 0 {
+		e.rootID = "<" + refs[0] + ">"
+	} else if replyTo, err := h.MsgIDList("In-Reply-To"); err == nil && len(replyTo) > 0 {
+		e.rootID = "<" + replyTo[0] + ">"
+	}
+	e.ThreadID = "T" + e.rootID
+
+	e.BodyValues = make(map[string]jmap.BodyValue)
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		typ, params, _ := part.Header.ContentType()
+		if strings.HasPrefix(typ, "multipart/") {
+			return nil
+		}
+		partID := "1"
+		if len(path) > 0 {
+			var ids []string
+			for _, n := range path {
+				ids = append(ids, fmt.Sprint(n+1))
+			}
+			partID = strings.Join(ids, ".")
+		}
+		content, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		disposition, dispParams, _ := part.Header.ContentDisposition()
+		bp := jmap.BodyPart{
+			PartID:      partID,
+			BlobID:      e.BlobID + "-" + partID,
+			Size:        int64(len(content)),
+			Name:        dispParams["filename"],
+			Type:        typ,
+			Charset:     params["charset"],
+			Disposition: disposition,
+			CID:         strings.Trim(part.Header.Get("Content-Id"), "<>"),
+		}
+		if bp.Name == "" {
+			bp.Name = params["name"]
+		}
+		s.blobs[bp.BlobID] = content
+
+		if strings.HasPrefix(typ, "text/") && disposition != "attachment" && bp.Name == "" {
+			e.BodyValues[partID] = jmap.BodyValue{Value: string(content)}
+			switch typ {
+			case "text/plain":
+				e.TextBody = append(e.TextBody, bp)
+			case "text/html":
+				e.HTMLBody = append(e.HTMLBody, bp)
+			}
+			return nil
+		}
+		e.Attachments = append(e.Attachments, bp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(e.HTMLBody) == 0 {
+		e.HTMLBody = e.TextBody
+	}
+
+	s.emails[e.ID] = e
+	return e, nil
+}
+
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request) {
+	core := json.RawMessage(`{}`)
+	if s.MaxObjectsInGet > 0 {
+		core = json.RawMessage(fmt.Sprintf(`{"maxObjectsInGet":%d}`, s.MaxObjectsInGet))
+	}
+	writeJSON(w, jmap.Session{
+		Capabilities: map[string]json.RawMessage{
+			jmap.CapabilityCore:       core,
+			jmap.CapabilityMail:       json.RawMessage(`{}`),
+			jmap.CapabilitySubmission: json.RawMessage(`{}`),
+		},
+		PrimaryAccounts: map[string]string{jmap.CapabilityMail: AccountID, jmap.CapabilitySubmission: AccountID},
+		Username:        s.Username,
+		APIURL:          "/api",
+		DownloadURL:     "/download/{accountId}/{blobId}/{name}?type={type}",
+		UploadURL:       "/upload/{accountId}/",
+		State:           "0",
+	})
+}
+
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	data, ok := s.blobs[parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+	w.Write(data)
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	id := s.id("U")
+	s.blobs[id] = data
+	s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"accountId": AccountID, "blobId": id, "type": r.Header.Get("Content-Type"), "size": len(data)})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// methodError is the arguments of an error response.
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string { return e.Type + ": " + e.Description }
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MethodCalls [][3]json.RawMessage `json:"methodCalls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var responses [][3]interface{}
+	results := make(map[string]map[string]interface{}) // By call ID
+	for _, call := range req.MethodCalls {
+		var name, callID string
+		var args map[string]interface{}
+		json.Unmarshal(call[0], &name)
+		json.Unmarshal(call[1], &args)
+		json.Unmarshal(call[2], &callID)
+
+		var result map[string]interface{}
+		err := s.resolveRefs(args, results)
+		if err == nil {
+			result, err = s.method(name, args)
+		}
+		if err != nil {
+			e, ok := err.(*methodError)
+			if !ok {
+				e = &methodError{Type: "serverFail", Description: err.Error()}
+			}
+			responses = append(responses, [3]interface{}{"error", e, callID})
+			continue
+		}
+		results[callID] = result
+		responses = append(responses, [3]interface{}{name, result, callID})
+	}
+	writeJSON(w, map[string]interface{}{"methodResponses": responses, "sessionState": "0"})
+}
+
+// resolveRefs replaces "#"-prefixed arguments with the results they refer
+// to. Only paths to a top-level property are supported.
+func (s *Server) resolveRefs(args map[string]interface{}, results map[string]map[string]interface{}) error {
+	for key, value := range args {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		ref, _ := value.(map[string]interface{})
+		result, ok := results[fmt.Sprint(ref["resultOf"])]
+		if !ok {
+			return &methodError{Type: "invalidResultReference"}
+		}
+		delete(args, key)
+		args[key[1:]] = result[strings.TrimPrefix(fmt.Sprint(ref["path"]), "/")]
+	}
+	return nil
+}
+
+func (s *Server) method(name string, args map[string]interface{}) (map[string]interface{}, error) {
+	switch name {
+	case "Mailbox/get":
+		return s.mailboxGet()
+	case "Email/query":
+		return s.emailQuery(args)
+	case "Email/get":
+		return s.emailGet(args)
+	case "Email/set":
+		return s.emailSet(args)
+	case "Email/import":
+		return s.emailImport(args)
+	case "Thread/get":
+		return s.threadGet(args)
+	case "Identity/get":
+		return map[string]interface{}{"list": []jmap.Identity{{ID: "I1", Email: s.Username}}}, nil
+	case "EmailSubmission/set":
+		return s.submissionSet(args)
+	}
+	return nil, &methodError{Type: "unknownMethod", Description: name}
+}
+
+func (s *Server) mailboxGet() (map[string]interface{}, error) {
+	list := make([]jmap.Mailbox, len(s.mailboxes))
+	for i, mb := range s.mailboxes {
+		for _, e := range s.emails {
+			if e.MailboxIDs[mb.ID] {
+				mb.TotalEmails++
+				if !e.Keywords[jmap.KeywordSeen] {
+					mb.UnreadEmails++
+				}
+			}
+		}
+		list[i] = mb
+	}
+	return map[string]interface{}{"list": list}, nil
+}
+
+func stringList(v interface{}) []string {
+	if list, ok := v.([]string); ok {
+		// A result referred to by a later call.
+		return list
+	}
+	var list []string
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		list = append(list, fmt.Sprint(item))
+	}
+	return list
+}
+
+func (s *Server) emailQuery(args map[string]interface{}) (map[string]interface{}, error) {
+	var found []*email
+	for _, e := range s.emails {
+		if s.matches(e, args["filter"]) {
+			found = append(found, e)
+		}
+	}
+	ascending := false
+	if sorts, ok := args["sort"].([]interface{}); ok && len(sorts) > 0 {
+		ascending, _ = sorts[0].(map[string]interface{})["isAscending"].(bool)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i].ReceivedAt, found[j].ReceivedAt
+		if a.Equal(b) {
+			return found[i].ID < found[j].ID
+		}
+		return a.Before(b) == ascending
+	})
+
+	position := 0
+	if p, ok := args["position"].(float64); ok {
+		position = int(p)
+	}
+	if anchor, ok := args["anchor"].(string); ok {
+		position = -1
+		for i, e := range found {
+			if e.ID == anchor {
+				position = i
+			}
+		}
+		if position == -1 {
+			return nil, &methodError{Type: "anchorNotFound"}
+		}
+		if offset, ok := args["anchorOffset"].(float64); ok {
+			position += int(offset)
+		}
+	}
+	limit := s.MaxQueryResults
+	if l, ok := args["limit"].(float64); ok && (limit == 0 || int(l) < limit) {
+		limit = int(l)
+	}
+	ids := []string{}
+	for i := position; i < len(found); i++ {
+		if limit > 0 && len(ids) >= limit {
+			break
+		}
+		ids = append(ids, found[i].ID)
+	}
+	return map[string]interface{}{"ids": ids, "position": position, "total": len(found)}, nil
+}
+
+// matches reports whether e matches a FilterCondition or FilterOperator.
+func (s *Server) matches(e *email, filter interface{}) bool {
+	f, ok := filter.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	if op, ok := f["operator"].(string); ok {
+		conditions, _ := f["conditions"].([]interface{})
+		for _, c := range conditions {
+			m := s.matches(e, c)
+			if op == "OR" && m {
+				return true
+			}
+			if op == "AND" && !m {
+				return false
+			}
+			if op == "NOT" && m {
+				return false
+			}
+		}
+		return op != "OR"
+	}
+
+	header := func(name string) string {
+		var values []string
+		for _, h := range e.Headers {
+			if strings.EqualFold(h.Name, name) {
+				values = append(values, strings.TrimSpace(h.Value))
+			}
+		}
+		return strings.ToLower(strings.Join(values, ", "))
+	}
+	body := func() string {
+		var text []string
+		for _, v := range e.BodyValues {
+			text = append(text, v.Value)
+		}
+		return strings.ToLower(strings.Join(text, "\n"))
+	}
+	contains := func(s, sub interface{}) bool {
+		return strings.Contains(fmt.Sprint(s), strings.ToLower(fmt.Sprint(sub)))
+	}
+
+	for key, value := range f {
+		var ok bool
+		switch key {
+		case "inMailbox":
+			ok = e.MailboxIDs[fmt.Sprint(value)]
+		case "from", "to", "cc", "bcc", "subject":
+			ok = contains(header(key), value)
+		case "body":
+			ok = contains(body(), value)
+		case "text":
+			ok = contains(header("from")+header("to")+header("cc")+header("subject")+body(), value)
+		case "header":
+			h := stringList(value)
+			ok = len(h) == 2 && strings.TrimSpace(header(h[0])) == strings.ToLower(h[1])
+		case "hasKeyword":
+			ok = e.Keywords[fmt.Sprint(value)]
+		case "notKeyword":
+			ok = !e.Keywords[fmt.Sprint(value)]
+		case "hasAttachment":
+			ok = (len(e.Attachments) > 0) == value
+		case "after", "before":
+			t, err := time.Parse(time.RFC3339, fmt.Sprint(value))
+			ok = err == nil && (key == "after" && !e.ReceivedAt.Before(t) || key == "before" && e.ReceivedAt.Before(t))
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) emailGet(args map[string]interface{}) (map[string]interface{}, error) {
+	list := []jmap.Email{}
+	var notFound []string
+	withValues, _ := args["fetchAllBodyValues"].(bool)
+	ids := stringList(args["ids"])
+	if s.MaxObjectsInGet > 0 && len(ids) > s.MaxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	for _, id := range ids {
+		e, ok := s.emails[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		found := e.Email
+		found.MailboxIDs = copyMap(e.MailboxIDs)
+		found.Keywords = copyMap(e.Keywords)
+		if !withValues {
+			found.BodyValues = nil
+		}
+		list = append(list, found)
+	}
+	return map[string]interface{}{"list": list, "notFound": notFound}, nil
+}
+
+func (s *Server) emailSet(args map[string]interface{}) (map[string]interface{}, error) {
+	updated := map[string]interface{}{}
+	notUpdated := map[string]interface{}{}
+	patches, _ := args["update"].(map[string]interface{})
+	for id, p := range patches {
+		e, ok := s.emails[id]
+		if !ok {
+			notUpdated[id] = methodError{Type: "notFound"}
+			continue
+		}
+		patch, _ := p.(map[string]interface{})
+		s.applyPatch(e, patch)
+		updated[id] = nil
+	}
+
+	destroyed := []string{}
+	notDestroyed := map[string]interface{}{}
+	for _, id := range stringList(args["destroy"]) {
+		if _, ok := s.emails[id]; !ok {
+			notDestroyed[id] = methodError{Type: "notFound"}
+			continue
+		}
+		delete(s.emails, id)
+		destroyed = append(destroyed, id)
+	}
+	return map[string]interface{}{"updated": updated, "notUpdated": notUpdated, "destroyed": destroyed, "notDestroyed": notDestroyed}, nil
+}
+
+func (s *Server) applyPatch(e *email, patch map[string]interface{}) {
+	for path, value := range patch {
+		property, key, _ := strings.Cut(path, "/")
+		var target map[string]bool
+		switch property {
+		case "mailboxIds":
+			target = e.MailboxIDs
+		case "keywords":
+			target = e.Keywords
+		default:
+			continue
+		}
+		if key == "" {
+			for k := range target {
+				delete(target, k)
+			}
+			values, _ := value.(map[string]interface{})
+			for k := range values {
+				target[k] = true
+			}
+		} else if value == nil {
+			delete(target, key)
+		} else {
+			target[key] = true
+		}
+	}
+}
+
+func (s *Server) emailImport(args map[string]interface{}) (map[string]interface{}, error) {
+	created := map[string]interface{}{}
+	notCreated := map[string]interface{}{}
+	emails, _ := args["emails"].(map[string]interface{})
+	for key, v := range emails {
+		spec, _ := v.(map[string]interface{})
+		raw, ok := s.blobs[fmt.Sprint(spec["blobId"])]
+		if !ok {
+			notCreated[key] = methodError{Type: "blobNotFound"}
+			continue
+		}
+		toSet := func(v interface{}) map[string]bool {
+			set := make(map[string]bool)
+			m, _ := v.(map[string]interface{})
+			for k := range m {
+				set[k] = true
+			}
+			return set
+		}
+		e, err := s.store(raw, toSet(spec["mailboxIds"]), toSet(spec["keywords"]), time.Now())
+		if err != nil {
+			notCreated[key] = methodError{Type: "invalidEmail", Description: err.Error()}
+			continue
+		}
+		created[key] = map[string]interface{}{"id": e.ID, "blobId": e.BlobID, "threadId": e.ThreadID, "size": e.Size}
+	}
+	return map[string]interface{}{"created": created, "notCreated": notCreated}, nil
+}
+
+func (s *Server) threadGet(args map[string]interface{}) (map[string]interface{}, error) {
+	list := []jmap.Thread{}
+	for _, id := range stringList(args["ids"]) {
+		var members []*email
+		for _, e := range s.emails {
+			if e.ThreadID == id {
+				members = append(members, e)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool { return members[i].ReceivedAt.Before(members[j].ReceivedAt) })
+		thread := jmap.Thread{ID: id}
+		for _, e := range members {
+			thread.EmailIDs = append(thread.EmailIDs, e.ID)
+		}
+		list = append(list, thread)
+	}
+	return map[string]interface{}{"list": list}, nil
+}
+
+func (s *Server) submissionSet(args map[string]interface{}) (map[string]interface{}, error) {
+	created := map[string]interface{}{}
+	notCreated := map[string]interface{}{}
+	creates, _ := args["create"].(map[string]interface{})
+	onSuccess, _ := args["onSuccessUpdateEmail"].(map[string]interface{})
+	for key, v := range creates {
+		spec, _ := v.(map[string]interface{})
+		e, ok := s.emails[fmt.Sprint(spec["emailId"])]
+		if !ok {
+			notCreated[key] = methodError{Type: "invalidProperties", Description: "no such email"}
+			continue
+		}
+		sub := Submission{IdentityID: fmt.Sprint(spec["identityId"]), EmailID: e.ID}
+		if env, ok := spec["envelope"]; ok {
+			data, _ := json.Marshal(env)
+			sub.Envelope = &jmap.Envelope{}
+			json.Unmarshal(data, sub.Envelope)
+		}
+		s.submissions = append(s.submissions, sub)
+		created[key] = map[string]interface{}{"id": s.id("S")}
+		if patch, ok := onSuccess["#"+key].(map[string]interface{}); ok {
+			s.applyPatch(e, patch)
+		}
+	}
+	return map[string]interface{}{"created": created, "notCreated": notCreated}, nil
+}
@@ -0,0 +1,348 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Mailbox is a folder (RFC 8621, section 2).
+type Mailbox struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ParentID     string `json:"parentId,omitempty"`
+	Role         string `json:"role,omitempty"`
+	SortOrder    int    `json:"sortOrder"`
+	TotalEmails  uint32 `json:"totalEmails"`
+	UnreadEmails uint32 `json:"unreadEmails"`
+}
+
+// Header is a header field as it appears in the message.
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// BodyPart is a part of an email's MIME structure.
+type BodyPart struct {
+	PartID      string `json:"partId,omitempty"`
+	BlobID      string `json:"blobId,omitempty"`
+	Size        int64  `json:"size"`
+	Name        string `json:"name,omitempty"`
+	Type        string `json:"type"`
+	Charset     string `json:"charset,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	CID         string `json:"cid,omitempty"`
+}
+
+// BodyValue is the decoded text of a text part.
+type BodyValue struct {
+	Value       string `json:"value"`
+	IsTruncated bool   `json:"isTruncated,omitempty"`
+}
+
+// Email is an email with the properties that were asked for (RFC 8621,
+// section 4).
+type Email struct {
+	ID          string               `json:"id"`
+	BlobID      string               `json:"blobId,omitempty"`
+	ThreadID    string               `json:"threadId,omitempty"`
+	MailboxIDs  map[string]bool      `json:"mailboxIds,omitempty"`
+	Keywords    map[string]bool      `json:"keywords,omitempty"`
+	Size        int64                `json:"size,omitempty"`
+	ReceivedAt  time.Time            `json:"receivedAt"`
+	Headers     []Header             `json:"headers,omitempty"`
+	Preview     string               `json:"preview,omitempty"`
+	TextBody    []BodyPart           `json:"textBody,omitempty"`
+	HTMLBody    []BodyPart           `json:"htmlBody,omitempty"`
+	Attachments []BodyPart           `json:"attachments,omitempty"`
+	BodyValues  map[string]BodyValue `json:"bodyValues,omitempty"`
+}
+
+// Keywords of emails, the counterparts of IMAP's system flags.
+const (
+	KeywordSeen      = "$seen"
+	KeywordFlagged   = "$flagged"
+	KeywordAnswered  = "$answered"
+	KeywordDraft     = "$draft"
+	KeywordForwarded = "$forwarded"
+)
+
+// Comparator is a sort order of Email/query.
+type Comparator struct {
+	Property    string `json:"property"`
+	IsAscending bool   `json:"isAscending"`
+}
+
+// Query selects emails with Email/query. Results start at Position, or
+// AnchorOffset past the email with ID Anchor if one is set.
+type Query struct {
+	Filter       interface{}
+	Sort         []Comparator
+	Position     int
+	Anchor       string
+	AnchorOffset int
+	Limit        int // 0 for all
+}
+
+func (c *Client) args(args map[string]interface{}) map[string]interface{} {
+	args["accountId"] = c.AccountID
+	return args
+}
+
+// Mailboxes returns all mailboxes of the account.
+func (c *Client) Mailboxes() ([]Mailbox, error) {
+	var resp struct {
+		List []Mailbox `json:"list"`
+	}
+	if err := c.call("Mailbox/get", c.args(map[string]interface{}{"ids": nil}), &resp); err != nil {
+		return nil, err
+	}
+	return resp.List, nil
+}
+
+// queryArgs returns the arguments of Email/query for q.
+func (c *Client) queryArgs(q Query) map[string]interface{} {
+	query := c.args(map[string]interface{}{})
+	if q.Filter != nil {
+		query["filter"] = q.Filter
+	}
+	if len(q.Sort) > 0 {
+		query["sort"] = q.Sort
+	}
+	if q.Anchor != "" {
+		query["anchor"] = q.Anchor
+		query["anchorOffset"] = q.AnchorOffset
+	} else if q.Position > 0 {
+		query["position"] = q.Position
+	}
+	if q.Limit > 0 {
+		query["limit"] = q.Limit
+	}
+	return query
+}
+
+// QueryEmails runs q and gets the emails found with the given properties,
+// in a single request. The server may return fewer emails than asked for,
+// so q should have a Limit no higher than MaxObjectsInGet.
+func (c *Client) QueryEmails(q Query, properties []string) ([]Email, error) {
+	get := c.args(map[string]interface{}{
+		"#ids":       Ref{ResultOf: "query", Name: "Email/query", Path: "/ids"},
+		"properties": properties,
+	})
+	resps, err := c.Call(
+		Invocation{Name: "Email/query", Args: c.queryArgs(q), CallID: "query"},
+		Invocation{Name: "Email/get", Args: get, CallID: "get"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resps) != 2 {
+		return nil, fmt.Errorf("jmap: Email/query: expected 2 responses, got %d", len(resps))
+	}
+
+	var ids struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.Unmarshal(resps[0].Args, &ids); err != nil {
+		return nil, err
+	}
+	var found struct {
+		List []Email `json:"list"`
+	}
+	if err := json.Unmarshal(resps[1].Args, &found); err != nil {
+		return nil, err
+	}
+	// Email/get needn't keep the order of the query.
+	position := make(map[string]int, len(ids.IDs))
+	for i, id := range ids.IDs {
+		position[id] = i
+	}
+	sort.SliceStable(found.List, func(i, j int) bool { return position[found.List[i].ID] < position[found.List[j].ID] })
+	return found.List, nil
+}
+
+// QueryAllEmailIDs runs q and returns the IDs of every email found from
+// its Position on, querying as many times as the server's limit on
+// results takes. Anchor and Limit are ignored.
+func (c *Client) QueryAllEmailIDs(q Query) ([]string, error) {
+	q.Anchor, q.Limit = "", 0
+	var all []string
+	for {
+		query := c.queryArgs(q)
+		query["calculateTotal"] = true
+		var resp struct {
+			IDs   []string `json:"ids"`
+			Total *int     `json:"total"`
+		}
+		if err := c.call("Email/query", query, &resp); err != nil {
+			return nil, err
+		}
+		all = append(all, resp.IDs...)
+		q.Position += len(resp.IDs)
+		// A server that doesn't count stops when it runs out of results.
+		if len(resp.IDs) == 0 || (resp.Total != nil && q.Position >= *resp.Total) {
+			return all, nil
+		}
+	}
+}
+
+// GetEmails returns the emails with the given IDs and properties. With
+// bodyValues, the text of their text parts is included. More IDs than the
+// server returns at once are got over several calls.
+func (c *Client) GetEmails(ids, properties []string, bodyValues bool) ([]Email, error) {
+	var list []Email
+	size := c.MaxObjectsInGet()
+	for start := 0; start < len(ids); start += size {
+		chunk := ids[start:min(start+size, len(ids))]
+		args := c.args(map[string]interface{}{"ids": chunk, "properties": properties})
+		if bodyValues {
+			args["fetchAllBodyValues"] = true
+		}
+		var resp struct {
+			List []Email `json:"list"`
+		}
+		if err := c.call("Email/get", args, &resp); err != nil {
+			return nil, err
+		}
+		list = append(list, resp.List...)
+	}
+	return list, nil
+}
+
+// UpdateEmails applies patches to emails, keyed by email ID. A patch maps
+// paths such as "keywords/$seen" to a value, or to nil to remove it.
+func (c *Client) UpdateEmails(patches map[string]map[string]interface{}) error {
+	if len(patches) == 0 {
+		return nil
+	}
+	var resp struct {
+		NotUpdated map[string]*SetError `json:"notUpdated"`
+	}
+	if err := c.call("Email/set", c.args(map[string]interface{}{"update": patches}), &resp); err != nil {
+		return err
+	}
+	for _, err := range resp.NotUpdated {
+		return err
+	}
+	return nil
+}
+
+// DestroyEmails deletes emails for good.
+func (c *Client) DestroyEmails(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var resp struct {
+		NotDestroyed map[string]*SetError `json:"notDestroyed"`
+	}
+	if err := c.call("Email/set", c.args(map[string]interface{}{"destroy": ids}), &resp); err != nil {
+		return err
+	}
+	for _, err := range resp.NotDestroyed {
+		return err
+	}
+	return nil
+}
+
+// ImportEmail adds an uploaded RFC 5322 message to mailboxes and returns
+// the new email's ID.
+func (c *Client) ImportEmail(blobID string, mailboxIDs, keywords map[string]bool) (string, error) {
+	args := c.args(map[string]interface{}{
+		"emails": map[string]interface{}{
+			"import": map[string]interface{}{"blobId": blobID, "mailboxIds": mailboxIDs, "keywords": keywords},
+		},
+	})
+	var resp struct {
+		Created    map[string]Email     `json:"created"`
+		NotCreated map[string]*SetError `json:"notCreated"`
+	}
+	if err := c.call("Email/import", args, &resp); err != nil {
+		return "", err
+	}
+	if err := resp.NotCreated["import"]; err != nil {
+		return "", err
+	}
+	created, ok := resp.Created["import"]
+	if !ok {
+		return "", fmt.Errorf("jmap: Email/import created nothing")
+	}
+	return created.ID, nil
+}
+
+// Thread is the emails of a conversation, oldest first.
+type Thread struct {
+	ID       string   `json:"id"`
+	EmailIDs []string `json:"emailIds"`
+}
+
+// Threads returns the threads with the given IDs.
+func (c *Client) Threads(ids []string) ([]Thread, error) {
+	var resp struct {
+		List []Thread `json:"list"`
+	}
+	if err := c.call("Thread/get", c.args(map[string]interface{}{"ids": ids}), &resp); err != nil {
+		return nil, err
+	}
+	return resp.List, nil
+}
+
+// Identity is an address the user can send from.
+type Identity struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Identities returns the identities of the account.
+func (c *Client) Identities() ([]Identity, error) {
+	var resp struct {
+		List []Identity `json:"list"`
+	}
+	if err := c.call("Identity/get", c.args(map[string]interface{}{"ids": nil}), &resp); err != nil {
+		return nil, err
+	}
+	return resp.List, nil
+}
+
+// Address is an address of a submission's SMTP envelope.
+type Address struct {
+	Email string `json:"email"`
+}
+
+// Envelope is the SMTP envelope of a submission.
+type Envelope struct {
+	MailFrom Address   `json:"mailFrom"`
+	RcptTo   []Address `json:"rcptTo"`
+}
+
+// Submit sends an email with EmailSubmission/set. Once it is sent, the
+// email is patched with onSuccess, e.g. to remove its $draft keyword.
+func (c *Client) Submit(identityID, emailID string, envelope *Envelope, onSuccess map[string]interface{}) error {
+	submission := map[string]interface{}{"identityId": identityID, "emailId": emailID}
+	if envelope != nil {
+		submission["envelope"] = envelope
+	}
+	args := c.args(map[string]interface{}{
+		"create": map[string]interface{}{"send": submission},
+	})
+	if onSuccess != nil {
+		args["onSuccessUpdateEmail"] = map[string]interface{}{"#send": onSuccess}
+	}
+
+	resps, err := c.Call(Invocation{Name: "EmailSubmission/set", Args: args, CallID: "0"})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		NotCreated map[string]*SetError `json:"notCreated"`
+	}
+	if err := json.Unmarshal(resps[0].Args, &resp); err != nil {
+		return err
+	}
+	if err := resp.NotCreated["send"]; err != nil {
+		return err
+	}
+	return nil
+}
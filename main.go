@@ -4,8 +4,11 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -20,8 +23,11 @@ import (
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/floatpane/matcha/backend"
+	"github.com/floatpane/matcha/backup"
 	"github.com/floatpane/matcha/config"
 	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/oauth"
 	"github.com/floatpane/matcha/sender"
 	"github.com/floatpane/matcha/tui"
 	"github.com/google/uuid"
@@ -32,6 +38,7 @@ import (
 const (
 	initialEmailLimit = 20
 	paginationLimit   = 20
+	searchResultLimit = 200 // Newest matches kept per account
 )
 
 // Version variables are injected by the build (GoReleaser ldflags).
@@ -48,6 +55,20 @@ type UpdateAvailableMsg struct {
 	Current string
 }
 
+// attachmentDownload is an attachment being downloaded into ~/Downloads.
+type attachmentDownload struct {
+	cancel context.CancelFunc
+	// updates carries tui.AttachmentProgressMsg while the download runs,
+	// then an attachmentDoneMsg.
+	updates chan tea.Msg
+}
+
+// attachmentDoneMsg is sent when an attachment download ends, however it
+// ended.
+type attachmentDoneMsg struct {
+	tui.AttachmentDownloadedMsg
+}
+
 // internal struct for parsing GitHub release JSON.
 type githubRelease struct {
 	TagName string `json:"tag_name"`
@@ -67,6 +88,27 @@ type mainModel struct {
 	sentByAcct    map[string][]fetcher.Email
 	inbox         *tui.Inbox
 	sentInbox     *tui.Inbox
+	folderEmails  []fetcher.Email
+	folderByAcct  map[string][]fetcher.Email
+	folderInbox   *tui.Inbox
+	folderName    string
+	folders       *tui.Folders
+	flaggedEmails []fetcher.Email
+	flaggedByAcct map[string][]fetcher.Email
+	flaggedInbox  *tui.Inbox
+	searchEmails  []fetcher.Email
+	searchByAcct  map[string][]fetcher.Email
+	searchInbox   *tui.Inbox
+	search        *tui.Search
+	searchQuery   fetcher.Query
+	searchRaw     string
+	syncStates    map[string]fetcher.SyncState // Inbox sync state by account ID
+	watcher       *backend.Watcher
+	trust         *tui.TrustPrompt              // Shown over the current view while open
+	untrusted     []tui.CertificateUntrustedMsg // Certificates to ask about, the first one shown in trust
+	signIn        context.Context               // OAuth2 sign-in in progress, if any
+	cancelSignIn  context.CancelFunc
+	download      *attachmentDownload // Attachment download in progress, if any
 	width         int
 	height        int
 	err           error
@@ -74,8 +116,12 @@ type mainModel struct {
 
 func newInitialModel(cfg *config.Config) *mainModel {
 	initialModel := &mainModel{
-		emailsByAcct: make(map[string][]fetcher.Email),
-		sentByAcct:   make(map[string][]fetcher.Email),
+		emailsByAcct:  make(map[string][]fetcher.Email),
+		sentByAcct:    make(map[string][]fetcher.Email),
+		folderByAcct:  make(map[string][]fetcher.Email),
+		flaggedByAcct: make(map[string][]fetcher.Email),
+		searchByAcct:  make(map[string][]fetcher.Email),
+		syncStates:    make(map[string]fetcher.SyncState),
 	}
 
 	if cfg == nil || !cfg.HasAccounts() {
@@ -88,13 +134,20 @@ func newInitialModel(cfg *config.Config) *mainModel {
 }
 
 func (m *mainModel) Init() tea.Cmd {
-	return tea.Batch(m.current.Init(), checkForUpdatesCmd())
+	return tea.Batch(m.current.Init(), checkForUpdatesCmd(), waitForUntrustedCertificate(), waitForRefreshedToken())
 }
 
 func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 	var cmds []tea.Cmd
 
+	// A certificate prompt takes the keyboard until it is answered, while
+	// the view below it keeps receiving everything else.
+	if key, ok := msg.(tea.KeyMsg); ok && m.trust != nil && key.String() != "ctrl+c" {
+		_, cmd = m.trust.Update(msg)
+		return m, cmd
+	}
+
 	m.current, cmd = m.current.Update(msg)
 	cmds = append(cmds, cmd)
 
@@ -112,7 +165,20 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			switch m.current.(type) {
 			case *tui.FilePicker:
 				return m, func() tea.Msg { return tui.CancelFilePickerMsg{} }
-			case *tui.Inbox, *tui.Login:
+			case *tui.MovePrompt:
+				m.current = m.mailboxView(m.current.(*tui.MovePrompt).Mailbox())
+				return m, nil
+			case *tui.Inbox, *tui.Login, *tui.Folders, *tui.Search:
+				// A folder goes back to the folder picker it was opened from.
+				if m.folderInbox != nil && m.current == tea.Model(m.folderInbox) && m.folders != nil {
+					m.current = m.folders
+					return m, nil
+				}
+				// Search results go back to the prompt to refine the query.
+				if m.searchInbox != nil && m.current == tea.Model(m.searchInbox) && m.search != nil {
+					m.current = m.search
+					return m, m.current.Init()
+				}
 				m.current = tui.NewChoice()
 				return m, m.current.Init()
 			}
@@ -127,19 +193,7 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 
 	case tui.BackToMailboxMsg:
-		switch msg.Mailbox {
-		case tui.MailboxSent:
-			if m.sentInbox != nil {
-				m.current = m.sentInbox
-				return m, nil
-			}
-		case tui.MailboxInbox:
-			if m.inbox != nil {
-				m.current = m.inbox
-				return m, nil
-			}
-		}
-		m.current = tui.NewChoice()
+		m.current = m.mailboxView(msg.Mailbox)
 		return m, nil
 
 	case tui.DiscardDraftMsg:
@@ -163,19 +217,42 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			Email:           msg.Host, // login/email used for authentication comes from Host field in the form
 			Password:        msg.Password,
 			ServiceProvider: msg.Provider,
-			FetchEmail:      msg.FetchEmail,
 		}
+		account.Addresses, account.AllMail = config.ParseAddresses(msg.Addresses)
 
 		if msg.Provider == "custom" {
 			account.IMAPServer = msg.IMAPServer
 			account.IMAPPort = msg.IMAPPort
 			account.SMTPServer = msg.SMTPServer
 			account.SMTPPort = msg.SMTPPort
+			account.IMAPSecurity = msg.IMAPSecurity
+			account.SMTPSecurity = msg.SMTPSecurity
+		}
+
+		if msg.Provider == "pop3" {
+			// POP3 accounts have custom servers, sending through SMTP.
+			account.ServiceProvider = "custom"
+			account.Backend = config.BackendPOP3
+			account.POP3Server = msg.POP3Server
+			account.POP3Port = msg.POP3Port
+			account.POP3Security = msg.POP3Security
+			account.POP3Delete = msg.POP3Delete
+			account.SMTPServer = msg.SMTPServer
+			account.SMTPPort = msg.SMTPPort
+			account.SMTPSecurity = msg.SMTPSecurity
+		}
+
+		if msg.Provider == "jmap" {
+			account.Backend = config.BackendJMAP
+			account.JMAPURL = msg.JMAPURL
 		}
 
-		// Ensure FetchEmail defaults to the login Email (Host) if not explicitly set
-		if account.FetchEmail == "" && account.Email != "" {
-			account.FetchEmail = account.Email
+		if msg.AuthMethod == config.AuthToken {
+			account.AuthMethod = config.AuthToken
+		}
+		if msg.AuthMethod == config.AuthOAuth2 {
+			account.AuthMethod = config.AuthOAuth2
+			account.OAuth2 = &config.OAuth2{ClientID: msg.ClientID, ClientSecret: msg.ClientSecret}
 		}
 
 		if m.config == nil {
@@ -189,6 +266,12 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			for i, acc := range m.config.Accounts {
 				if acc.ID == existingID {
 					account.ID = existingID
+					// Keep the endpoints and the sign-in of the same client.
+					if account.OAuth2 != nil && acc.OAuth2 != nil && acc.OAuth2.ClientID == account.OAuth2.ClientID {
+						oauth2 := *acc.OAuth2
+						oauth2.ClientSecret = account.OAuth2.ClientSecret
+						account.OAuth2 = &oauth2
+					}
 					m.config.Accounts[i] = account
 					break
 				}
@@ -202,9 +285,76 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, tea.Quit
 		}
 
+		if account.UsesOAuth2() && account.OAuth2.RefreshToken == "" {
+			accountID := account.ID
+			return m, func() tea.Msg { return tui.SignInMsg{AccountID: accountID} }
+		}
+
+		if m.watcher != nil {
+			m.watcher.Watch(account, "INBOX")
+		}
+
+		m.current = tui.NewChoice()
+		return m, m.current.Init()
+
+	case tui.SignInMsg:
+		account := m.config.GetAccountByID(msg.AccountID)
+		if account == nil {
+			return m, nil
+		}
+		if m.cancelSignIn != nil {
+			m.cancelSignIn()
+		}
+		m.signIn, m.cancelSignIn = context.WithTimeout(context.Background(), 15*time.Minute)
+		m.current = tui.NewStatus("Starting sign-in...")
+		return m, tea.Batch(m.current.Init(), startSignInCmd(m.signIn, *account))
+
+	case tui.SignInStartedMsg:
+		if m.signIn == nil {
+			return m, nil
+		}
+		if msg.Err != nil {
+			return m, func() tea.Msg { return tui.SignInDoneMsg{AccountID: msg.AccountID, Err: msg.Err} }
+		}
+		m.current = tui.NewSignInPrompt(msg, m.accountName(msg.AccountID))
+		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+		if msg.Authorization.UserCode == "" {
+			go openExternal(msg.Authorization.URL)
+		}
+		return m, waitForSignInCmd(m.signIn, msg)
+
+	case tui.CancelSignInMsg:
+		if m.cancelSignIn != nil {
+			m.cancelSignIn()
+			m.signIn, m.cancelSignIn = nil, nil
+		}
+		m.current = tui.NewChoice()
+		return m, m.current.Init()
+
+	case tui.SignInDoneMsg:
+		if m.signIn == nil {
+			// Cancelled meanwhile.
+			return m, nil
+		}
+		m.cancelSignIn()
+		m.signIn, m.cancelSignIn = nil, nil
+		if msg.Err != nil {
+			m.previousModel = tui.NewChoice()
+			m.current = tui.NewStatus(fmt.Sprintf("Could not sign in: %v", msg.Err))
+			return m, tea.Tick(3*time.Second, func(t time.Time) tea.Msg {
+				return tui.RestoreViewMsg{}
+			})
+		}
+		m.signedIn(msg.AccountID, msg.Token)
 		m.current = tui.NewChoice()
 		return m, m.current.Init()
 
+	case tui.TokenRefreshedMsg:
+		if account := m.config.GetAccountByID(msg.AccountID); account != nil && account.OAuth2 != nil {
+			m.saveRefreshToken(account, msg.RefreshToken)
+		}
+		return m, waitForRefreshedToken()
+
 	case tui.GoToInboxMsg:
 		if m.config == nil || !m.config.HasAccounts() {
 			m.current = tui.NewLogin()
@@ -218,6 +368,56 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.current = tui.NewStatus("Fetching emails from all accounts...")
 		return m, tea.Batch(m.current.Init(), fetchAllAccountsEmails(m.config, tui.MailboxInbox))
 
+	case tui.GoToFlaggedMsg:
+		if m.config == nil || !m.config.HasAccounts() {
+			m.current = tui.NewLogin()
+			return m, m.current.Init()
+		}
+		m.current = tui.NewStatus("Fetching flagged emails from all accounts...")
+		return m, tea.Batch(m.current.Init(), fetchAllAccountsEmails(m.config, tui.MailboxFlagged))
+
+	case tui.GoToSearchMsg:
+		if m.config == nil || !m.config.HasAccounts() {
+			m.current = tui.NewLogin()
+			return m, m.current.Init()
+		}
+		m.search = tui.NewSearch(m.searchRaw)
+		m.current = m.search
+		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+		return m, m.current.Init()
+
+	case tui.SearchMsg:
+		m.searchQuery = msg.Query
+		m.searchRaw = msg.Raw
+		m.current = tui.NewStatus("Searching all accounts...")
+		return m, tea.Batch(m.current.Init(), searchAllAccounts(m.config, msg.Query, false))
+
+	case tui.GoToFoldersMsg:
+		if m.config == nil || !m.config.HasAccounts() {
+			m.current = tui.NewLogin()
+			return m, m.current.Init()
+		}
+		m.current = tui.NewStatus("Fetching folders from all accounts...")
+		return m, tea.Batch(m.current.Init(), fetchAllAccountsFolders(m.config))
+
+	case tui.FoldersFetchedMsg:
+		m.folders = tui.NewFolders(m.config.Accounts, msg.FoldersByAccount)
+		m.current = m.folders
+		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+		return m, m.current.Init()
+
+	case tui.OpenFolderMsg:
+		account := m.config.GetAccountByID(msg.AccountID)
+		if account == nil {
+			return m, nil
+		}
+		m.folderName = msg.Folder
+		m.folderEmails = nil
+		m.folderByAcct = make(map[string][]fetcher.Email)
+		m.folderInbox = nil
+		m.current = tui.NewStatus(fmt.Sprintf("Fetching %s...", msg.Folder))
+		return m, tea.Batch(m.current.Init(), fetchEmails(account, msg.Folder, initialEmailLimit, 0, 0, tui.MailboxFolder))
+
 	case tui.GoToSentInboxMsg:
 		if m.config == nil || !m.config.HasAccounts() {
 			m.current = tui.NewLogin()
@@ -238,13 +438,19 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		emailsByAcct := make(map[string][]fetcher.Email)
 		for _, cached := range msg.Cache.Emails {
 			email := fetcher.Email{
-				UID:       cached.UID,
-				From:      cached.From,
-				To:        cached.To,
-				Subject:   cached.Subject,
-				Date:      cached.Date,
-				MessageID: cached.MessageID,
-				AccountID: cached.AccountID,
+				UID:         cached.UID,
+				From:        cached.From,
+				To:          cached.To,
+				Subject:     cached.Subject,
+				Date:        cached.Date,
+				MessageID:   cached.MessageID,
+				InReplyTo:   cached.InReplyTo,
+				References:  cached.References,
+				ThreadID:    cached.ThreadID,
+				Preview:     cached.Preview,
+				AccountID:   cached.AccountID,
+				UIDValidity: cached.UIDValidity,
+				Flags:       cached.Flags,
 			}
 			cachedEmails = append(cachedEmails, email)
 			emailsByAcct[cached.AccountID] = append(emailsByAcct[cached.AccountID], email)
@@ -252,7 +458,18 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		m.emails = cachedEmails
 		m.emailsByAcct = emailsByAcct
+		for _, account := range m.config.Accounts {
+			if state, ok := msg.Cache.Mailboxes[config.MailboxKey(account.ID, "INBOX")]; ok {
+				m.syncStates[account.ID] = fetcher.SyncState{
+					UIDValidity:   state.UIDValidity,
+					UIDNext:       state.UIDNext,
+					Messages:      state.Messages,
+					HighestModSeq: state.HighestModSeq,
+				}
+			}
+		}
 		m.inbox = tui.NewInbox(m.emails, m.config.Accounts)
+		m.inbox.SetCompact(m.config.CompactInbox)
 		m.current = m.inbox
 		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
 
@@ -260,16 +477,79 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, tea.Batch(
 			m.current.Init(),
 			func() tea.Msg { return tui.RefreshingEmailsMsg{Mailbox: tui.MailboxInbox} },
-			refreshEmails(m.config, tui.MailboxInbox),
+			m.syncInbox(),
+			m.startWatching(),
 		)
 
 	case tui.RequestRefreshMsg:
+		if msg.Mailbox == tui.MailboxSearch {
+			return m, tea.Batch(
+				func() tea.Msg { return tui.RefreshingEmailsMsg{Mailbox: msg.Mailbox} },
+				searchAllAccounts(m.config, m.searchQuery, true),
+			)
+		}
+		if msg.Mailbox == tui.MailboxFolder {
+			return m, tea.Batch(
+				func() tea.Msg { return tui.RefreshingEmailsMsg{Mailbox: msg.Mailbox} },
+				refreshFolder(m.config, m.folderByAcct, m.folderName),
+			)
+		}
+		if msg.Mailbox == tui.MailboxInbox {
+			return m, tea.Batch(
+				func() tea.Msg { return tui.RefreshingEmailsMsg{Mailbox: msg.Mailbox} },
+				m.syncInbox(),
+			)
+		}
 		return m, tea.Batch(
 			func() tea.Msg { return tui.RefreshingEmailsMsg{Mailbox: msg.Mailbox} },
 			refreshEmails(m.config, msg.Mailbox),
 		)
 
+	case tui.EmailsSyncedMsg:
+		// Accounts that failed to sync keep the emails they have.
+		emailsByAcct := make(map[string][]fetcher.Email, len(m.emailsByAcct))
+		for id, emails := range m.emailsByAcct {
+			emailsByAcct[id] = emails
+		}
+		for id, changes := range msg.Changes {
+			emailsByAcct[id] = changes.Apply(emailsByAcct[id])
+		}
+		for id, emails := range msg.Reloaded {
+			emailsByAcct[id] = emails
+		}
+		for id, state := range msg.States {
+			m.syncStates[id] = state
+		}
+		return m.Update(tui.EmailsRefreshedMsg{EmailsByAccount: emailsByAcct, Mailbox: tui.MailboxInbox})
+
 	case tui.EmailsRefreshedMsg:
+		if msg.Mailbox == tui.MailboxSearch {
+			m.searchByAcct = msg.EmailsByAccount
+			m.searchEmails = flattenAndSort(msg.EmailsByAccount)
+			if m.searchInbox != nil {
+				m.searchInbox.SetEmails(m.searchEmails, m.config.Accounts)
+				m.current, _ = m.current.Update(msg)
+			}
+			return m, nil
+		}
+		if msg.Mailbox == tui.MailboxFlagged {
+			m.flaggedByAcct = msg.EmailsByAccount
+			m.flaggedEmails = flattenAndSort(msg.EmailsByAccount)
+			if m.flaggedInbox != nil {
+				m.flaggedInbox.SetEmails(m.flaggedEmails, m.config.Accounts)
+				m.current, _ = m.current.Update(msg)
+			}
+			return m, nil
+		}
+		if msg.Mailbox == tui.MailboxFolder {
+			m.folderByAcct = msg.EmailsByAccount
+			m.folderEmails = flattenAndSort(msg.EmailsByAccount)
+			if m.folderInbox != nil {
+				m.folderInbox.SetEmails(m.folderEmails, m.folderAccounts())
+				m.current, _ = m.current.Update(msg)
+			}
+			return m, nil
+		}
 		if msg.Mailbox == tui.MailboxSent {
 			m.sentByAcct = msg.EmailsByAccount
 			m.sentEmails = flattenAndSort(msg.EmailsByAccount)
@@ -284,7 +564,7 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.emails = flattenAndSort(msg.EmailsByAccount)
 
 		// Save to cache (inbox only)
-		go saveEmailsToCache(m.emails)
+		m.saveCache()
 
 		// Update inbox if it exists
 		if m.inbox != nil {
@@ -295,11 +575,32 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 
 	case tui.AllEmailsFetchedMsg:
+		if msg.Mailbox == tui.MailboxSearch {
+			m.searchByAcct = msg.EmailsByAccount
+			m.searchEmails = flattenAndSort(msg.EmailsByAccount)
+
+			m.searchInbox = tui.NewSearchInbox(m.searchEmails, m.config.Accounts, m.searchRaw)
+			m.searchInbox.SetCompact(m.config.CompactInbox)
+			m.current = m.searchInbox
+			m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+			return m, m.current.Init()
+		}
+		if msg.Mailbox == tui.MailboxFlagged {
+			m.flaggedByAcct = msg.EmailsByAccount
+			m.flaggedEmails = flattenAndSort(msg.EmailsByAccount)
+
+			m.flaggedInbox = tui.NewInboxWithMailbox(m.flaggedEmails, m.config.Accounts, tui.MailboxFlagged)
+			m.flaggedInbox.SetCompact(m.config.CompactInbox)
+			m.current = m.flaggedInbox
+			m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+			return m, m.current.Init()
+		}
 		if msg.Mailbox == tui.MailboxSent {
 			m.sentByAcct = msg.EmailsByAccount
 			m.sentEmails = flattenAndSort(msg.EmailsByAccount)
 
 			m.sentInbox = tui.NewSentInbox(m.sentEmails, m.config.Accounts)
+			m.sentInbox.SetCompact(m.config.CompactInbox)
 			m.current = m.sentInbox
 			m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
 			return m, m.current.Init()
@@ -309,14 +610,39 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.emails = flattenAndSort(msg.EmailsByAccount)
 
 		// Save to cache
-		go saveEmailsToCache(m.emails)
+		m.saveCache()
 
 		m.inbox = tui.NewInbox(m.emails, m.config.Accounts)
+		m.inbox.SetCompact(m.config.CompactInbox)
 		m.current = m.inbox
 		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
-		return m, m.current.Init()
+		return m, tea.Batch(m.current.Init(), m.startWatching())
+
+	case tui.MailboxUpdateMsg:
+		if msg.Mailbox == tui.MailboxInbox && uidValidityChanged(m.emailsByAcct[msg.AccountID], msg.Added) {
+			// The watcher reconnected to a mailbox whose UIDs were reset.
+			return m, tea.Batch(
+				waitForMailboxUpdate(m.watcher),
+				func() tea.Msg { return tui.UIDValidityChangedMsg{AccountID: msg.AccountID, Mailbox: msg.Mailbox} },
+			)
+		}
+		m.applyMailboxUpdate(msg)
+		return m, waitForMailboxUpdate(m.watcher)
 
 	case tui.EmailsFetchedMsg:
+		if msg.Mailbox == tui.MailboxFolder {
+			account := m.config.GetAccountByID(msg.AccountID)
+			if account == nil {
+				return m, nil
+			}
+			m.folderByAcct = map[string][]fetcher.Email{msg.AccountID: msg.Emails}
+			m.folderEmails = flattenAndSort(m.folderByAcct)
+			m.folderInbox = tui.NewFolderInbox(m.folderEmails, *account, m.folderName)
+			m.folderInbox.SetCompact(m.config.CompactInbox)
+			m.current = m.folderInbox
+			m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+			return m, m.current.Init()
+		}
 		if msg.Mailbox == tui.MailboxSent {
 			if m.sentByAcct == nil {
 				m.sentByAcct = make(map[string][]fetcher.Email)
@@ -325,6 +651,7 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.sentEmails = flattenAndSort(m.sentByAcct)
 			if m.sentInbox == nil {
 				m.sentInbox = tui.NewSentInbox(m.sentEmails, m.config.Accounts)
+				m.sentInbox.SetCompact(m.config.CompactInbox)
 			} else {
 				m.sentInbox.SetEmails(m.sentEmails, m.config.Accounts)
 			}
@@ -341,6 +668,7 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.emails = flattenAndSort(m.emailsByAcct)
 		if m.inbox == nil {
 			m.inbox = tui.NewInbox(m.emails, m.config.Accounts)
+			m.inbox.SetCompact(m.config.CompactInbox)
 		} else {
 			m.inbox.SetEmails(m.emails, m.config.Accounts)
 		}
@@ -358,10 +686,25 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, tea.Batch(
 			func() tea.Msg { return tui.FetchingMoreEmailsMsg{} },
-			fetchEmails(account, paginationLimit, msg.Offset, msg.Mailbox),
+			fetchEmails(account, m.mailboxName(msg.AccountID, msg.Mailbox), paginationLimit, msg.BeforeUID, msg.UIDValidity, msg.Mailbox),
 		)
 
+	case tui.UIDValidityChangedMsg:
+		// The loaded UIDs now point at other messages: drop them, including
+		// the cached ones, and load the mailbox again.
+		log.Printf("UIDVALIDITY of %s changed for account %s, reloading", msg.Mailbox, msg.AccountID)
+		if msg.Mailbox == tui.MailboxInbox {
+			delete(m.syncStates, msg.AccountID)
+		}
+		m.dropAccountEmails(msg.AccountID, msg.Mailbox)
+		return m, func() tea.Msg { return tui.RequestRefreshMsg{Mailbox: msg.Mailbox} }
+
 	case tui.EmailsAppendedMsg:
+		if msg.Mailbox == tui.MailboxFolder {
+			m.folderByAcct[msg.AccountID] = append(m.folderByAcct[msg.AccountID], msg.Emails...)
+			m.folderEmails = append(m.folderEmails, msg.Emails...)
+			return m, nil
+		}
 		if msg.Mailbox == tui.MailboxSent {
 			if m.sentByAcct == nil {
 				m.sentByAcct = make(map[string][]fetcher.Email)
@@ -417,13 +760,30 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case tui.GoToSettingsMsg:
 		if m.config != nil {
-			m.current = tui.NewSettings(m.config.Accounts)
+			settings := tui.NewSettings(m.config.Accounts)
+			settings.SetCompactInbox(m.config.CompactInbox)
+			m.current = settings
 		} else {
 			m.current = tui.NewSettings(nil)
 		}
 		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
 		return m, m.current.Init()
 
+	case tui.CompactInboxMsg:
+		if m.config == nil {
+			return m, nil
+		}
+		m.config.CompactInbox = msg.Compact
+		if err := config.SaveConfig(m.config); err != nil {
+			log.Printf("could not save config: %v", err)
+		}
+		for _, inbox := range []*tui.Inbox{m.inbox, m.flaggedInbox, m.sentInbox, m.folderInbox, m.searchInbox} {
+			if inbox != nil {
+				inbox.SetCompact(msg.Compact)
+			}
+		}
+		return m, nil
+
 	case tui.GoToAddAccountMsg:
 		m.current = tui.NewLogin()
 		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
@@ -435,7 +795,13 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case tui.DeleteAccountMsg:
 		if m.config != nil {
+			if account := m.config.GetAccountByID(msg.AccountID); account != nil {
+				go closeBackend(*account)
+			}
 			m.config.RemoveAccount(msg.AccountID)
+			if m.watcher != nil {
+				m.watcher.Unwatch(msg.AccountID)
+			}
 			if err := config.SaveConfig(m.config); err != nil {
 				log.Printf("could not save config: %v", err)
 			}
@@ -461,16 +827,12 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 		m.current = tui.NewStatus("Fetching email content...")
-		return m, tea.Batch(m.current.Init(), fetchEmailBodyCmd(m.config, *email, msg.UID, msg.AccountID, msg.Mailbox))
+		return m, tea.Batch(m.current.Init(), fetchEmailBodyCmd(m.config, m.mailboxName(msg.AccountID, msg.Mailbox), msg.UID, msg.AccountID, msg.Mailbox))
 
 	case tui.EmailBodyFetchedMsg:
 		if msg.Err != nil {
 			log.Printf("could not fetch email body: %v", msg.Err)
-			if msg.Mailbox == tui.MailboxSent && m.sentInbox != nil {
-				m.current = m.sentInbox
-			} else {
-				m.current = m.inbox
-			}
+			m.current = m.mailboxView(msg.Mailbox)
 			return m, nil
 		}
 
@@ -479,19 +841,58 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		email := m.getEmailByUIDAndAccount(msg.UID, msg.AccountID, msg.Mailbox)
 		if email == nil {
-			if msg.Mailbox == tui.MailboxSent && m.sentInbox != nil {
-				m.current = m.sentInbox
-			} else {
-				m.current = m.inbox
-			}
+			m.current = m.mailboxView(msg.Mailbox)
 			return m, nil
 		}
 
+		// Opening a message marks it as read.
+		var markRead tea.Cmd
+		if email.IsUnread() {
+			markRead = m.setFlag(tui.SetFlagMsg{UID: msg.UID, AccountID: msg.AccountID, Mailbox: msg.Mailbox, Flag: fetcher.FlagSeen, Enable: true})
+		}
+
 		// Find the index for the email view (used for display purposes)
 		emailIndex := m.getEmailIndex(msg.UID, msg.AccountID, msg.Mailbox)
 		emailView := tui.NewEmailView(*email, emailIndex, m.width, m.height, msg.Mailbox)
 		m.current = emailView
-		return m, m.current.Init()
+		return m, tea.Batch(m.current.Init(), markRead, fetchConversationCmd(m.config, *email, m.loadedBodies(msg.AccountID)))
+
+	case tui.ConversationFetchedMsg:
+		if msg.Err != nil {
+			log.Printf("could not fetch conversation: %v", msg.Err)
+			return m, nil
+		}
+		// Keep the fetched bodies, so that opening another email of the
+		// conversation doesn't fetch them again.
+		for _, e := range msg.Emails {
+			switch e.Mailbox {
+			case "INBOX":
+				m.updateEmailBodyByUID(e.UID, msg.AccountID, tui.MailboxInbox, e.Body, e.Attachments)
+			case m.mailboxName(msg.AccountID, tui.MailboxSent):
+				m.updateEmailBodyByUID(e.UID, msg.AccountID, tui.MailboxSent, e.Body, e.Attachments)
+			}
+		}
+		if emailView, ok := m.current.(*tui.EmailView); ok {
+			email := emailView.GetEmail()
+			if email.UID == msg.UID && email.AccountID == msg.AccountID {
+				emailView.SetConversation(msg.Emails)
+			}
+		}
+		return m, nil
+
+	case tui.SetFlagMsg:
+		return m, m.setFlag(msg)
+
+	case tui.FlagSetMsg:
+		if msg.Err != nil {
+			log.Printf("could not update flags: %v", msg.Err)
+			// Roll back the optimistic update.
+			m.applyFlag(msg.UID, msg.AccountID, msg.Mailbox, msg.Flag, !msg.Enable)
+			if ev, ok := m.current.(*tui.EmailView); ok && ev.GetEmail().UID == msg.UID && ev.GetAccountID() == msg.AccountID {
+				ev.SetEmailFlag(msg.Flag, !msg.Enable)
+			}
+		}
+		return m, nil
 
 	case tui.ReplyToEmailMsg:
 		to := msg.Email.From
@@ -516,8 +917,9 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		composer.SetQuotedText(quotedText)
 
 		// Set reply headers
+		// sender.BuildMessage appends In-Reply-To to References itself.
 		inReplyTo := msg.Email.MessageID
-		references := append(msg.Email.References, msg.Email.MessageID)
+		references := append([]string(nil), msg.Email.References...)
 		composer.SetReplyContext(inReplyTo, references)
 
 		m.current = composer
@@ -577,24 +979,55 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, tea.Batch(m.current.Init(), sendEmail(account, msg))
 
 	case tui.EmailResultMsg:
+		if msg.Err != nil {
+			var certErr *config.CertificateError
+			if errors.As(msg.Err, &certErr) {
+				m.promptTrust(tui.CertificateUntrustedMsg{AccountID: msg.AccountID, Err: certErr})
+				m.current = tui.NewChoice()
+				return m, m.current.Init()
+			}
+			m.previousModel = tui.NewChoice()
+			m.current = tui.NewStatus(fmt.Sprintf("Could not send the email: %v", msg.Err))
+			return m, tea.Tick(3*time.Second, func(t time.Time) tea.Msg {
+				return tui.RestoreViewMsg{}
+			})
+		}
 		m.current = tui.NewChoice()
 		return m, m.current.Init()
 
+	case tui.CertificateUntrustedMsg:
+		m.promptTrust(msg)
+		return m, waitForUntrustedCertificate()
+
+	case tui.TrustCertificateMsg:
+		if msg.Trust {
+			m.trustCertificate(msg.AccountID, msg.Fingerprint)
+		}
+		m.trust = nil
+		if len(m.untrusted) > 0 {
+			m.untrusted = m.untrusted[1:]
+		}
+		if len(m.untrusted) > 0 {
+			m.trust = tui.NewTrustPrompt(m.untrusted[0], m.accountName(m.untrusted[0].AccountID))
+		}
+		if msg.Trust && m.inbox != nil {
+			return m, func() tea.Msg { return tui.RequestRefreshMsg{Mailbox: tui.MailboxInbox} }
+		}
+		return m, nil
+
 	case tui.DeleteEmailMsg:
 		m.previousModel = m.current
 		m.current = tui.NewStatus("Deleting email...")
 
 		account := m.config.GetAccountByID(msg.AccountID)
 		if account == nil {
-			if msg.Mailbox == tui.MailboxSent && m.sentInbox != nil {
-				m.current = m.sentInbox
-			} else {
-				m.current = m.inbox
-			}
+			m.current = m.mailboxView(msg.Mailbox)
 			return m, nil
 		}
 
-		return m, tea.Batch(m.current.Init(), deleteEmailCmd(account, msg.UID, msg.AccountID, msg.Mailbox))
+		mailboxName := m.mailboxName(msg.AccountID, msg.Mailbox)
+		undo := m.undoMove(msg.UID, msg.AccountID, msg.Mailbox, mailboxName, specialMailbox(account, fetcher.SpecialTrash))
+		return m, tea.Batch(m.current.Init(), deleteEmailCmd(account, mailboxName, msg.UID, msg.AccountID, msg.Mailbox, undo))
 
 	case tui.ArchiveEmailMsg:
 		m.previousModel = m.current
@@ -602,76 +1035,133 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		account := m.config.GetAccountByID(msg.AccountID)
 		if account == nil {
-			if msg.Mailbox == tui.MailboxSent && m.sentInbox != nil {
-				m.current = m.sentInbox
-			} else {
-				m.current = m.inbox
-			}
+			m.current = m.mailboxView(msg.Mailbox)
 			return m, nil
 		}
 
-		return m, tea.Batch(m.current.Init(), archiveEmailCmd(account, msg.UID, msg.AccountID, msg.Mailbox))
+		mailboxName := m.mailboxName(msg.AccountID, msg.Mailbox)
+		undo := m.undoMove(msg.UID, msg.AccountID, msg.Mailbox, mailboxName, specialMailbox(account, fetcher.SpecialArchive))
+		return m, tea.Batch(m.current.Init(), archiveEmailCmd(account, mailboxName, msg.UID, msg.AccountID, msg.Mailbox, undo))
 
 	case tui.EmailActionDoneMsg:
 		if msg.Err != nil {
 			log.Printf("Action failed: %v", msg.Err)
-			if msg.Mailbox == tui.MailboxSent && m.sentInbox != nil {
-				m.current = m.sentInbox
-			} else {
-				m.current = m.inbox
-			}
+			m.current = m.mailboxView(msg.Mailbox)
 			return m, nil
 		}
 
 		// Remove email from stores
 		m.removeEmailByMailbox(msg.UID, msg.AccountID, msg.Mailbox)
+		m.removeFromOtherViews([]uint32{msg.UID}, msg.AccountID, msg.Mailbox)
 
-		if msg.Mailbox == tui.MailboxSent {
-			if m.sentInbox != nil {
-				m.sentInbox.RemoveEmail(msg.UID, msg.AccountID)
-				m.current = m.sentInbox
-				m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
-				return m, m.current.Init()
+		if inbox := m.mailboxInbox(msg.Mailbox); inbox != nil {
+			inbox.RemoveEmail(msg.UID, msg.AccountID)
+			m.current = inbox
+			m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+			if msg.Undo != nil {
+				return m, tea.Batch(m.current.Init(), inbox.ShowUndo(*msg.Undo))
 			}
-			m.current = tui.NewChoice()
 			return m, m.current.Init()
 		}
+		m.current = tui.NewChoice()
+		return m, m.current.Init()
 
-		if m.inbox != nil {
-			m.inbox.RemoveEmail(msg.UID, msg.AccountID)
-			m.current = m.inbox
+	case tui.BulkActionMsg:
+		if msg.Action == tui.BulkMove && msg.Dest == "" {
+			m.current = tui.NewMovePrompt(msg)
 			m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
 			return m, m.current.Init()
 		}
-		m.current = tui.NewChoice()
-		return m, m.current.Init()
 
-	case tui.DownloadAttachmentMsg:
-		m.previousModel = m.current
-		m.current = tui.NewStatus(fmt.Sprintf("Downloading %s...", msg.Filename))
+		status := map[tui.BulkAction]string{
+			tui.BulkDelete:   "Deleting %d %s...",
+			tui.BulkArchive:  "Archiving %d %s...",
+			tui.BulkMove:     "Moving %d %s...",
+			tui.BulkMarkRead: "Marking %d %s read...",
+		}[msg.Action]
+		m.current = tui.NewStatus(fmt.Sprintf(status, msg.Count(), emailsNoun(msg.Count())))
+
+		mailboxNames := make(map[string]string, len(msg.UIDsByAccount))
+		for accountID := range msg.UIDsByAccount {
+			mailboxNames[accountID] = m.mailboxName(accountID, msg.Mailbox)
+		}
+		return m, tea.Batch(m.current.Init(), bulkActionCmd(m.config, mailboxNames, msg))
+
+	case tui.BulkActionDoneMsg:
+		done := 0
+		for accountID, uids := range msg.Done {
+			done += len(uids)
+			if msg.Action == tui.BulkMarkRead {
+				for _, uid := range uids {
+					m.applyFlag(uid, accountID, msg.Mailbox, fetcher.FlagSeen, true)
+				}
+				continue
+			}
+			for _, uid := range uids {
+				m.removeEmailByMailbox(uid, accountID, msg.Mailbox)
+			}
+			if inbox := m.mailboxInbox(msg.Mailbox); inbox != nil {
+				inbox.RemoveEmails(uids, accountID)
+			}
+			m.removeFromOtherViews(uids, accountID, msg.Mailbox)
+		}
+		if showsInbox(msg.Mailbox) {
+			m.saveCache()
+		}
+
+		inbox := m.mailboxInbox(msg.Mailbox)
+		if inbox == nil {
+			m.current = tui.NewChoice()
+			return m, m.current.Init()
+		}
+		inbox.ClearMarks()
+		m.current = inbox
+		m.current, _ = m.current.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+		return m, tea.Batch(m.current.Init(), inbox.ShowNotice(bulkActionSummary(msg.Action, msg.Dest, done, msg.Failed)))
 
+	case tui.UndoMoveMsg:
+		account := m.config.GetAccountByID(msg.AccountID)
+		if account == nil {
+			return m, nil
+		}
+		return m, restoreEmailCmd(account, msg)
+
+	case tui.EmailRestoredMsg:
+		if msg.Err != nil {
+			log.Printf("Undo failed: %v", msg.Err)
+			return m, nil
+		}
+		// The restored email has a new UID, so load it from the server.
+		return m, func() tea.Msg { return tui.RequestRefreshMsg{Mailbox: msg.Mailbox} }
+
+	case tui.DownloadAttachmentMsg:
+		if m.download != nil {
+			return m, nil
+		}
 		account := m.config.GetAccountByID(msg.AccountID)
 		if account == nil {
-			m.current = m.previousModel
 			return m, nil
 		}
 
-		email := m.getEmailByIndex(msg.Index, msg.Mailbox)
+		// Looked up by UID, as the list may have been re-sorted by new mail
+		// since the email was opened.
+		email := m.getEmailByUIDAndAccount(msg.UID, msg.AccountID, msg.Mailbox)
 		if email == nil {
-			m.current = m.previousModel
 			return m, nil
 		}
 
-		// Find the correct attachment to get encoding
+		// Find the correct attachment to get encoding and size
 		var encoding string
+		var size int64
 		for _, att := range email.Attachments {
 			if att.PartID == msg.PartID {
 				encoding = att.Encoding
+				size = att.Size
 				break
 			}
 		}
 		newMsg := tui.DownloadAttachmentMsg{
-			Index:     msg.Index,
+			UID:       msg.UID,
 			Filename:  msg.Filename,
 			PartID:    msg.PartID,
 			Data:      msg.Data,
@@ -679,11 +1169,74 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			Encoding:  encoding,
 			Mailbox:   msg.Mailbox,
 		}
-		return m, tea.Batch(m.current.Init(), downloadAttachmentCmd(account, email.UID, newMsg))
+		ctx, cancel := context.WithCancel(context.Background())
+		m.download = &attachmentDownload{cancel: cancel, updates: make(chan tea.Msg, 1)}
+		go downloadAttachment(ctx, m.download.updates, account, m.mailboxName(msg.AccountID, msg.Mailbox), email.UID, newMsg, size)
+		if emailView, ok := m.current.(*tui.EmailView); ok {
+			emailView.SetDownloadProgress(tui.AttachmentProgressMsg{Filename: msg.Filename, Total: size})
+		}
+		return m, waitForDownload(m.download.updates)
+
+	case tui.AttachmentProgressMsg:
+		if emailView, ok := m.current.(*tui.EmailView); ok {
+			emailView.SetDownloadProgress(msg)
+		}
+		if m.download == nil {
+			return m, nil
+		}
+		return m, waitForDownload(m.download.updates)
+
+	case tui.CancelDownloadMsg:
+		if m.download != nil {
+			m.download.cancel()
+		}
+		return m, nil
+
+	case attachmentDoneMsg:
+		m.download = nil
+		if emailView, ok := m.current.(*tui.EmailView); ok {
+			emailView.EndDownload()
+		}
+		m.previousModel = m.current
+		done := msg.AttachmentDownloadedMsg
+		return m, func() tea.Msg { return done }
+
+	case tui.FetchSourceMsg:
+		account := m.config.GetAccountByID(msg.AccountID)
+		if account == nil {
+			return m, nil
+		}
+		return m, fetchSourceCmd(account, m.mailboxName(msg.AccountID, msg.Mailbox), msg)
+
+	case tui.SourceFetchedMsg:
+		if msg.Err != nil {
+			log.Printf("could not fetch message source: %v", msg.Err)
+		}
+		if emailView, ok := m.current.(*tui.EmailView); ok {
+			email := emailView.GetEmail()
+			if email.UID == msg.UID && email.AccountID == msg.AccountID {
+				if msg.HeaderOnly {
+					emailView.SetHeader(msg.Raw, msg.Err)
+				} else {
+					emailView.SetSource(msg.Raw, msg.Err)
+				}
+			}
+		}
+		return m, nil
+
+	case tui.SaveSourceMsg:
+		m.previousModel = m.current
+		m.current = tui.NewStatus(fmt.Sprintf("Saving %s...", msg.Filename))
+		return m, tea.Batch(m.current.Init(), func() tea.Msg {
+			path, err := saveToDownloads(msg.Filename, msg.Raw)
+			return tui.AttachmentDownloadedMsg{Path: path, Err: err}
+		})
 
 	case tui.AttachmentDownloadedMsg:
 		var statusMsg string
-		if msg.Err != nil {
+		if errors.Is(msg.Err, context.Canceled) {
+			statusMsg = "Download cancelled"
+		} else if msg.Err != nil {
 			statusMsg = fmt.Sprintf("Error downloading: %v", msg.Err)
 		} else {
 			statusMsg = fmt.Sprintf("Saved to %s", msg.Path)
@@ -704,136 +1257,373 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, tea.Batch(cmds...)
 }
 
-func (m *mainModel) getEmailByIndex(index int, mailbox tui.MailboxKind) *fetcher.Email {
-	switch mailbox {
-	case tui.MailboxSent:
-		if index >= 0 && index < len(m.sentEmails) {
-			return &m.sentEmails[index]
-		}
-	default:
-		if index >= 0 && index < len(m.emails) {
-			return &m.emails[index]
-		}
+// promptTrust asks whether to trust a certificate, after any prompts that
+// are already open.
+func (m *mainModel) promptTrust(msg tui.CertificateUntrustedMsg) {
+	m.untrusted = append(m.untrusted, msg)
+	if m.trust == nil {
+		m.trust = tui.NewTrustPrompt(msg, m.accountName(msg.AccountID))
 	}
-	return nil
 }
 
-func (m *mainModel) getEmailByUIDAndAccount(uid uint32, accountID string, mailbox tui.MailboxKind) *fetcher.Email {
-	switch mailbox {
-	case tui.MailboxSent:
-		for i := range m.sentEmails {
-			if m.sentEmails[i].UID == uid && m.sentEmails[i].AccountID == accountID {
-				return &m.sentEmails[i]
-			}
-		}
-	default:
-		for i := range m.emails {
-			if m.emails[i].UID == uid && m.emails[i].AccountID == accountID {
-				return &m.emails[i]
+// trustCertificate pins a certificate for an account and reconnects it.
+func (m *mainModel) trustCertificate(accountID, fingerprint string) {
+	account := m.config.GetAccountByID(accountID)
+	if account == nil {
+		return
+	}
+	account.CertFingerprints = append(account.CertFingerprints, fingerprint)
+	if err := config.SaveConfig(m.config); err != nil {
+		log.Printf("could not save config: %v", err)
+	}
+	closeBackend(*account)
+	if m.watcher != nil {
+		m.watcher.Watch(*account, "INBOX")
+	}
+}
+
+// signedIn stores the token of an account that signed in and reconnects it
+// with it.
+func (m *mainModel) signedIn(accountID string, token *oauth.Token) {
+	account := m.config.GetAccountByID(accountID)
+	if account == nil || account.OAuth2 == nil {
+		return
+	}
+	oauth.Store(accountID, token)
+	if token.RefreshToken != "" {
+		m.saveRefreshToken(account, token.RefreshToken)
+	}
+	closeBackend(*account)
+	if m.watcher != nil {
+		m.watcher.Watch(*account, "INBOX")
+	}
+}
+
+// saveRefreshToken replaces an account's refresh token and saves it. The
+// OAuth2 config is copied rather than changed, since copies of the account
+// in use elsewhere share it.
+func (m *mainModel) saveRefreshToken(account *config.Account, refreshToken string) {
+	oauth2 := *account.OAuth2
+	oauth2.RefreshToken = refreshToken
+	account.OAuth2 = &oauth2
+	if err := config.SaveConfig(m.config); err != nil {
+		log.Printf("could not save config: %v", err)
+	}
+}
+
+// accountName returns the email address of an account for display.
+func (m *mainModel) accountName(accountID string) string {
+	if m.config != nil {
+		if account := m.config.GetAccountByID(accountID); account != nil {
+			return account.Email
+		}
+	}
+	return accountID
+}
+
+// setFlag applies a flag change locally right away and returns the command
+// that stores it on the server.
+func (m *mainModel) setFlag(msg tui.SetFlagMsg) tea.Cmd {
+	account := m.config.GetAccountByID(msg.AccountID)
+	if account == nil {
+		return nil
+	}
+	m.applyFlag(msg.UID, msg.AccountID, msg.Mailbox, msg.Flag, msg.Enable)
+	return setFlagCmd(account, m.mailboxName(msg.AccountID, msg.Mailbox), msg)
+}
+
+// applyFlag sets or clears a flag on an email in the model and its list view.
+// The inbox, flagged and search views show the same mailbox, so all of
+// them are updated.
+func (m *mainModel) applyFlag(uid uint32, accountID string, mailbox tui.MailboxKind, flag string, enable bool) {
+	kinds := []tui.MailboxKind{mailbox}
+	switch mailbox {
+	case tui.MailboxInbox, tui.MailboxFlagged, tui.MailboxSearch:
+		kinds = []tui.MailboxKind{tui.MailboxInbox, tui.MailboxFlagged, tui.MailboxSearch}
+	}
+
+	for _, kind := range kinds {
+		emails, byAcct := m.mailboxStore(kind)
+		for i := range *emails {
+			if (*emails)[i].UID == uid && (*emails)[i].AccountID == accountID {
+				(*emails)[i].SetFlag(flag, enable)
 			}
 		}
+		for i := range byAcct[accountID] {
+			if byAcct[accountID][i].UID == uid {
+				byAcct[accountID][i].SetFlag(flag, enable)
+			}
+		}
+		if inbox := m.mailboxInbox(kind); inbox != nil {
+			inbox.SetEmailFlag(uid, accountID, flag, enable)
+		}
 	}
-	return nil
 }
 
-func (m *mainModel) getEmailIndex(uid uint32, accountID string, mailbox tui.MailboxKind) int {
+// mailboxStore returns the flattened, date-sorted email list and the
+// per-account emails backing a mailbox kind.
+func (m *mainModel) mailboxStore(mailbox tui.MailboxKind) (*[]fetcher.Email, map[string][]fetcher.Email) {
 	switch mailbox {
 	case tui.MailboxSent:
-		for i := range m.sentEmails {
-			if m.sentEmails[i].UID == uid && m.sentEmails[i].AccountID == accountID {
-				return i
-			}
+		return &m.sentEmails, m.sentByAcct
+	case tui.MailboxFolder:
+		return &m.folderEmails, m.folderByAcct
+	case tui.MailboxFlagged:
+		return &m.flaggedEmails, m.flaggedByAcct
+	case tui.MailboxSearch:
+		return &m.searchEmails, m.searchByAcct
+	default:
+		return &m.emails, m.emailsByAcct
+	}
+}
+
+// mailboxInbox returns the list view for a mailbox kind, or nil if it has
+// not been opened yet.
+func (m *mainModel) mailboxInbox(mailbox tui.MailboxKind) *tui.Inbox {
+	switch mailbox {
+	case tui.MailboxSent:
+		return m.sentInbox
+	case tui.MailboxFolder:
+		return m.folderInbox
+	case tui.MailboxFlagged:
+		return m.flaggedInbox
+	case tui.MailboxSearch:
+		return m.searchInbox
+	default:
+		return m.inbox
+	}
+}
+
+// mailboxView returns the view to go back to for a mailbox kind.
+func (m *mainModel) mailboxView(mailbox tui.MailboxKind) tea.Model {
+	if inbox := m.mailboxInbox(mailbox); inbox != nil {
+		return inbox
+	}
+	return tui.NewChoice()
+}
+
+// mailboxName returns the IMAP mailbox behind a mailbox kind for an account.
+func (m *mainModel) mailboxName(accountID string, mailbox tui.MailboxKind) string {
+	switch mailbox {
+	case tui.MailboxSent:
+		if account := m.config.GetAccountByID(accountID); account != nil {
+			return specialMailbox(account, fetcher.SpecialSent)
 		}
+		return "Sent"
+	case tui.MailboxFolder:
+		return m.folderName
 	default:
-		for i := range m.emails {
-			if m.emails[i].UID == uid && m.emails[i].AccountID == accountID {
-				return i
-			}
+		return "INBOX"
+	}
+}
+
+// folderAccounts returns the accounts shown in the open folder.
+func (m *mainModel) folderAccounts() []config.Account {
+	var accounts []config.Account
+	for _, acc := range m.config.Accounts {
+		if _, ok := m.folderByAcct[acc.ID]; ok {
+			accounts = append(accounts, acc)
+		}
+	}
+	return accounts
+}
+
+func (m *mainModel) getEmailByUIDAndAccount(uid uint32, accountID string, mailbox tui.MailboxKind) *fetcher.Email {
+	if i := m.getEmailIndex(uid, accountID, mailbox); i >= 0 {
+		emails, _ := m.mailboxStore(mailbox)
+		return &(*emails)[i]
+	}
+	return nil
+}
+
+func (m *mainModel) getEmailIndex(uid uint32, accountID string, mailbox tui.MailboxKind) int {
+	emails, _ := m.mailboxStore(mailbox)
+	for i := range *emails {
+		if (*emails)[i].UID == uid && (*emails)[i].AccountID == accountID {
+			return i
 		}
 	}
 	return -1
 }
 
 func (m *mainModel) updateEmailBodyByUID(uid uint32, accountID string, mailbox tui.MailboxKind, body string, attachments []fetcher.Attachment) {
-	switch mailbox {
-	case tui.MailboxSent:
-		for i := range m.sentEmails {
-			if m.sentEmails[i].UID == uid && m.sentEmails[i].AccountID == accountID {
-				m.sentEmails[i].Body = body
-				m.sentEmails[i].Attachments = attachments
+	emails, byAcct := m.mailboxStore(mailbox)
+	for i := range *emails {
+		if (*emails)[i].UID == uid && (*emails)[i].AccountID == accountID {
+			(*emails)[i].Body = body
+			(*emails)[i].Attachments = attachments
+			break
+		}
+	}
+	if acctEmails, ok := byAcct[accountID]; ok {
+		for i := range acctEmails {
+			if acctEmails[i].UID == uid {
+				acctEmails[i].Body = body
+				acctEmails[i].Attachments = attachments
 				break
 			}
 		}
-		if emails, ok := m.sentByAcct[accountID]; ok {
-			for i := range emails {
-				if emails[i].UID == uid {
-					emails[i].Body = body
-					emails[i].Attachments = attachments
-					break
-				}
-			}
+	}
+}
+
+// loadedBodies returns the inbox and Sent emails of an account whose bodies
+// have been fetched.
+func (m *mainModel) loadedBodies(accountID string) fetcher.LoadedBodies {
+	var emails []fetcher.Email
+	emails = append(emails, m.emailsByAcct[accountID]...)
+	emails = append(emails, m.sentByAcct[accountID]...)
+	return fetcher.NewLoadedBodies(emails)
+}
+
+func (m *mainModel) removeEmailByMailbox(uid uint32, accountID string, mailbox tui.MailboxKind) {
+	emails, byAcct := m.mailboxStore(mailbox)
+	var filtered []fetcher.Email
+	for _, e := range *emails {
+		if !(e.UID == uid && e.AccountID == accountID) {
+			filtered = append(filtered, e)
 		}
-	default:
-		for i := range m.emails {
-			if m.emails[i].UID == uid && m.emails[i].AccountID == accountID {
-				m.emails[i].Body = body
-				m.emails[i].Attachments = attachments
-				break
+	}
+	*emails = filtered
+	if acctEmails, ok := byAcct[accountID]; ok {
+		var filteredAcct []fetcher.Email
+		for _, e := range acctEmails {
+			if e.UID != uid {
+				filteredAcct = append(filteredAcct, e)
 			}
 		}
-		if emails, ok := m.emailsByAcct[accountID]; ok {
-			for i := range emails {
-				if emails[i].UID == uid {
-					emails[i].Body = body
-					emails[i].Attachments = attachments
-					break
-				}
-			}
+		byAcct[accountID] = filteredAcct
+	}
+}
+
+// showsInbox reports whether a mailbox kind shows emails of the inbox.
+func showsInbox(mailbox tui.MailboxKind) bool {
+	return mailbox == tui.MailboxInbox || mailbox == tui.MailboxFlagged || mailbox == tui.MailboxSearch
+}
+
+// removeFromOtherViews removes emails deleted or moved out of the inbox
+// through one of the views showing it from the stores and lists of the
+// others, so that they don't linger there until the next sync.
+func (m *mainModel) removeFromOtherViews(uids []uint32, accountID string, mailbox tui.MailboxKind) {
+	if !showsInbox(mailbox) {
+		return
+	}
+	for _, kind := range []tui.MailboxKind{tui.MailboxInbox, tui.MailboxFlagged, tui.MailboxSearch} {
+		if kind == mailbox {
+			continue
+		}
+		for _, uid := range uids {
+			m.removeEmailByMailbox(uid, accountID, kind)
+		}
+		if inbox := m.mailboxInbox(kind); inbox != nil {
+			inbox.RemoveEmails(uids, accountID)
 		}
 	}
 }
 
-func (m *mainModel) removeEmailByMailbox(uid uint32, accountID string, mailbox tui.MailboxKind) {
-	switch mailbox {
-	case tui.MailboxSent:
+// dropAccountEmails removes an account's emails of a mailbox kind from the
+// model, its list view and, for the inbox, the cache.
+func (m *mainModel) dropAccountEmails(accountID string, mailbox tui.MailboxKind) {
+	emails, byAcct := m.mailboxStore(mailbox)
+	var uids []uint32
+	for _, e := range byAcct[accountID] {
+		uids = append(uids, e.UID)
+	}
+	delete(byAcct, accountID)
+	*emails = flattenAndSort(byAcct)
+
+	if inbox := m.mailboxInbox(mailbox); inbox != nil {
+		inbox.RemoveEmails(uids, accountID)
+	}
+	if mailbox == tui.MailboxInbox {
+		m.saveCache()
+	}
+}
+
+func (m *mainModel) View() string {
+	if m.trust != nil {
+		return m.trust.View()
+	}
+	return m.current.View()
+}
+
+// startWatching starts pushing inbox changes for all accounts, unless that
+// is already happening.
+func (m *mainModel) startWatching() tea.Cmd {
+	if m.watcher != nil || m.config == nil {
+		return nil
+	}
+	m.watcher = backend.NewWatcher()
+	for _, account := range m.config.Accounts {
+		m.watcher.Watch(account, "INBOX")
+	}
+	return waitForMailboxUpdate(m.watcher)
+}
+
+// applyMailboxUpdate merges pushed inbox changes into the model, the inbox
+// view and the cache.
+func (m *mainModel) applyMailboxUpdate(msg tui.MailboxUpdateMsg) {
+	if msg.Mailbox != tui.MailboxInbox {
+		return
+	}
+
+	emails := m.emailsByAcct[msg.AccountID]
+	if len(msg.Removed) > 0 {
+		removed := make(map[uint32]bool, len(msg.Removed))
+		for _, uid := range msg.Removed {
+			removed[uid] = true
+		}
 		var filtered []fetcher.Email
-		for _, e := range m.sentEmails {
-			if !(e.UID == uid && e.AccountID == accountID) {
+		for _, e := range emails {
+			if !removed[e.UID] {
 				filtered = append(filtered, e)
 			}
 		}
-		m.sentEmails = filtered
-		if emails, ok := m.sentByAcct[accountID]; ok {
-			var filteredAcct []fetcher.Email
-			for _, e := range emails {
-				if e.UID != uid {
-					filteredAcct = append(filteredAcct, e)
-				}
+		emails = filtered
+	}
+
+	var added []fetcher.Email
+	for _, email := range msg.Added {
+		known := false
+		for _, e := range emails {
+			if e.UID == email.UID {
+				known = true
+				break
 			}
-			m.sentByAcct[accountID] = filteredAcct
 		}
-	default:
-		var filtered []fetcher.Email
-		for _, e := range m.emails {
-			if !(e.UID == uid && e.AccountID == accountID) {
-				filtered = append(filtered, e)
-			}
+		if !known {
+			added = append(added, email)
 		}
-		m.emails = filtered
-		if emails, ok := m.emailsByAcct[accountID]; ok {
-			var filteredAcct []fetcher.Email
-			for _, e := range emails {
-				if e.UID != uid {
-					filteredAcct = append(filteredAcct, e)
-				}
-			}
-			m.emailsByAcct[accountID] = filteredAcct
+	}
+	emails = append(added, emails...)
+
+	if m.emailsByAcct == nil {
+		m.emailsByAcct = make(map[string][]fetcher.Email)
+	}
+	m.emailsByAcct[msg.AccountID] = emails
+	m.emails = flattenAndSort(m.emailsByAcct)
+	m.saveCache()
+
+	if m.inbox != nil {
+		if len(msg.Removed) > 0 {
+			m.inbox.RemoveEmails(msg.Removed, msg.AccountID)
+		}
+		if len(added) > 0 {
+			m.inbox.AddEmails(added)
 		}
 	}
 }
 
-func (m *mainModel) View() string {
-	return m.current.View()
+// uidValidityChanged reports whether fresh emails were fetched with another
+// UIDVALIDITY than the loaded ones.
+func uidValidityChanged(loaded, fresh []fetcher.Email) bool {
+	for _, f := range fresh {
+		for _, l := range loaded {
+			if f.UIDValidity != 0 && l.UIDValidity != 0 && f.UIDValidity != l.UIDValidity {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func flattenAndSort(emailsByAccount map[string][]fetcher.Email) []fetcher.Email {
@@ -851,6 +1641,54 @@ func flattenAndSort(emailsByAccount map[string][]fetcher.Email) []fetcher.Email
 	return allEmails
 }
 
+// openBackend returns the backend of an account. Tests replace it to run
+// without servers.
+var openBackend = backend.Open
+
+// closeBackend releases what an account's backend holds open, so that it
+// reconnects with the account's current settings.
+func closeBackend(account config.Account) {
+	if b, err := openBackend(&account); err == nil {
+		b.Close()
+	}
+}
+
+// specialMailbox returns the name of an account's mailbox with a special
+// role.
+func specialMailbox(account *config.Account, use fetcher.SpecialUse) string {
+	b, err := openBackend(account)
+	if err != nil {
+		return ""
+	}
+	return b.SpecialMailbox(use)
+}
+
+// fetchFirstPage fetches the newest emails of a mailbox kind for one account.
+func fetchFirstPage(account *config.Account, mailbox tui.MailboxKind) ([]fetcher.Email, error) {
+	b, err := openBackend(account)
+	if err != nil {
+		return nil, err
+	}
+	switch mailbox {
+	case tui.MailboxSent:
+		page, err := b.FetchPage(b.SpecialMailbox(fetcher.SpecialSent), initialEmailLimit, 0, 0)
+		return page.Emails, err
+	case tui.MailboxFlagged:
+		return b.Flagged("INBOX")
+	default:
+		page, err := b.FetchPage("INBOX", initialEmailLimit, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if threader, ok := b.(backend.Threader); ok {
+			if err := threader.Thread("INBOX", page.Emails); err != nil {
+				log.Printf("Error threading emails from %s: %v", account.Email, err)
+			}
+		}
+		return page.Emails, nil
+	}
+}
+
 func fetchAllAccountsEmails(cfg *config.Config, mailbox tui.MailboxKind) tea.Cmd {
 	return func() tea.Msg {
 		emailsByAccount := make(map[string][]fetcher.Email)
@@ -861,13 +1699,7 @@ func fetchAllAccountsEmails(cfg *config.Config, mailbox tui.MailboxKind) tea.Cmd
 			wg.Add(1)
 			go func(acc config.Account) {
 				defer wg.Done()
-				var emails []fetcher.Email
-				var err error
-				if mailbox == tui.MailboxSent {
-					emails, err = fetcher.FetchSentEmails(&acc, initialEmailLimit, 0)
-				} else {
-					emails, err = fetcher.FetchEmails(&acc, initialEmailLimit, 0)
-				}
+				emails, err := fetchFirstPage(&acc, mailbox)
 				if err != nil {
 					log.Printf("Error fetching from %s: %v", acc.Email, err)
 					return
@@ -883,22 +1715,168 @@ func fetchAllAccountsEmails(cfg *config.Config, mailbox tui.MailboxKind) tea.Cmd
 	}
 }
 
-func fetchEmails(account *config.Account, limit, offset uint32, mailbox tui.MailboxKind) tea.Cmd {
+// searchAllAccounts runs a search query on every account in parallel. A
+// refresh reports the results as EmailsRefreshedMsg.
+func searchAllAccounts(cfg *config.Config, query fetcher.Query, refresh bool) tea.Cmd {
 	return func() tea.Msg {
-		var emails []fetcher.Email
-		var err error
-		if mailbox == tui.MailboxSent {
-			emails, err = fetcher.FetchSentEmails(account, limit, offset)
-		} else {
-			emails, err = fetcher.FetchEmails(account, limit, offset)
+		emailsByAccount := make(map[string][]fetcher.Email)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for _, account := range cfg.Accounts {
+			wg.Add(1)
+			go func(acc config.Account) {
+				defer wg.Done()
+				var emails []fetcher.Email
+				err := withBackend(&acc, func(b backend.Backend) (err error) {
+					emails, err = b.Search("INBOX", query, searchResultLimit)
+					return err
+				})
+				if err != nil {
+					log.Printf("Error searching %s: %v", acc.Email, err)
+					return
+				}
+				mu.Lock()
+				emailsByAccount[acc.ID] = emails
+				mu.Unlock()
+			}(account)
+		}
+
+		wg.Wait()
+		if refresh {
+			return tui.EmailsRefreshedMsg{EmailsByAccount: emailsByAccount, Mailbox: tui.MailboxSearch}
+		}
+		return tui.AllEmailsFetchedMsg{EmailsByAccount: emailsByAccount, Mailbox: tui.MailboxSearch}
+	}
+}
+
+// fetchEmails fetches the page of emails older than beforeUID, or the newest
+// emails if beforeUID is 0.
+func fetchEmails(account *config.Account, mailboxName string, limit, beforeUID, uidValidity uint32, mailbox tui.MailboxKind) tea.Cmd {
+	return func() tea.Msg {
+		b, err := openBackend(account)
+		if err != nil {
+			return tui.FetchErr(err)
+		}
+		page, err := b.FetchPage(mailboxName, limit, beforeUID, uidValidity)
+		if errors.Is(err, fetcher.ErrUIDValidityChanged) {
+			return tui.UIDValidityChangedMsg{AccountID: account.ID, Mailbox: mailbox}
 		}
 		if err != nil {
 			return tui.FetchErr(err)
 		}
-		if offset == 0 {
-			return tui.EmailsFetchedMsg{Emails: emails, AccountID: account.ID, Mailbox: mailbox}
+		if beforeUID == 0 {
+			return tui.EmailsFetchedMsg{Emails: page.Emails, AccountID: account.ID, Mailbox: mailbox}
+		}
+		return tui.EmailsAppendedMsg{Emails: page.Emails, AccountID: account.ID, Mailbox: mailbox, OldestUID: page.OldestUID}
+	}
+}
+
+// waitForUntrustedCertificate waits for a server certificate that failed
+// verification.
+func waitForUntrustedCertificate() tea.Cmd {
+	return func() tea.Msg {
+		u := <-fetcher.UntrustedCertificates()
+		return tui.CertificateUntrustedMsg{AccountID: u.AccountID, Err: u.Err}
+	}
+}
+
+// waitForRefreshedToken waits for a refresh token that the server replaced
+// while refreshing an access token.
+func waitForRefreshedToken() tea.Cmd {
+	return func() tea.Msg {
+		r := <-oauth.RefreshedTokens()
+		return tui.TokenRefreshedMsg{AccountID: r.AccountID, RefreshToken: r.RefreshToken}
+	}
+}
+
+// startSignInCmd starts signing an OAuth2 account in.
+func startSignInCmd(ctx context.Context, account config.Account) tea.Cmd {
+	return func() tea.Msg {
+		a, err := oauth.Authorize(ctx, &account)
+		return tui.SignInStartedMsg{AccountID: account.ID, Authorization: a, Err: err}
+	}
+}
+
+// waitForSignInCmd waits for the user to approve a sign-in.
+func waitForSignInCmd(ctx context.Context, msg tui.SignInStartedMsg) tea.Cmd {
+	return func() tea.Msg {
+		token, err := msg.Authorization.Wait(ctx)
+		return tui.SignInDoneMsg{AccountID: msg.AccountID, Token: token, Err: err}
+	}
+}
+
+// waitForMailboxUpdate waits for the next change pushed by the watcher.
+// It is re-issued after every update it delivers.
+func waitForMailboxUpdate(w *backend.Watcher) tea.Cmd {
+	if w == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		update := <-w.Updates()
+		return tui.MailboxUpdateMsg{
+			AccountID: update.AccountID,
+			Mailbox:   tui.MailboxInbox,
+			Added:     update.New,
+			Removed:   update.Expunged,
+		}
+	}
+}
+
+func fetchAllAccountsFolders(cfg *config.Config) tea.Cmd {
+	return func() tea.Msg {
+		foldersByAccount := make(map[string][]fetcher.Folder)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for _, account := range cfg.Accounts {
+			wg.Add(1)
+			go func(acc config.Account) {
+				defer wg.Done()
+				var folders []fetcher.Folder
+				err := withBackend(&acc, func(b backend.Backend) (err error) {
+					folders, err = b.Folders()
+					return err
+				})
+				if err != nil {
+					log.Printf("Error fetching folders from %s: %v", acc.Email, err)
+					return
+				}
+				mu.Lock()
+				foldersByAccount[acc.ID] = folders
+				mu.Unlock()
+			}(account)
+		}
+
+		wg.Wait()
+		return tui.FoldersFetchedMsg{FoldersByAccount: foldersByAccount}
+	}
+}
+
+// refreshFolder re-fetches the open folder for the accounts it is shown for.
+func refreshFolder(cfg *config.Config, folderByAcct map[string][]fetcher.Email, folder string) tea.Cmd {
+	var accounts []config.Account
+	for _, acc := range cfg.Accounts {
+		if _, ok := folderByAcct[acc.ID]; ok {
+			accounts = append(accounts, acc)
+		}
+	}
+	return func() tea.Msg {
+		emailsByAccount := make(map[string][]fetcher.Email)
+		for _, acc := range accounts {
+			var emails []fetcher.Email
+			err := withBackend(&acc, func(b backend.Backend) error {
+				page, err := b.FetchPage(folder, initialEmailLimit, 0, 0)
+				emails = page.Emails
+				return err
+			})
+			if err != nil {
+				log.Printf("Error fetching %s from %s: %v", folder, acc.Email, err)
+				emails = folderByAcct[acc.ID]
+			}
+			emailsByAccount[acc.ID] = emails
 		}
-		return tui.EmailsAppendedMsg{Emails: emails, AccountID: account.ID, Mailbox: mailbox}
+		return tui.EmailsRefreshedMsg{EmailsByAccount: emailsByAccount, Mailbox: tui.MailboxFolder}
 	}
 }
 
@@ -922,13 +1900,7 @@ func refreshEmails(cfg *config.Config, mailbox tui.MailboxKind) tea.Cmd {
 			wg.Add(1)
 			go func(acc config.Account) {
 				defer wg.Done()
-				var emails []fetcher.Email
-				var err error
-				if mailbox == tui.MailboxSent {
-					emails, err = fetcher.FetchSentEmails(&acc, initialEmailLimit, 0)
-				} else {
-					emails, err = fetcher.FetchEmails(&acc, initialEmailLimit, 0)
-				}
+				emails, err := fetchFirstPage(&acc, mailbox)
 				if err != nil {
 					log.Printf("Error fetching from %s: %v", acc.Email, err)
 					return
@@ -944,17 +1916,123 @@ func refreshEmails(cfg *config.Config, mailbox tui.MailboxKind) tea.Cmd {
 	}
 }
 
-func saveEmailsToCache(emails []fetcher.Email) {
+// syncInbox refreshes the inbox of every account incrementally, from the
+// sync state and the emails loaded so far.
+func (m *mainModel) syncInbox() tea.Cmd {
+	known := make(map[string][]uint32, len(m.emailsByAcct))
+	for id, emails := range m.emailsByAcct {
+		for _, e := range emails {
+			known[id] = append(known[id], e.UID)
+		}
+	}
+	states := make(map[string]fetcher.SyncState, len(m.syncStates))
+	for id, state := range m.syncStates {
+		states[id] = state
+	}
+	return syncAllAccounts(m.config, known, states)
+}
+
+// syncAllAccounts asks every account's inbox for the changes since its sync
+// state. Accounts without a usable state have their first page fetched again.
+func syncAllAccounts(cfg *config.Config, known map[string][]uint32, states map[string]fetcher.SyncState) tea.Cmd {
+	return func() tea.Msg {
+		msg := tui.EmailsSyncedMsg{
+			Changes:  make(map[string]fetcher.Changes),
+			Reloaded: make(map[string][]fetcher.Email),
+			States:   make(map[string]fetcher.SyncState),
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for _, account := range cfg.Accounts {
+			wg.Add(1)
+			go func(acc config.Account) {
+				defer wg.Done()
+				b, err := openBackend(&acc)
+				if err != nil {
+					log.Printf("Error syncing %s: %v", acc.Email, err)
+					return
+				}
+				syncer, ok := b.(backend.Syncer)
+				if !ok {
+					// Without sync support, the first page is fetched again.
+					emails, err := fetchFirstPage(&acc, tui.MailboxInbox)
+					if err != nil {
+						log.Printf("Error fetching from %s: %v", acc.Email, err)
+						return
+					}
+					mu.Lock()
+					msg.Reloaded[acc.ID] = emails
+					mu.Unlock()
+					return
+				}
+
+				if state, ok := states[acc.ID]; ok {
+					changes, err := syncer.Sync("INBOX", state, known[acc.ID])
+					if err == nil {
+						mu.Lock()
+						msg.Changes[acc.ID] = changes
+						msg.States[acc.ID] = changes.State
+						mu.Unlock()
+						return
+					}
+					if !errors.Is(err, fetcher.ErrUIDValidityChanged) {
+						log.Printf("Error syncing %s: %v", acc.Email, err)
+						return
+					}
+					log.Printf("UIDVALIDITY of INBOX changed for %s, reloading", acc.Email)
+				}
+
+				// Take the state first, so mail arriving meanwhile is synced next time.
+				state, err := syncer.SyncState("INBOX")
+				if err != nil {
+					log.Printf("Error fetching from %s: %v", acc.Email, err)
+					return
+				}
+				emails, err := fetchFirstPage(&acc, tui.MailboxInbox)
+				if err != nil {
+					log.Printf("Error fetching from %s: %v", acc.Email, err)
+					return
+				}
+				mu.Lock()
+				msg.Reloaded[acc.ID] = emails
+				msg.States[acc.ID] = state
+				mu.Unlock()
+			}(account)
+		}
+
+		wg.Wait()
+		return msg
+	}
+}
+
+// saveCache writes the inbox emails and their sync state to the cache in
+// the background.
+func (m *mainModel) saveCache() {
+	states := make(map[string]fetcher.SyncState, len(m.syncStates))
+	for id, state := range m.syncStates {
+		states[id] = state
+	}
+	go saveEmailsToCache(m.emails, states)
+}
+
+func saveEmailsToCache(emails []fetcher.Email, states map[string]fetcher.SyncState) {
 	var cachedEmails []config.CachedEmail
 	for _, email := range emails {
 		cachedEmails = append(cachedEmails, config.CachedEmail{
-			UID:       email.UID,
-			From:      email.From,
-			To:        email.To,
-			Subject:   email.Subject,
-			Date:      email.Date,
-			MessageID: email.MessageID,
-			AccountID: email.AccountID,
+			UID:         email.UID,
+			From:        email.From,
+			To:          email.To,
+			Subject:     email.Subject,
+			Date:        email.Date,
+			MessageID:   email.MessageID,
+			InReplyTo:   email.InReplyTo,
+			References:  email.References,
+			ThreadID:    email.ThreadID,
+			Preview:     email.Preview,
+			AccountID:   email.AccountID,
+			UIDValidity: email.UIDValidity,
+			Flags:       email.Flags,
 		})
 
 		// Save sender as a contact
@@ -965,7 +2043,16 @@ func saveEmailsToCache(emails []fetcher.Email) {
 			}
 		}
 	}
-	cache := &config.EmailCache{Emails: cachedEmails}
+	mailboxes := make(map[string]config.MailboxState, len(states))
+	for id, state := range states {
+		mailboxes[config.MailboxKey(id, "INBOX")] = config.MailboxState{
+			UIDValidity:   state.UIDValidity,
+			UIDNext:       state.UIDNext,
+			Messages:      state.Messages,
+			HighestModSeq: state.HighestModSeq,
+		}
+	}
+	cache := &config.EmailCache{Emails: cachedEmails, Mailboxes: mailboxes}
 	if err := config.SaveEmailCache(cache); err != nil {
 		log.Printf("Error saving email cache: %v", err)
 	}
@@ -988,23 +2075,18 @@ func parseEmailAddress(addr string) (name, email string) {
 	return name, email
 }
 
-func fetchEmailBodyCmd(cfg *config.Config, email fetcher.Email, uid uint32, accountID string, mailbox tui.MailboxKind) tea.Cmd {
+func fetchEmailBodyCmd(cfg *config.Config, mailboxName string, uid uint32, accountID string, mailbox tui.MailboxKind) tea.Cmd {
 	return func() tea.Msg {
 		account := cfg.GetAccountByID(accountID)
 		if account == nil {
 			return tui.EmailBodyFetchedMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: fmt.Errorf("account not found")}
 		}
 
-		var (
-			body        string
-			attachments []fetcher.Attachment
-			err         error
-		)
-		if mailbox == tui.MailboxSent {
-			body, attachments, err = fetcher.FetchSentEmailBody(account, uid)
-		} else {
-			body, attachments, err = fetcher.FetchEmailBody(account, uid)
+		b, err := openBackend(account)
+		if err != nil {
+			return tui.EmailBodyFetchedMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: err}
 		}
+		body, attachments, err := b.FetchBody(mailboxName, uid)
 		if err != nil {
 			return tui.EmailBodyFetchedMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: err}
 		}
@@ -1019,6 +2101,30 @@ func fetchEmailBodyCmd(cfg *config.Config, email fetcher.Email, uid uint32, acco
 	}
 }
 
+// fetchConversationCmd fetches the other emails of the conversation an email
+// belongs to, including replies from the Sent folder.
+func fetchConversationCmd(cfg *config.Config, email fetcher.Email, loaded fetcher.LoadedBodies) tea.Cmd {
+	if email.MessageID == "" && len(email.References) == 0 {
+		return nil
+	}
+	return func() tea.Msg {
+		account := cfg.GetAccountByID(email.AccountID)
+		if account == nil {
+			return tui.ConversationFetchedMsg{UID: email.UID, AccountID: email.AccountID, Err: fmt.Errorf("account not found")}
+		}
+		b, err := openBackend(account)
+		if err != nil {
+			return tui.ConversationFetchedMsg{UID: email.UID, AccountID: email.AccountID, Err: err}
+		}
+		threader, ok := b.(backend.Threader)
+		if !ok {
+			return tui.ConversationFetchedMsg{UID: email.UID, AccountID: email.AccountID}
+		}
+		emails, err := threader.Conversation(email, loaded)
+		return tui.ConversationFetchedMsg{UID: email.UID, AccountID: email.AccountID, Emails: emails, Err: err}
+	}
+}
+
 func markdownToHTML(md []byte) []byte {
 	var buf bytes.Buffer
 	p := goldmark.New(goldmark.WithRendererOptions(html.WithUnsafe()))
@@ -1070,128 +2176,329 @@ func sendEmail(account *config.Account, msg tui.SendEmailMsg) tea.Cmd {
 			}
 		}
 
-		err := sender.SendEmail(account, recipients, msg.Subject, msg.Body, string(htmlBody), images, attachments, msg.InReplyTo, msg.References)
+		raw, err := sender.BuildMessage(account, recipients, msg.Subject, msg.Body, string(htmlBody), images, attachments, msg.InReplyTo, msg.References)
+		if err == nil {
+			err = withBackend(account, func(b backend.Backend) error {
+				if s, ok := b.(backend.Submitter); ok {
+					return s.Submit(raw, recipients)
+				}
+				return sender.Send(account, recipients, raw)
+			})
+		}
 		if err != nil {
 			log.Printf("Failed to send email: %v", err)
-			return tui.EmailResultMsg{Err: err}
+			return tui.EmailResultMsg{AccountID: account.ID, Err: err}
 		}
-		return tui.EmailResultMsg{}
+		return tui.EmailResultMsg{AccountID: account.ID}
 	}
 }
 
-func deleteEmailCmd(account *config.Account, uid uint32, accountID string, mailbox tui.MailboxKind) tea.Cmd {
-	return func() tea.Msg {
-		var err error
-		if mailbox == tui.MailboxSent {
-			err = fetcher.DeleteSentEmail(account, uid)
-		} else {
-			err = fetcher.DeleteEmail(account, uid)
-		}
-		return tui.EmailActionDoneMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: err}
+// undoMove describes how to move an email back after it is moved from
+// mailboxName to dest, or returns nil if that can't be undone.
+func (m *mainModel) undoMove(uid uint32, accountID string, mailbox tui.MailboxKind, mailboxName, dest string) *tui.UndoMoveMsg {
+	email := m.getEmailByUIDAndAccount(uid, accountID, mailbox)
+	if email == nil || email.MessageID == "" || mailboxName == dest {
+		return nil
+	}
+	return &tui.UndoMoveMsg{
+		MessageID: email.MessageID,
+		AccountID: accountID,
+		Mailbox:   mailbox,
+		From:      dest,
+		To:        mailboxName,
 	}
 }
 
-func archiveEmailCmd(account *config.Account, uid uint32, accountID string, mailbox tui.MailboxKind) tea.Cmd {
+// withBackend runs fn with the account's backend.
+func withBackend(account *config.Account, fn func(b backend.Backend) error) error {
+	b, err := openBackend(account)
+	if err != nil {
+		return err
+	}
+	return fn(b)
+}
+
+func deleteEmailCmd(account *config.Account, mailboxName string, uid uint32, accountID string, mailbox tui.MailboxKind, undo *tui.UndoMoveMsg) tea.Cmd {
 	return func() tea.Msg {
-		var err error
-		if mailbox == tui.MailboxSent {
-			err = fetcher.ArchiveSentEmail(account, uid)
-		} else {
-			err = fetcher.ArchiveEmail(account, uid)
-		}
-		return tui.EmailActionDoneMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: err}
+		err := withBackend(account, func(b backend.Backend) error {
+			return b.Delete(mailboxName, []uint32{uid})
+		})
+		return tui.EmailActionDoneMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: err, Undo: undo}
 	}
 }
 
-func downloadAttachmentCmd(account *config.Account, uid uint32, msg tui.DownloadAttachmentMsg) tea.Cmd {
+// bulkActionCmd applies a bulk action with one UID command per account.
+// mailboxNames holds the IMAP mailbox the emails are in, by account.
+func bulkActionCmd(cfg *config.Config, mailboxNames map[string]string, msg tui.BulkActionMsg) tea.Cmd {
 	return func() tea.Msg {
-		// Download and decode the attachment using encoding provided in msg.Encoding.
-		var data []byte
-		var err error
-		if msg.Mailbox == tui.MailboxSent {
-			data, err = fetcher.FetchSentAttachment(account, uid, msg.PartID, msg.Encoding)
-		} else {
-			data, err = fetcher.FetchAttachment(account, uid, msg.PartID, msg.Encoding)
+		result := tui.BulkActionDoneMsg{
+			Action:  msg.Action,
+			Mailbox: msg.Mailbox,
+			Dest:    msg.Dest,
+			Done:    make(map[string][]uint32),
 		}
-		if err != nil {
-			return tui.AttachmentDownloadedMsg{Err: err}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for accountID, uids := range msg.UIDsByAccount {
+			account := cfg.GetAccountByID(accountID)
+			if account == nil {
+				result.Failed += len(uids)
+				continue
+			}
+			wg.Add(1)
+			go func(account *config.Account, uids []uint32) {
+				defer wg.Done()
+				mailboxName := mailboxNames[account.ID]
+				err := withBackend(account, func(b backend.Backend) error {
+					switch msg.Action {
+					case tui.BulkDelete:
+						return b.Delete(mailboxName, uids)
+					case tui.BulkArchive:
+						return backend.Archive(b, mailboxName, uids)
+					case tui.BulkMove:
+						return b.Move(mailboxName, uids, msg.Dest)
+					case tui.BulkMarkRead:
+						return b.SetFlag(mailboxName, uids, fetcher.FlagSeen, true)
+					}
+					return nil
+				})
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					log.Printf("Bulk %s failed for %s: %v", msg.Action, account.Email, err)
+					result.Failed += len(uids)
+					return
+				}
+				result.Done[account.ID] = uids
+			}(account, uids)
 		}
 
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return tui.AttachmentDownloadedMsg{Err: err}
+		wg.Wait()
+		return result
+	}
+}
+
+// bulkActionSummary describes the outcome of a bulk action.
+func bulkActionSummary(action tui.BulkAction, dest string, done, failed int) string {
+	noun := emailsNoun(done)
+	var summary string
+	switch action {
+	case tui.BulkDelete:
+		summary = fmt.Sprintf("Deleted %d %s", done, noun)
+	case tui.BulkArchive:
+		summary = fmt.Sprintf("Archived %d %s", done, noun)
+	case tui.BulkMove:
+		summary = fmt.Sprintf("Moved %d %s to %s", done, noun, dest)
+	case tui.BulkMarkRead:
+		summary = fmt.Sprintf("Marked %d %s read", done, noun)
+	}
+	if failed > 0 {
+		summary += fmt.Sprintf(", %d failed", failed)
+	}
+	return summary
+}
+
+// emailsNoun returns "email" or "emails" to follow a count of n.
+func emailsNoun(n int) string {
+	if n == 1 {
+		return "email"
+	}
+	return "emails"
+}
+
+func restoreEmailCmd(account *config.Account, msg tui.UndoMoveMsg) tea.Cmd {
+	return func() tea.Msg {
+		err := withBackend(account, func(b backend.Backend) error {
+			return b.Restore(msg.MessageID, msg.From, msg.To)
+		})
+		return tui.EmailRestoredMsg{AccountID: msg.AccountID, Mailbox: msg.Mailbox, Err: err}
+	}
+}
+
+func setFlagCmd(account *config.Account, mailboxName string, msg tui.SetFlagMsg) tea.Cmd {
+	return func() tea.Msg {
+		err := withBackend(account, func(b backend.Backend) error {
+			return b.SetFlag(mailboxName, []uint32{msg.UID}, msg.Flag, msg.Enable)
+		})
+		return tui.FlagSetMsg{UID: msg.UID, AccountID: msg.AccountID, Mailbox: msg.Mailbox, Flag: msg.Flag, Enable: msg.Enable, Err: err}
+	}
+}
+
+func archiveEmailCmd(account *config.Account, mailboxName string, uid uint32, accountID string, mailbox tui.MailboxKind, undo *tui.UndoMoveMsg) tea.Cmd {
+	return func() tea.Msg {
+		err := withBackend(account, func(b backend.Backend) error {
+			return backend.Archive(b, mailboxName, []uint32{uid})
+		})
+		return tui.EmailActionDoneMsg{UID: uid, AccountID: accountID, Mailbox: mailbox, Err: err, Undo: undo}
+	}
+}
+
+// downloadAttachment saves an attachment into ~/Downloads as it is
+// downloaded, sending its progress to updates. A download that fails or is
+// cancelled leaves no file behind.
+func downloadAttachment(ctx context.Context, updates chan<- tea.Msg, account *config.Account, mailboxName string, uid uint32, msg tui.DownloadAttachmentMsg, size int64) {
+	done := func(path string, err error) {
+		updates <- attachmentDoneMsg{tui.AttachmentDownloadedMsg{Path: path, Err: err}}
+	}
+
+	f, filePath, err := createInDownloads(msg.Filename)
+	if err != nil {
+		done("", err)
+		return
+	}
+	// Progress is sent at most every percent, and dropped while the UI
+	// hasn't taken the previous update, so that it never slows the download.
+	var last int64
+	progress := func(fetched int64) {
+		if size > 0 && fetched-last < size/100 && fetched < size {
+			return
+		}
+		last = fetched
+		select {
+		case updates <- tui.AttachmentProgressMsg{Filename: msg.Filename, Fetched: fetched, Total: size}:
+		default:
 		}
-		downloadsPath := filepath.Join(homeDir, "Downloads")
-		if _, err := os.Stat(downloadsPath); os.IsNotExist(err) {
-			if mkErr := os.MkdirAll(downloadsPath, 0755); mkErr != nil {
-				return tui.AttachmentDownloadedMsg{Err: mkErr}
-			}
+	}
+	err = withBackend(account, func(b backend.Backend) error {
+		return backend.SaveAttachment(ctx, b, mailboxName, uid, msg.PartID, msg.Encoding, f, progress)
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if removeErr := os.Remove(filePath); removeErr != nil {
+			log.Printf("could not remove partial download %s: %v", filePath, removeErr)
 		}
+		done("", err)
+		return
+	}
+	log.Printf("attachment saved to %s", filePath)
 
-		// Save the attachment using an exclusive create so we never overwrite an existing file.
-		// If the filename already exists, append \" (n)\" before the extension.
-		origName := msg.Filename
-		ext := filepath.Ext(origName)
-		base := strings.TrimSuffix(origName, ext)
-		candidate := origName
-		i := 1
-		var filePath string
+	// Try to open the file using a platform-specific opener asynchronously and log the outcome.
+	go openExternal(filePath)
 
-		for {
-			filePath = filepath.Join(downloadsPath, candidate)
+	done(filePath, nil)
+}
 
-			// Try to create file exclusively. If it already exists, os.OpenFile will return an error
-			// that satisfies os.IsExist(err), so we can increment the candidate.
-			f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-			if err != nil {
-				if os.IsExist(err) {
-					// file exists, try next candidate
-					candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
-					i++
-					continue
-				}
-				// Some other error while attempting to create file
-				log.Printf("error creating file %s: %v", filePath, err)
-				return tui.AttachmentDownloadedMsg{Err: err}
-			}
+// waitForDownload waits for the next update of an attachment download. It
+// is re-issued after every progress update it delivers.
+func waitForDownload(updates <-chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		return <-updates
+	}
+}
 
-			// Successfully created the file descriptor; write and close.
-			if _, writeErr := f.Write(data); writeErr != nil {
-				_ = f.Close()
-				log.Printf("error writing to file %s: %v", filePath, writeErr)
-				return tui.AttachmentDownloadedMsg{Err: writeErr}
+// fetchSourceCmd fetches the full message of an email as it was received,
+// or only its header if the backend can fetch that alone.
+func fetchSourceCmd(account *config.Account, mailboxName string, msg tui.FetchSourceMsg) tea.Cmd {
+	return func() tea.Msg {
+		var raw bytes.Buffer
+		err := withBackend(account, func(b backend.Backend) error {
+			if headers, ok := b.(backend.HeaderFetcher); ok && msg.HeaderOnly {
+				raw.Reset()
+				return headers.FetchHeader(mailboxName, msg.UID, &raw)
 			}
-			if closeErr := f.Close(); closeErr != nil {
-				log.Printf("warning: error closing file %s: %v", filePath, closeErr)
+			exporter, ok := b.(backend.Exporter)
+			if !ok {
+				return fmt.Errorf("the source of messages of %s cannot be shown", account.Email)
 			}
+			raw.Reset()
+			return exporter.FetchRaw(mailboxName, msg.UID, &raw)
+		})
+		if err != nil {
+			return tui.SourceFetchedMsg{UID: msg.UID, AccountID: msg.AccountID, HeaderOnly: msg.HeaderOnly, Err: err}
+		}
+		return tui.SourceFetchedMsg{UID: msg.UID, AccountID: msg.AccountID, HeaderOnly: msg.HeaderOnly, Raw: raw.Bytes()}
+	}
+}
 
-			// file saved successfully
-			break
+// saveToDownloads saves data as a file named filename in ~/Downloads and
+// returns its path.
+func saveToDownloads(filename string, data []byte) (string, error) {
+	f, filePath, err := createInDownloads(filename)
+	if err != nil {
+		return "", err
+	}
+	if _, writeErr := f.Write(data); writeErr != nil {
+		_ = f.Close()
+		_ = os.Remove(filePath)
+		log.Printf("error writing to file %s: %v", filePath, writeErr)
+		return "", writeErr
+	}
+	if closeErr := f.Close(); closeErr != nil {
+		log.Printf("warning: error closing file %s: %v", filePath, closeErr)
+	}
+	return filePath, nil
+}
+
+// createInDownloads creates a new file named filename in ~/Downloads and
+// returns it with its path.
+func createInDownloads(filename string) (*os.File, string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, "", err
+	}
+	downloadsPath := filepath.Join(homeDir, "Downloads")
+	if _, err := os.Stat(downloadsPath); os.IsNotExist(err) {
+		if mkErr := os.MkdirAll(downloadsPath, 0755); mkErr != nil {
+			return nil, "", mkErr
 		}
+	}
 
-		log.Printf("attachment saved to %s", filePath)
-
-		// Try to open the file using a platform-specific opener asynchronously and log the outcome.
-		go func(p string) {
-			var cmd *exec.Cmd
-			switch runtime.GOOS {
-			case "darwin":
-				cmd = exec.Command("open", p)
-			case "linux":
-				cmd = exec.Command("xdg-open", p)
-			case "windows":
-				// 'start' is a cmd builtin; provide an empty title argument to avoid interpreting the path as the title.
-				cmd = exec.Command("cmd", "/c", "start", "", p)
-			default:
-				// Unsupported OS: nothing to do.
-				return
-			}
-			if err := cmd.Start(); err != nil {
-				log.Printf("failed to open file %s: %v", p, err)
+	// Create the file exclusively so we never overwrite an existing file.
+	// If the filename already exists, append \" (n)\" before the extension.
+	origName := filename
+	ext := filepath.Ext(origName)
+	base := strings.TrimSuffix(origName, ext)
+	candidate := origName
+	i := 1
+
+	for {
+		filePath := filepath.Join(downloadsPath, candidate)
+
+		// Try to create file exclusively. If it already exists, os.OpenFile will return an error
+		// that satisfies os.IsExist(err), so we can increment the candidate.
+		f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			if os.IsExist(err) {
+				// file exists, try next candidate
+				candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+				i++
+				continue
 			}
-		}(filePath)
+			// Some other error while attempting to create file
+			log.Printf("error creating file %s: %v", filePath, err)
+			return nil, "", err
+		}
+		return f, filePath, nil
+	}
+}
 
-		return tui.AttachmentDownloadedMsg{Path: filePath, Err: nil}
+// openExternal opens a file or URL with the platform's default application
+// and logs the outcome.
+func openExternal(target string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "linux":
+		cmd = exec.Command("xdg-open", target)
+	case "windows":
+		if strings.Contains(target, "://") {
+			// cmd would split a URL at its '&'s.
+			cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+		} else {
+			// 'start' is a cmd builtin; provide an empty title argument to avoid interpreting the path as the title.
+			cmd = exec.Command("cmd", "/c", "start", "", target)
+		}
+	default:
+		// Unsupported OS: nothing to do.
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("failed to open %s: %v", target, err)
 	}
 }
 
@@ -1490,6 +2797,91 @@ func runUpdateCLI() error {
 	return nil
 }
 
+// backupFlags parses the flags of `matcha export` and `matcha import`,
+// returning the account, folder and format they name and the path after
+// them. Only export takes a format; import tells it from the path, a file
+// being mbox and a directory Maildir.
+func backupFlags(name string, args []string) (*config.Account, string, string, string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	accountFlag := flags.String("account", "", "email address or ID of the account")
+	folder := flags.String("folder", "INBOX", "folder of the account")
+	format := new(string)
+	usage := fmt.Sprintf("usage: matcha %s --account ACCOUNT [--folder FOLDER] PATH", name)
+	if name == "export" {
+		flags.StringVar(format, "format", backup.FormatMbox, "mbox or maildir")
+		usage = "usage: matcha export --account ACCOUNT [--folder FOLDER] [--format mbox|maildir] PATH"
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, "", "", "", err
+	}
+	if flags.NArg() != 1 {
+		return nil, "", "", "", errors.New(usage)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("could not load config: %w", err)
+	}
+	account := cfg.GetAccountByEmail(*accountFlag)
+	if account == nil {
+		account = cfg.GetAccountByID(*accountFlag)
+	}
+	if account == nil {
+		if *accountFlag == "" && len(cfg.Accounts) == 1 {
+			account = cfg.GetFirstAccount()
+		} else {
+			return nil, "", "", "", fmt.Errorf("no account %q; use --account with an email address", *accountFlag)
+		}
+	}
+	return account, *folder, *format, flags.Arg(0), nil
+}
+
+// printProgress shows how far a copy got on one line of the terminal.
+func printProgress(verb string) backup.Progress {
+	return func(done, total int) {
+		fmt.Fprintf(os.Stderr, "\r%s: %d/%d", verb, done, total)
+		if done == total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+// runExportCLI implements `matcha export`, which writes a folder to an mbox
+// file or a Maildir.
+func runExportCLI(args []string) error {
+	account, folder, format, path, err := backupFlags("export", args)
+	if err != nil {
+		return err
+	}
+	b, err := backend.Open(account)
+	if err != nil {
+		return err
+	}
+	src, ok := b.(backend.Exporter)
+	if !ok {
+		return fmt.Errorf("%s cannot be exported", account.Email)
+	}
+	return backup.Export(src, account, folder, format, path, printProgress("Exporting "+folder))
+}
+
+// runImportCLI implements `matcha import`, which stores the messages of an
+// mbox file or a Maildir in a folder.
+func runImportCLI(args []string) error {
+	account, folder, _, path, err := backupFlags("import", args)
+	if err != nil {
+		return err
+	}
+	b, err := backend.Open(account)
+	if err != nil {
+		return err
+	}
+	dest, ok := b.(backend.Importer)
+	if !ok {
+		return fmt.Errorf("%s cannot import mail", account.Email)
+	}
+	return backup.Import(dest, account, folder, path, printProgress("Importing into "+folder))
+}
+
 func main() {
 	// If invoked as CLI update command, run updater and exit.
 	if len(os.Args) > 1 && os.Args[1] == "update" {
@@ -1499,6 +2891,21 @@ func main() {
 		}
 		os.Exit(0)
 	}
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		run := runExportCLI
+		if os.Args[1] == "import" {
+			run = runImportCLI
+		}
+		err := run(os.Args[2:])
+		backend.CloseAll()
+		if err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+			}
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	cfg, err := config.LoadConfig()
 	var initialModel *mainModel
@@ -1510,7 +2917,13 @@ func main() {
 
 	p := tea.NewProgram(initialModel, tea.WithAltScreen())
 
-	if _, err := p.Run(); err != nil {
+	_, err = p.Run()
+	// Log out of the watcher and pooled IMAP connections before exiting.
+	if initialModel.watcher != nil {
+		initialModel.watcher.Close()
+	}
+	backend.CloseAll()
+	if err != nil {
 		fmt.Printf("Alas, there's been an error: %v", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/floatpane/matcha/backend"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/tui"
+)
+
+// fakeBackend keeps emails in memory, standing in for a mail server. It
+// implements neither backend.Syncer nor backend.Threader.
+type fakeBackend struct {
+	emails  map[string][]fetcher.Email // By mailbox
+	deleted []uint32
+	moved   map[string][]uint32 // By destination
+}
+
+func (b *fakeBackend) Folders() ([]fetcher.Folder, error) {
+	var folders []fetcher.Folder
+	for name := range b.emails {
+		folders = append(folders, fetcher.Folder{Name: name})
+	}
+	return folders, nil
+}
+
+func (b *fakeBackend) FetchPage(mailbox string, limit, beforeUID, uidValidity uint32) (fetcher.Page, error) {
+	return fetcher.Page{Emails: b.emails[mailbox]}, nil
+}
+
+func (b *fakeBackend) FetchBody(mailbox string, uid uint32) (string, []fetcher.Attachment, error) {
+	return "body", nil, nil
+}
+
+func (b *fakeBackend) FetchAttachment(mailbox string, uid uint32, partID, encoding string) ([]byte, error) {
+	return nil, nil
+}
+
+func (b *fakeBackend) Move(mailbox string, uids []uint32, dest string) error {
+	b.moved[dest] = append(b.moved[dest], uids...)
+	return nil
+}
+
+func (b *fakeBackend) Delete(mailbox string, uids []uint32) error {
+	b.deleted = append(b.deleted, uids...)
+	return nil
+}
+
+func (b *fakeBackend) Restore(messageID, from, to string) error { return nil }
+
+func (b *fakeBackend) SetFlag(mailbox string, uids []uint32, flag string, enable bool) error {
+	return nil
+}
+
+func (b *fakeBackend) Search(mailbox string, query fetcher.Query, limit int) ([]fetcher.Email, error) {
+	return nil, nil
+}
+
+func (b *fakeBackend) Flagged(mailbox string) ([]fetcher.Email, error) {
+	return nil, nil
+}
+
+func (b *fakeBackend) SpecialMailbox(use fetcher.SpecialUse) string {
+	return map[fetcher.SpecialUse]string{fetcher.SpecialArchive: "Archive", fetcher.SpecialTrash: "Trash"}[use]
+}
+
+func (b *fakeBackend) Close() {}
+
+// useFakeBackend serves every account from b for the duration of the test.
+func useFakeBackend(t *testing.T, b *fakeBackend) {
+	t.Helper()
+	previous := openBackend
+	openBackend = func(account *config.Account) (backend.Backend, error) { return b, nil }
+	t.Cleanup(func() { openBackend = previous })
+}
+
+func TestSyncWithoutSyncerReloads(t *testing.T) {
+	b := &fakeBackend{emails: map[string][]fetcher.Email{
+		"INBOX": {{UID: 2, AccountID: "a"}, {UID: 1, AccountID: "a"}},
+	}}
+	useFakeBackend(t, b)
+	cfg := &config.Config{Accounts: []config.Account{{ID: "a", Email: "me@example.com"}}}
+
+	msg := syncAllAccounts(cfg, nil, map[string]fetcher.SyncState{"a": {}})().(tui.EmailsSyncedMsg)
+	if len(msg.Reloaded["a"]) != 2 {
+		t.Errorf("expected the inbox to be fetched again, got %+v", msg)
+	}
+	if len(msg.Changes) != 0 || len(msg.States) != 0 {
+		t.Errorf("expected no sync state without a Syncer, got %+v", msg)
+	}
+}
+
+func TestBulkActionUsesBackend(t *testing.T) {
+	b := &fakeBackend{moved: make(map[string][]uint32)}
+	useFakeBackend(t, b)
+	cfg := &config.Config{Accounts: []config.Account{{ID: "a", Email: "me@example.com"}}}
+	mailboxes := map[string]string{"a": "INBOX"}
+
+	archive := tui.BulkActionMsg{Action: tui.BulkArchive, UIDsByAccount: map[string][]uint32{"a": {3, 4}}}
+	done := bulkActionCmd(cfg, mailboxes, archive)().(tui.BulkActionDoneMsg)
+	if len(done.Done["a"]) != 2 || len(b.moved["Archive"]) != 2 {
+		t.Errorf("expected 2 emails archived, got %+v and moves %v", done, b.moved)
+	}
+
+	del := tui.BulkActionMsg{Action: tui.BulkDelete, UIDsByAccount: map[string][]uint32{"a": {5}, "missing": {6}}}
+	done = bulkActionCmd(cfg, mailboxes, del)().(tui.BulkActionDoneMsg)
+	if len(b.deleted) != 1 || b.deleted[0] != 5 || done.Failed != 1 {
+		t.Errorf("expected 1 email deleted and 1 failed, got %+v and deletions %v", done, b.deleted)
+	}
+}
+
+func TestActionFromFlaggedRemovesFromInbox(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	m := newInitialModel(&config.Config{Accounts: []config.Account{{ID: "a", Email: "me@example.com"}}})
+	email := fetcher.Email{UID: 7, AccountID: "a", Mailbox: "INBOX", Flags: []string{fetcher.FlagFlagged}}
+	m.emails, m.emailsByAcct["a"] = []fetcher.Email{email}, []fetcher.Email{email}
+	m.flaggedEmails, m.flaggedByAcct["a"] = []fetcher.Email{email}, []fetcher.Email{email}
+
+	m.Update(tui.EmailActionDoneMsg{UID: 7, AccountID: "a", Mailbox: tui.MailboxFlagged})
+	if len(m.flaggedEmails) != 0 {
+		t.Errorf("expected the email to leave the Flagged view, got %+v", m.flaggedEmails)
+	}
+	if len(m.emails) != 0 || len(m.emailsByAcct["a"]) != 0 {
+		t.Errorf("expected the email to leave the inbox too, got %+v", m.emails)
+	}
+}
+
+func TestCancelledDownloadLeavesNoFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	useFakeBackend(t, &fakeBackend{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	updates := make(chan tea.Msg, 1)
+	msg := tui.DownloadAttachmentMsg{Filename: "report.pdf", PartID: "2"}
+	downloadAttachment(ctx, updates, &config.Account{ID: "a"}, "INBOX", 1, msg, 100)
+	done, ok := (<-updates).(attachmentDoneMsg)
+	if !ok || !errors.Is(done.Err, context.Canceled) {
+		t.Fatalf("expected the download to be cancelled, got %#v", done)
+	}
+	entries, err := os.ReadDir(filepath.Join(home, "Downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the partial file to be removed, got %v", entries)
+	}
+}
+
+func TestImportRejectsFormat(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	_, _, _, _, err := backupFlags("import", []string{"--format", "maildir", "inbox.mbox"})
+	if err == nil || !strings.Contains(err.Error(), "-format") {
+		t.Errorf("expected import to reject --format, got %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+// Package oauth signs accounts in with OAuth2 and keeps their access tokens
+// fresh, for servers that take XOAUTH2 or OAUTHBEARER instead of passwords.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/floatpane/matcha/config"
+)
+
+// Endpoint is where an account gets its tokens and what it asks for.
+type Endpoint struct {
+	AuthURL       string
+	DeviceAuthURL string
+	TokenURL      string
+	Scopes        []string
+}
+
+// providerEndpoints are the endpoints of providers that support OAuth2 for
+// IMAP and SMTP. Google's device flow doesn't allow the mail scope, so
+// Gmail signs in through the browser.
+var providerEndpoints = map[string]Endpoint{
+	"gmail": {
+		AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+		TokenURL: "https://oauth2.googleapis.com/token",
+		Scopes:   []string{"https://mail.google.com/"},
+	},
+}
+
+// EndpointFor returns the account's endpoint: its provider's, with anything
+// set in the account's OAuth2 config taking precedence.
+func EndpointFor(account *config.Account) Endpoint {
+	e := providerEndpoints[account.ServiceProvider]
+	if o := account.OAuth2; o != nil {
+		if o.AuthURL != "" {
+			e.AuthURL = o.AuthURL
+		}
+		if o.DeviceAuthURL != "" {
+			e.DeviceAuthURL = o.DeviceAuthURL
+		}
+		if o.TokenURL != "" {
+			e.TokenURL = o.TokenURL
+		}
+		if len(o.Scopes) > 0 {
+			e.Scopes = o.Scopes
+		}
+	}
+	return e
+}
+
+// Token is the result of signing in or refreshing.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// Error is an error response of an OAuth2 server.
+type Error struct {
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("oauth2: %s: %s", e.Code, e.Description)
+	}
+	return "oauth2: " + e.Code
+}
+
+// ErrNotSignedIn is returned for OAuth2 accounts without a refresh token,
+// or whose refresh token was revoked or expired.
+var ErrNotSignedIn = errors.New("the account's OAuth2 sign-in is missing or expired; sign in again from the account settings")
+
+// Authorization is a sign-in waiting for the user to approve it.
+type Authorization struct {
+	// URL is the page to open in a browser: the provider's consent page, or
+	// with the device flow, the page to enter UserCode on.
+	URL string
+	// UserCode is the code to enter with the device flow, and empty
+	// otherwise.
+	UserCode string
+
+	wait func(ctx context.Context) (*Token, error)
+}
+
+// Wait waits until the user has approved or denied the sign-in, or ctx is
+// done, and returns the token.
+func (a *Authorization) Wait(ctx context.Context) (*Token, error) {
+	return a.wait(ctx)
+}
+
+// Authorize starts signing the account in. With a device authorization
+// endpoint the user enters a code on another device, otherwise they approve
+// in a browser, which redirects back to a port on this machine.
+func Authorize(ctx context.Context, account *config.Account) (*Authorization, error) {
+	if account.OAuth2 == nil || account.OAuth2.ClientID == "" {
+		return nil, errors.New("the account has no OAuth2 client ID")
+	}
+	e := EndpointFor(account)
+	if e.TokenURL == "" || (e.AuthURL == "" && e.DeviceAuthURL == "") {
+		return nil, fmt.Errorf("no OAuth2 endpoints are known for %q; set auth_url and token_url in the account's oauth2 config", account.ServiceProvider)
+	}
+	if e.DeviceAuthURL != "" {
+		return authorizeDevice(ctx, account.OAuth2, e)
+	}
+	return authorizeLoopback(ctx, account.OAuth2, e)
+}
+
+// authorizeDevice starts the device authorization flow of RFC 8628.
+func authorizeDevice(ctx context.Context, client *config.OAuth2, e Endpoint) (*Authorization, error) {
+	form := url.Values{"client_id": {client.ClientID}}
+	if len(e.Scopes) > 0 {
+		form.Set("scope", strings.Join(e.Scopes, " "))
+	}
+	var resp struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURL         string `json:"verification_url"` // Google's name for it
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	if err := post(ctx, e.DeviceAuthURL, form, &resp); err != nil {
+		return nil, err
+	}
+
+	a := &Authorization{URL: resp.VerificationURI, UserCode: resp.UserCode}
+	if a.URL == "" {
+		a.URL = resp.VerificationURL
+	}
+	if resp.VerificationURIComplete != "" {
+		a.URL = resp.VerificationURIComplete
+	}
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expiry := time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+
+	a.wait = func(ctx context.Context) (*Token, error) {
+		for {
+			if resp.ExpiresIn > 0 && time.Now().After(expiry) {
+				return nil, errors.New("the sign-in code expired before it was entered")
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(interval):
+			}
+			token, err := requestToken(ctx, client, e.TokenURL, url.Values{
+				"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+				"device_code": {resp.DeviceCode},
+			})
+			var oauthErr *Error
+			if errors.As(err, &oauthErr) {
+				switch oauthErr.Code {
+				case "authorization_pending":
+					continue
+				case "slow_down":
+					interval += 5 * time.Second
+					continue
+				}
+			}
+			return token, err
+		}
+	}
+	return a, nil
+}
+
+// authorizeLoopback starts the authorization code flow with PKCE, listening
+// for the browser's redirect on a local port (RFC 8252) until ctx is done.
+func authorizeLoopback(ctx context.Context, client *config.OAuth2, e Endpoint) (*Authorization, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for the sign-in redirect: %w", err)
+	}
+	redirectURI := fmt.Sprintf("http://%s/", l.Addr())
+	state := randomString()
+	verifier := randomString()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {redirectURI},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		// Google only returns a refresh token when asked like this.
+		"access_type": {"offline"},
+		"prompt":      {"consent"},
+	}
+	if len(e.Scopes) > 0 {
+		query.Set("scope", strings.Join(e.Scopes, " "))
+	}
+	authURL := e.AuthURL
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + query.Encode()
+	} else {
+		authURL += "?" + query.Encode()
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var res result
+		switch {
+		case q.Get("state") != state:
+			http.Error(w, "Unexpected sign-in response.", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			res.err = &Error{Code: q.Get("error"), Description: q.Get("error_description")}
+			fmt.Fprintln(w, "Sign-in was not approved. You can close this window.")
+		default:
+			res.code = q.Get("code")
+			fmt.Fprintln(w, "Signed in to matcha. You can close this window.")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+	go srv.Serve(l)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	return &Authorization{
+		URL: authURL,
+		wait: func(ctx context.Context) (*Token, error) {
+			defer srv.Close()
+			var res result
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case res = <-results:
+			}
+			if res.err != nil {
+				return nil, res.err
+			}
+			return requestToken(ctx, client, e.TokenURL, url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {res.code},
+				"redirect_uri":  {redirectURI},
+				"code_verifier": {verifier},
+			})
+		},
+	}, nil
+}
+
+// requestToken asks the token endpoint for a token with the given grant.
+func requestToken(ctx context.Context, client *config.OAuth2, tokenURL string, form url.Values) (*Token, error) {
+	form.Set("client_id", client.ClientID)
+	if client.ClientSecret != "" {
+		form.Set("client_secret", client.ClientSecret)
+	}
+	var resp struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := post(ctx, tokenURL, form, &resp); err != nil {
+		return nil, err
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.New("oauth2: the server returned no access token")
+	}
+	token := &Token{AccessToken: resp.AccessToken, RefreshToken: resp.RefreshToken}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// post sends a form to an OAuth2 endpoint and decodes the JSON response,
+// or the error it describes.
+func post(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error != "" {
+			return &Error{Code: oauthErr.Error, Description: oauthErr.ErrorDescription}
+		}
+		return fmt.Errorf("oauth2: %s returned %s", endpoint, resp.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("oauth2: invalid response from %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+func randomString() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// expiryMargin is how long before it expires an access token is refreshed,
+// so that it doesn't expire while connecting.
+const expiryMargin = time.Minute
+
+// RefreshedToken is a new refresh token that replaced an account's old one
+// and needs to be saved.
+type RefreshedToken struct {
+	AccountID    string
+	RefreshToken string
+}
+
+var (
+	tokensMu  sync.Mutex
+	tokens    = make(map[string]*Token) // By account ID
+	refreshed = make(chan RefreshedToken, 4)
+)
+
+// RefreshedTokens returns the channel on which refresh tokens that the
+// server replaced are delivered, so that they can be saved.
+func RefreshedTokens() <-chan RefreshedToken {
+	return refreshed
+}
+
+// Store remembers the token of an account that just signed in.
+func Store(accountID string, token *Token) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	tokens[accountID] = token
+}
+
+// AccessToken returns a valid access token for the account, refreshing it
+// when it is about to expire.
+func AccessToken(account *config.Account) (string, error) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	cached := tokens[account.ID]
+	if cached != nil && (cached.Expiry.IsZero() || time.Until(cached.Expiry) > expiryMargin) {
+		return cached.AccessToken, nil
+	}
+
+	if account.OAuth2 == nil {
+		return "", ErrNotSignedIn
+	}
+	// A refresh token rotated earlier wins over the one in the account,
+	// which may be a copy made before it was saved.
+	refreshToken := account.OAuth2.RefreshToken
+	if cached != nil && cached.RefreshToken != "" {
+		refreshToken = cached.RefreshToken
+	}
+	if refreshToken == "" {
+		return "", ErrNotSignedIn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	token, err := requestToken(ctx, account.OAuth2, EndpointFor(account).TokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	var oauthErr *Error
+	if errors.As(err, &oauthErr) && oauthErr.Code == "invalid_grant" {
+		return "", fmt.Errorf("%w (%v)", ErrNotSignedIn, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not refresh the OAuth2 token: %w", err)
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	} else if token.RefreshToken != refreshToken {
+		select {
+		case refreshed <- RefreshedToken{AccountID: account.ID, RefreshToken: token.RefreshToken}:
+		default:
+		}
+	}
+	tokens[account.ID] = token
+	return token.AccessToken, nil
+}
@@ -0,0 +1,250 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/floatpane/matcha/config"
+)
+
+// testServer is an OAuth2 server that approves everything, standing in for
+// a provider's.
+type testServer struct {
+	*httptest.Server
+	challenge string // PKCE challenge of the last authorization URL
+	polls     int32
+	refreshes int32
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := &testServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      "device-code",
+			"user_code":        "WDJB-MJHT",
+			"verification_uri": s.URL + "/activate",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "client" {
+			writeError(w, "invalid_client")
+			return
+		}
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if atomic.AddInt32(&s.polls, 1) == 1 {
+				writeError(w, "authorization_pending")
+				return
+			}
+			writeToken(w, "device-access", "device-refresh")
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != s.challenge {
+				writeError(w, "invalid_grant")
+				return
+			}
+			writeToken(w, "browser-access", "browser-refresh")
+		case "refresh_token":
+			n := atomic.AddInt32(&s.refreshes, 1)
+			if r.Form.Get("refresh_token") != "refresh" {
+				writeError(w, "invalid_grant")
+				return
+			}
+			// The first refresh rotates the refresh token.
+			if n == 1 {
+				writeToken(w, "refreshed-access", "rotated")
+				return
+			}
+			writeToken(w, "refreshed-access", "")
+		default:
+			writeError(w, "unsupported_grant_type")
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func writeToken(w http.ResponseWriter, access, refresh string) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  access,
+		"refresh_token": refresh,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func writeError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func testAccount(s *testServer) *config.Account {
+	return &config.Account{
+		ID:              "oauth-account",
+		Email:           "me@example.com",
+		ServiceProvider: "custom",
+		AuthMethod:      config.AuthOAuth2,
+		OAuth2: &config.OAuth2{
+			ClientID: "client",
+			AuthURL:  s.URL + "/auth",
+			TokenURL: s.URL + "/token",
+			Scopes:   []string{"mail"},
+		},
+	}
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	s := newTestServer(t)
+	account := testAccount(s)
+	account.OAuth2.DeviceAuthURL = s.URL + "/device"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, err := Authorize(ctx, account)
+	if err != nil {
+		t.Fatalf("Authorize() failed: %v", err)
+	}
+	if a.UserCode != "WDJB-MJHT" || a.URL != s.URL+"/activate" {
+		t.Errorf("unexpected authorization %+v", a)
+	}
+
+	token, err := a.Wait(ctx)
+	if err != nil {
+		t.Fatalf("Wait() failed: %v", err)
+	}
+	if token.AccessToken != "device-access" || token.RefreshToken != "device-refresh" {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if polls := atomic.LoadInt32(&s.polls); polls != 2 {
+		t.Errorf("expected polling to go on while pending, got %d polls", polls)
+	}
+}
+
+func TestAuthorizeLoopback(t *testing.T) {
+	s := newTestServer(t)
+	account := testAccount(s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, err := Authorize(ctx, account)
+	if err != nil {
+		t.Fatalf("Authorize() failed: %v", err)
+	}
+	if a.UserCode != "" {
+		t.Errorf("expected no user code, got %q", a.UserCode)
+	}
+	authURL, err := url.Parse(a.URL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL %q: %v", a.URL, err)
+	}
+	q := authURL.Query()
+	if authURL.Path != "/auth" || q.Get("client_id") != "client" || q.Get("scope") != "mail" || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("unexpected authorization URL %s", a.URL)
+	}
+	s.challenge = q.Get("code_challenge")
+
+	// A redirect with the wrong state is ignored.
+	resp, err := http.Get(q.Get("redirect_uri") + "?code=forged&state=wrong")
+	if err != nil {
+		t.Fatalf("redirect failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a forged redirect to be refused, got %s", resp.Status)
+	}
+
+	// The browser's redirect after approval.
+	resp, err = http.Get(q.Get("redirect_uri") + "?code=code&state=" + url.QueryEscape(q.Get("state")))
+	if err != nil {
+		t.Fatalf("redirect failed: %v", err)
+	}
+	resp.Body.Close()
+
+	token, err := a.Wait(ctx)
+	if err != nil {
+		t.Fatalf("Wait() failed: %v", err)
+	}
+	if token.AccessToken != "browser-access" || token.RefreshToken != "browser-refresh" {
+		t.Errorf("unexpected token %+v", token)
+	}
+}
+
+func TestAccessTokenRefresh(t *testing.T) {
+	s := newTestServer(t)
+	account := testAccount(s)
+	t.Cleanup(func() { Store(account.ID, nil) })
+
+	if _, err := AccessToken(account); err != ErrNotSignedIn {
+		t.Fatalf("expected ErrNotSignedIn without a refresh token, got %v", err)
+	}
+
+	account.OAuth2.RefreshToken = "refresh"
+	token, err := AccessToken(account)
+	if err != nil {
+		t.Fatalf("AccessToken() failed: %v", err)
+	}
+	if token != "refreshed-access" {
+		t.Errorf("expected the refreshed access token, got %q", token)
+	}
+	select {
+	case r := <-RefreshedTokens():
+		if r.AccountID != account.ID || r.RefreshToken != "rotated" {
+			t.Errorf("unexpected refreshed token %+v", r)
+		}
+	default:
+		t.Error("expected the rotated refresh token to be delivered")
+	}
+
+	// The token is reused while it is valid.
+	if _, err := AccessToken(account); err != nil {
+		t.Fatalf("AccessToken() failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&s.refreshes); n != 1 {
+		t.Errorf("expected a single refresh, got %d", n)
+	}
+
+	// Close to expiring, it is refreshed with the latest refresh token,
+	// which the test server doesn't know.
+	Store(account.ID, &Token{AccessToken: "old", RefreshToken: "rotated", Expiry: time.Now().Add(30 * time.Second)})
+	if _, err := AccessToken(account); !errors.Is(err, ErrNotSignedIn) {
+		t.Errorf("expected refreshing with the rotated token to reach the server, got %v", err)
+	}
+	if n := atomic.LoadInt32(&s.refreshes); n != 2 {
+		t.Errorf("expected a second refresh, got %d", n)
+	}
+}
+
+func TestSASLClients(t *testing.T) {
+	c := NewSASLClient("me@example.com", "token", func(mech string) bool { return false })
+	mech, ir, err := c.Start()
+	if err != nil || mech != XOAuth2 {
+		t.Fatalf("expected XOAUTH2, got %q (%v)", mech, err)
+	}
+	if want := "user=me@example.com\x01auth=Bearer token\x01\x01"; string(ir) != want {
+		t.Errorf("expected %q, got %q", want, ir)
+	}
+	if resp, err := c.Next([]byte(`{"status":"401"}`)); err != nil || len(resp) != 0 {
+		t.Errorf("expected an empty response to an error challenge, got %q (%v)", resp, err)
+	}
+
+	c = NewSASLClient("me@example.com", "token", func(mech string) bool { return mech == sasl.OAuthBearer })
+	if mech, _, _ := c.Start(); mech != sasl.OAuthBearer {
+		t.Errorf("expected OAUTHBEARER when offered, got %q", mech)
+	}
+}
@@ -0,0 +1,41 @@
+package oauth
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of Google's and Microsoft's SASL mechanism for OAuth2,
+// which predates OAUTHBEARER.
+const XOAuth2 = "XOAUTH2"
+
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+// NewXOAuth2Client returns a SASL client that authenticates with an OAuth2
+// access token using XOAUTH2.
+func NewXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return XOAuth2, []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", c.username, c.token)), nil
+}
+
+// Next answers the error details a server sends as a challenge before
+// failing: with an empty response, as the mechanism requires.
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// NewSASLClient returns a client for the best OAuth2 mechanism the server
+// supports: the standard OAUTHBEARER if it offers it, otherwise XOAUTH2.
+func NewSASLClient(username, token string, supports func(mech string) bool) sasl.Client {
+	if supports(sasl.OAuthBearer) {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: username, Token: token})
+	}
+	return NewXOAuth2Client(username, token)
+}
@@ -0,0 +1,250 @@
+// Package pop3 is a client for the parts of POP3 (RFC 1939) that matcha
+// uses to download mail, with STLS (RFC 2595) and SASL sign-in (RFC 5034).
+package pop3
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// Client is a connection to a POP3 server.
+type Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// Error is a -ERR response from the server.
+type Error struct {
+	Command string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("pop3: %s: %s", e.Command, e.Message)
+	}
+	return fmt.Sprintf("pop3: %s failed", e.Command)
+}
+
+// Dial connects to addr in plaintext.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn)
+}
+
+// DialTLS connects to addr over TLS.
+func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn)
+}
+
+// NewClient reads the server's greeting on conn.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, text: textproto.NewConn(conn)}
+	if _, err := c.response("greeting"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// response reads a single-line response and returns the text after +OK.
+func (c *Client) response(command string) (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", &Error{Command: command, Message: strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))}
+	default:
+		return "", fmt.Errorf("pop3: %s: unexpected response %q", command, line)
+	}
+}
+
+// cmd sends a command and reads its single-line response.
+func (c *Client) cmd(name, format string, args ...interface{}) (string, error) {
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return "", err
+	}
+	return c.response(name)
+}
+
+// Capabilities returns the server's capabilities with their arguments, or
+// none if it doesn't support CAPA (RFC 2449).
+func (c *Client) Capabilities() (map[string][]string, error) {
+	if _, err := c.cmd("CAPA", "CAPA"); err != nil {
+		var popErr *Error
+		if errors.As(err, &popErr) {
+			return map[string][]string{}, nil
+		}
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string][]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			caps[strings.ToUpper(fields[0])] = fields[1:]
+		}
+	}
+	return caps, nil
+}
+
+// StartTLS upgrades the connection to TLS with STLS.
+func (c *Client) StartTLS(tlsConfig *tls.Config) error {
+	if _, err := c.cmd("STLS", "STLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	return nil
+}
+
+// Login signs in with USER and PASS.
+func (c *Client) Login(username, password string) error {
+	if _, err := c.cmd("USER", "USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS", "PASS %s", password)
+	return err
+}
+
+// Authenticate signs in with a SASL mechanism, such as XOAUTH2.
+func (c *Client) Authenticate(client sasl.Client) error {
+	mech, ir, err := client.Start()
+	if err != nil {
+		return err
+	}
+	if ir != nil {
+		_, err = c.text.Cmd("AUTH %s %s", mech, encode(ir))
+	} else {
+		_, err = c.text.Cmd("AUTH %s", mech)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "+ ") && line != "+" {
+			switch {
+			case strings.HasPrefix(line, "+OK"):
+				return nil
+			case strings.HasPrefix(line, "-ERR"):
+				return &Error{Command: "AUTH", Message: strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))}
+			}
+			return fmt.Errorf("pop3: AUTH: unexpected response %q", line)
+		}
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "+")))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Next(challenge)
+		if err != nil {
+			// Cancel the exchange.
+			c.text.PrintfLine("*")
+			c.response("AUTH")
+			return err
+		}
+		if err := c.text.PrintfLine("%s", encode(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+// encode encodes a SASL response, with "=" for an empty one.
+func encode(b []byte) string {
+	if len(b) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Message is a message in the maildrop, numbered from 1 for the session
+// and identified by a unique ID that stays the same across sessions.
+type Message struct {
+	Number int
+	UID    string
+}
+
+// UIDL lists the messages in the maildrop.
+func (c *Client) UIDL() ([]Message, error) {
+	if _, err := c.cmd("UIDL", "UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("pop3: UIDL: invalid line %q", line)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("pop3: UIDL: invalid line %q", line)
+		}
+		msgs = append(msgs, Message{Number: n, UID: fields[1]})
+	}
+	return msgs, nil
+}
+
+// Retr returns a reader of the message with the given number, which must be
+// read to the end before the next command.
+func (c *Client) Retr(number int) (io.Reader, error) {
+	if _, err := c.cmd("RETR", "RETR %d", number); err != nil {
+		return nil, err
+	}
+	return c.text.DotReader(), nil
+}
+
+// Dele marks the message with the given number for deletion, which
+// happens when the session ends with Quit.
+func (c *Client) Dele(number int) error {
+	_, err := c.cmd("DELE", "DELE %d", number)
+	return err
+}
+
+// Quit ends the session, deleting the messages marked for deletion, and
+// closes the connection.
+func (c *Client) Quit() error {
+	_, err := c.cmd("QUIT", "QUIT")
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close closes the connection without deleting anything.
+func (c *Client) Close() error {
+	return c.text.Close()
+}
@@ -0,0 +1,63 @@
+package pop3_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/floatpane/matcha/pop3"
+	"github.com/floatpane/matcha/pop3/pop3test"
+)
+
+func TestDownload(t *testing.T) {
+	s := pop3test.NewServer("me", "secret")
+	defer s.Close()
+	s.AddMessage("a1", []byte("Subject: one\r\n\r\n.hidden dot\r\n"))
+	s.AddMessage("b2", []byte("Subject: two\r\n\r\nbody\r\n"))
+
+	c, err := pop3.Dial(s.Addr)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	if err := c.Login("me", "wrong"); err == nil {
+		t.Fatal("expected wrong credentials to fail")
+	}
+	if err := c.Login("me", "secret"); err != nil {
+		t.Fatalf("Login() failed: %v", err)
+	}
+	caps, err := c.Capabilities()
+	if err != nil {
+		t.Fatalf("Capabilities() failed: %v", err)
+	}
+	if _, ok := caps["UIDL"]; !ok {
+		t.Errorf("expected UIDL among the capabilities, got %v", caps)
+	}
+
+	msgs, err := c.UIDL()
+	if err != nil {
+		t.Fatalf("UIDL() failed: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].UID != "a1" || msgs[1].Number != 2 {
+		t.Fatalf("unexpected listing %+v", msgs)
+	}
+	r, err := c.Retr(1)
+	if err != nil {
+		t.Fatalf("Retr() failed: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading the message failed: %v", err)
+	}
+	if string(data) != "Subject: one\n\n.hidden dot\n" {
+		t.Errorf("expected the dot-unstuffed message, got %q", data)
+	}
+
+	if err := c.Dele(1); err != nil {
+		t.Fatalf("Dele() failed: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() failed: %v", err)
+	}
+	if uids := s.UIDs(); len(uids) != 1 || uids[0] != "b2" {
+		t.Errorf("expected the deleted message to be gone, got %v", uids)
+	}
+}
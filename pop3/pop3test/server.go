@@ -0,0 +1,232 @@
+// Package pop3test is a POP3 server that keeps its maildrop in memory,
+// standing in for a real one in tests. It speaks plaintext on localhost and
+// implements the commands the pop3 package's client uses.
+package pop3test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a POP3 server for a single maildrop.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr     string
+	Username string
+	Password string
+
+	listener net.Listener
+	mu       sync.Mutex
+	messages []message
+	sessions int
+}
+
+// message is a message in the maildrop.
+type message struct {
+	uid string
+	raw []byte
+}
+
+// NewServer starts a server with the given credentials and an empty
+// maildrop. Close it when done.
+func NewServer(username, password string) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("pop3test: failed to listen: %v", err))
+	}
+	s := &Server{Addr: l.Addr().String(), Username: username, Password: password, listener: l}
+	go s.serve()
+	return s
+}
+
+// Host returns the host of Addr.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+// Port returns the port of Addr.
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.listener.Close()
+}
+
+// AddMessage adds a message with the given unique ID to the maildrop.
+func (s *Server) AddMessage(uid string, raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message{uid: uid, raw: raw})
+}
+
+// UIDs returns the unique IDs of the messages in the maildrop.
+func (s *Server) UIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uids := make([]string, len(s.messages))
+	for i, m := range s.messages {
+		uids[i] = m.uid
+	}
+	return uids
+}
+
+// Sessions returns how many sessions signed in.
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle runs a session. Messages marked with DELE are only deleted if the
+// session ends with QUIT.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	reply("+OK pop3test ready")
+	var user string
+	var signedIn bool
+	var snapshot []message
+	deleted := make(map[int]bool)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(strings.TrimSpace(line))
+		if len(fields) == 0 {
+			reply("-ERR empty command")
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		args := fields[1:]
+
+		if !signedIn {
+			switch cmd {
+			case "CAPA":
+				reply("+OK")
+				reply("USER\r\nUIDL\r\n.")
+			case "USER":
+				if len(args) == 1 {
+					user = args[0]
+					reply("+OK")
+				} else {
+					reply("-ERR USER needs a name")
+				}
+			case "PASS":
+				if user == s.Username && len(args) == 1 && args[0] == s.Password {
+					signedIn = true
+					s.mu.Lock()
+					snapshot = append([]message(nil), s.messages...)
+					s.sessions++
+					s.mu.Unlock()
+					reply("+OK signed in")
+				} else {
+					reply("-ERR invalid credentials")
+				}
+			case "QUIT":
+				reply("+OK bye")
+				return
+			default:
+				reply("-ERR sign in first")
+			}
+			continue
+		}
+
+		number := func() (int, bool) {
+			if len(args) != 1 {
+				return 0, false
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 || n > len(snapshot) || deleted[n] {
+				return 0, false
+			}
+			return n, true
+		}
+		switch cmd {
+		case "CAPA":
+			reply("+OK")
+			reply("USER\r\nUIDL\r\n.")
+		case "NOOP":
+			reply("+OK")
+		case "UIDL":
+			reply("+OK")
+			for i, m := range snapshot {
+				if !deleted[i+1] {
+					fmt.Fprintf(w, "%d %s\r\n", i+1, m.uid)
+				}
+			}
+			reply(".")
+		case "RETR":
+			n, ok := number()
+			if !ok {
+				reply("-ERR no such message")
+				continue
+			}
+			fmt.Fprintf(w, "+OK %d octets\r\n", len(snapshot[n-1].raw))
+			for _, l := range strings.SplitAfter(strings.ReplaceAll(string(snapshot[n-1].raw), "\r\n", "\n"), "\n") {
+				if l == "" {
+					continue
+				}
+				l = strings.TrimSuffix(l, "\n")
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				fmt.Fprintf(w, "%s\r\n", l)
+			}
+			reply(".")
+		case "DELE":
+			n, ok := number()
+			if !ok {
+				reply("-ERR no such message")
+				continue
+			}
+			deleted[n] = true
+			reply("+OK marked")
+		case "QUIT":
+			s.mu.Lock()
+			var kept []message
+			for _, m := range s.messages {
+				gone := false
+				for n := range deleted {
+					if snapshot[n-1].uid == m.uid {
+						gone = true
+					}
+				}
+				if !gone {
+					kept = append(kept, m)
+				}
+			}
+			s.messages = kept
+			s.mu.Unlock()
+			reply("+OK bye")
+			return
+		default:
+			reply("-ERR unknown command")
+		}
+	}
+}
@@ -3,7 +3,9 @@ package sender
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"mime"
 	"mime/multipart"
@@ -13,7 +15,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/oauth"
 )
 
 // generateMessageID creates a unique Message-ID header.
@@ -28,15 +32,16 @@ func generateMessageID(from string) string {
 
 // SendEmail constructs a multipart message with plain text, HTML, embedded images, and attachments.
 func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBody string, images map[string][]byte, attachments map[string][]byte, inReplyTo string, references []string) error {
-	smtpServer := account.GetSMTPServer()
-	smtpPort := account.GetSMTPPort()
-
-	if smtpServer == "" {
-		return fmt.Errorf("unsupported or missing service_provider: %s", account.ServiceProvider)
+	msg, err := BuildMessage(account, to, subject, plainBody, htmlBody, images, attachments, inReplyTo, references)
+	if err != nil {
+		return err
 	}
+	return Send(account, to, msg)
+}
 
-	auth := smtp.PlainAuth("", account.Email, account.Password, smtpServer)
-
+// BuildMessage constructs the message SendEmail sends, for sending some
+// other way.
+func BuildMessage(account *config.Account, to []string, subject, plainBody, htmlBody string, images map[string][]byte, attachments map[string][]byte, inReplyTo string, references []string) ([]byte, error) {
 	fromHeader := account.Email
 	if account.Name != "" {
 		fromHeader = fmt.Sprintf("%s <%s>", account.Name, account.Email)
@@ -77,7 +82,7 @@ func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBod
 	relatedHeader.Set("Content-Type", "multipart/related; boundary="+relatedBoundary)
 	relatedPartWriter, err := mainWriter.CreatePart(relatedHeader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	relatedWriter := multipart.NewWriter(relatedPartWriter)
 	relatedWriter.SetBoundary(relatedBoundary)
@@ -88,7 +93,7 @@ func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBod
 	altHeader.Set("Content-Type", "multipart/alternative; boundary="+altBoundary)
 	altPartWriter, err := relatedWriter.CreatePart(altHeader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	altWriter := multipart.NewWriter(altPartWriter)
 	altWriter.SetBoundary(altBoundary)
@@ -96,14 +101,14 @@ func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBod
 	// Plain text part
 	textPart, err := altWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	fmt.Fprint(textPart, plainBody)
 
 	// HTML part
 	htmlPart, err := altWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=UTF-8"}})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	fmt.Fprint(htmlPart, htmlBody)
 
@@ -125,7 +130,7 @@ func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBod
 
 		imgPart, err := relatedWriter.CreatePart(imgHeader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		// data is already base64 encoded, but needs MIME line wrapping (76 chars per line)
 		imgPart.Write([]byte(wrapBase64(string(data))))
@@ -147,7 +152,7 @@ func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBod
 
 		attachmentPart, err := mainWriter.CreatePart(partHeader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		encodedData := base64.StdEncoding.EncodeToString(data)
 		// MIME requires base64 to be line-wrapped at 76 characters
@@ -156,8 +161,135 @@ func SendEmail(account *config.Account, to []string, subject, plainBody, htmlBod
 
 	mainWriter.Close() // Finish the main message
 
+	return msg.Bytes(), nil
+}
+
+// Send sends a message built by BuildMessage over SMTP.
+func Send(account *config.Account, to []string, msg []byte) error {
+	smtpServer := account.GetSMTPServer()
+	smtpPort := account.GetSMTPPort()
+
+	if smtpServer == "" {
+		return fmt.Errorf("unsupported or missing service_provider: %s", account.ServiceProvider)
+	}
+
+	var auth smtp.Auth
+	if account.UsesOAuth2() {
+		token, err := oauth.AccessToken(account)
+		if err != nil {
+			return err
+		}
+		auth = &oauthAuth{username: account.Email, token: token}
+	} else {
+		auth = smtp.PlainAuth("", account.Email, account.Password, smtpServer)
+	}
+
+	tlsConfig, err := account.TLSConfig(smtpServer)
+	if err != nil {
+		return err
+	}
 	addr := fmt.Sprintf("%s:%d", smtpServer, smtpPort)
-	return smtp.SendMail(addr, auth, account.Email, to, msg.Bytes())
+	c, err := dialSMTP(addr, smtpServer, account.GetSMTPSecurity(), tlsConfig)
+	if err != nil {
+		return config.ExplainTLSError(smtpServer, err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("AUTH"); ok {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(account.Email); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dialSMTP connects to addr with the given security, never settling for
+// less: STARTTLS fails if the server doesn't offer it, and plaintext is only
+// allowed to localhost.
+func dialSMTP(addr, host, security string, tlsConfig *tls.Config) (*smtp.Client, error) {
+	switch security {
+	case config.SecurityTLS:
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	case config.SecuritySTARTTLS:
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("%s does not support STARTTLS", host)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	case config.SecurityNone:
+		if !config.IsLocalhost(host) {
+			return nil, fmt.Errorf("plaintext SMTP is only allowed to localhost, not %s", host)
+		}
+		return smtp.Dial(addr)
+	default:
+		return nil, fmt.Errorf("unknown SMTP security %q", security)
+	}
+}
+
+// oauthAuth authenticates with an OAuth2 access token, using OAUTHBEARER
+// if the server offers it and XOAUTH2 otherwise.
+type oauthAuth struct {
+	username string
+	token    string
+	client   sasl.Client
+}
+
+func (a *oauthAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, don't send the token in the clear.
+	if !server.TLS && !config.IsLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	a.client = oauth.NewSASLClient(a.username, a.token, func(mech string) bool {
+		for _, m := range server.Auth {
+			if strings.EqualFold(m, mech) {
+				return true
+			}
+		}
+		return false
+	})
+	return a.client.Start()
+}
+
+func (a *oauthAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return a.client.Next(fromServer)
 }
 
 // wrapBase64 wraps base64-encoded data at 76 characters per line as required by MIME.
@@ -1,8 +1,14 @@
 package sender
 
 import (
+	"bufio"
+	"net"
+	"net/smtp"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/floatpane/matcha/config"
 )
 
 // TestGenerateMessageID ensures the Message-ID has the correct format.
@@ -43,3 +49,115 @@ func TestGenerateMessageID(t *testing.T) {
 		t.Errorf("Message-ID has an empty random part, got %s", msgID)
 	}
 }
+
+// newTestSMTPServer starts a plaintext SMTP server on localhost that offers
+// neither STARTTLS nor AUTH. Messages it accepts are sent to the returned
+// channel.
+func newTestSMTPServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			messages <- data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// TestDialSMTPSecurity ensures connections never fall back to plaintext.
+func TestDialSMTPSecurity(t *testing.T) {
+	addr, _ := newTestSMTPServer(t)
+
+	if _, err := dialSMTP(addr, "127.0.0.1", config.SecuritySTARTTLS, nil); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("expected STARTTLS to be required, got %v", err)
+	}
+	if _, err := dialSMTP(addr, "smtp.example.com", config.SecurityNone, nil); err == nil || !strings.Contains(err.Error(), "only allowed to localhost") {
+		t.Errorf("expected plaintext to be refused for a remote host, got %v", err)
+	}
+}
+
+// TestSendEmailPlaintextToLocalhost sends through a local server without TLS.
+func TestSendEmailPlaintextToLocalhost(t *testing.T) {
+	addr, messages := newTestSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	smtpPort, _ := strconv.Atoi(port)
+	account := &config.Account{
+		Email:           "me@example.com",
+		Password:        "secret",
+		ServiceProvider: "custom",
+		SMTPServer:      host,
+		SMTPPort:        smtpPort,
+		SMTPSecurity:    config.SecurityNone,
+	}
+
+	err := SendEmail(account, []string{"you@example.com"}, "Hello", "Hi there", "<p>Hi there</p>", nil, nil, "", nil)
+	if err != nil {
+		t.Fatalf("SendEmail() failed: %v", err)
+	}
+	if msg := <-messages; !strings.Contains(msg, "Subject: Hello") {
+		t.Errorf("expected the message to be delivered, got %q", msg)
+	}
+}
+
+// TestOAuthAuth checks the mechanism picked for OAuth2 accounts.
+func TestOAuthAuth(t *testing.T) {
+	auth := &oauthAuth{username: "me@example.com", token: "token"}
+
+	mech, ir, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true, Auth: []string{"PLAIN", "XOAUTH2"}})
+	if err != nil || mech != "XOAUTH2" || !strings.Contains(string(ir), "auth=Bearer token") {
+		t.Errorf("expected XOAUTH2, got %q %q (%v)", mech, ir, err)
+	}
+	if mech, _, _ := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true, Auth: []string{"XOAUTH2", "OAUTHBEARER"}}); mech != "OAUTHBEARER" {
+		t.Errorf("expected OAUTHBEARER when offered, got %q", mech)
+	}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", Auth: []string{"XOAUTH2"}}); err == nil {
+		t.Error("expected the token not to be sent without TLS")
+	}
+}
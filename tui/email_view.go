@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
+	"unicode"
 
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
@@ -14,9 +15,20 @@ import (
 
 var (
 	emailHeaderStyle   = lipgloss.NewStyle().BorderStyle(lipgloss.NormalBorder()).BorderBottom(true).Padding(0, 1)
+	conversationStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).BorderStyle(lipgloss.NormalBorder()).BorderTop(true)
+	currentMsgStyle    = conversationStyle.Foreground(lipgloss.Color("42")).Bold(true)
 	attachmentBoxStyle = lipgloss.NewStyle().Border(lipgloss.NormalBorder(), false, false, false, true).PaddingLeft(2).MarginTop(1)
 )
 
+// emailPane is what the email view shows.
+type emailPane int
+
+const (
+	paneBody    emailPane = iota
+	paneHeaders           // Every header of the message, as received
+	paneSource            // The whole message, as received
+)
+
 type EmailView struct {
 	viewport           viewport.Model
 	email              fetcher.Email
@@ -25,16 +37,17 @@ type EmailView struct {
 	focusOnAttachments bool
 	accountID          string
 	mailbox            MailboxKind
+	conversation       []fetcher.Email // Every email of the conversation, oldest first
+	pane               emailPane
+	source             []byte // The message as received, once fetched
+	header             []byte // Its header alone, if only that was fetched
+	sourceErr          error
+	fetchingSource     bool
+	fetchingHeader     bool
+	download           *AttachmentProgressMsg // The attachment being downloaded, if any
 }
 
 func NewEmailView(email fetcher.Email, emailIndex, width, height int, mailbox MailboxKind) *EmailView {
-	// Pass the styles from the tui package to the view package
-	inlineImages := inlineImagesFromAttachments(email.Attachments)
-	body, err := view.ProcessBodyWithInline(email.Body, inlineImages, H1Style, H2Style, BodyStyle)
-	if err != nil {
-		body = fmt.Sprintf("Error rendering body: %v", err)
-	}
-
 	// Create header and compute heights that reduce viewport space.
 	header := fmt.Sprintf("From: %s\nSubject: %s", email.From, email.Subject)
 	headerHeight := lipgloss.Height(header) + 2
@@ -46,16 +59,16 @@ func NewEmailView(email fetcher.Email, emailIndex, width, height int, mailbox Ma
 
 	// Build viewport with initial size and set wrapped content.
 	vp := viewport.New(width, height-headerHeight-attachmentHeight)
-	wrapped := wrapBodyToWidth(body, vp.Width)
-	vp.SetContent("\x1b_Ga=d\x1b\\\n" + wrapped + "\n")
 
-	return &EmailView{
+	m := &EmailView{
 		viewport:   vp,
 		email:      email,
 		emailIndex: emailIndex,
 		accountID:  email.AccountID,
 		mailbox:    mailbox,
 	}
+	m.setContent()
+	return m
 }
 
 func (m *EmailView) Init() tea.Cmd {
@@ -74,6 +87,11 @@ func (m *EmailView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.focusOnAttachments = false
 				return m, nil
 			}
+			if m.pane != paneBody {
+				m.pane = paneBody
+				m.setContent()
+				return m, nil
+			}
 			m.viewport.SetContent("\x1b_Ga=d\x1b\\")
 			return m, func() tea.Msg { return BackToMailboxMsg{Mailbox: m.mailbox} }
 		}
@@ -89,13 +107,13 @@ func (m *EmailView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.attachmentCursor++
 				}
 			case "enter":
-				if len(m.email.Attachments) > 0 {
+				if len(m.email.Attachments) > 0 && m.download == nil {
 					selected := m.email.Attachments[m.attachmentCursor]
-					idx := m.emailIndex
+					uid := m.email.UID
 					accountID := m.accountID
 					return m, func() tea.Msg {
 						return DownloadAttachmentMsg{
-							Index:     idx,
+							UID:       uid,
 							Filename:  selected.Filename,
 							PartID:    selected.PartID,
 							Data:      selected.Data,
@@ -106,6 +124,10 @@ func (m *EmailView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}
 			case "tab":
 				m.focusOnAttachments = false
+			case "c":
+				if m.download != nil {
+					return m, func() tea.Msg { return CancelDownloadMsg{} }
+				}
 			}
 		} else {
 			switch msg.String() {
@@ -123,6 +145,30 @@ func (m *EmailView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, func() tea.Msg {
 					return ArchiveEmailMsg{UID: uid, AccountID: accountID, Mailbox: m.mailbox}
 				}
+			case "u":
+				// Update optimistically; the main model rolls back on failure.
+				enable := m.email.IsUnread()
+				m.email.SetFlag(fetcher.FlagSeen, enable)
+				msg := SetFlagMsg{UID: m.email.UID, AccountID: m.accountID, Mailbox: m.mailbox, Flag: fetcher.FlagSeen, Enable: enable}
+				return m, func() tea.Msg { return msg }
+			case "f":
+				enable := !m.email.HasFlag(fetcher.FlagFlagged)
+				m.email.SetFlag(fetcher.FlagFlagged, enable)
+				msg := SetFlagMsg{UID: m.email.UID, AccountID: m.accountID, Mailbox: m.mailbox, Flag: fetcher.FlagFlagged, Enable: enable}
+				return m, func() tea.Msg { return msg }
+			case "c":
+				if m.download != nil {
+					return m, func() tea.Msg { return CancelDownloadMsg{} }
+				}
+			case "h":
+				return m, m.showPane(paneHeaders)
+			case "v":
+				return m, m.showPane(paneSource)
+			case "s":
+				if m.pane == paneSource && m.source != nil {
+					msg := SaveSourceMsg{Filename: emlFilename(m.email.Subject), Raw: m.source}
+					return m, func() tea.Msg { return msg }
+				}
 			case "tab":
 				if len(m.email.Attachments) > 0 {
 					m.focusOnAttachments = true
@@ -141,13 +187,7 @@ func (m *EmailView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.viewport.Height = msg.Height - headerHeight - attachmentHeight
 
 		// When the window size changes, wrap and clear kitty images to keep placement stable
-		inlineImages := inlineImagesFromAttachments(m.email.Attachments)
-		body, err := view.ProcessBodyWithInline(m.email.Body, inlineImages, H1Style, H2Style, BodyStyle)
-		if err != nil {
-			body = fmt.Sprintf("Error rendering body: %v", err)
-		}
-		wrapped := wrapBodyToWidth(body, m.viewport.Width)
-		m.viewport.SetContent("\x1b_Ga=d\x1b\\\n" + wrapped + "\n")
+		m.setContent()
 	}
 
 	m.viewport, cmd = m.viewport.Update(msg)
@@ -158,13 +198,23 @@ func (m *EmailView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (m *EmailView) View() string {
 	header := fmt.Sprintf("From: %s | Subject: %s", m.email.From, m.email.Subject)
+	if m.email.IsUnread() {
+		header += " | Unread"
+	}
+	if m.email.HasFlag(fetcher.FlagFlagged) {
+		header += " | ⚑ Flagged"
+	}
 	styledHeader := emailHeaderStyle.Width(m.viewport.Width).Render(header)
 
 	var help string
 	if m.focusOnAttachments {
 		help = helpStyle.Render("↑/↓: navigate • enter: download • esc/tab: back to email body")
+	} else if m.pane == paneHeaders {
+		help = helpStyle.Render("↑/↓: scroll • v: source • esc/h: back to email body")
+	} else if m.pane == paneSource {
+		help = helpStyle.Render("↑/↓: scroll • s: save as .eml • h: headers • esc/v: back to email body")
 	} else {
-		help = helpStyle.Render("r: reply • d: delete • a: archive • tab: focus attachments • esc: back to inbox")
+		help = helpStyle.Render("r: reply • d: delete • a: archive • u: read/unread • f: flag • h: headers • v: source • tab: focus attachments • esc: back to inbox")
 	}
 
 	var attachmentView string
@@ -183,10 +233,204 @@ func (m *EmailView) View() string {
 		}
 		attachmentView = attachmentBoxStyle.Render(b.String())
 	}
+	if m.download != nil {
+		help = m.downloadView() + "\n" + help
+	}
 
 	return fmt.Sprintf("%s\n%s\n%s\n%s", styledHeader, m.viewport.View(), attachmentView, help)
 }
 
+// setContent renders the email, or the whole conversation once it is known,
+// into the viewport. In a conversation the viewport starts at this email.
+func (m *EmailView) setContent() {
+	if m.pane != paneBody {
+		var content string
+		switch {
+		case m.sourceErr != nil:
+			content = fmt.Sprintf("Error fetching the message: %v", m.sourceErr)
+		case m.pane == paneHeaders && m.source != nil:
+			content = printable(headerSection(m.source))
+		case m.pane == paneHeaders && m.header != nil:
+			content = printable(headerSection(m.header))
+		case m.pane == paneSource && m.source != nil:
+			content = printable(m.source)
+		default:
+			content = "Loading..."
+		}
+		m.viewport.SetContent("\x1b_Ga=d\x1b\\\n" + content + "\n")
+		m.viewport.GotoTop()
+		return
+	}
+	if len(m.conversation) < 2 {
+		m.viewport.SetContent("\x1b_Ga=d\x1b\\\n" + wrapBodyToWidth(renderBody(m.email), m.viewport.Width) + "\n")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b_Ga=d\x1b\\\n")
+	offset := 0
+	for _, e := range m.conversation {
+		style := conversationStyle
+		current := e.UID == m.email.UID
+		if m.email.MessageID != "" {
+			current = e.MessageID == m.email.MessageID
+		}
+		if current {
+			style = currentMsgStyle
+			offset = lipgloss.Height(b.String()) - 1
+		}
+		b.WriteString(style.Width(m.viewport.Width).Render(fmt.Sprintf("%s · %s", e.From, e.Date.Local().Format("Mon, Jan 2 2006 15:04"))))
+		b.WriteString("\n")
+		b.WriteString(wrapBodyToWidth(renderBody(e), m.viewport.Width))
+		b.WriteString("\n\n")
+	}
+	m.viewport.SetContent(b.String())
+	m.viewport.SetYOffset(offset)
+}
+
+// renderBody renders the body of an email with its inline images.
+func renderBody(email fetcher.Email) string {
+	// Pass the styles from the tui package to the view package
+	inlineImages := inlineImagesFromAttachments(email.Attachments)
+	body, err := view.ProcessBodyWithInline(email.Body, inlineImages, H1Style, H2Style, BodyStyle)
+	if err != nil {
+		body = fmt.Sprintf("Error rendering body: %v", err)
+	}
+	return body
+}
+
+// showPane switches to the headers or the source of the message, or back
+// to the body if it is shown already. The headers pane fetches only the
+// header of the message, and the source pane all of it, the first time.
+func (m *EmailView) showPane(pane emailPane) tea.Cmd {
+	if m.pane == pane {
+		pane = paneBody
+	}
+	m.pane = pane
+	headerOnly := pane == paneHeaders
+	if pane == paneBody || m.source != nil || m.fetchingSource || (headerOnly && (m.header != nil || m.fetchingHeader)) {
+		m.setContent()
+		return nil
+	}
+	if headerOnly {
+		m.fetchingHeader = true
+	} else {
+		m.fetchingSource = true
+	}
+	m.sourceErr = nil
+	m.setContent()
+	msg := FetchSourceMsg{UID: m.email.UID, AccountID: m.accountID, Mailbox: m.mailbox, HeaderOnly: headerOnly}
+	return func() tea.Msg { return msg }
+}
+
+// SetSource sets the message as it was received, or why it couldn't be
+// fetched.
+func (m *EmailView) SetSource(raw []byte, err error) {
+	m.fetchingSource = false
+	m.source, m.sourceErr = raw, err
+	if m.pane != paneBody {
+		m.setContent()
+	}
+}
+
+// SetHeader sets the header of the message as it was received, or why it
+// couldn't be fetched.
+func (m *EmailView) SetHeader(raw []byte, err error) {
+	m.fetchingHeader = false
+	m.header, m.sourceErr = raw, err
+	if m.pane != paneBody {
+		m.setContent()
+	}
+}
+
+// headerSection returns the header of a message, up to the blank line
+// before its body.
+func headerSection(raw []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := strings.Index(string(raw), sep); i >= 0 {
+			return raw[:i]
+		}
+	}
+	return raw
+}
+
+// printable makes received text safe to show in the terminal: control
+// characters, which could move the cursor or change colors, are replaced.
+func printable(raw []byte) string {
+	text := strings.ReplaceAll(string(raw), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return '\uFFFD'
+		}
+		return r
+	}, text)
+}
+
+// emlFilename names the .eml file an email is saved as after its subject.
+func emlFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if len(name) > 100 {
+		name = strings.ToValidUTF8(name[:100], "")
+	}
+	if name == "" || strings.Trim(name, ".") == "" {
+		name = "message"
+	}
+	return name + ".eml"
+}
+
+// SetDownloadProgress shows how far the download of an attachment got.
+func (m *EmailView) SetDownloadProgress(msg AttachmentProgressMsg) {
+	m.download = &msg
+}
+
+// EndDownload stops showing the download of an attachment.
+func (m *EmailView) EndDownload() {
+	m.download = nil
+}
+
+// downloadView renders a progress bar of the attachment being downloaded.
+func (m *EmailView) downloadView() string {
+	d := m.download
+	if d.Total <= 0 {
+		return fmt.Sprintf("Downloading %s: %s • c: cancel", d.Filename, formatSize(d.Fetched))
+	}
+	const width = 30
+	fraction := float64(d.Fetched) / float64(d.Total)
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * width)
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+	return fmt.Sprintf("Downloading %s %s %3.0f%% (%s of %s) • c: cancel", d.Filename, bar, fraction*100, formatSize(d.Fetched), formatSize(d.Total))
+}
+
+// formatSize formats a number of bytes for people to read.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// SetConversation shows every email of the conversation, oldest first,
+// around the email being viewed.
+func (m *EmailView) SetConversation(emails []fetcher.Email) {
+	m.conversation = emails
+	m.setContent()
+}
+
 // GetAccountID returns the account ID for this email
 func (m *EmailView) GetAccountID() string {
 	return m.accountID
@@ -210,6 +454,11 @@ func wrapBodyToWidth(body string, width int) string {
 	return BodyStyle.Width(width).Render(body)
 }
 
+// SetEmailFlag sets or clears a flag on the email being viewed.
+func (m *EmailView) SetEmailFlag(flag string, enable bool) {
+	m.email.SetFlag(flag, enable)
+}
+
 // GetEmail returns the email being viewed
 func (m *EmailView) GetEmail() fetcher.Email {
 	return m.email
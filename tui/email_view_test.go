@@ -1,6 +1,7 @@
 package tui
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 
 func TestEmailViewUpdate(t *testing.T) {
 	emailWithAttachments := fetcher.Email{
+		UID:     7,
 		From:    "test@example.com",
 		Subject: "Test Email with Attachments",
 		Body:    "This is the body.",
@@ -121,6 +123,9 @@ func TestEmailViewUpdate(t *testing.T) {
 		if downloadMsg.Mailbox != MailboxInbox {
 			t.Errorf("Expected mailbox to be MailboxInbox, got %s", downloadMsg.Mailbox)
 		}
+		if downloadMsg.UID != 7 {
+			t.Errorf("Expected the email's UID 7, got %d", downloadMsg.UID)
+		}
 	})
 
 	t.Run("Reply to email", func(t *testing.T) {
@@ -141,3 +146,119 @@ func TestEmailViewUpdate(t *testing.T) {
 		}
 	})
 }
+
+func TestEmailViewToggleRead(t *testing.T) {
+	email := fetcher.Email{UID: 5, AccountID: "account-1", Subject: "Hello", Flags: []string{fetcher.FlagSeen}}
+	emailView := NewEmailView(email, 0, 80, 24, MailboxInbox)
+
+	_, cmd := emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'u'}})
+	if cmd == nil {
+		t.Fatal("expected a command after pressing u")
+	}
+	msg, ok := cmd().(SetFlagMsg)
+	if !ok || msg.UID != 5 || msg.Enable {
+		t.Fatalf("expected SetFlagMsg clearing \\Seen on UID 5, got %#v", msg)
+	}
+	if !emailView.GetEmail().IsUnread() {
+		t.Error("expected the view to show the email as unread right away")
+	}
+}
+
+func TestEmailViewConversation(t *testing.T) {
+	now := time.Now()
+	original := fetcher.Email{UID: 1, From: "alice@example.com", Subject: "Plan", Body: "Shall we meet?", MessageID: "<a@x>", Date: now.Add(-time.Hour)}
+	reply := fetcher.Email{UID: 7, From: "me@example.com", Subject: "Re: Plan", Body: "Sure, at noon.", MessageID: "<b@x>", References: []string{"<a@x>"}, Mailbox: "Sent", Date: now}
+
+	emailView := NewEmailView(original, 0, 80, 24, MailboxInbox)
+	emailView.SetConversation([]fetcher.Email{original, reply})
+
+	content := emailView.viewport.View()
+	if !strings.Contains(content, "Shall we meet?") || !strings.Contains(content, "me@example.com") {
+		t.Errorf("expected both emails of the conversation in the view, got %q", content)
+	}
+}
+
+func TestEmailViewSource(t *testing.T) {
+	email := fetcher.Email{UID: 3, AccountID: "account-1", From: "bank@example.com", Subject: "Your account", Body: "Click here."}
+	emailView := NewEmailView(email, 0, 80, 24, MailboxInbox)
+
+	_, cmd := emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'h'}})
+	if cmd == nil {
+		t.Fatal("expected a command after pressing h")
+	}
+	msg, ok := cmd().(FetchSourceMsg)
+	if !ok || msg.UID != 3 || msg.AccountID != "account-1" || !msg.HeaderOnly {
+		t.Fatalf("expected FetchSourceMsg for the header of UID 3, got %#v", msg)
+	}
+
+	header := "Received: from mx.example.net\r\n\tby mail.example.com\r\nAuthentication-Results: spf=fail\r\nSubject: Your account\r\nX-Trick: \x1b[2J\r\n"
+	raw := header + "\r\nClick here.\r\n"
+	emailView.SetHeader([]byte(header), nil)
+	content := emailView.viewport.View()
+	if !strings.Contains(content, "Authentication-Results: spf=fail") || !strings.Contains(content, "by mail.example.com") {
+		t.Errorf("expected every header in the headers pane, got %q", content)
+	}
+	if strings.Contains(content, "Click here.") {
+		t.Errorf("expected the body to be left out of the headers pane, got %q", content)
+	}
+	if strings.Contains(content, "\x1b[2J") {
+		t.Errorf("expected control characters of the message to be replaced, got %q", content)
+	}
+
+	// The source pane fetches the whole message, once, and it can be saved.
+	_, cmd = emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'v'}})
+	if cmd == nil {
+		t.Fatal("expected a command after pressing v")
+	}
+	if msg, ok := cmd().(FetchSourceMsg); !ok || msg.HeaderOnly {
+		t.Fatalf("expected FetchSourceMsg for the whole message, got %#v", msg)
+	}
+	emailView.SetSource([]byte(raw), nil)
+	emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'h'}})
+	if _, cmd = emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'v'}}); cmd != nil {
+		t.Error("expected the source not to be fetched again")
+	}
+	if content := emailView.viewport.View(); !strings.Contains(content, "Click here.") {
+		t.Errorf("expected the whole message in the source pane, got %q", content)
+	}
+	_, cmd = emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'s'}})
+	if cmd == nil {
+		t.Fatal("expected a command after pressing s")
+	}
+	save, ok := cmd().(SaveSourceMsg)
+	if !ok || save.Filename != "Your account.eml" || string(save.Raw) != raw {
+		t.Errorf("expected SaveSourceMsg with the message, got %#v", save)
+	}
+
+	// Esc goes back to the body rather than the inbox.
+	_, cmd = emailView.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if cmd != nil {
+		t.Error("expected esc to go back to the body")
+	}
+	if content := emailView.viewport.View(); strings.Contains(content, "Authentication-Results") {
+		t.Errorf("expected the body to be shown again, got %q", content)
+	}
+}
+
+func TestEmailViewDownloadProgress(t *testing.T) {
+	email := fetcher.Email{UID: 4, AccountID: "account-1", Subject: "Report", Attachments: []fetcher.Attachment{{Filename: "report.pdf", PartID: "2"}}}
+	emailView := NewEmailView(email, 0, 120, 24, MailboxInbox)
+
+	emailView.SetDownloadProgress(AttachmentProgressMsg{Filename: "report.pdf", Fetched: 5 << 20, Total: 20 << 20})
+	if view := emailView.View(); !strings.Contains(view, "25%") || !strings.Contains(view, "5.0 MB of 20.0 MB") {
+		t.Errorf("expected the download's progress in the view, got %q", view)
+	}
+
+	_, cmd := emailView.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'c'}})
+	if cmd == nil {
+		t.Fatal("expected a command after pressing c")
+	}
+	if _, ok := cmd().(CancelDownloadMsg); !ok {
+		t.Error("expected c to cancel the download")
+	}
+
+	emailView.EndDownload()
+	if view := emailView.View(); strings.Contains(view, "Downloading") {
+		t.Errorf("expected the progress to be gone once the download ended, got %q", view)
+	}
+}
@@ -0,0 +1,171 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+var (
+	folderAccountStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("42")).Bold(true).PaddingLeft(2)
+	folderUnreadStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("208"))
+	folderMutedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
+)
+
+// folderEntry is a row of the folder picker: either an account header or a folder.
+type folderEntry struct {
+	accountID string
+	header    string
+	folder    fetcher.Folder
+}
+
+func (e folderEntry) selectable() bool {
+	return e.header == "" && e.folder.Selectable()
+}
+
+// Folders lets the user pick a folder from the folder tree of each account.
+type Folders struct {
+	entries []folderEntry
+	cursor  int
+	offset  int
+	width   int
+	height  int
+}
+
+// NewFolders creates a folder picker for the given accounts.
+func NewFolders(accounts []config.Account, foldersByAccount map[string][]fetcher.Folder) *Folders {
+	var entries []folderEntry
+	for _, acc := range accounts {
+		folders, ok := foldersByAccount[acc.ID]
+		if !ok {
+			continue
+		}
+		header := acc.Email
+		if acc.Name != "" {
+			header = fmt.Sprintf("%s (%s)", acc.Name, acc.Email)
+		}
+		entries = append(entries, folderEntry{accountID: acc.ID, header: header})
+		for _, f := range folders {
+			entries = append(entries, folderEntry{accountID: acc.ID, folder: f})
+		}
+	}
+
+	m := &Folders{entries: entries, cursor: -1}
+	m.move(1)
+	return m
+}
+
+// Init initializes the folder picker.
+func (m *Folders) Init() tea.Cmd {
+	return nil
+}
+
+// Update handles messages for the folder picker.
+func (m *Folders) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		return m, nil
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "up", "k":
+			m.move(-1)
+		case "down", "j":
+			m.move(1)
+		case "enter":
+			if m.cursor >= 0 && m.cursor < len(m.entries) {
+				entry := m.entries[m.cursor]
+				return m, func() tea.Msg {
+					return OpenFolderMsg{AccountID: entry.accountID, Folder: entry.folder.Name}
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// move moves the cursor to the next selectable entry in direction dir.
+func (m *Folders) move(dir int) {
+	for i := m.cursor + dir; i >= 0 && i < len(m.entries); i += dir {
+		if m.entries[i].selectable() {
+			m.cursor = i
+			break
+		}
+	}
+
+	visible := m.visibleRows()
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+		// Keep the account header in view when moving to its first folder.
+		if m.offset > 0 && m.entries[m.offset-1].header != "" {
+			m.offset--
+		}
+	}
+	if m.cursor >= m.offset+visible {
+		m.offset = m.cursor - visible + 1
+	}
+	if m.offset < 0 {
+		m.offset = 0
+	}
+}
+
+func (m *Folders) visibleRows() int {
+	// Leave room for the title, help line and margins.
+	if m.height > 8 {
+		return m.height - 8
+	}
+	return 20
+}
+
+// View renders the folder picker.
+func (m *Folders) View() string {
+	var b strings.Builder
+
+	b.WriteString(titleStyle.Render("Folders") + "\n\n")
+
+	if len(m.entries) == 0 {
+		b.WriteString(folderMutedStyle.Render("  No folders found.\n"))
+	}
+
+	end := m.offset + m.visibleRows()
+	if end > len(m.entries) {
+		end = len(m.entries)
+	}
+	for i := m.offset; i < end; i++ {
+		entry := m.entries[i]
+		if entry.header != "" {
+			if i > m.offset {
+				b.WriteString("\n")
+			}
+			b.WriteString(folderAccountStyle.Render(entry.header))
+			b.WriteString("\n")
+			continue
+		}
+
+		name := strings.Repeat("  ", entry.folder.Depth()) + entry.folder.DisplayName()
+		switch {
+		case !entry.folder.Selectable():
+			name = folderMutedStyle.Render(name)
+		case entry.folder.Unseen > 0:
+			name = fmt.Sprintf("%s %s", name, folderUnreadStyle.Render(fmt.Sprintf("(%d)", entry.folder.Unseen)))
+		}
+
+		if i == m.cursor {
+			b.WriteString(selectedItemStyle.Render(fmt.Sprintf("> %s", name)))
+		} else {
+			b.WriteString(itemStyle.Render(fmt.Sprintf("  %s", name)))
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\n")
+	b.WriteString(helpStyle.Render("↑/↓: navigate • enter: open folder • esc: back"))
+
+	return docStyle.Render(b.String())
+}
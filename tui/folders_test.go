@@ -0,0 +1,55 @@
+package tui
+
+import (
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+func TestFoldersSkipsHeadersAndNoselect(t *testing.T) {
+	accounts := []config.Account{
+		{ID: "account-1", Email: "one@example.com"},
+		{ID: "account-2", Email: "two@example.com"},
+	}
+	folders := map[string][]fetcher.Folder{
+		"account-1": {
+			{Name: "INBOX", Delimiter: "/"},
+			{Name: "[Gmail]", Delimiter: "/", Attributes: []string{"\\Noselect"}},
+			{Name: "[Gmail]/Spam", Delimiter: "/"},
+		},
+		"account-2": {
+			{Name: "INBOX", Delimiter: "."},
+		},
+	}
+
+	m := NewFolders(accounts, folders)
+
+	down := tea.KeyMsg{Type: tea.KeyDown}
+	want := []struct {
+		accountID string
+		folder    string
+	}{
+		{"account-1", "INBOX"},
+		{"account-1", "[Gmail]/Spam"},
+		{"account-2", "INBOX"},
+		{"account-2", "INBOX"}, // stays on the last folder
+	}
+
+	for i, w := range want {
+		_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		msgs := collectMsgs(cmd)
+		if len(msgs) != 1 {
+			t.Fatalf("step %d: expected one message, got %d", i, len(msgs))
+		}
+		open, ok := msgs[0].(OpenFolderMsg)
+		if !ok {
+			t.Fatalf("step %d: expected OpenFolderMsg, got %T", i, msgs[0])
+		}
+		if open.AccountID != w.accountID || open.Folder != w.folder {
+			t.Errorf("step %d: expected %s/%s, got %s/%s", i, w.accountID, w.folder, open.AccountID, open.Folder)
+		}
+		m.Update(down)
+	}
+}
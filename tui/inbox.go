@@ -3,7 +3,9 @@ package tui
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
@@ -19,6 +21,8 @@ var (
 	tabStyle        = lipgloss.NewStyle().Padding(0, 2)
 	activeTabStyle  = lipgloss.NewStyle().Padding(0, 2).Foreground(lipgloss.Color("42")).Bold(true).Underline(true)
 	tabBarStyle     = lipgloss.NewStyle().BorderStyle(lipgloss.NormalBorder()).BorderBottom(true).PaddingBottom(1).MarginBottom(1)
+	noticeStyle     = lipgloss.NewStyle().PaddingLeft(4).Foreground(lipgloss.Color("42"))
+	previewStyle    = lipgloss.NewStyle().PaddingLeft(6).Foreground(lipgloss.Color("240"))
 )
 
 type item struct {
@@ -27,15 +31,31 @@ type item struct {
 	uid           uint32
 	accountID     string
 	accountEmail  string
+	unread        bool
+	flagged       bool
+	threadKey     string // Set on the row of a thread with more than one email
+	threadCount   int
+	expanded      bool
+	inThread      bool // Set on the emails listed under an expanded thread
+	preview       string
 }
 
 func (i item) Title() string       { return i.title }
 func (i item) Description() string { return i.desc }
-func (i item) FilterValue() string { return i.title + " " + i.desc }
+func (i item) FilterValue() string { return i.title + " " + i.desc + " " + i.preview }
 
-type itemDelegate struct{}
+type itemDelegate struct {
+	marked  map[string]bool // Shared with the inbox, keyed by emailKey
+	compact bool            // Rows are one line, without the preview
+}
+
+func (d itemDelegate) Height() int {
+	if d.compact {
+		return 1
+	}
+	return 2
+}
 
-func (d itemDelegate) Height() int                               { return 1 }
 func (d itemDelegate) Spacing() int                              { return 0 }
 func (d itemDelegate) Update(msg tea.Msg, m *list.Model) tea.Cmd { return nil }
 func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list.Item) {
@@ -44,21 +64,48 @@ func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list
 		return
 	}
 
-	str := fmt.Sprintf("%d. %s", index+1, i.title)
+	title := i.title
+	if i.inThread {
+		title = "  ↳ " + i.desc
+	}
+	if i.flagged {
+		title = "⚑ " + title
+	}
+	if d.marked[emailKey(i.uid, i.accountID)] {
+		title = "● " + title
+	}
+	if i.threadKey != "" {
+		arrow := "▸"
+		if i.expanded {
+			arrow = "▾"
+		}
+		title = fmt.Sprintf("%s %s (%d)", arrow, title, i.threadCount)
+	}
+
+	str := fmt.Sprintf("%d. %s", index+1, title)
 
 	// For "ALL" view, show account indicator
 	if i.accountEmail != "" {
-		str = fmt.Sprintf("%d. [%s] %s", index+1, truncateEmail(i.accountEmail), i.title)
+		str = fmt.Sprintf("%d. [%s] %s", index+1, truncateEmail(i.accountEmail), title)
 	}
 
-	fn := itemStyle.Render
+	style, selectedStyle := itemStyle, selectedItemStyle
+	if i.unread {
+		style, selectedStyle = style.Bold(true), selectedStyle.Bold(true)
+	}
+
+	fn := style.Render
 	if index == m.Index() {
 		fn = func(s ...string) string {
-			return selectedItemStyle.Render("> " + s[0])
+			return selectedStyle.Render("> " + s[0])
 		}
 	}
 
 	fmt.Fprint(w, fn(str))
+	if !d.compact {
+		// The line is written even without a preview, to keep rows even.
+		fmt.Fprint(w, "\n"+previewStyle.MaxWidth(m.Width()).Render(i.preview))
+	}
 }
 
 // truncateEmail shortens an email for display
@@ -95,8 +142,24 @@ type Inbox struct {
 	currentAccountID string // Empty means "ALL"
 	emailCountByAcct map[string]int
 	mailbox          MailboxKind
+	folder           string // Folder name when mailbox is MailboxFolder
+	expanded         map[string]bool
+	oldestUID        map[string]uint32 // Per account, where the next page starts
+	exhausted        map[string]bool   // Per account, set when there are no older emails
+	query            string            // Search query when mailbox is MailboxSearch
+	marked           map[string]bool   // Emails marked for a bulk action, keyed by emailKey
+	notice           string            // Shown below the list until noticeUntil
+	noticeUntil      time.Time
+	undo             *UndoMoveMsg // Offered while the notice is shown
+	compact          bool         // Rows leave out the preview
 }
 
+// noticeTimeout is how long a notice, and the undo it offers, is shown.
+const noticeTimeout = 5 * time.Second
+
+// noticeExpiredMsg redraws the inbox once a notice may have expired.
+type noticeExpiredMsg struct{}
+
 func NewInbox(emails []fetcher.Email, accounts []config.Account) *Inbox {
 	return NewInboxWithMailbox(emails, accounts, MailboxInbox)
 }
@@ -134,12 +197,32 @@ func NewInboxWithMailbox(emails []fetcher.Email, accounts []config.Account, mail
 		currentAccountID: "",
 		emailCountByAcct: emailCountByAcct,
 		mailbox:          mailbox,
+		expanded:         make(map[string]bool),
+		oldestUID:        make(map[string]uint32),
+		exhausted:        make(map[string]bool),
+		marked:           make(map[string]bool),
 	}
 
 	inbox.updateList()
 	return inbox
 }
 
+// NewFolderInbox creates an inbox showing a single folder of one account.
+func NewFolderInbox(emails []fetcher.Email, account config.Account, folder string) *Inbox {
+	inbox := NewInboxWithMailbox(emails, []config.Account{account}, MailboxFolder)
+	inbox.folder = folder
+	inbox.list.Title = inbox.getTitle()
+	return inbox
+}
+
+// NewSearchInbox creates an inbox showing the results of a search query.
+func NewSearchInbox(emails []fetcher.Email, accounts []config.Account, query string) *Inbox {
+	inbox := NewInboxWithMailbox(emails, accounts, MailboxSearch)
+	inbox.query = query
+	inbox.list.Title = inbox.getTitle()
+	return inbox
+}
+
 // NewInboxSingleAccount creates an inbox for a single account (legacy support)
 func NewInboxSingleAccount(emails []fetcher.Email) *Inbox {
 	return NewInbox(emails, nil)
@@ -161,8 +244,12 @@ func (m *Inbox) updateList() {
 
 	m.emailsCount = len(displayEmails)
 
-	items := make([]list.Item, len(displayEmails))
+	indexOf := make(map[string]int, len(displayEmails))
 	for i, email := range displayEmails {
+		indexOf[emailKey(email.UID, email.AccountID)] = i
+	}
+
+	newItem := func(email fetcher.Email) item {
 		accountEmail := ""
 		if showAccountLabel {
 			// Find the account email for display
@@ -173,18 +260,48 @@ func (m *Inbox) updateList() {
 				}
 			}
 		}
-
-		items[i] = item{
+		return item{
 			title:         email.Subject,
 			desc:          email.From,
-			originalIndex: i,
+			originalIndex: indexOf[emailKey(email.UID, email.AccountID)],
 			uid:           email.UID,
 			accountID:     email.AccountID,
 			accountEmail:  accountEmail,
+			unread:        email.IsUnread(),
+			flagged:       email.HasFlag(fetcher.FlagFlagged),
+			preview:       email.Preview,
+		}
+	}
+
+	// Conversations are shown as one row for their newest email, which can
+	// be expanded to list every email.
+	var items []list.Item
+	for _, thread := range fetcher.GroupThreads(displayEmails) {
+		latest := newItem(thread.Latest())
+		if len(thread.Emails) == 1 {
+			items = append(items, latest)
+			continue
+		}
+
+		latest.threadKey = thread.Emails[0].AccountID + "\x00" + thread.ID
+		latest.threadCount = len(thread.Emails)
+		latest.expanded = m.expanded[latest.threadKey]
+		latest.unread = thread.Unread() > 0
+		for _, e := range thread.Emails {
+			latest.flagged = latest.flagged || e.HasFlag(fetcher.FlagFlagged)
+		}
+		items = append(items, latest)
+
+		if latest.expanded {
+			for _, e := range thread.Emails {
+				child := newItem(e)
+				child.inThread = true
+				items = append(items, child)
+			}
 		}
 	}
 
-	l := list.New(items, itemDelegate{}, 20, 14)
+	l := list.New(items, itemDelegate{marked: m.marked, compact: m.compact}, 20, 14)
 	l.Title = m.getTitle()
 	l.SetShowStatusBar(true)
 	l.SetFilteringEnabled(true)
@@ -196,7 +313,17 @@ func (m *Inbox) updateList() {
 		bindings := []key.Binding{
 			key.NewBinding(key.WithKeys("d"), key.WithHelp("d", "delete")),
 			key.NewBinding(key.WithKeys("a"), key.WithHelp("a", "archive")),
+			key.NewBinding(key.WithKeys("u"), key.WithHelp("u", "read/unread")),
+			key.NewBinding(key.WithKeys("f"), key.WithHelp("f", "flag")),
 			key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "refresh")),
+			key.NewBinding(key.WithKeys("s"), key.WithHelp("s", "search")),
+			key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "expand thread")),
+			key.NewBinding(key.WithKeys("m"), key.WithHelp("m", "mark")),
+			key.NewBinding(key.WithKeys("M"), key.WithHelp("M", "mark all shown")),
+			key.NewBinding(key.WithKeys("v"), key.WithHelp("v", "move")),
+		}
+		if m.canUndo() {
+			bindings = append(bindings, key.NewBinding(key.WithKeys("z"), key.WithHelp("z", "undo")))
 		}
 		if len(m.tabs) > 1 {
 			bindings = append(bindings,
@@ -233,6 +360,9 @@ func (m *Inbox) getTitle() string {
 			}
 		}
 	}
+	if n := m.markedCount(); n > 0 {
+		title += fmt.Sprintf(" (%d marked)", n)
+	}
 	if m.isRefreshing {
 		title += " (refreshing...)"
 	}
@@ -246,6 +376,12 @@ func (m *Inbox) getBaseTitle() string {
 	switch m.mailbox {
 	case MailboxSent:
 		return "Sent"
+	case MailboxFolder:
+		return m.folder
+	case MailboxFlagged:
+		return "Flagged"
+	case MailboxSearch:
+		return "Search: " + m.query
 	default:
 		return "Inbox"
 	}
@@ -270,25 +406,18 @@ func (m *Inbox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch keypress := msg.String(); keypress {
 		case "left", "h":
 			if len(m.tabs) > 1 {
-				m.activeTabIndex--
-				if m.activeTabIndex < 0 {
-					m.activeTabIndex = len(m.tabs) - 1
-				}
-				m.currentAccountID = m.tabs[m.activeTabIndex].ID
-				m.updateList()
+				m.switchTab((m.activeTabIndex + len(m.tabs) - 1) % len(m.tabs))
 				return m, nil
 			}
 		case "right", "l":
 			if len(m.tabs) > 1 {
-				m.activeTabIndex++
-				if m.activeTabIndex >= len(m.tabs) {
-					m.activeTabIndex = 0
-				}
-				m.currentAccountID = m.tabs[m.activeTabIndex].ID
-				m.updateList()
+				m.switchTab((m.activeTabIndex + 1) % len(m.tabs))
 				return m, nil
 			}
 		case "d":
+			if m.markedCount() > 0 {
+				return m, m.bulkAction(BulkDelete)
+			}
 			selectedItem, ok := m.list.SelectedItem().(item)
 			if ok {
 				return m, func() tea.Msg {
@@ -296,16 +425,89 @@ func (m *Inbox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}
 			}
 		case "a":
+			if m.markedCount() > 0 {
+				return m, m.bulkAction(BulkArchive)
+			}
 			selectedItem, ok := m.list.SelectedItem().(item)
 			if ok {
 				return m, func() tea.Msg {
 					return ArchiveEmailMsg{UID: selectedItem.uid, AccountID: selectedItem.accountID, Mailbox: m.mailbox}
 				}
 			}
+		case "u":
+			if m.markedCount() > 0 {
+				return m, m.bulkAction(BulkMarkRead)
+			}
+			selectedItem, ok := m.list.SelectedItem().(item)
+			if ok {
+				return m, func() tea.Msg {
+					return SetFlagMsg{UID: selectedItem.uid, AccountID: selectedItem.accountID, Mailbox: m.mailbox, Flag: fetcher.FlagSeen, Enable: selectedItem.unread}
+				}
+			}
+			return m, nil
+		case "f":
+			selectedItem, ok := m.list.SelectedItem().(item)
+			if ok {
+				return m, func() tea.Msg {
+					return SetFlagMsg{UID: selectedItem.uid, AccountID: selectedItem.accountID, Mailbox: m.mailbox, Flag: fetcher.FlagFlagged, Enable: !selectedItem.flagged}
+				}
+			}
+			return m, nil
 		case "r":
 			return m, func() tea.Msg {
 				return RequestRefreshMsg{Mailbox: m.mailbox}
 			}
+		case " ":
+			selectedItem, ok := m.list.SelectedItem().(item)
+			if ok && selectedItem.threadKey != "" {
+				m.expanded[selectedItem.threadKey] = !selectedItem.expanded
+				m.updateListKeepingSelection()
+			}
+			return m, nil
+		case "s":
+			return m, func() tea.Msg { return GoToSearchMsg{} }
+		case "m":
+			if selectedItem, ok := m.list.SelectedItem().(item); ok {
+				key := emailKey(selectedItem.uid, selectedItem.accountID)
+				if m.marked[key] {
+					delete(m.marked, key)
+				} else {
+					m.marked[key] = true
+				}
+				m.list.Title = m.getTitle()
+				m.list.CursorDown()
+			}
+			return m, nil
+		case "M":
+			// Marks what is shown, so a filter marks its matches. If all of
+			// it is marked already, it is unmarked instead.
+			var keys []string
+			allMarked := true
+			for _, listItem := range m.list.VisibleItems() {
+				if it, ok := listItem.(item); ok {
+					key := emailKey(it.uid, it.accountID)
+					keys = append(keys, key)
+					allMarked = allMarked && m.marked[key]
+				}
+			}
+			for _, key := range keys {
+				if allMarked {
+					delete(m.marked, key)
+				} else {
+					m.marked[key] = true
+				}
+			}
+			m.list.Title = m.getTitle()
+			return m, nil
+		case "v":
+			return m, m.bulkAction(BulkMove)
+		case "z":
+			if m.canUndo() {
+				undo := *m.undo
+				m.undo = nil
+				return m, func() tea.Msg { return undo }
+			}
+			return m, nil
 		case "enter":
 			selectedItem, ok := m.list.SelectedItem().(item)
 			if ok {
@@ -323,6 +525,13 @@ func (m *Inbox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.list.SetWidth(msg.Width)
 		return m, nil
 
+	case noticeExpiredMsg:
+		if !time.Now().Before(m.noticeUntil) {
+			m.notice = ""
+			m.undo = nil
+		}
+		return m, nil
+
 	case FetchingMoreEmailsMsg:
 		m.isFetching = true
 		m.list.Title = m.getTitle()
@@ -335,8 +544,17 @@ func (m *Inbox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.isFetching = false
 		m.list.Title = m.getTitle()
 
+		if msg.OldestUID == 0 {
+			m.exhausted[msg.AccountID] = true
+		} else {
+			m.oldestUID[msg.AccountID] = msg.OldestUID
+		}
+
 		// Add emails to the appropriate account
 		for _, email := range msg.Emails {
+			if m.hasEmail(email.UID, email.AccountID) {
+				continue
+			}
 			m.emailsByAccount[email.AccountID] = append(m.emailsByAccount[email.AccountID], email)
 			m.allEmails = append(m.allEmails, email)
 		}
@@ -358,9 +576,11 @@ func (m *Inbox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 		m.isRefreshing = false
+		m.isFetching = false
 
 		// Replace emails with fresh data
 		m.emailsByAccount = msg.EmailsByAccount
+		m.resetPaging()
 
 		// Flatten all emails
 		var allEmails []fetcher.Email
@@ -400,7 +620,8 @@ func (m *Inbox) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m *Inbox) shouldFetchMore() bool {
-	if m.isFetching {
+	// The flagged and search views always hold every match.
+	if m.isFetching || m.mailbox == MailboxFlagged || m.mailbox == MailboxSearch {
 		return false
 	}
 	if len(m.list.Items()) == 0 {
@@ -413,32 +634,49 @@ func (m *Inbox) shouldFetchMore() bool {
 }
 
 func (m *Inbox) fetchMoreCmds() []tea.Cmd {
-	var cmds []tea.Cmd
+	accountIDs := []string{m.currentAccountID}
 	if m.currentAccountID == "" {
-		if len(m.accounts) == 0 {
-			return nil
-		}
+		accountIDs = nil
 		for _, acc := range m.accounts {
-			accountID := acc.ID
-			offset := uint32(len(m.emailsByAccount[accountID]))
-			cmds = append(cmds, func(id string, off uint32) tea.Cmd {
-				return func() tea.Msg {
-					return FetchMoreEmailsMsg{Offset: off, AccountID: id, Mailbox: m.mailbox}
-				}
-			}(accountID, offset))
+			accountIDs = append(accountIDs, acc.ID)
 		}
-		return cmds
 	}
 
-	offset := uint32(len(m.emailsByAccount[m.currentAccountID]))
-	cmds = append(cmds, func(id string, off uint32) tea.Cmd {
-		return func() tea.Msg {
-			return FetchMoreEmailsMsg{Offset: off, AccountID: id, Mailbox: m.mailbox}
+	var cmds []tea.Cmd
+	for _, accountID := range accountIDs {
+		beforeUID, uidValidity := m.pageAnchor(accountID)
+		if beforeUID == 0 || m.exhausted[accountID] {
+			continue
 		}
-	}(m.currentAccountID, offset))
+		msg := FetchMoreEmailsMsg{BeforeUID: beforeUID, UIDValidity: uidValidity, AccountID: accountID, Mailbox: m.mailbox}
+		cmds = append(cmds, func() tea.Msg { return msg })
+	}
 	return cmds
 }
 
+// pageAnchor returns the UID the next page of an account starts below and
+// the UIDVALIDITY of the loaded emails. Emails pushed by the server are
+// newer, so the oldest UID seen always marks the end of the loaded pages.
+func (m *Inbox) pageAnchor(accountID string) (beforeUID, uidValidity uint32) {
+	beforeUID = m.oldestUID[accountID]
+	for _, e := range m.emailsByAccount[accountID] {
+		if beforeUID == 0 || e.UID < beforeUID {
+			beforeUID = e.UID
+		}
+		if uidValidity == 0 {
+			uidValidity = e.UIDValidity
+		}
+	}
+	return beforeUID, uidValidity
+}
+
+// resetPaging forgets where the loaded pages end, after the emails were
+// replaced with a fresh first page.
+func (m *Inbox) resetPaging() {
+	m.oldestUID = make(map[string]uint32)
+	m.exhausted = make(map[string]bool)
+}
+
 func (m *Inbox) View() string {
 	var b strings.Builder
 
@@ -463,9 +701,79 @@ func (m *Inbox) View() string {
 	}
 
 	b.WriteString(m.list.View())
+	if m.notice != "" && time.Now().Before(m.noticeUntil) {
+		b.WriteString("\n")
+		b.WriteString(noticeStyle.Render(m.notice))
+	}
 	return b.String()
 }
 
+// ShowNotice shows a message below the list for a few seconds.
+func (m *Inbox) ShowNotice(notice string) tea.Cmd {
+	m.notice = notice
+	m.noticeUntil = time.Now().Add(noticeTimeout)
+	m.undo = nil
+	return tea.Tick(noticeTimeout, func(time.Time) tea.Msg { return noticeExpiredMsg{} })
+}
+
+// ShowUndo offers to undo a delete or archive for a few seconds.
+func (m *Inbox) ShowUndo(undo UndoMoveMsg) tea.Cmd {
+	cmd := m.ShowNotice(fmt.Sprintf("Moved to %s · z: undo", undo.From))
+	m.undo = &undo
+	return cmd
+}
+
+// canUndo reports whether an undo is on offer.
+func (m *Inbox) canUndo() bool {
+	return m.undo != nil && time.Now().Before(m.noticeUntil)
+}
+
+// switchTab shows the tab at index. Marks are cleared, so that a bulk
+// action never reaches emails out of sight in another tab.
+func (m *Inbox) switchTab(index int) {
+	m.activeTabIndex = index
+	m.currentAccountID = m.tabs[index].ID
+	clear(m.marked)
+	m.updateList()
+}
+
+// markedCount returns the number of loaded emails that are marked.
+func (m *Inbox) markedCount() int {
+	n := 0
+	for _, e := range m.allEmails {
+		if m.marked[emailKey(e.UID, e.AccountID)] {
+			n++
+		}
+	}
+	return n
+}
+
+// bulkAction applies action to the marked emails, or to the selected email
+// if none are marked.
+func (m *Inbox) bulkAction(action BulkAction) tea.Cmd {
+	uids := make(map[string][]uint32)
+	for _, e := range m.allEmails {
+		if m.marked[emailKey(e.UID, e.AccountID)] {
+			uids[e.AccountID] = append(uids[e.AccountID], e.UID)
+		}
+	}
+	if len(uids) == 0 {
+		selectedItem, ok := m.list.SelectedItem().(item)
+		if !ok {
+			return nil
+		}
+		uids[selectedItem.accountID] = []uint32{selectedItem.uid}
+	}
+	msg := BulkActionMsg{Action: action, UIDsByAccount: uids, Mailbox: m.mailbox}
+	return func() tea.Msg { return msg }
+}
+
+// ClearMarks unmarks all emails.
+func (m *Inbox) ClearMarks() {
+	clear(m.marked)
+	m.list.Title = m.getTitle()
+}
+
 // GetCurrentAccountID returns the currently selected account ID
 func (m *Inbox) GetCurrentAccountID() string {
 	return m.currentAccountID
@@ -490,6 +798,11 @@ func (m *Inbox) GetMailbox() MailboxKind {
 	return m.mailbox
 }
 
+// GetFolder returns the folder name of a folder inbox.
+func (m *Inbox) GetFolder() string {
+	return m.folder
+}
+
 // RemoveEmail removes an email by UID and account ID
 func (m *Inbox) RemoveEmail(uid uint32, accountID string) {
 	// Remove from account-specific list
@@ -515,6 +828,109 @@ func (m *Inbox) RemoveEmail(uid uint32, accountID string) {
 	m.updateList()
 }
 
+// AddEmails merges newly arrived emails into the inbox, keeping the current
+// selection. Emails that are already listed are ignored.
+func (m *Inbox) AddEmails(emails []fetcher.Email) {
+	added := false
+	for _, email := range emails {
+		if m.hasEmail(email.UID, email.AccountID) {
+			continue
+		}
+		m.emailsByAccount[email.AccountID] = append([]fetcher.Email{email}, m.emailsByAccount[email.AccountID]...)
+		m.allEmails = append(m.allEmails, email)
+		m.emailCountByAcct[email.AccountID] = len(m.emailsByAccount[email.AccountID])
+		added = true
+	}
+	if !added {
+		return
+	}
+
+	// Sort by date (newest first)
+	sort.SliceStable(m.allEmails, func(i, j int) bool {
+		return m.allEmails[i].Date.After(m.allEmails[j].Date)
+	})
+	m.updateListKeepingSelection()
+}
+
+// RemoveEmails removes emails of one account by UID, keeping the current
+// selection when it is not among them.
+func (m *Inbox) RemoveEmails(uids []uint32, accountID string) {
+	removed := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		removed[uid] = true
+	}
+
+	var filtered []fetcher.Email
+	for _, e := range m.emailsByAccount[accountID] {
+		if !removed[e.UID] {
+			filtered = append(filtered, e)
+		}
+	}
+	m.emailsByAccount[accountID] = filtered
+	m.emailCountByAcct[accountID] = len(filtered)
+
+	var filteredAll []fetcher.Email
+	for _, e := range m.allEmails {
+		if !(e.AccountID == accountID && removed[e.UID]) {
+			filteredAll = append(filteredAll, e)
+		}
+	}
+	m.allEmails = filteredAll
+
+	m.updateListKeepingSelection()
+}
+
+// SetEmailFlag sets or clears a flag on an email in the list.
+func (m *Inbox) SetEmailFlag(uid uint32, accountID string, flag string, enable bool) {
+	for i := range m.emailsByAccount[accountID] {
+		if m.emailsByAccount[accountID][i].UID == uid {
+			m.emailsByAccount[accountID][i].SetFlag(flag, enable)
+		}
+	}
+	for i := range m.allEmails {
+		if m.allEmails[i].UID == uid && m.allEmails[i].AccountID == accountID {
+			m.allEmails[i].SetFlag(flag, enable)
+		}
+	}
+	m.updateListKeepingSelection()
+}
+
+func emailKey(uid uint32, accountID string) string {
+	return fmt.Sprintf("%s:%d", accountID, uid)
+}
+
+func (m *Inbox) hasEmail(uid uint32, accountID string) bool {
+	for _, e := range m.emailsByAccount[accountID] {
+		if e.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// updateListKeepingSelection rebuilds the list and re-selects the email that
+// was selected before, so background updates don't move the cursor.
+func (m *Inbox) updateListKeepingSelection() {
+	selected, ok := m.list.SelectedItem().(item)
+	m.updateList()
+	if !ok {
+		return
+	}
+	for i, listItem := range m.list.Items() {
+		if it, ok := listItem.(item); ok && it.uid == selected.uid && it.accountID == selected.accountID {
+			m.list.Select(i)
+			return
+		}
+	}
+}
+
+// SetCompact sets whether rows are a single line, leaving out the preview
+// of each email so that more fit on the screen.
+func (m *Inbox) SetCompact(compact bool) {
+	m.compact = compact
+	m.list.SetDelegate(itemDelegate{marked: m.marked, compact: compact})
+}
+
 // SetEmails updates all emails (used after fetch)
 func (m *Inbox) SetEmails(emails []fetcher.Email, accounts []config.Account) {
 	m.accounts = accounts
@@ -529,6 +945,7 @@ func (m *Inbox) SetEmails(emails []fetcher.Email, accounts []config.Account) {
 	m.tabs = tabs
 
 	// Re-group emails by account
+	m.resetPaging()
 	m.emailsByAccount = make(map[string][]fetcher.Email)
 	for _, email := range emails {
 		m.emailsByAccount[email.AccountID] = append(m.emailsByAccount[email.AccountID], email)
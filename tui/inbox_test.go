@@ -211,6 +211,158 @@ func TestInboxArchiveEmailMsg(t *testing.T) {
 	}
 }
 
+func TestInboxUndo(t *testing.T) {
+	accounts := []config.Account{{ID: "account-1", Email: "test@example.com"}}
+	inbox := NewInbox(nil, accounts)
+	z := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'z'}}
+
+	if _, cmd := inbox.Update(z); len(collectMsgs(cmd)) != 0 {
+		t.Fatal("expected nothing to undo")
+	}
+
+	undo := UndoMoveMsg{MessageID: "<a@x>", AccountID: "account-1", Mailbox: MailboxInbox, From: "Trash", To: "INBOX"}
+	if cmd := inbox.ShowUndo(undo); cmd == nil {
+		t.Fatal("expected a command expiring the undo")
+	}
+	if !strings.Contains(inbox.View(), "Moved to Trash") {
+		t.Errorf("expected the undo offer in the view, got %q", inbox.View())
+	}
+
+	_, cmd := inbox.Update(z)
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 || msgs[0] != undo {
+		t.Fatalf("expected the undo message, got %v", msgs)
+	}
+	if _, cmd := inbox.Update(z); len(collectMsgs(cmd)) != 0 {
+		t.Error("expected a move to be undone only once")
+	}
+
+	inbox.ShowUndo(undo)
+	inbox.noticeUntil = time.Now().Add(-time.Second)
+	inbox.Update(noticeExpiredMsg{})
+	if strings.Contains(inbox.View(), "Moved to Trash") {
+		t.Error("expected the undo offer to expire")
+	}
+}
+
+func TestInboxBulkActions(t *testing.T) {
+	accounts := []config.Account{
+		{ID: "account-1", Email: "test1@example.com"},
+		{ID: "account-2", Email: "test2@example.com"},
+	}
+	emails := []fetcher.Email{
+		{UID: 1, From: "a@example.com", Subject: "Email 1", Date: time.Now(), AccountID: "account-1"},
+		{UID: 2, From: "b@example.com", Subject: "Email 2", Date: time.Now().Add(-time.Hour), AccountID: "account-1"},
+		{UID: 3, From: "c@example.com", Subject: "Email 3", Date: time.Now().Add(-2 * time.Hour), AccountID: "account-2"},
+	}
+	inbox := NewInbox(emails, accounts)
+	key := func(r rune) tea.KeyMsg { return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}} }
+
+	// Mark the first email, which moves the cursor to the second, then skip it.
+	inbox.Update(key('m'))
+	inbox.list.CursorDown()
+	inbox.Update(key('m'))
+	if !strings.Contains(inbox.list.Title, "(2 marked)") {
+		t.Errorf("expected the marked count in the title, got %q", inbox.list.Title)
+	}
+
+	_, cmd := inbox.Update(key('d'))
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %v", msgs)
+	}
+	bulk, ok := msgs[0].(BulkActionMsg)
+	if !ok || bulk.Action != BulkDelete || bulk.Count() != 2 {
+		t.Fatalf("expected a bulk delete of 2 emails, got %#v", msgs[0])
+	}
+	if uids := bulk.UIDsByAccount["account-1"]; len(uids) != 1 || uids[0] != 1 {
+		t.Errorf("expected UID 1 of account-1, got %v", bulk.UIDsByAccount)
+	}
+	if uids := bulk.UIDsByAccount["account-2"]; len(uids) != 1 || uids[0] != 3 {
+		t.Errorf("expected UID 3 of account-2, got %v", bulk.UIDsByAccount)
+	}
+
+	// M marks everything shown, and unmarks it when it all is marked.
+	inbox.Update(key('M'))
+	if n := inbox.markedCount(); n != 3 {
+		t.Fatalf("expected all 3 emails to be marked, got %d", n)
+	}
+	inbox.Update(key('M'))
+	if n := inbox.markedCount(); n != 0 {
+		t.Fatalf("expected all emails to be unmarked, got %d", n)
+	}
+
+	// Without marks, a move applies to the selected email.
+	_, cmd = inbox.Update(key('v'))
+	msgs = collectMsgs(cmd)
+	if bulk, ok := msgs[0].(BulkActionMsg); !ok || bulk.Action != BulkMove || bulk.Count() != 1 || bulk.Dest != "" {
+		t.Fatalf("expected a move of the selected email, got %#v", msgs[0])
+	}
+
+	inbox.Update(key('M'))
+	inbox.ClearMarks()
+	if inbox.markedCount() != 0 || strings.Contains(inbox.list.Title, "marked") {
+		t.Errorf("expected the marks to be cleared, got %q", inbox.list.Title)
+	}
+	inbox.ShowNotice("Deleted 3 emails")
+	if !strings.Contains(inbox.View(), "Deleted 3 emails") {
+		t.Error("expected the notice in the view")
+	}
+}
+
+func TestInboxTabSwitchClearsMarks(t *testing.T) {
+	accounts := []config.Account{
+		{ID: "account-1", Email: "test1@example.com"},
+		{ID: "account-2", Email: "test2@example.com"},
+	}
+	emails := []fetcher.Email{
+		{UID: 1, From: "a@example.com", Subject: "Email 1", Date: time.Now(), AccountID: "account-1"},
+		{UID: 2, From: "b@example.com", Subject: "Email 2", Date: time.Now().Add(-time.Hour), AccountID: "account-2"},
+	}
+	inbox := NewInbox(emails, accounts)
+
+	// Mark every email of the ALL tab, then go to account-2's tab.
+	inbox.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'M'}})
+	inbox.Update(tea.KeyMsg{Type: tea.KeyLeft})
+	if inbox.GetCurrentAccountID() != "account-2" {
+		t.Fatalf("expected account-2's tab, got %q", inbox.GetCurrentAccountID())
+	}
+	if n := inbox.markedCount(); n != 0 {
+		t.Fatalf("expected the marks of the other tab to be cleared, got %d", n)
+	}
+
+	// A delete now applies to the selected email only.
+	_, cmd := inbox.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'d'}})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %v", msgs)
+	}
+	if del, ok := msgs[0].(DeleteEmailMsg); !ok || del.UID != 2 || del.AccountID != "account-2" {
+		t.Errorf("expected the selected email of account-2 to be deleted, got %#v", msgs[0])
+	}
+}
+
+func TestMovePrompt(t *testing.T) {
+	action := BulkActionMsg{Action: BulkMove, UIDsByAccount: map[string][]uint32{"account-1": {1, 2}}, Mailbox: MailboxFolder}
+	m := NewMovePrompt(action)
+	if !strings.Contains(m.View(), "Move 2 emails") || m.Mailbox() != MailboxFolder {
+		t.Errorf("unexpected prompt %q for %q", m.View(), m.Mailbox())
+	}
+
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter}); len(collectMsgs(cmd)) != 0 {
+		t.Fatal("expected no move without a folder")
+	}
+	m.input.SetValue(" Archive/2024 ")
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %v", msgs)
+	}
+	if move, ok := msgs[0].(BulkActionMsg); !ok || move.Dest != "Archive/2024" || move.Count() != 2 {
+		t.Errorf("expected the move to Archive/2024, got %#v", msgs[0])
+	}
+}
+
 // TestInboxRemoveEmail verifies that emails can be removed from the inbox.
 func TestInboxRemoveEmail(t *testing.T) {
 	accounts := []config.Account{
@@ -237,6 +389,51 @@ func TestInboxRemoveEmail(t *testing.T) {
 	}
 }
 
+// TestInboxAddAndRemoveEmailsKeepSelection verifies that pushed updates
+// merge into the list without moving the cursor.
+func TestInboxAddAndRemoveEmailsKeepSelection(t *testing.T) {
+	accounts := []config.Account{
+		{ID: "account-1", Email: "test@example.com"},
+	}
+	now := time.Now()
+
+	emails := []fetcher.Email{
+		{UID: 3, Subject: "Email 3", AccountID: "account-1", Date: now.Add(-1 * time.Hour)},
+		{UID: 2, Subject: "Email 2", AccountID: "account-1", Date: now.Add(-2 * time.Hour)},
+		{UID: 1, Subject: "Email 1", AccountID: "account-1", Date: now.Add(-3 * time.Hour)},
+	}
+
+	inbox := NewInbox(emails, accounts)
+	inbox.list.Select(1) // Email 2
+
+	inbox.AddEmails([]fetcher.Email{
+		{UID: 4, Subject: "Email 4", AccountID: "account-1", Date: now},
+		{UID: 3, Subject: "Email 3", AccountID: "account-1", Date: now.Add(-1 * time.Hour)},
+	})
+
+	if len(inbox.allEmails) != 4 {
+		t.Fatalf("Expected 4 emails after adding, got %d", len(inbox.allEmails))
+	}
+	if inbox.allEmails[0].UID != 4 {
+		t.Errorf("Expected the new email first, got UID %d", inbox.allEmails[0].UID)
+	}
+	if selected := inbox.list.SelectedItem().(item); selected.uid != 2 {
+		t.Errorf("Expected Email 2 to stay selected, got UID %d", selected.uid)
+	}
+
+	inbox.RemoveEmails([]uint32{4, 1}, "account-1")
+
+	if len(inbox.allEmails) != 2 {
+		t.Fatalf("Expected 2 emails after removal, got %d", len(inbox.allEmails))
+	}
+	if len(inbox.emailsByAccount["account-1"]) != 2 {
+		t.Errorf("Expected 2 emails for account-1, got %d", len(inbox.emailsByAccount["account-1"]))
+	}
+	if selected := inbox.list.SelectedItem().(item); selected.uid != 2 {
+		t.Errorf("Expected Email 2 to stay selected, got UID %d", selected.uid)
+	}
+}
+
 // TestInboxGetEmailAtIndex verifies retrieving emails by index.
 func TestInboxGetEmailAtIndex(t *testing.T) {
 	accounts := []config.Account{
@@ -307,6 +504,92 @@ func TestSentInboxTitleShowsCount(t *testing.T) {
 	}
 }
 
+func TestFolderInboxTitleAndMailbox(t *testing.T) {
+	account := config.Account{ID: "account-1", Email: "test@example.com"}
+
+	emails := []fetcher.Email{
+		{UID: 7, From: "sender@example.com", Subject: "Report", AccountID: "account-1", Date: time.Now(), Mailbox: "Work/Reports"},
+	}
+
+	inbox := NewFolderInbox(emails, account, "Work/Reports")
+
+	if !strings.Contains(inbox.list.Title, "Work/Reports (1)") {
+		t.Fatalf("expected folder title to contain name and count, got %q", inbox.list.Title)
+	}
+
+	_, cmd := inbox.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'d'}})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	del, ok := msgs[0].(DeleteEmailMsg)
+	if !ok || del.Mailbox != MailboxFolder || del.UID != 7 {
+		t.Errorf("expected DeleteEmailMsg for UID 7 in the folder, got %#v", msgs[0])
+	}
+}
+
+func TestInboxToggleRead(t *testing.T) {
+	accounts := []config.Account{
+		{ID: "account-1", Email: "test@example.com"},
+	}
+
+	emails := []fetcher.Email{
+		{UID: 1, Subject: "Unread", AccountID: "account-1"},
+		{UID: 2, Subject: "Read", AccountID: "account-1", Flags: []string{fetcher.FlagSeen}},
+	}
+
+	inbox := NewInbox(emails, accounts)
+	if !inbox.list.Items()[0].(item).unread || inbox.list.Items()[1].(item).unread {
+		t.Fatal("expected only the first email to render as unread")
+	}
+
+	_, cmd := inbox.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'u'}})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	setFlag, ok := msgs[0].(SetFlagMsg)
+	if !ok || setFlag.UID != 1 || setFlag.Flag != fetcher.FlagSeen || !setFlag.Enable {
+		t.Fatalf("expected SetFlagMsg marking UID 1 read, got %#v", msgs[0])
+	}
+
+	inbox.SetEmailFlag(1, "account-1", fetcher.FlagSeen, true)
+	if inbox.list.Items()[0].(item).unread {
+		t.Error("expected the first email to render as read after SetEmailFlag")
+	}
+}
+
+func TestInboxToggleFlag(t *testing.T) {
+	accounts := []config.Account{
+		{ID: "account-1", Email: "test@example.com"},
+	}
+
+	emails := []fetcher.Email{
+		{UID: 1, Subject: "Follow up", AccountID: "account-1", Flags: []string{fetcher.FlagFlagged}},
+	}
+
+	inbox := NewInboxWithMailbox(emails, accounts, MailboxFlagged)
+	if !strings.Contains(inbox.list.Title, "Flagged (1)") {
+		t.Fatalf("expected flagged title, got %q", inbox.list.Title)
+	}
+	if !inbox.list.Items()[0].(item).flagged {
+		t.Fatal("expected the email to render as flagged")
+	}
+
+	_, cmd := inbox.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'f'}})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	setFlag, ok := msgs[0].(SetFlagMsg)
+	if !ok || setFlag.Flag != fetcher.FlagFlagged || setFlag.Enable || setFlag.Mailbox != MailboxFlagged {
+		t.Fatalf("expected SetFlagMsg clearing the flag, got %#v", msgs[0])
+	}
+	if inbox.shouldFetchMore() {
+		t.Error("the flagged view should never fetch more emails")
+	}
+}
+
 func TestFetchMoreTriggeredAtListEnd(t *testing.T) {
 	accounts := []config.Account{
 		{ID: "account-1", Email: "test@example.com"},
@@ -334,8 +617,9 @@ func TestFetchMoreTriggeredAtListEnd(t *testing.T) {
 		t.Fatal("expected a FetchMoreEmailsMsg when reaching end of the list")
 	}
 
-	if fetchMsg.Offset != uint32(len(emails)) {
-		t.Fatalf("expected offset %d, got %d", len(emails), fetchMsg.Offset)
+	// The next page continues below the oldest loaded UID.
+	if fetchMsg.BeforeUID != 1 {
+		t.Fatalf("expected to fetch emails before UID 1, got %d", fetchMsg.BeforeUID)
 	}
 	if fetchMsg.AccountID != "account-1" {
 		t.Fatalf("expected account ID 'account-1', got %q", fetchMsg.AccountID)
@@ -344,3 +628,103 @@ func TestFetchMoreTriggeredAtListEnd(t *testing.T) {
 		t.Fatalf("expected MailboxInbox, got %s", fetchMsg.Mailbox)
 	}
 }
+
+func TestInboxThreadRows(t *testing.T) {
+	accounts := []config.Account{{ID: "account-1", Email: "test@example.com"}}
+	now := time.Now()
+	emails := []fetcher.Email{
+		{UID: 3, From: "b@example.com", Subject: "Re: Plan", MessageID: "<c@x>", References: []string{"<a@x>"}, AccountID: "account-1", Date: now},
+		{UID: 2, From: "c@example.com", Subject: "Other", MessageID: "<b@x>", AccountID: "account-1", Date: now.Add(-time.Hour)},
+		{UID: 1, From: "a@example.com", Subject: "Plan", MessageID: "<a@x>", AccountID: "account-1", Date: now.Add(-2 * time.Hour)},
+	}
+
+	inbox := NewInbox(emails, accounts)
+
+	items := inbox.list.Items()
+	if len(items) != 2 {
+		t.Fatalf("expected a thread row and a single email, got %d rows", len(items))
+	}
+	thread := items[0].(item)
+	if thread.uid != 3 || thread.threadCount != 2 || thread.expanded {
+		t.Fatalf("expected a collapsed thread of 2 showing UID 3, got %+v", thread)
+	}
+
+	// Expand the thread.
+	inbox.Update(tea.KeyMsg{Type: tea.KeySpace, Runes: []rune{' '}})
+	items = inbox.list.Items()
+	if len(items) != 4 {
+		t.Fatalf("expected the thread row, its 2 emails and the single email, got %d rows", len(items))
+	}
+	if first, second := items[1].(item), items[2].(item); !first.inThread || first.uid != 1 || second.uid != 3 {
+		t.Errorf("expected the thread's emails oldest first under the thread row, got %+v and %+v", first, second)
+	}
+
+	// Opening an email inside the thread opens that email.
+	inbox.list.Select(1)
+	_, cmd := inbox.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	if view, ok := msgs[0].(ViewEmailMsg); !ok || view.UID != 1 || view.Index != 2 {
+		t.Errorf("expected ViewEmailMsg for UID 1 at index 2, got %#v", msgs[0])
+	}
+
+	// Collapse it again.
+	inbox.list.Select(0)
+	inbox.Update(tea.KeyMsg{Type: tea.KeySpace, Runes: []rune{' '}})
+	if len(inbox.list.Items()) != 2 {
+		t.Errorf("expected the thread to collapse, got %d rows", len(inbox.list.Items()))
+	}
+}
+
+func TestInboxStopsPagingWhenExhausted(t *testing.T) {
+	accounts := []config.Account{{ID: "account-1", Email: "test@example.com"}}
+	emails := []fetcher.Email{
+		{UID: 40, Subject: "Email 40", AccountID: "account-1", UIDValidity: 7, Date: time.Now()},
+		{UID: 30, Subject: "Email 30", AccountID: "account-1", UIDValidity: 7, Date: time.Now().Add(-time.Minute)},
+	}
+	inbox := NewInbox(emails, accounts)
+
+	// A page whose emails were all filtered out still moves the anchor.
+	inbox.Update(EmailsAppendedMsg{AccountID: "account-1", Mailbox: MailboxInbox, OldestUID: 12})
+	cmds := inbox.fetchMoreCmds()
+	if len(cmds) != 1 {
+		t.Fatalf("expected one fetch command, got %d", len(cmds))
+	}
+	msg := cmds[0]().(FetchMoreEmailsMsg)
+	if msg.BeforeUID != 12 || msg.UIDValidity != 7 {
+		t.Fatalf("expected to fetch before UID 12 with UIDVALIDITY 7, got %+v", msg)
+	}
+
+	inbox.Update(EmailsAppendedMsg{AccountID: "account-1", Mailbox: MailboxInbox})
+	if cmds := inbox.fetchMoreCmds(); len(cmds) != 0 {
+		t.Fatalf("expected no more fetches once there are no older emails, got %d", len(cmds))
+	}
+}
+
+func TestInboxRowsShowPreviews(t *testing.T) {
+	accounts := []config.Account{{ID: "account-1", Email: "test@example.com"}}
+	emails := []fetcher.Email{
+		{UID: 1, From: "a@example.com", Subject: "Lunch", Preview: "Shall we meet at noon?", AccountID: "account-1", Date: time.Now()},
+	}
+
+	inbox := NewInbox(emails, accounts)
+	inbox.Update(tea.WindowSizeMsg{Width: 80, Height: 24})
+	view := inbox.View()
+	if !strings.Contains(view, "Lunch") || !strings.Contains(view, "Shall we meet at noon?") {
+		t.Errorf("expected the row to show the subject and the preview, got %q", view)
+	}
+
+	inbox.SetCompact(true)
+	view = inbox.View()
+	if !strings.Contains(view, "Lunch") || strings.Contains(view, "Shall we meet") {
+		t.Errorf("expected a compact row without the preview, got %q", view)
+	}
+
+	// The setting outlives the list being rebuilt.
+	inbox.SetEmails(emails, accounts)
+	if strings.Contains(inbox.View(), "Shall we meet") {
+		t.Error("expected rows to stay compact after the emails are set again")
+	}
+}
@@ -2,10 +2,12 @@ package tui
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/floatpane/matcha/config"
 )
 
 // Login holds the state for the login/add account form.
@@ -13,6 +15,8 @@ type Login struct {
 	focusIndex int
 	inputs     []textinput.Model
 	showCustom bool // Show custom server fields
+	showJMAP   bool // Show the JMAP session URL instead
+	showPOP3   bool // Show the POP3 and SMTP server fields
 	isEditMode bool // Whether we're editing an existing account
 	accountID  string
 	width      int
@@ -23,12 +27,22 @@ const (
 	inputProvider = iota
 	inputName
 	inputEmail
-	inputFetchEmail
+	inputAddresses
+	inputAuth
 	inputPassword
+	inputClientID
+	inputClientSecret
 	inputIMAPServer
 	inputIMAPPort
+	inputIMAPSecurity
 	inputSMTPServer
 	inputSMTPPort
+	inputSMTPSecurity
+	inputJMAPURL
+	inputPOP3Server
+	inputPOP3Port
+	inputPOP3Security
+	inputPOP3Delete
 	inputCount
 )
 
@@ -46,7 +60,7 @@ func NewLogin() *Login {
 
 		switch i {
 		case inputProvider:
-			t.Placeholder = "Provider (gmail, icloud, or custom)"
+			t.Placeholder = "Provider (gmail, icloud, custom, jmap, or pop3)"
 			t.Focus()
 			t.Prompt = "☁️ > "
 		case inputName:
@@ -55,25 +69,58 @@ func NewLogin() *Login {
 		case inputEmail:
 			t.Placeholder = "Username"
 			t.Prompt = "🏠 > "
-		case inputFetchEmail:
-			t.Placeholder = "Email Address"
+		case inputAddresses:
+			t.Placeholder = "Email Addresses (comma-separated, *@domain for a catch-all, * for all mail)"
+			t.CharLimit = 256
 			t.Prompt = "✉️ > "
+		case inputAuth:
+			t.Placeholder = "Sign-in (password, oauth2 through the browser, or token for jmap)"
+			t.Prompt = "🪪 > "
 		case inputPassword:
 			t.Placeholder = "Password / App Password"
 			t.EchoMode = textinput.EchoPassword
 			t.Prompt = "🔑 > "
+		case inputClientID:
+			t.Placeholder = "OAuth2 Client ID"
+			t.Prompt = "🆔 > "
+		case inputClientSecret:
+			t.Placeholder = "OAuth2 Client Secret (if the client has one)"
+			t.EchoMode = textinput.EchoPassword
+			t.Prompt = "🔑 > "
 		case inputIMAPServer:
 			t.Placeholder = "IMAP Server (e.g., imap.example.com)"
 			t.Prompt = "📥 > "
 		case inputIMAPPort:
-			t.Placeholder = "IMAP Port (default: 993)"
+			t.Placeholder = "IMAP Port (default: 993, or 143 without TLS)"
 			t.Prompt = "🔢 > "
+		case inputIMAPSecurity:
+			t.Placeholder = "IMAP Security (tls, starttls, or none for localhost)"
+			t.Prompt = "🔒 > "
 		case inputSMTPServer:
 			t.Placeholder = "SMTP Server (e.g., smtp.example.com)"
 			t.Prompt = "📤 > "
 		case inputSMTPPort:
-			t.Placeholder = "SMTP Port (default: 587)"
+			t.Placeholder = "SMTP Port (default: 587, or 465 with tls)"
 			t.Prompt = "🔢 > "
+		case inputSMTPSecurity:
+			t.Placeholder = "SMTP Security (tls, starttls, or none for localhost)"
+			t.Prompt = "🔒 > "
+		case inputJMAPURL:
+			t.Placeholder = "JMAP Session URL (e.g., https://api.fastmail.com/jmap/session)"
+			t.CharLimit = 256
+			t.Prompt = "🌐 > "
+		case inputPOP3Server:
+			t.Placeholder = "POP3 Server (e.g., pop.example.com)"
+			t.Prompt = "📥 > "
+		case inputPOP3Port:
+			t.Placeholder = "POP3 Port (default: 995, or 110 without TLS)"
+			t.Prompt = "🔢 > "
+		case inputPOP3Security:
+			t.Placeholder = "POP3 Security (tls, starttls, or none for localhost)"
+			t.Prompt = "🔒 > "
+		case inputPOP3Delete:
+			t.Placeholder = "Delete from the server once downloaded? (yes or no)"
+			t.Prompt = "🗑️ > "
 		}
 		m.inputs[i] = t
 	}
@@ -102,82 +149,37 @@ func (m *Login) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, func() tea.Msg { return GoToChoiceMenuMsg{} }
 
 		case tea.KeyEnter:
-			// Check if provider is "custom" to show/hide custom fields
-			provider := m.inputs[inputProvider].Value()
-			if provider == "custom" {
-				m.showCustom = true
-			} else {
-				m.showCustom = false
-			}
-
-			lastFieldIndex := inputPassword
-			if m.showCustom {
-				lastFieldIndex = inputSMTPPort
-			}
-
-			if m.focusIndex == lastFieldIndex {
-				// Submit the form
-				imapPort := 993
-				smtpPort := 587
-				if m.inputs[inputIMAPPort].Value() != "" {
-					if p, err := strconv.Atoi(m.inputs[inputIMAPPort].Value()); err == nil {
-						imapPort = p
-					}
-				}
-				if m.inputs[inputSMTPPort].Value() != "" {
-					if p, err := strconv.Atoi(m.inputs[inputSMTPPort].Value()); err == nil {
-						smtpPort = p
-					}
-				}
-
-				return m, func() tea.Msg {
-					return Credentials{
-						Provider:   m.inputs[inputProvider].Value(),
-						Name:       m.inputs[inputName].Value(),
-						Host:       m.inputs[inputEmail].Value(),
-						FetchEmail: m.inputs[inputFetchEmail].Value(),
-						Password:   m.inputs[inputPassword].Value(),
-						IMAPServer: m.inputs[inputIMAPServer].Value(),
-						IMAPPort:   imapPort,
-						SMTPServer: m.inputs[inputSMTPServer].Value(),
-						SMTPPort:   smtpPort,
-					}
-				}
+			m.setProviderFields()
+			fields := m.visibleInputs()
+			if m.focusIndex == fields[len(fields)-1] {
+				return m, m.submit()
 			}
 			fallthrough
 
 		case tea.KeyTab, tea.KeyShiftTab, tea.KeyUp, tea.KeyDown:
 			s := msg.String()
-
-			// Check provider to update showCustom
-			provider := m.inputs[inputProvider].Value()
-			m.showCustom = provider == "custom"
-
-			maxIndex := inputPassword
-			if m.showCustom {
-				maxIndex = inputSMTPPort
+			m.setProviderFields()
+
+			// Move through the fields shown, which depend on the provider
+			// and the sign-in method.
+			fields := m.visibleInputs()
+			pos := 0
+			for i, field := range fields {
+				if field == m.focusIndex {
+					pos = i
+				}
 			}
-
 			if s == "up" || s == "shift+tab" {
-				m.focusIndex--
+				pos--
 			} else {
-				m.focusIndex++
+				pos++
 			}
-
-			if m.focusIndex > maxIndex {
-				m.focusIndex = 0
-			} else if m.focusIndex < 0 {
-				m.focusIndex = maxIndex
-			}
-
-			// Skip custom fields if not showing them
-			if !m.showCustom && m.focusIndex > inputPassword {
-				if s == "up" || s == "shift+tab" {
-					m.focusIndex = inputPassword
-				} else {
-					m.focusIndex = 0
-				}
+			if pos >= len(fields) {
+				pos = 0
+			} else if pos < 0 {
+				pos = len(fields) - 1
 			}
+			m.focusIndex = fields[pos]
 
 			cmds := make([]tea.Cmd, len(m.inputs))
 			for i := 0; i < len(m.inputs); i++ {
@@ -198,10 +200,94 @@ func (m *Login) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 
 	// Check if provider changed
+	m.setProviderFields()
+
+	return m, tea.Batch(cmds...)
+}
+
+// setProviderFields shows the server fields the provider needs.
+func (m *Login) setProviderFields() {
 	provider := m.inputs[inputProvider].Value()
 	m.showCustom = provider == "custom"
+	m.showJMAP = provider == "jmap"
+	m.showPOP3 = provider == "pop3"
+}
 
-	return m, tea.Batch(cmds...)
+// visibleInputs returns the fields shown in the form, in order.
+func (m *Login) visibleInputs() []int {
+	fields := []int{inputProvider, inputName, inputEmail, inputAddresses, inputAuth}
+	if m.usesOAuth2() {
+		fields = append(fields, inputClientID, inputClientSecret)
+	} else {
+		fields = append(fields, inputPassword)
+	}
+	if m.showJMAP {
+		fields = append(fields, inputJMAPURL)
+	}
+	if m.showCustom {
+		fields = append(fields, inputIMAPServer, inputIMAPPort, inputIMAPSecurity, inputSMTPServer, inputSMTPPort, inputSMTPSecurity)
+	}
+	if m.showPOP3 {
+		fields = append(fields, inputPOP3Server, inputPOP3Port, inputPOP3Security, inputPOP3Delete, inputSMTPServer, inputSMTPPort, inputSMTPSecurity)
+	}
+	return fields
+}
+
+func (m *Login) usesOAuth2() bool {
+	return authValue(m.inputs[inputAuth].Value()) == config.AuthOAuth2
+}
+
+// submit returns the command that submits the form. Ports left empty follow
+// the security setting.
+func (m *Login) submit() tea.Cmd {
+	imapPort := 0
+	smtpPort := 0
+	pop3Port := 0
+	if m.inputs[inputIMAPPort].Value() != "" {
+		if p, err := strconv.Atoi(m.inputs[inputIMAPPort].Value()); err == nil {
+			imapPort = p
+		}
+	}
+	if m.inputs[inputPOP3Port].Value() != "" {
+		if p, err := strconv.Atoi(m.inputs[inputPOP3Port].Value()); err == nil {
+			pop3Port = p
+		}
+	}
+	if m.inputs[inputSMTPPort].Value() != "" {
+		if p, err := strconv.Atoi(m.inputs[inputSMTPPort].Value()); err == nil {
+			smtpPort = p
+		}
+	}
+
+	creds := Credentials{
+		Provider:   m.inputs[inputProvider].Value(),
+		Name:       m.inputs[inputName].Value(),
+		Host:       m.inputs[inputEmail].Value(),
+		Addresses:  m.inputs[inputAddresses].Value(),
+		IMAPServer: m.inputs[inputIMAPServer].Value(),
+		IMAPPort:   imapPort,
+		SMTPServer: m.inputs[inputSMTPServer].Value(),
+		SMTPPort:   smtpPort,
+
+		IMAPSecurity: securityValue(m.inputs[inputIMAPSecurity].Value()),
+		SMTPSecurity: securityValue(m.inputs[inputSMTPSecurity].Value()),
+
+		JMAPURL: strings.TrimSpace(m.inputs[inputJMAPURL].Value()),
+
+		POP3Server:   m.inputs[inputPOP3Server].Value(),
+		POP3Port:     pop3Port,
+		POP3Security: securityValue(m.inputs[inputPOP3Security].Value()),
+		POP3Delete:   yesValue(m.inputs[inputPOP3Delete].Value()),
+	}
+	if m.usesOAuth2() {
+		creds.AuthMethod = config.AuthOAuth2
+		creds.ClientID = strings.TrimSpace(m.inputs[inputClientID].Value())
+		creds.ClientSecret = strings.TrimSpace(m.inputs[inputClientSecret].Value())
+	} else {
+		creds.AuthMethod = authValue(m.inputs[inputAuth].Value())
+		creds.Password = m.inputs[inputPassword].Value()
+	}
+	return func() tea.Msg { return creds }
 }
 
 // View renders the login form.
@@ -223,8 +309,35 @@ func (m *Login) View() string {
 		m.inputs[inputProvider].View(),
 		m.inputs[inputName].View(),
 		m.inputs[inputEmail].View(),
-		m.inputs[inputFetchEmail].View(),
-		m.inputs[inputPassword].View(),
+		m.inputs[inputAddresses].View(),
+		m.inputs[inputAuth].View(),
+	}
+	if m.usesOAuth2() {
+		views = append(views, m.inputs[inputClientID].View(), m.inputs[inputClientSecret].View())
+	} else {
+		views = append(views, m.inputs[inputPassword].View())
+	}
+
+	if m.showJMAP {
+		views = append(views,
+			"",
+			listHeader.Render("JMAP Server Settings:"),
+			m.inputs[inputJMAPURL].View(),
+		)
+	}
+
+	if m.showPOP3 {
+		views = append(views,
+			"",
+			listHeader.Render("POP3 Server Settings:"),
+			m.inputs[inputPOP3Server].View(),
+			m.inputs[inputPOP3Port].View(),
+			m.inputs[inputPOP3Security].View(),
+			m.inputs[inputPOP3Delete].View(),
+			m.inputs[inputSMTPServer].View(),
+			m.inputs[inputSMTPPort].View(),
+			m.inputs[inputSMTPSecurity].View(),
+		)
 	}
 
 	if m.showCustom {
@@ -233,8 +346,10 @@ func (m *Login) View() string {
 			listHeader.Render("Custom Server Settings:"),
 			m.inputs[inputIMAPServer].View(),
 			m.inputs[inputIMAPPort].View(),
+			m.inputs[inputIMAPSecurity].View(),
 			m.inputs[inputSMTPServer].View(),
 			m.inputs[inputSMTPPort].View(),
+			m.inputs[inputSMTPSecurity].View(),
 		)
 	}
 
@@ -244,25 +359,62 @@ func (m *Login) View() string {
 }
 
 // SetEditMode sets the login form to edit an existing account.
-func (m *Login) SetEditMode(accountID, provider, name, email, fetchEmail, imapServer string, imapPort int, smtpServer string, smtpPort int) {
+func (m *Login) SetEditMode(accountID, provider, name, email, addresses, imapServer string, imapPort int, imapSecurity, smtpServer string, smtpPort int, smtpSecurity, authMethod, clientID, jmapURL string) {
 	m.isEditMode = true
 	m.accountID = accountID
 	m.inputs[inputProvider].SetValue(provider)
 	m.inputs[inputName].SetValue(name)
 	m.inputs[inputEmail].SetValue(email)
-	m.inputs[inputFetchEmail].SetValue(fetchEmail)
-	m.showCustom = provider == "custom"
+	m.inputs[inputAddresses].SetValue(addresses)
+	m.inputs[inputAuth].SetValue(authMethod)
+	m.inputs[inputClientID].SetValue(clientID)
+	m.inputs[inputJMAPURL].SetValue(jmapURL)
+	m.setProviderFields()
 
 	if m.showCustom {
 		m.inputs[inputIMAPServer].SetValue(imapServer)
 		if imapPort != 0 {
 			m.inputs[inputIMAPPort].SetValue(strconv.Itoa(imapPort))
 		}
+		m.inputs[inputIMAPSecurity].SetValue(imapSecurity)
 		m.inputs[inputSMTPServer].SetValue(smtpServer)
 		if smtpPort != 0 {
 			m.inputs[inputSMTPPort].SetValue(strconv.Itoa(smtpPort))
 		}
+		m.inputs[inputSMTPSecurity].SetValue(smtpSecurity)
+	}
+}
+
+// securityValue normalizes a security setting typed into the form. Anything
+// unknown is left empty, which means the default for the port.
+func securityValue(s string) string {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case config.SecurityTLS, config.SecuritySTARTTLS, config.SecurityNone:
+		return s
+	}
+	return ""
+}
+
+// yesValue reports whether a yes or no question in the form was answered
+// yes.
+func yesValue(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "yes", "y", "true":
+		return true
+	}
+	return false
+}
+
+// authValue normalizes a sign-in method typed into the form. Anything but
+// OAuth2 or an API token means a password.
+func authValue(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case config.AuthOAuth2, "oauth":
+		return config.AuthOAuth2
+	case config.AuthToken:
+		return config.AuthToken
 	}
+	return ""
 }
 
 // GetAccountID returns the account ID being edited (if in edit mode).
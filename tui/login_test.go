@@ -0,0 +1,134 @@
+package tui
+
+import (
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/floatpane/matcha/config"
+)
+
+func TestLoginSecuritySettings(t *testing.T) {
+	m := NewLogin()
+	m.inputs[inputProvider].SetValue("custom")
+	m.inputs[inputEmail].SetValue("me")
+	m.inputs[inputIMAPServer].SetValue("localhost")
+	m.inputs[inputIMAPSecurity].SetValue(" None ")
+	m.inputs[inputSMTPServer].SetValue("smtp.example.com")
+	m.inputs[inputSMTPSecurity].SetValue("plain")
+	m.focusIndex = inputSMTPSecurity
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected the form to be submitted, got %v", msgs)
+	}
+	creds, ok := msgs[0].(Credentials)
+	if !ok {
+		t.Fatalf("expected Credentials, got %T", msgs[0])
+	}
+	if creds.IMAPSecurity != config.SecurityNone {
+		t.Errorf("expected IMAP security %q, got %q", config.SecurityNone, creds.IMAPSecurity)
+	}
+	// Unknown settings fall back to the default rather than to plaintext.
+	if creds.SMTPSecurity != "" {
+		t.Errorf("expected no SMTP security setting, got %q", creds.SMTPSecurity)
+	}
+	if creds.IMAPPort != 0 || creds.SMTPPort != 0 {
+		t.Errorf("expected empty ports to be left to the default, got %d and %d", creds.IMAPPort, creds.SMTPPort)
+	}
+}
+
+func TestLoginOAuth2(t *testing.T) {
+	m := NewLogin()
+	m.inputs[inputProvider].SetValue("gmail")
+	m.inputs[inputEmail].SetValue("me@gmail.com")
+	m.inputs[inputAuth].SetValue("OAuth2")
+
+	// The password is replaced by the client's fields.
+	m.focusIndex = inputAuth
+	m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	if m.focusIndex != inputClientID {
+		t.Fatalf("expected the client ID to follow the sign-in method, got field %d", m.focusIndex)
+	}
+	m.inputs[inputClientID].SetValue(" client-id ")
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.focusIndex != inputClientSecret {
+		t.Fatalf("expected the client secret field, got field %d", m.focusIndex)
+	}
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected the form to be submitted, got %v", msgs)
+	}
+	creds, ok := msgs[0].(Credentials)
+	if !ok {
+		t.Fatalf("expected Credentials, got %T", msgs[0])
+	}
+	if creds.AuthMethod != config.AuthOAuth2 || creds.ClientID != "client-id" || creds.Password != "" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+}
+
+func TestLoginJMAP(t *testing.T) {
+	m := NewLogin()
+	m.inputs[inputProvider].SetValue("jmap")
+	m.inputs[inputEmail].SetValue("me@fastmail.com")
+	m.inputs[inputAuth].SetValue("token")
+
+	// The session URL replaces the IMAP and SMTP servers.
+	m.focusIndex = inputPassword
+	m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	if m.focusIndex != inputJMAPURL {
+		t.Fatalf("expected the JMAP URL to follow the password, got field %d", m.focusIndex)
+	}
+	m.inputs[inputJMAPURL].SetValue(" https://api.fastmail.com/jmap/session ")
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected the form to be submitted, got %v", msgs)
+	}
+	creds, ok := msgs[0].(Credentials)
+	if !ok {
+		t.Fatalf("expected Credentials, got %T", msgs[0])
+	}
+	if creds.JMAPURL != "https://api.fastmail.com/jmap/session" || creds.AuthMethod != config.AuthToken {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+}
+
+func TestLoginPOP3(t *testing.T) {
+	m := NewLogin()
+	m.inputs[inputProvider].SetValue("pop3")
+	m.inputs[inputEmail].SetValue("me@isp.example")
+	m.inputs[inputPOP3Server].SetValue("pop.isp.example")
+	m.inputs[inputPOP3Port].SetValue("110")
+	m.inputs[inputPOP3Security].SetValue("STARTTLS")
+	m.inputs[inputPOP3Delete].SetValue("Yes")
+	m.inputs[inputSMTPServer].SetValue("smtp.isp.example")
+
+	// The SMTP server follows the POP3 settings.
+	m.focusIndex = inputPOP3Delete
+	m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	if m.focusIndex != inputSMTPServer {
+		t.Fatalf("expected the SMTP server to follow the POP3 settings, got field %d", m.focusIndex)
+	}
+
+	m.focusIndex = inputSMTPSecurity
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected the form to be submitted, got %v", msgs)
+	}
+	creds, ok := msgs[0].(Credentials)
+	if !ok {
+		t.Fatalf("expected Credentials, got %T", msgs[0])
+	}
+	if creds.POP3Server != "pop.isp.example" || creds.POP3Port != 110 || creds.POP3Security != config.SecuritySTARTTLS || !creds.POP3Delete {
+		t.Errorf("unexpected POP3 settings %+v", creds)
+	}
+	if creds.SMTPServer != "smtp.isp.example" {
+		t.Errorf("expected the SMTP server, got %q", creds.SMTPServer)
+	}
+}
@@ -3,13 +3,17 @@ package tui
 import (
 	"github.com/floatpane/matcha/config"
 	"github.com/floatpane/matcha/fetcher"
+	"github.com/floatpane/matcha/oauth"
 )
 
 type MailboxKind string
 
 const (
-	MailboxInbox MailboxKind = "inbox"
-	MailboxSent  MailboxKind = "sent"
+	MailboxInbox   MailboxKind = "inbox"
+	MailboxSent    MailboxKind = "sent"
+	MailboxFolder  MailboxKind = "folder"  // Any other folder, opened from the folder picker
+	MailboxFlagged MailboxKind = "flagged" // Flagged emails of all accounts
+	MailboxSearch  MailboxKind = "search"  // Search results of all accounts
 )
 
 type ViewEmailMsg struct {
@@ -34,12 +38,31 @@ type Credentials struct {
 	Provider   string
 	Name       string
 	Host       string // Host (this was the previous \"Email Address\" field in the UI)
-	FetchEmail string // Single email address to fetch messages for. If empty, code should default this to Host when creating the account.
+	Addresses  string // Comma-separated addresses to show mail for, as config.ParseAddresses reads them
 	Password   string
 	IMAPServer string
 	IMAPPort   int
 	SMTPServer string
 	SMTPPort   int
+	// IMAPSecurity and SMTPSecurity are config.SecurityTLS,
+	// config.SecuritySTARTTLS, config.SecurityNone or empty for the default.
+	IMAPSecurity string
+	SMTPSecurity string
+	// AuthMethod is config.AuthOAuth2 to sign in with OAuth2 using
+	// ClientID and ClientSecret instead of Password, config.AuthToken if
+	// Password is a JMAP API token, and empty otherwise.
+	AuthMethod   string
+	ClientID     string
+	ClientSecret string
+	// JMAPURL is the session URL of a "jmap" provider's server.
+	JMAPURL string
+	// POP3Server, POP3Port and POP3Security are the server of a "pop3"
+	// provider, whose mail is sent through SMTPServer. POP3Delete deletes
+	// downloaded mail from the server.
+	POP3Server   string
+	POP3Port     int
+	POP3Security string
+	POP3Delete   bool
 }
 
 type ChooseServiceMsg struct {
@@ -47,7 +70,8 @@ type ChooseServiceMsg struct {
 }
 
 type EmailResultMsg struct {
-	Err error
+	AccountID string
+	Err       error
 }
 
 type ClearStatusMsg struct{}
@@ -72,10 +96,39 @@ type GoToSendMsg struct {
 
 type GoToSettingsMsg struct{}
 
-type FetchMoreEmailsMsg struct {
-	Offset    uint32
+// GoToFlaggedMsg signals a request to show the flagged emails of all accounts.
+type GoToFlaggedMsg struct{}
+
+// GoToSearchMsg signals a request to open the search prompt.
+type GoToSearchMsg struct{}
+
+// SearchMsg signals that a parsed query should be searched for on all accounts.
+type SearchMsg struct {
+	Query fetcher.Query
+	Raw   string
+}
+
+// GoToFoldersMsg signals a request to browse the folders of all accounts.
+type GoToFoldersMsg struct{}
+
+// FoldersFetchedMsg carries the folder tree of each account.
+type FoldersFetchedMsg struct {
+	FoldersByAccount map[string][]fetcher.Folder
+}
+
+// OpenFolderMsg signals that a folder should be opened in the inbox view.
+type OpenFolderMsg struct {
 	AccountID string
-	Mailbox   MailboxKind
+	Folder    string
+}
+
+// FetchMoreEmailsMsg requests the page of emails older than BeforeUID.
+// UIDValidity is the UIDVALIDITY the loaded emails were fetched with.
+type FetchMoreEmailsMsg struct {
+	BeforeUID   uint32
+	UIDValidity uint32
+	AccountID   string
+	Mailbox     MailboxKind
 }
 
 type FetchingMoreEmailsMsg struct{}
@@ -84,6 +137,14 @@ type EmailsAppendedMsg struct {
 	Emails    []fetcher.Email
 	AccountID string
 	Mailbox   MailboxKind
+	OldestUID uint32 // Where the next page starts; 0 when there are no older emails
+}
+
+// UIDValidityChangedMsg signals that a mailbox's UIDs were reset by the
+// server, so the emails loaded from it are stale.
+type UIDValidityChangedMsg struct {
+	AccountID string
+	Mailbox   MailboxKind
 }
 
 type ReplyToEmailMsg struct {
@@ -117,12 +178,85 @@ type EmailActionDoneMsg struct {
 	AccountID string
 	Mailbox   MailboxKind
 	Err       error
+	Undo      *UndoMoveMsg // Set when the action can be undone
+}
+
+// UndoMoveMsg moves an email back to the folder it was deleted or archived
+// from.
+type UndoMoveMsg struct {
+	MessageID string
+	AccountID string
+	Mailbox   MailboxKind
+	From      string // Folder the email was moved to
+	To        string // Folder the email was moved from
+}
+
+// EmailRestoredMsg reports the outcome of an UndoMoveMsg.
+type EmailRestoredMsg struct {
+	AccountID string
+	Mailbox   MailboxKind
+	Err       error
+}
+
+// BulkAction is an action applied to several emails at once.
+type BulkAction string
+
+const (
+	BulkDelete   BulkAction = "delete"
+	BulkArchive  BulkAction = "archive"
+	BulkMove     BulkAction = "move"
+	BulkMarkRead BulkAction = "read"
+)
+
+// BulkActionMsg applies an action to the marked emails.
+type BulkActionMsg struct {
+	Action        BulkAction
+	UIDsByAccount map[string][]uint32
+	Mailbox       MailboxKind
+	Dest          string // Folder to move to, for BulkMove
+}
+
+// Count returns the number of emails the action applies to.
+func (m BulkActionMsg) Count() int {
+	n := 0
+	for _, uids := range m.UIDsByAccount {
+		n += len(uids)
+	}
+	return n
+}
+
+// BulkActionDoneMsg reports the outcome of a BulkActionMsg.
+type BulkActionDoneMsg struct {
+	Action  BulkAction
+	Mailbox MailboxKind
+	Dest    string
+	Done    map[string][]uint32 // UIDs the action succeeded on, by account
+	Failed  int                 // Number of emails the action failed on
+}
+
+// SetFlagMsg signals that a flag (e.g. \Seen) should be set or cleared on an email.
+type SetFlagMsg struct {
+	UID       uint32
+	AccountID string
+	Mailbox   MailboxKind
+	Flag      string
+	Enable    bool
+}
+
+// FlagSetMsg reports the outcome of a SetFlagMsg.
+type FlagSetMsg struct {
+	UID       uint32
+	AccountID string
+	Mailbox   MailboxKind
+	Flag      string
+	Enable    bool
+	Err       error
 }
 
 type GoToChoiceMenuMsg struct{}
 
 type DownloadAttachmentMsg struct {
-	Index     int
+	UID       uint32
 	Filename  string
 	PartID    string
 	Data      []byte
@@ -136,6 +270,17 @@ type AttachmentDownloadedMsg struct {
 	Err  error
 }
 
+// AttachmentProgressMsg tells how much of an attachment being downloaded
+// has arrived, out of Total bytes, or an unknown size if Total is 0.
+type AttachmentProgressMsg struct {
+	Filename string
+	Fetched  int64
+	Total    int64
+}
+
+// CancelDownloadMsg cancels the attachment download in progress.
+type CancelDownloadMsg struct{}
+
 type RestoreViewMsg struct{}
 
 type BackToInboxMsg struct{}
@@ -160,6 +305,41 @@ type EmailBodyFetchedMsg struct {
 	Mailbox     MailboxKind
 }
 
+// ConversationFetchedMsg carries every email of the conversation an opened
+// email belongs to, oldest first.
+type ConversationFetchedMsg struct {
+	UID       uint32
+	AccountID string
+	Emails    []fetcher.Email
+	Err       error
+}
+
+// FetchSourceMsg asks for the full message of an email as it was received,
+// to show its source, or only its header with HeaderOnly.
+type FetchSourceMsg struct {
+	UID        uint32
+	AccountID  string
+	Mailbox    MailboxKind
+	HeaderOnly bool
+}
+
+// SourceFetchedMsg carries the full message of an email, or its header if
+// only that was asked for.
+type SourceFetchedMsg struct {
+	UID        uint32
+	AccountID  string
+	HeaderOnly bool
+	Raw        []byte
+	Err        error
+}
+
+// SaveSourceMsg asks for the full message of an email to be saved as an
+// .eml file.
+type SaveSourceMsg struct {
+	Filename string
+	Raw      []byte
+}
+
 // --- Multi-Account Messages ---
 
 // GoToAddAccountMsg signals navigation to the add account screen.
@@ -206,6 +386,49 @@ type SwitchFromAccountMsg struct {
 // GoToAccountListMsg signals navigation to the account list in settings.
 type GoToAccountListMsg struct{}
 
+// CertificateUntrustedMsg carries a server certificate that failed
+// verification, to ask the user whether to trust it.
+type CertificateUntrustedMsg struct {
+	AccountID string
+	Err       *config.CertificateError
+}
+
+// TrustCertificateMsg is the user's answer to a CertificateUntrustedMsg.
+type TrustCertificateMsg struct {
+	AccountID   string
+	Fingerprint string
+	Trust       bool
+}
+
+// SignInMsg starts signing an OAuth2 account in.
+type SignInMsg struct {
+	AccountID string
+}
+
+// SignInStartedMsg carries a sign-in waiting for the user to approve it.
+type SignInStartedMsg struct {
+	AccountID     string
+	Authorization *oauth.Authorization
+	Err           error
+}
+
+// SignInDoneMsg carries the token of a completed sign-in.
+type SignInDoneMsg struct {
+	AccountID string
+	Token     *oauth.Token
+	Err       error
+}
+
+// CancelSignInMsg cancels the sign-in in progress.
+type CancelSignInMsg struct{}
+
+// TokenRefreshedMsg carries a refresh token that replaced an account's old
+// one and needs to be saved.
+type TokenRefreshedMsg struct {
+	AccountID    string
+	RefreshToken string
+}
+
 // --- Draft Messages (persisted) ---
 
 // SaveDraftMsg signals that the current draft should be saved to disk.
@@ -264,7 +487,30 @@ type EmailsRefreshedMsg struct {
 	Mailbox         MailboxKind
 }
 
+// EmailsSyncedMsg carries the outcome of an incremental inbox refresh.
+// Accounts that could not be synced incrementally were fetched again and are
+// in Reloaded instead of Changes.
+type EmailsSyncedMsg struct {
+	Changes  map[string]fetcher.Changes
+	Reloaded map[string][]fetcher.Email
+	States   map[string]fetcher.SyncState
+}
+
 // RequestRefreshMsg signals a request to refresh emails from the server.
 type RequestRefreshMsg struct {
 	Mailbox MailboxKind
 }
+
+// MailboxUpdateMsg carries changes pushed by the server for a watched mailbox.
+type MailboxUpdateMsg struct {
+	AccountID string
+	Mailbox   MailboxKind
+	Added     []fetcher.Email
+	Removed   []uint32
+}
+
+// CompactInboxMsg switches the inbox between rows with a preview of each
+// email and compact one-line rows.
+type CompactInboxMsg struct {
+	Compact bool
+}
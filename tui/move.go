@@ -0,0 +1,76 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// MovePrompt asks for the folder to move emails to.
+type MovePrompt struct {
+	input  textinput.Model
+	action BulkActionMsg
+}
+
+// NewMovePrompt creates a prompt that completes action with the folder
+// entered.
+func NewMovePrompt(action BulkActionMsg) *MovePrompt {
+	input := textinput.New()
+	input.Cursor.Style = cursorStyle
+	input.Placeholder = "Archive/2024"
+	input.Prompt = "> "
+	input.CharLimit = 256
+	input.Focus()
+	return &MovePrompt{input: input, action: action}
+}
+
+// Init initializes the move prompt.
+func (m *MovePrompt) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+// Update handles messages for the move prompt.
+func (m *MovePrompt) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.input.Width = msg.Width - 10
+		return m, nil
+
+	case tea.KeyMsg:
+		if msg.Type == tea.KeyEnter {
+			dest := strings.TrimSpace(m.input.Value())
+			if dest == "" {
+				return m, nil
+			}
+			action := m.action
+			action.Dest = dest
+			return m, func() tea.Msg { return action }
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+// View renders the move prompt.
+func (m *MovePrompt) View() string {
+	var b strings.Builder
+
+	title := "Move email"
+	if n := m.action.Count(); n != 1 {
+		title = fmt.Sprintf("Move %d emails", n)
+	}
+	b.WriteString(titleStyle.Render(title) + "\n\n")
+	b.WriteString(m.input.View() + "\n\n")
+	b.WriteString(helpStyle.Render("enter: move • esc: back"))
+
+	return docStyle.Render(b.String())
+}
+
+// Mailbox returns the mailbox kind the emails are moved from.
+func (m *MovePrompt) Mailbox() MailboxKind {
+	return m.action.Mailbox
+}
@@ -0,0 +1,76 @@
+package tui
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+var searchErrorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
+
+// Search is a prompt for a server-side search query.
+type Search struct {
+	input textinput.Model
+	err   string
+}
+
+// NewSearch creates a search prompt, optionally pre-filled with a query.
+func NewSearch(query string) *Search {
+	input := textinput.New()
+	input.Cursor.Style = cursorStyle
+	input.Placeholder = `from:alice subject:"weekly report" since:2024-01-31 is:unread`
+	input.Prompt = "> "
+	input.CharLimit = 256
+	input.SetValue(query)
+	input.Focus()
+	return &Search{input: input}
+}
+
+// Init initializes the search prompt.
+func (m *Search) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+// Update handles messages for the search prompt.
+func (m *Search) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.input.Width = msg.Width - 10
+		return m, nil
+
+	case tea.KeyMsg:
+		if msg.Type == tea.KeyEnter {
+			raw := strings.TrimSpace(m.input.Value())
+			query, err := fetcher.ParseQuery(raw)
+			if err != nil {
+				m.err = err.Error()
+				return m, nil
+			}
+			m.err = ""
+			return m, func() tea.Msg { return SearchMsg{Query: query, Raw: raw} }
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+// View renders the search prompt.
+func (m *Search) View() string {
+	var b strings.Builder
+
+	b.WriteString(titleStyle.Render("Search") + "\n\n")
+	b.WriteString(m.input.View() + "\n\n")
+	if m.err != "" {
+		b.WriteString(searchErrorStyle.Render(m.err) + "\n\n")
+	}
+	b.WriteString(helpStyle.Render("from: to: subject: body: since:YYYY-MM-DD before:YYYY-MM-DD has:attachment is:unread"))
+	b.WriteString("\n")
+	b.WriteString(helpStyle.Render("enter: search • esc: back"))
+
+	return docStyle.Render(b.String())
+}
@@ -0,0 +1,55 @@
+package tui
+
+import (
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/floatpane/matcha/config"
+	"github.com/floatpane/matcha/fetcher"
+)
+
+func TestSearchEmitsParsedQuery(t *testing.T) {
+	m := NewSearch(`from:alice is:unread`)
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	search, ok := msgs[0].(SearchMsg)
+	if !ok {
+		t.Fatalf("expected SearchMsg, got %T", msgs[0])
+	}
+	if search.Raw != "from:alice is:unread" || len(search.Query.From) != 1 || !search.Query.Unread {
+		t.Errorf("unexpected search message %#v", search)
+	}
+}
+
+func TestSearchShowsParseErrors(t *testing.T) {
+	m := NewSearch("since:yesterday")
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if msgs := collectMsgs(cmd); len(msgs) != 0 {
+		t.Fatalf("expected no search for an invalid query, got %v", msgs)
+	}
+	if !strings.Contains(m.View(), "since:") {
+		t.Errorf("expected the parse error in the view, got %q", m.View())
+	}
+}
+
+func TestSearchInboxTitleAndNoPaging(t *testing.T) {
+	accounts := []config.Account{{ID: "account-1", Email: "test@example.com"}}
+	emails := []fetcher.Email{
+		{UID: 3, From: "alice@example.com", Subject: "Hello", AccountID: "account-1"},
+	}
+
+	inbox := NewSearchInbox(emails, accounts, "from:alice")
+
+	if !strings.Contains(inbox.list.Title, "Search: from:alice (1)") {
+		t.Fatalf("expected search title with query and count, got %q", inbox.list.Title)
+	}
+	if inbox.shouldFetchMore() {
+		t.Error("expected search results not to page in more emails")
+	}
+}
@@ -21,6 +21,7 @@ type Settings struct {
 	accounts         []config.Account
 	cursor           int
 	confirmingDelete bool
+	compactInbox     bool
 	width            int
 	height           int
 }
@@ -79,6 +80,16 @@ func (m *Settings) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.cursor < len(m.accounts) && len(m.accounts) > 0 {
 				m.confirmingDelete = true
 			}
+		case "s":
+			// Sign an OAuth2 account in again, e.g. after its access was revoked
+			if m.cursor < len(m.accounts) && m.accounts[m.cursor].UsesOAuth2() {
+				accountID := m.accounts[m.cursor].ID
+				return m, func() tea.Msg { return SignInMsg{AccountID: accountID} }
+			}
+		case "c":
+			m.compactInbox = !m.compactInbox
+			compact := m.compactInbox
+			return m, func() tea.Msg { return CompactInboxMsg{Compact: compact} }
 		case "enter":
 			// If cursor is on "Add Account"
 			if m.cursor == len(m.accounts) {
@@ -114,6 +125,9 @@ func (m *Settings) View() string {
 		if account.ServiceProvider == "custom" {
 			providerInfo = fmt.Sprintf("custom: %s", account.IMAPServer)
 		}
+		if account.UsesOAuth2() {
+			providerInfo += ", OAuth2"
+		}
 
 		line := fmt.Sprintf("%s - %s", displayName, accountEmailStyle.Render(providerInfo))
 
@@ -134,7 +148,13 @@ func (m *Settings) View() string {
 	}
 	b.WriteString("\n\n")
 
-	b.WriteString(helpStyle.Render("↑/↓: navigate • enter: select • d: delete account • esc: back"))
+	rows := "with previews"
+	if m.compactInbox {
+		rows = "compact"
+	}
+	b.WriteString(accountItemStyle.Render("Inbox rows: "+accountEmailStyle.Render(rows)) + "\n\n")
+
+	b.WriteString(helpStyle.Render("↑/↓: navigate • enter: select • d: delete account • s: sign in again (OAuth2) • c: compact inbox rows • esc: back"))
 
 	if m.confirmingDelete {
 		accountName := m.accounts[m.cursor].Email
@@ -151,6 +171,11 @@ func (m *Settings) View() string {
 	return docStyle.Render(b.String())
 }
 
+// SetCompactInbox sets whether the inbox is shown with compact rows.
+func (m *Settings) SetCompactInbox(compact bool) {
+	m.compactInbox = compact
+}
+
 // UpdateAccounts updates the list of accounts.
 func (m *Settings) UpdateAccounts(accounts []config.Account) {
 	m.accounts = accounts
@@ -0,0 +1,68 @@
+package tui
+
+import (
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var userCodeStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("42")).Bold(true)
+
+// SignInPrompt shows where to approve an OAuth2 sign-in while it is waited
+// for.
+type SignInPrompt struct {
+	msg     SignInStartedMsg
+	account string
+	width   int
+}
+
+// NewSignInPrompt creates a prompt for the sign-in in msg of the named
+// account.
+func NewSignInPrompt(msg SignInStartedMsg, account string) *SignInPrompt {
+	return &SignInPrompt{msg: msg, account: account}
+}
+
+// Init initializes the sign-in prompt.
+func (m *SignInPrompt) Init() tea.Cmd {
+	return nil
+}
+
+// Update handles messages for the sign-in prompt.
+func (m *SignInPrompt) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case tea.KeyMsg:
+		if msg.String() == "esc" {
+			return m, func() tea.Msg { return CancelSignInMsg{} }
+		}
+	}
+	return m, nil
+}
+
+// View renders the sign-in prompt.
+func (m *SignInPrompt) View() string {
+	a := m.msg.Authorization
+	var b strings.Builder
+
+	b.WriteString(titleStyle.Render("Sign in to "+m.account) + "\n\n")
+	if a.UserCode != "" {
+		b.WriteString("Open this page on any device:\n\n")
+		b.WriteString(a.URL + "\n\n")
+		b.WriteString("and enter the code " + userCodeStyle.Render(a.UserCode) + "\n\n")
+	} else {
+		b.WriteString("Approve access in the browser that was opened. If none was, open:\n\n")
+		// Long URLs must stay unbroken to be copied, so they aren't wrapped.
+		b.WriteString(a.URL + "\n\n")
+	}
+	b.WriteString(accountEmailStyle.Render("Waiting for approval...") + "\n\n")
+	b.WriteString(helpStyle.Render("esc: cancel"))
+
+	return docStyle.Render(b.String())
+}
+
+// AccountID returns the ID of the account being signed in.
+func (m *SignInPrompt) AccountID() string {
+	return m.msg.AccountID
+}
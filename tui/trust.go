@@ -0,0 +1,89 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	trustWarningStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("214")).Bold(true)
+	trustLabelStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).Width(10)
+)
+
+// TrustPrompt asks whether to trust a server certificate that failed
+// verification.
+type TrustPrompt struct {
+	msg     CertificateUntrustedMsg
+	account string
+}
+
+// NewTrustPrompt creates a prompt for the certificate in msg, presented by
+// a server of the named account.
+func NewTrustPrompt(msg CertificateUntrustedMsg, account string) *TrustPrompt {
+	return &TrustPrompt{msg: msg, account: account}
+}
+
+// Init initializes the trust prompt.
+func (m *TrustPrompt) Init() tea.Cmd {
+	return nil
+}
+
+// Update handles messages for the trust prompt.
+func (m *TrustPrompt) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch msg.String() {
+		case "y":
+			return m, m.answer(true)
+		case "n", "esc":
+			return m, m.answer(false)
+		}
+	}
+	return m, nil
+}
+
+func (m *TrustPrompt) answer(trust bool) tea.Cmd {
+	answer := TrustCertificateMsg{
+		AccountID:   m.msg.AccountID,
+		Fingerprint: m.msg.Err.Fingerprint(),
+		Trust:       trust,
+	}
+	return func() tea.Msg { return answer }
+}
+
+// View renders the trust prompt.
+func (m *TrustPrompt) View() string {
+	cert := m.msg.Err.Cert
+	var b strings.Builder
+
+	b.WriteString(titleStyle.Render("Untrusted certificate") + "\n\n")
+	explanation := m.msg.Err.Error()
+	b.WriteString(trustWarningStyle.Render(strings.ToUpper(explanation[:1])+explanation[1:]) + "\n\n")
+
+	names := strings.Join(cert.DNSNames, ", ")
+	for _, ip := range cert.IPAddresses {
+		if names != "" {
+			names += ", "
+		}
+		names += ip.String()
+	}
+	rows := [][2]string{
+		{"Account", m.account},
+		{"Subject", cert.Subject.String()},
+		{"Issuer", cert.Issuer.String()},
+		{"Names", names},
+		{"Valid", fmt.Sprintf("%s to %s", cert.NotBefore.Format("Jan 2 2006"), cert.NotAfter.Format("Jan 2 2006"))},
+		{"SHA-256", m.msg.Err.Fingerprint()},
+	}
+	for _, row := range rows {
+		b.WriteString(trustLabelStyle.Render(row[0]) + row[1] + "\n")
+	}
+
+	b.WriteString("\nOnly trust it if you expect this certificate, e.g. from your own server or a local mail bridge.\n")
+	b.WriteString("Compare the fingerprint with the one the server shows.\n\n")
+	b.WriteString(helpStyle.Render("y: trust and remember • n/esc: don't trust"))
+
+	return docStyle.Render(b.String())
+}
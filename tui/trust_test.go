@@ -0,0 +1,44 @@
+package tui
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/floatpane/matcha/config"
+)
+
+func TestTrustPrompt(t *testing.T) {
+	cert := &x509.Certificate{
+		Raw:      []byte("certificate"),
+		Subject:  pkix.Name{CommonName: "Mail Bridge"},
+		Issuer:   pkix.Name{CommonName: "Mail Bridge"},
+		DNSNames: []string{"localhost"},
+	}
+	certErr := &config.CertificateError{Host: "127.0.0.1", Cert: cert, Err: x509.UnknownAuthorityError{Cert: cert}}
+	m := NewTrustPrompt(CertificateUntrustedMsg{AccountID: "account-1", Err: certErr}, "me@example.com")
+
+	view := m.View()
+	for _, want := range []string{"self-signed", "me@example.com", "CN=Mail Bridge", config.CertFingerprint(cert)} {
+		if !strings.Contains(view, want) {
+			t.Errorf("expected %q in the view, got %q", want, view)
+		}
+	}
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'y'}})
+	msgs := collectMsgs(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %v", msgs)
+	}
+	answer, ok := msgs[0].(TrustCertificateMsg)
+	if !ok || !answer.Trust || answer.AccountID != "account-1" || answer.Fingerprint != config.CertFingerprint(cert) {
+		t.Errorf("expected the certificate to be trusted, got %#v", msgs[0])
+	}
+
+	_, cmd = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if msgs := collectMsgs(cmd); len(msgs) != 1 || msgs[0].(TrustCertificateMsg).Trust {
+		t.Errorf("expected esc not to trust the certificate, got %v", msgs)
+	}
+}
@@ -160,6 +160,20 @@ func decodeQuotedPrintable(s string) (string, error) {
 	return string(body), nil
 }
 
+// PlainText returns the text of an HTML document without its markup, or
+// of as much of one as was given. Styles, scripts and the head are dropped.
+func PlainText(htmlBody string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlBody))
+	if err != nil {
+		return htmlBody
+	}
+	doc.Find("head, style, script, title").Remove()
+	doc.Find("br, p, div, li, tr, h1, h2, h3").Each(func(i int, s *goquery.Selection) {
+		s.AfterHtml(" ")
+	})
+	return doc.Text()
+}
+
 // markdownToHTML converts a Markdown string to an HTML string.
 func markdownToHTML(md []byte) []byte {
 	var buf bytes.Buffer